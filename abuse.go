@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lncm/invoicer/common"
+	"github.com/lncm/invoicer/ratelimit"
+)
+
+const (
+	// How long an issued proof-of-work challenge stays valid
+	powChallengeTTL = 5 * time.Minute
+
+	captchaTimeout = 10 * time.Second
+)
+
+var (
+	ipLimiter  *ratelimit.Limiter
+	keyLimiter *ratelimit.Limiter
+
+	// Number of currently open status long-polls
+	statusWaiters int64
+
+	// Used to sign proof-of-work challenges, so that they don't need to be stored until they're used
+	powSecret = make([]byte, 32)
+
+	// Challenges that were already used, kept until they expire to prevent replays
+	usedPowMu sync.Mutex
+	usedPow   = make(map[string]time.Time)
+
+	captchaClient = &http.Client{Timeout: captchaTimeout}
+)
+
+func init() {
+	_, err := rand.Read(powSecret)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func startLimiters() {
+	ipLimiter = ratelimit.New(conf.RateLimit.PerIP, conf.RateLimit.PerIPBurst)
+	keyLimiter = ratelimit.New(conf.RateLimit.PerKey, conf.RateLimit.PerKeyBurst)
+
+	go func() {
+		for range time.Tick(powChallengeTTL) {
+			usedPowMu.Lock()
+			for challenge, expiry := range usedPow {
+				if time.Now().After(expiry) {
+					delete(usedPow, challenge)
+				}
+			}
+			usedPowMu.Unlock()
+		}
+	}()
+}
+
+func tooManyRequests(c *gin.Context, wait time.Duration, msg string) {
+	c.Header("Retry-After", fmt.Sprint(int64(math.Ceil(wait.Seconds()))))
+	replyStatus(c, common.StatusReply{
+		Code:  429,
+		Error: msg,
+	})
+}
+
+// requestKey returns API key authenticated by `authorize()`, if any
+func requestKey(c *gin.Context) (common.APIKey, bool) {
+	k, ok := c.Get(apiKeyCtxKey)
+	if !ok {
+		return common.APIKey{}, false
+	}
+
+	apiKey, ok := k.(common.APIKey)
+	return apiKey, ok
+}
+
+// limitPayments rate-limits payment creation per API key, or - for requests without one - per client IP.
+// Requests without an API key also have to pass proof-of-work, and captcha checks, if enabled.
+func limitPayments(c *gin.Context) {
+	if apiKey, ok := requestKey(c); ok {
+		if allowed, wait := keyLimiter.Allow(apiKey.ID); !allowed {
+			tooManyRequests(c, wait, fmt.Sprintf("rate limit of API key %s exceeded", apiKey.ID))
+		}
+
+		return
+	}
+
+	if allowed, wait := ipLimiter.Allow(c.ClientIP()); !allowed {
+		tooManyRequests(c, wait, "rate limit exceeded")
+		return
+	}
+
+	rateLimit := currentConf().RateLimit
+
+	if rateLimit.PowDifficulty > 0 {
+		err := checkPow(c.GetHeader("X-Pow-Challenge"), c.GetHeader("X-Pow-Nonce"))
+		if err != nil {
+			replyStatus(c, common.StatusReply{
+				Code:  403,
+				Error: fmt.Errorf("proof-of-work required: %w", err).Error(),
+			})
+			return
+		}
+	}
+
+	if rateLimit.Captcha.VerifyURL != "" {
+		err := checkCaptcha(c, rateLimit.Captcha, c.GetHeader("X-Captcha-Token"))
+		if err != nil {
+			replyStatus(c, common.StatusReply{
+				Code:  403,
+				Error: fmt.Errorf("captcha required: %w", err).Error(),
+			})
+			return
+		}
+	}
+}
+
+// acquireStatusWaiter returns false if the limit of concurrently open status long-polls was reached.
+// Otherwise, `releaseStatusWaiter()` has to be called once the long-poll finishes.
+func acquireStatusWaiter() bool {
+	limit := currentConf().RateLimit.MaxStatusWaiters
+
+	if n := atomic.AddInt64(&statusWaiters, 1); limit > 0 && n > limit {
+		atomic.AddInt64(&statusWaiters, -1)
+		return false
+	}
+
+	return true
+}
+
+func releaseStatusWaiter() {
+	atomic.AddInt64(&statusWaiters, -1)
+}
+
+func signPow(payload string) string {
+	mac := hmac.New(sha256.New, powSecret)
+	_, _ = mac.Write([]byte(payload))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newPowChallenge returns a signed challenge in a form of `<unix-timestamp>.<random>.<signature>`
+func newPowChallenge() (string, error) {
+	random := make([]byte, 8)
+
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+
+	payload := fmt.Sprintf("%d.%s", time.Now().Unix(), hex.EncodeToString(random))
+
+	return payload + "." + signPow(payload), nil
+}
+
+// leadingZeroBits counts zero bits at the beginning of `b`
+func leadingZeroBits(b []byte) (n int) {
+	for _, x := range b {
+		if x != 0 {
+			return n + bits.LeadingZeros8(x)
+		}
+
+		n += 8
+	}
+
+	return
+}
+
+// checkPow verifies that sha256(challenge + nonce) starts with at least `pow-difficulty` zero bits, and that
+// the challenge was issued by this invoicer, has not expired, and was not used before
+func checkPow(challenge, nonce string) error {
+	if challenge == "" || nonce == "" {
+		return errors.New("get a challenge from /api/pow, and pass it with a nonce in X-Pow-Challenge, and X-Pow-Nonce headers")
+	}
+
+	i := strings.LastIndex(challenge, ".")
+	if i < 0 || !hmac.Equal([]byte(challenge[i+1:]), []byte(signPow(challenge[:i]))) {
+		return errors.New("invalid challenge")
+	}
+
+	issuedAt, err := strconv.ParseInt(strings.Split(challenge, ".")[0], 10, 64)
+	if err != nil {
+		return errors.New("invalid challenge")
+	}
+
+	expiry := time.Unix(issuedAt, 0).Add(powChallengeTTL)
+	if time.Now().After(expiry) {
+		return errors.New("challenge expired")
+	}
+
+	sum := sha256.Sum256([]byte(challenge + nonce))
+	if int64(leadingZeroBits(sum[:])) < currentConf().RateLimit.PowDifficulty {
+		return errors.New("insufficient work")
+	}
+
+	usedPowMu.Lock()
+	defer usedPowMu.Unlock()
+
+	if _, ok := usedPow[challenge]; ok {
+		return errors.New("challenge already used")
+	}
+
+	usedPow[challenge] = expiry
+
+	return nil
+}
+
+// checkCaptcha verifies token with a `siteverify`-compatible captcha service
+func checkCaptcha(c *gin.Context, captcha common.Captcha, token string) error {
+	if token == "" {
+		return errors.New("pass solved captcha token in X-Captcha-Token header")
+	}
+
+	ctx, cancel := context.WithTimeout(c, captchaTimeout)
+	defer cancel()
+
+	form := url.Values{
+		"secret":   {captcha.Secret},
+		"response": {token},
+		"remoteip": {c.ClientIP()},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", captcha.VerifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := captchaClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to verify: %w", err)
+	}
+
+	defer func() { _ = res.Body.Close() }()
+
+	var result struct {
+		Success bool `json:"success"`
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&result)
+	if err != nil {
+		return fmt.Errorf("unable to verify: %w", err)
+	}
+
+	if !result.Success {
+		return errors.New("invalid token")
+	}
+
+	return nil
+}
+
+type powReply struct {
+	Challenge  string `json:"challenge"`
+	Difficulty int64  `json:"difficulty" doc:"Required number of leading zero bits of sha256(challenge + nonce)"`
+	Expiry     int64  `json:"expiry" doc:"Seconds until the challenge expires"`
+}
+
+func powChallenge(c *gin.Context) {
+	difficulty := currentConf().RateLimit.PowDifficulty
+	if difficulty == 0 {
+		replyStatus(c, common.StatusReply{
+			Code:  404,
+			Error: "proof-of-work is not enabled",
+		})
+		return
+	}
+
+	challenge, err := newPowChallenge()
+	if err != nil {
+		replyStatus(c, common.StatusReply{
+			Code:  500,
+			Error: err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, powReply{
+		Challenge:  challenge,
+		Difficulty: difficulty,
+		Expiry:     int64(powChallengeTTL.Seconds()),
+	})
+}
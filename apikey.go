@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lncm/invoicer/common"
+)
+
+const apiKeyUsage = `usage:
+	invoicer apikey add -scopes <scope>[,<scope>…] [-label <label>] [-expires <duration>]
+	invoicer apikey list
+	invoicer apikey revoke <id>
+
+scopes: ` + "create-payment, read-status, read-history, admin"
+
+// apiKeyCommand manages API keys kept in the data file.  Running invoicer picks up all changes immediately.
+func apiKeyCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(apiKeyUsage)
+	}
+
+	switch args[0] {
+	case "add":
+		fs := flag.NewFlagSet("apikey add", flag.ExitOnError)
+		label := fs.String("label", "", "Human-readable description of the key, ex. name of the shop using it")
+		scopes := fs.String("scopes", "", "Comma-separated list of scopes granted to the key")
+		expires := fs.Duration("expires", 0, "Duration after which the key expires, ex. 720h.  Never if not set")
+		_ = fs.Parse(args[1:])
+
+		key, apiKey, err := common.NewAPIKey(*label, splitList(*scopes), *expires)
+		if err != nil {
+			return err
+		}
+
+		err = db.AddAPIKey(apiKey)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("API key %s created.  Save it now, as it can't be retrieved later:\n\n\t%s\n\n", apiKey.ID, key)
+		fmt.Println("Pass it to invoicer as either `Authorization: Bearer <key>`, or `X-Api-Key: <key>` header.")
+
+	case "list":
+		keys, err := db.APIKeys()
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "ID\tLABEL\tSCOPES\tCREATED\tEXPIRES\tSTATUS")
+
+		for _, k := range keys {
+			status := "active"
+			switch {
+			case k.RevokedAt > 0:
+				status = "revoked"
+
+			case !k.Active():
+				status = "expired"
+			}
+
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				k.ID, k.Label, strings.Join(k.Scopes, ","), formatTime(k.CreatedAt), formatTime(k.ExpiresAt), status)
+		}
+
+		return w.Flush()
+
+	case "revoke":
+		if len(args) != 2 {
+			return errors.New(apiKeyUsage)
+		}
+
+		err := db.RevokeAPIKey(args[1])
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("API key %s revoked\n", args[1])
+
+	default:
+		return errors.New(apiKeyUsage)
+	}
+
+	return nil
+}
+
+// splitList splits comma-separated list, and drops empty elements
+func splitList(list string) (items []string) {
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return
+}
+
+func formatTime(ts int64) string {
+	if ts == 0 {
+		return "never"
+	}
+
+	return time.Unix(ts, 0).Format(time.RFC3339)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lncm/invoicer/common"
+)
+
+// Key under which a valid API key is stored in request's context
+const apiKeyCtxKey = "api-key"
+
+// isScopeRequired returns true if endpoints guarded by `scope` can't be accessed without an API key
+func isScopeRequired(scope string) bool {
+	if scope == common.ScopeReadHistory || scope == common.ScopeAdmin {
+		return true
+	}
+
+	for _, s := range currentConf().Auth.Require {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requestAPIKey extracts API key passed either as `Authorization: Bearer <key>`, or `X-Api-Key: <key>`
+func requestAPIKey(r *http.Request) string {
+	const bearer = "Bearer "
+
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, bearer) {
+		return strings.TrimSpace(strings.TrimPrefix(auth, bearer))
+	}
+
+	return strings.TrimSpace(r.Header.Get("X-Api-Key"))
+}
+
+// basicAuthorized checks request against deprecated `[users]` credentials
+func basicAuthorized(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	expected, ok := currentConf().Users[user]
+	if !ok {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(pass), []byte(expected)) == 1
+}
+
+// hasClientCert returns true if request was made with a client certificate signed by configured `client-ca`
+func hasClientCert(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+// authorize guards endpoints with `scope`.  If scope is not required, requests without an API key are let through,
+// but the ones with an invalid key are always rejected.  Valid keys are stored in context under `apiKeyCtxKey`.
+// Admin routes can also be accessed with a valid client certificate.
+func authorize(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if scope == common.ScopeAdmin && hasClientCert(c.Request) {
+			return
+		}
+
+		key := requestAPIKey(c.Request)
+		if key == "" {
+			if !isScopeRequired(scope) {
+				return
+			}
+
+			if scope == common.ScopeReadHistory && basicAuthorized(c.Request) {
+				return
+			}
+
+			c.Header("WWW-Authenticate", `Bearer realm="invoicer"`)
+			replyStatus(c, common.StatusReply{
+				Code:  401,
+				Error: fmt.Sprintf("API key with `%s` scope is required", scope),
+			})
+			return
+		}
+
+		apiKey, err := db.Authenticate(key)
+		if err != nil {
+			code := 500
+			if errors.Is(err, common.ErrInvalidAPIKey) {
+				code = 401
+				err = errors.New("invalid, expired, or revoked API key")
+			}
+
+			replyStatus(c, common.StatusReply{
+				Code:  code,
+				Error: err.Error(),
+			})
+			return
+		}
+
+		if !apiKey.Allows(scope) {
+			replyStatus(c, common.StatusReply{
+				Code:  403,
+				Error: fmt.Sprintf("API key %s lacks `%s` scope", apiKey.ID, scope),
+			})
+			return
+		}
+
+		c.Set(apiKeyCtxKey, apiKey)
+	}
+}
@@ -2,30 +2,62 @@ package bitcoind
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 
 	"github.com/lncm/invoicer/common"
+	"github.com/lncm/invoicer/metrics"
 )
 
 const (
 	DefaultHostname = "localhost"
 	DefaultPort     = 8332
 	DefaultUsername = "invoicer"
+	DefaultTimeout  = 30 // seconds
 
 	MethodGetBlockCount        = "getblockcount"
+	MethodGetBlockchainInfo    = "getblockchaininfo"
 	MethodGetNewAddress        = "getnewaddress"
 	MethodImportAddress        = "importaddress"
 	MethodListReceiveByAddress = "listreceivedbyaddress"
 
 	Bech32 = "bech32"
+
+	// How often connection to bitcoind is re-checked when it's not (yet) available
+	reconnectInterval = 10 * time.Second
 )
 
 type (
 	Bitcoind struct {
 		url, user, pass string
+
+		// If set, credentials are read from bitcoind's `.cookie` file instead of user, and pass
+		cookie *cookie
+
+		client *http.Client
+
+		mu     sync.RWMutex
+		ready  bool
+		health common.BitcoindHealth
+	}
+
+	BlockchainInfo struct {
+		Chain                string  `json:"chain"`
+		Blocks               int64   `json:"blocks"`
+		Headers              int64   `json:"headers"`
+		VerificationProgress float64 `json:"verificationprogress"`
+		InitialBlockDownload bool    `json:"initialblockdownload"`
 	}
 
 	requestBody struct {
@@ -44,15 +76,109 @@ type (
 	}
 )
 
-func (b Bitcoind) BlockCount() (count int64, err error) {
-	res, _ := b.sendRequest(MethodGetBlockCount)
+// Ready returns true if bitcoind responded to the last connection check
+func (b *Bitcoind) Ready() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.ready
+}
+
+// Health returns the outcome of the most recent connection check
+func (b *Bitcoind) Health() common.BitcoindHealth {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.health
+}
+
+// setUnreachable marks bitcoind as not ready until the next successful connection check
+func (b *Bitcoind) setUnreachable(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.ready {
+		log.WithError(err).Warningln("bitcoind connection lost")
+	}
+
+	b.ready = false
+	b.health.Reachable = false
+	b.health.Error = err.Error()
+}
+
+// check fetches current chain state, and records the outcome
+func (b *Bitcoind) check() error {
+	info, err := b.BlockchainInfo()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.ready = err == nil
+	b.health.Reachable = err == nil
+	b.health.LastCheck = time.Now().Unix()
+	b.health.Error = ""
+
+	if err != nil {
+		b.health.Error = err.Error()
+		return err
+	}
+
+	b.health.LastSuccess = b.health.LastCheck
+	b.health.Blocks = info.Blocks
+	b.health.Headers = info.Headers
+	b.health.VerificationProgress = info.VerificationProgress
+	b.health.Synced = !info.InitialBlockDownload && info.Blocks >= info.Headers
+
+	return nil
+}
+
+func (b *Bitcoind) checkConnectionStatus() {
+	failures := 0
+	if !b.Ready() {
+		failures = 1
+	}
+
+	for {
+		// requests that find bitcoind unreachable get it re-checked sooner
+		time.Sleep(reconnectInterval)
+		for slept := reconnectInterval; failures == 0 && slept < time.Minute && b.Ready(); slept += reconnectInterval {
+			time.Sleep(reconnectInterval)
+		}
+
+		err := b.check()
+		if err != nil {
+			failures++
+			log.WithError(err).WithField("count", failures).Printf("bitcoind unreachable")
+		} else if failures > 0 {
+			log.WithField("count", failures).Printf("bitcoind connection reestablished")
+			failures = 0
+		}
+	}
+}
+
+func (b *Bitcoind) BlockchainInfo() (info BlockchainInfo, err error) {
+	res, err := b.sendRequest(MethodGetBlockchainInfo)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(res, &info)
+
+	return
+}
+
+func (b *Bitcoind) BlockCount() (count int64, err error) {
+	res, err := b.sendRequest(MethodGetBlockCount)
+	if err != nil {
+		return
+	}
 
 	err = json.Unmarshal(res, &count)
 
 	return
 }
 
-func (b Bitcoind) Address(bech32 bool) (addr string, err error) {
+func (b *Bitcoind) Address(bech32 bool) (addr string, err error) {
 	var params []interface{}
 	if bech32 {
 		params = []interface{}{"", Bech32}
@@ -68,14 +194,14 @@ func (b Bitcoind) Address(bech32 bool) (addr string, err error) {
 	return
 }
 
-func (b Bitcoind) ImportAddress(address, label string) (err error) {
+func (b *Bitcoind) ImportAddress(address, label string) (err error) {
 	_, err = b.sendRequest(MethodImportAddress, address, label, false)
 
 	return
 }
 
 // NOTE: returns all if empty string passed
-func (b Bitcoind) CheckAddress(address string) (state common.AddrsStatus, err error) {
+func (b *Bitcoind) CheckAddress(address string) (state common.AddrsStatus, err error) {
 	params := []interface{}{0, true, true}
 	if address != "" {
 		params = append(params, address)
@@ -90,7 +216,30 @@ func (b Bitcoind) CheckAddress(address string) (state common.AddrsStatus, err er
 	return
 }
 
-func (b Bitcoind) sendRequest(method string, params ...interface{}) (response []byte, err error) {
+// ErrUnauthorized is returned when bitcoind rejects provided credentials
+var ErrUnauthorized = errors.New("bitcoind rejected credentials")
+
+func (b *Bitcoind) sendRequest(method string, params ...interface{}) (response []byte, err error) {
+	defer func(start time.Time) {
+		metrics.ObserveRPC(metrics.BackendBitcoind, method, start, err)
+	}(time.Now())
+
+	response, err = b.doRequest(method, params...)
+
+	// bitcoind generates a new cookie on every restart.  Make sure the most recent one is used, and retry once.
+	if errors.Is(err, ErrUnauthorized) && b.cookie != nil {
+		b.cookie.invalidate()
+		response, err = b.doRequest(method, params...)
+	}
+
+	if errors.Is(err, common.ErrBackendUnavailable) {
+		b.setUnreachable(err)
+	}
+
+	return
+}
+
+func (b *Bitcoind) doRequest(method string, params ...interface{}) (response []byte, err error) {
 	reqBody, err := json.Marshal(requestBody{
 		JSONRPC: "1.0",
 		Method:  method,
@@ -105,17 +254,28 @@ func (b Bitcoind) sendRequest(method string, params ...interface{}) (response []
 		return
 	}
 
-	req.SetBasicAuth(b.user, b.pass)
+	user, pass := b.user, b.pass
+	if b.cookie != nil {
+		user, pass, err = b.cookie.credentials()
+		if err != nil && user == "" {
+			return nil, err
+		}
+	}
+
+	req.SetBasicAuth(user, pass)
 	req.Header.Set("Content-Type", "application/json")
-	req.Close = true
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := b.client.Do(req)
 	if err != nil {
-		return
+		return nil, fmt.Errorf("bitcoind: %w: %v", common.ErrBackendUnavailable, err)
 	}
 
 	defer func() { _ = res.Body.Close() }()
 
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		return nil, ErrUnauthorized
+	}
+
 	resBytes, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return
@@ -124,7 +284,7 @@ func (b Bitcoind) sendRequest(method string, params ...interface{}) (response []
 	var resBody responseBody
 	err = json.Unmarshal(resBytes, &resBody)
 	if err != nil {
-		return
+		return nil, fmt.Errorf("unexpected response from bitcoind (HTTP %d): %w", res.StatusCode, err)
 	}
 
 	if resBody.Error != nil {
@@ -134,7 +294,51 @@ func (b Bitcoind) sendRequest(method string, params ...interface{}) (response []
 	return resBody.Result, nil
 }
 
-func New(conf common.Bitcoind) (Bitcoind, error) {
+// newHTTPClient returns a client with timeouts, and (if configured) custom CA, and proxy set
+func newHTTPClient(conf common.Bitcoind) (*http.Client, error) {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+
+	if conf.Proxy != "" {
+		proxyURL, err := url.Parse(conf.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bitcoind proxy: %w", err)
+		}
+
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if conf.TLSCert != "" {
+		certBytes, err := ioutil.ReadFile(common.CleanAndExpandPath(conf.TLSCert))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read bitcoind TLS certificate: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(certBytes) {
+			return nil, errors.New("no valid certificates found in bitcoind TLS certificate file")
+		}
+
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(conf.Timeout) * time.Second,
+	}, nil
+}
+
+// New never fails on bitcoind being unavailable.  Instead, the returned client reports itself as not ready,
+// and keeps checking the connection in the background.  Only invalid configuration returns an error.
+func New(conf common.Bitcoind) (*Bitcoind, error) {
 	if conf.Host == "" {
 		conf.Host = DefaultHostname
 	}
@@ -147,16 +351,44 @@ func New(conf common.Bitcoind) (Bitcoind, error) {
 		conf.User = DefaultUsername
 	}
 
-	client := Bitcoind{
-		url:  fmt.Sprintf("http://%s:%d", conf.Host, conf.Port),
-		user: conf.User,
-		pass: conf.Pass,
+	if conf.Timeout == 0 {
+		conf.Timeout = DefaultTimeout
+	}
+
+	scheme := "http"
+	if conf.TLS || conf.TLSCert != "" {
+		scheme = "https"
+	}
+
+	endpoint := fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(conf.Host, fmt.Sprint(conf.Port)))
+
+	// Route all calls to a specific wallet, if bitcoind has more than one loaded
+	if conf.Wallet != "" {
+		endpoint += "/wallet/" + url.PathEscape(conf.Wallet)
+	}
+
+	httpClient, err := newHTTPClient(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &Bitcoind{
+		url:    endpoint,
+		user:   conf.User,
+		pass:   conf.Pass,
+		client: httpClient,
 	}
 
-	_, err := client.BlockCount()
+	if conf.Cookie != "" {
+		client.cookie = &cookie{path: common.CleanAndExpandPath(conf.Cookie)}
+	}
+
+	err = client.check()
 	if err != nil {
-		return Bitcoind{}, fmt.Errorf("can't connect to Bitcoind: %w", err)
+		log.WithError(err).Warningln("bitcoind unavailable, starting in degraded mode")
 	}
 
+	go client.checkConnectionStatus()
+
 	return client, nil
 }
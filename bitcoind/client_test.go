@@ -0,0 +1,147 @@
+package bitcoind
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lncm/invoicer/common"
+)
+
+func TestCookieRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "invoicer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	cookiePath := filepath.Join(dir, ".cookie")
+
+	writeCookie := func(pass string, modTime time.Time) {
+		err := ioutil.WriteFile(cookiePath, []byte("__cookie__:"+pass), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_ = os.Chtimes(cookiePath, modTime, modTime)
+	}
+
+	expectedPass := "first"
+	writeCookie(expectedPass, time.Now().Add(-time.Hour))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/wallet/shop" {
+			t.Errorf("expected request to /wallet/shop, got %s", r.URL.Path)
+		}
+
+		user, pass, _ := r.BasicAuth()
+		if user != "__cookie__" || pass != expectedPass {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"result": 42, "error": null}`))
+	}))
+	defer server.Close()
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	portNum, _ := strconv.ParseInt(port, 10, 64)
+
+	client, err := New(common.Bitcoind{Host: host, Port: portNum, Cookie: cookiePath, Wallet: "shop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := client.BlockCount()
+	if err != nil || count != 42 {
+		t.Fatalf("expected block count of 42, got: %d (err: %v)", count, err)
+	}
+
+	// simulate bitcoind restart
+	expectedPass = "second"
+	writeCookie(expectedPass, time.Now())
+
+	count, err = client.BlockCount()
+	if err != nil || count != 42 {
+		t.Fatalf("expected rotated cookie to be used, got: %d (err: %v)", count, err)
+	}
+}
+
+func TestCheckAddress(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req requestBody
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Method != MethodListReceiveByAddress {
+			_, _ = w.Write([]byte(`{"result": null, "error": {"code": -32601, "message": "Method not found"}}`))
+			return
+		}
+
+		// 0.29 BTC is 28999999.999999996 sats, when parsed as float64
+		_, _ = w.Write([]byte(`{"result": [
+			{"address": "exact", "amount": 0.29000000, "confirmations": 1, "label": "", "txids": ["a"]},
+			{"address": "sat", "amount": 0.00000001, "confirmations": 0, "label": "", "txids": ["b"]},
+			{"address": "whole", "amount": 21, "confirmations": 6, "label": "", "txids": ["c"]}
+		], "error": null}`))
+	}))
+	defer server.Close()
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	portNum, _ := strconv.ParseInt(port, 10, 64)
+
+	client, err := New(common.Bitcoind{Host: host, Port: portNum, User: "user", Pass: "pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err := client.CheckAddress("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]common.Sats{"exact": 29000000, "sat": 1, "whole": 2100000000}
+	if len(statuses) != len(expected) {
+		t.Fatalf("expected %d statuses, got: %+v", len(expected), statuses)
+	}
+
+	for _, s := range statuses {
+		if s.Amount != expected[s.Address] {
+			t.Errorf("%s: expected %d sats, got %d", s.Address, expected[s.Address], s.Amount)
+		}
+	}
+}
+
+func TestConnectionLost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"result": {"chain": "main", "blocks": 42, "headers": 42}, "error": null}`))
+	}))
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	portNum, _ := strconv.ParseInt(port, 10, 64)
+
+	client, err := New(common.Bitcoind{Host: host, Port: portNum, User: "user", Pass: "pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !client.Ready() {
+		t.Fatalf("expected bitcoind to be ready: %+v", client.Health())
+	}
+
+	server.Close()
+
+	_, err = client.BlockCount()
+	if !errors.Is(err, common.ErrBackendUnavailable) {
+		t.Errorf("expected %v, got: %v", common.ErrBackendUnavailable, err)
+	}
+
+	if client.Ready() || client.Health().Reachable {
+		t.Errorf("bitcoind that can't be reached should be marked as not ready: %+v", client.Health())
+	}
+}
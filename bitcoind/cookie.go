@@ -0,0 +1,58 @@
+package bitcoind
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cookie provides credentials from bitcoind's `.cookie` file.  bitcoind generates a new one on every start, so
+// the file is re-read whenever it changes.
+type cookie struct {
+	path string
+
+	mu         sync.Mutex
+	user, pass string
+	modTime    time.Time
+}
+
+// credentials returns current content of the cookie file.  If it can't be read, last known credentials are returned
+// together with an error.
+func (c *cookie) credentials() (user, pass string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fi, err := os.Stat(c.path)
+	if err != nil {
+		return c.user, c.pass, fmt.Errorf("unable to access cookie file: %w", err)
+	}
+
+	if fi.ModTime().Equal(c.modTime) {
+		return c.user, c.pass, nil
+	}
+
+	content, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return c.user, c.pass, fmt.Errorf("unable to read cookie file: %w", err)
+	}
+
+	parts := strings.SplitN(strings.TrimSpace(string(content)), ":", 2)
+	if len(parts) != 2 {
+		return c.user, c.pass, errors.New("invalid cookie file format, expected `user:password`")
+	}
+
+	c.user, c.pass, c.modTime = parts[0], parts[1], fi.ModTime()
+
+	return c.user, c.pass, nil
+}
+
+// invalidate forces the cookie file to be re-read on next use
+func (c *cookie) invalidate() {
+	c.mu.Lock()
+	c.modTime = time.Time{}
+	c.mu.Unlock()
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/lncm/invoicer/common"
+)
+
+const usageText = `usage: invoicer [-config <file>] [-print-config] [-version] [<command> [<args>]]
+
+commands:
+	serve                 run the API server (default)
+	check-config          validate config, and check if backends are reachable
+	create                create a new payment
+	status <hash>         show status of a payment
+	history               list past payments
+	export                export payments for accounting (csv, ods, json)
+	apikey                manage API keys (add, list, revoke)
+
+Run 'invoicer <command> -h' for details of a command.
+
+flags:
+`
+
+func usage() {
+	_, _ = fmt.Fprint(flag.CommandLine.Output(), usageText)
+	flag.PrintDefaults()
+}
+
+// exit terminates invoicer with a non-zero exit code if err is not nil
+func exit(err error) {
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
+
+func runCommand(cmd string, args []string) error {
+	switch cmd {
+	case "serve":
+		return serveCommand(args)
+
+	case "check-config":
+		return checkConfigCommand(args)
+
+	case "create":
+		return createCommand(args)
+
+	case "status":
+		return statusCommand(args)
+
+	case "history":
+		return historyCommand(args)
+
+	case "export":
+		return exportCommand(args)
+
+	case "apikey":
+		// lnd, and bitcoind are not used, so warnings about them are irrelevant
+		log.SetLevel(log.ErrorLevel)
+
+		err := setup()
+		if err != nil {
+			return err
+		}
+
+		return apiKeyCommand(args)
+	}
+
+	_, _ = fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", cmd)
+	flag.Usage()
+	os.Exit(2)
+
+	return nil
+}
+
+// connectCLI loads config, and connects to backends needed by a command.  Unlike `serve`, commands don't wait
+// for unavailable backends, and only log warnings to stderr.
+func connectCLI(needBtc bool) error {
+	err := setup()
+	if err != nil {
+		return err
+	}
+
+	log.SetLevel(log.WarnLevel)
+	skipOutcomes = true
+
+	err = connect()
+	if err != nil {
+		return err
+	}
+
+	if !lnClient.Ready() {
+		return fmt.Errorf("lnd is unavailable: %s", lnClient.Health().Error)
+	}
+
+	if needBtc && !btcReady() {
+		return fmt.Errorf("bitcoind is unavailable: %s", btcClient.Health().Error)
+	}
+
+	return nil
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// createCommand creates a payment the same way `POST /api/payment` does
+func createCommand(args []string) error {
+	var data paymentRequest
+
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	fs.Int64Var(&data.Amount, "amount", 0, "Amount in satoshis")
+	fs.Int64Var(&data.AmountMsat, "amount-msat", 0, "Amount in millisatoshis, instead of -amount")
+	fs.Int64Var(&data.MinAmount, "min-amount", 0, "Least amount accepted by an open-amount payment (without -amount), in satoshis")
+	fs.Int64Var(&data.MaxAmount, "max-amount", 0, "Most amount accepted by an open-amount payment, in satoshis")
+	fs.StringVar(&data.Description, "desc", "", "Description of the payment")
+	fs.StringVar(&data.Only, "only", "", "Create payment on a single rail only: `ln`, or `btc`")
+	fs.StringVar(&data.OrderID, "order-id", "", "ID of the order.  If a payment for it was created recently, it's returned instead")
+	fs.StringVar(&data.CustomerEmail, "email", "", "Email of the customer")
+	metadata := fs.String("metadata", "", "Any JSON `object` to store with the payment, ex. {\"sku\": \"tea\"}")
+	_ = fs.Parse(args)
+
+	if *metadata != "" {
+		err := json.Unmarshal([]byte(*metadata), &data.Metadata)
+		if err != nil {
+			return fmt.Errorf("metadata has to be a JSON object: %w", err)
+		}
+	}
+
+	if fail := data.validate(); fail != nil {
+		return errors.New(fail.Error)
+	}
+
+	err := connectCLI(data.Only != "ln")
+	if err != nil {
+		return err
+	}
+
+	var key string
+	if data.OrderID != "" {
+		key = "cli:order:" + data.OrderID
+	}
+
+	payment, _, fail := createPaymentOnce(context.Background(), data, key)
+	if fail != nil {
+		return errors.New(fail.Error)
+	}
+
+	return printJSON(payment)
+}
+
+// statusCommand shows current status of a payment, and optionally waits for LN invoice to get paid, or expire
+func statusCommand(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	addr := fs.String("address", "", "Bitcoin address of the payment")
+	wait := fs.Bool("wait", false, "Wait until LN invoice is paid, or expires")
+	fs.Usage = func() {
+		_, _ = fmt.Fprintln(fs.Output(), "usage: invoicer status [-address <address>] [-wait] [<hash>]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	hash := fs.Arg(0)
+	if hash == "" && *addr == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	err := connectCLI(hash == "")
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	var status common.StatusReply
+
+	if hash != "" {
+		reply := checkLnStatus(ctx, hash, lnClient.Status)
+		if reply.Code >= 300 && reply.Code != 408 {
+			return errors.New(reply.Error)
+		}
+
+		// Still pending
+		if reply.Code == 0 && *wait {
+			fin := time.Unix(reply.Ln.Ts, 0).Add(time.Duration(reply.Ln.Expiry) * time.Second)
+
+			waitCtx, cancel := context.WithDeadline(ctx, fin)
+			reply = checkLnStatus(waitCtx, hash, lnClient.StatusWait)
+			if waitCtx.Err() != nil {
+				reply = &common.StatusReply{Code: 408, Error: "expired"}
+			}
+			cancel()
+		}
+
+		status = *reply
+	}
+
+	if *addr != "" && btcReady() {
+		btcStatuses, err := btcClient.CheckAddress(*addr)
+		if err != nil {
+			return fmt.Errorf("unable to check status: %w", err)
+		}
+
+		// bitcoind doesn't return anything for addresses it doesn't watch
+		switch {
+		case len(btcStatuses) > 0:
+			status.Bitcoin = &btcStatuses[0]
+
+		case hash == "":
+			return fmt.Errorf("address %s is not watched by bitcoind", *addr)
+		}
+	}
+
+	addOrderInfo(&status, hash, *addr)
+
+	return printJSON(status)
+}
+
+// parseSince accepts either a duration (ex. `24h`), or anything `parseTime` does
+func parseSince(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	return parseTime(s, false)
+}
+
+// historyCommand lists past payments, the same way `GET /api/history` does
+func historyCommand(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	since := fs.String("since", "", "Only show payments created since, ex. `24h`, or `2020-04-01`")
+	onlyStatus := fs.String("status", "", "Only show payments that are: `paid`, `expired`, or `pending`")
+	format := fs.String("format", "json", "Output format: `json`, or `csv`")
+
+	var orders orderQuery
+	fs.StringVar(&orders.OrderID, "order-id", "", "Only show payments for this order")
+	fs.StringVar(&orders.CustomerEmail, "email", "", "Only show payments of this customer")
+	_ = fs.Parse(args)
+
+	if *format != "json" && *format != "csv" {
+		return fmt.Errorf("unsupported format: %s", *format)
+	}
+
+	switch *onlyStatus {
+	case "", "paid", "expired", "pending":
+	default:
+		return fmt.Errorf("invalid status: %s", *onlyStatus)
+	}
+
+	var from time.Time
+	if *since != "" {
+		var err error
+		from, err = parseSince(*since)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := connectCLI(false)
+	if err != nil {
+		return err
+	}
+
+	history, warning, err := fetchHistory(context.Background(), *onlyStatus)
+	if err != nil {
+		return err
+	}
+
+	if warning != "" {
+		log.Warningln(warning)
+	}
+
+	return writePayments(os.Stdout, *format, orders.filter(filterPayments(history, from, time.Time{})))
+}
+
+// exportCommand writes payments to a file, the same way `GET /api/history/export` does
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "csv", "Output format: `csv`, `ods`, or `json`")
+	fromFlag := fs.String("from", "", "Only export payments created since, ex. `2020-04-01`")
+	toFlag := fs.String("to", "", "Only export payments created until (inclusive), ex. `2020-04-30`")
+	output := fs.String("o", "", "File to write to.  Stdout, if not set")
+	_ = fs.Parse(args)
+
+	if _, ok := exportFormats[*format]; !ok {
+		return fmt.Errorf("unsupported format: %s", *format)
+	}
+
+	var from, to time.Time
+	var err error
+
+	if *fromFlag != "" {
+		from, err = parseTime(*fromFlag, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *toFlag != "" {
+		to, err = parseTime(*toFlag, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = connectCLI(false)
+	if err != nil {
+		return err
+	}
+
+	history, warning, err := fetchHistory(context.Background(), "")
+	if err != nil {
+		return err
+	}
+
+	if warning != "" {
+		log.Warningln(warning)
+	}
+
+	history = filterPayments(history, from, to)
+
+	if *output == "" {
+		return writePayments(os.Stdout, *format, history)
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+
+	err = writePayments(f, *format, history)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	_, _ = fmt.Fprintf(os.Stderr, "%d payments exported to %s\n", len(history), *output)
+	return nil
+}
@@ -0,0 +1,140 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	ScopeCreatePayment = "create-payment"
+	ScopeReadStatus    = "read-status"
+	ScopeReadHistory   = "read-history"
+
+	// Grants access to everything
+	ScopeAdmin = "admin"
+
+	// All API keys start with this, so that they're easy to recognize (ex. by secret scanners)
+	APIKeyPrefix = "inv_"
+
+	apiKeyIDLen     = 4  // bytes
+	apiKeySecretLen = 24 // bytes
+)
+
+var (
+	Scopes = []string{ScopeCreatePayment, ScopeReadStatus, ScopeReadHistory, ScopeAdmin}
+
+	ErrInvalidAPIKey = errors.New("invalid API key")
+)
+
+type APIKey struct {
+	// Public part of the key, used to find it, and to refer to it (ex. when revoking)
+	ID string `json:"id"`
+
+	// sha256 of the secret part of the key.  The key itself is only ever shown once, when it's created.
+	Hash string `json:"hash"`
+
+	Label  string   `json:"label,omitempty"`
+	Scopes []string `json:"scopes"`
+
+	// Unix timestamps.  ExpiresAt, and RevokedAt are 0 if not set.
+	CreatedAt int64 `json:"created_at"`
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	RevokedAt int64 `json:"revoked_at,omitempty"`
+}
+
+// NewAPIKey generates a new key, and returns it together with its hashed form to be stored.  Expiry of 0 means
+// the key never expires.
+func NewAPIKey(label string, scopes []string, expiry time.Duration) (key string, k APIKey, err error) {
+	for _, scope := range scopes {
+		if !IsValidScope(scope) {
+			return "", APIKey{}, fmt.Errorf("invalid scope %q, valid ones are: %s", scope, strings.Join(Scopes, ", "))
+		}
+	}
+
+	if len(scopes) == 0 {
+		return "", APIKey{}, errors.New("at least one scope is required")
+	}
+
+	id := make([]byte, apiKeyIDLen)
+	secret := make([]byte, apiKeySecretLen)
+
+	_, err = rand.Read(id)
+	if err != nil {
+		return
+	}
+
+	_, err = rand.Read(secret)
+	if err != nil {
+		return
+	}
+
+	k = APIKey{
+		ID:        hex.EncodeToString(id),
+		Hash:      hashSecret(hex.EncodeToString(secret)),
+		Label:     label,
+		Scopes:    scopes,
+		CreatedAt: time.Now().Unix(),
+	}
+
+	if expiry > 0 {
+		k.ExpiresAt = time.Now().Add(expiry).Unix()
+	}
+
+	return fmt.Sprintf("%s%s_%s", APIKeyPrefix, k.ID, hex.EncodeToString(secret)), k, nil
+}
+
+// ParseAPIKey splits key into its public ID, and secret parts
+func ParseAPIKey(key string) (id, secret string, err error) {
+	parts := strings.Split(strings.TrimPrefix(key, APIKeyPrefix), "_")
+	if !strings.HasPrefix(key, APIKeyPrefix) || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", ErrInvalidAPIKey
+	}
+
+	return parts[0], parts[1], nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Matches checks, in constant time, if secret belongs to this key
+func (k APIKey) Matches(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(k.Hash)) == 1
+}
+
+// Active returns false if the key was revoked, or has expired
+func (k APIKey) Active() bool {
+	if k.RevokedAt > 0 {
+		return false
+	}
+
+	return k.ExpiresAt == 0 || time.Now().Before(time.Unix(k.ExpiresAt, 0))
+}
+
+// Allows returns true if key was granted `scope`, or is an admin key
+func (k APIKey) Allows(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+func IsValidScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
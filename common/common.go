@@ -1,6 +1,7 @@
 package common
 
 import (
+	"errors"
 	"time"
 
 	"github.com/pelletier/go-toml"
@@ -10,13 +11,32 @@ const (
 	DefaultConfigDir  = "~/.lncm/"
 	DefaultConfigFile = DefaultConfigDir + "invoicer.conf"
 	DefaultLogFile    = DefaultConfigDir + "invoicer.log"
+	DefaultDataFile   = DefaultConfigDir + "invoicer.json"
 
 	DefaultInvoiceExpiry = 3600
 	MaxInvoiceDescLen    = 639
 )
 
+var (
+	// ErrBackendUnavailable is returned (wrapped) by backend clients that are not connected (yet)
+	ErrBackendUnavailable = errors.New("backend unavailable")
+
+	// ErrInvoiceNotFound is returned (wrapped) by LN clients asked about an invoice they don't know
+	ErrInvoiceNotFound = errors.New("invoice not found")
+
+	// ErrPaymentFailed is returned (wrapped) by LN clients when a payment (or on-chain send) definitely didn't go
+	// through.  Other errors leave its outcome unknown, ex. when connection was lost while it was in flight.
+	ErrPaymentFailed = errors.New("payment failed")
+
+	// ErrPaymentInFlight is returned (wrapped) by LN clients asked about a payment that hasn't completed yet
+	ErrPaymentInFlight = errors.New("payment in flight")
+)
+
 type (
 	NewPayment struct {
+		// Only set for payments created by invoicer (as opposed to ex. invoices created directly in lnd)
+		ID string `json:"id,omitempty"`
+
 		CreatedAt int64  `json:"created_at"`
 		Expiry    int64  `json:"expiry"`
 		Bolt11    string `json:"bolt11"`
@@ -26,25 +46,56 @@ type (
 
 	Payment struct {
 		NewPayment
+		OrderInfo
+		AmountBounds
 
 		Description string `json:"description"`
 
-		// The requested amount for the payment
-		Amount int64 `json:"amount"`
+		// The requested amount for the payment.  LN invoices can request fractions of a satoshi, in which case
+		// `Amount` is rounded up, as that's what has to be paid on-chain.  Open-amount payments have the amount
+		// received (up to `MaxAmount`) set instead, once paid.
+		Amount     int64 `json:"amount"`
+		AmountMsat int64 `json:"amount_msat"`
+		OpenAmount bool  `json:"open_amount,omitempty"`
+
+		// Slug of the payment link the payment was created through, if any
+		Link string `json:"link,omitempty"`
 
 		// General status of the payment
 		Expired bool  `json:"is_expired"`
 		Paid    bool  `json:"is_paid"`
 		PaidAt  int64 `json:"paid_at,omitempty"`
 
+		// Set if on-chain deposits completed the payment only after it had expired (within `late-payment-grace`)
+		PaidLate bool `json:"paid_late,omitempty"`
+
+		// Set if the payment was settled only after its payment link's stock ran out.  It's not counted as paid, and
+		// has to be refunded.
+		OverStock bool `json:"over_stock,omitempty"`
+
 		// LN specific
-		LnPaid bool `json:"ln_paid"`
+		LnPaid       bool   `json:"ln_paid"`
+		LnAmount     int64  `json:"ln_amount"`
+		LnAmountMsat int64  `json:"ln_amount_msat"`
+		Preimage     string `json:"preimage,omitempty"`
 
 		// BTC specific
-		BtcPaid       bool     `json:"btc_paid"` // only true if amount >= the requested one
-		BtcAmount     int64    `json:"btc_amount"`
+		BtcPaid       bool     `json:"btc_paid"`           // only true if amount >= the requested one (less tolerance)
+		BtcAmount     int64    `json:"btc_amount"`         // sum of all deposits made to the address
+		Overpaid      int64    `json:"overpaid,omitempty"` // deposited above the requested amount, to be refunded
 		Confirmations int64    `json:"confirmations"`
 		TxIds         []string `json:"txids"`
+
+		// Exchange rate (price of 1 BTC) at the time invoicer has seen the payment settle, if configured
+		FiatRate     float64 `json:"fiat_rate,omitempty"`
+		FiatCurrency string  `json:"fiat_currency,omitempty"`
+
+		// Fees paid by invoicer in relation to this payment.  Receiving payments is free, but refunding them isn't.
+		Fees int64 `json:"fees"`
+
+		// Refunds paid (or being paid) back to the customer, and their sum, fees excluded
+		Refunded int64    `json:"refunded,omitempty"`
+		Refunds  []Refund `json:"refunds,omitempty"`
 	}
 
 	Invoice struct {
@@ -52,33 +103,59 @@ type (
 
 		Description string `json:"description"`
 
-		// What was the requested amount for the payment
-		Amount int64 `json:"amount"`
+		// What was the requested amount for the payment.  `Amount` is rounded up to whole satoshis.
+		Amount     int64 `json:"amount"`
+		AmountMsat int64 `json:"amount_msat"`
 
 		// general status of the payment
 		Expired bool  `json:"is_expired"`
 		Paid    bool  `json:"is_paid"`
 		PaidAt  int64 `json:"paid_at"`
+
+		// Amount actually received, and proof of the payment
+		Received     int64  `json:"received"`
+		ReceivedMsat int64  `json:"received_msat"`
+		Preimage     string `json:"preimage,omitempty"`
 	}
 
 	Invoices []Invoice
 
+	// Settlement is what invoicer records when it sees a payment settle
+	Settlement struct {
+		PaidAt int64 `json:"paid_at"`
+
+		// Price of 1 BTC in `Currency` at `PaidAt`
+		Rate     float64 `json:"rate,omitempty"`
+		Currency string  `json:"currency,omitempty"`
+
+		// Set if on-chain deposits completed the payment only after it had expired
+		Late bool `json:"late,omitempty"`
+
+		// Set if the payment was settled after its payment link's stock ran out
+		OverStock bool `json:"over_stock,omitempty"`
+	}
+
 	Status struct {
-		Ts      int64 `json:"created_at"`
-		Settled bool  `json:"is_paid"`
-		Expiry  int64 `json:"expiry"`
-		Value   int64 `json:"amount"`
+		Ts        int64 `json:"created_at"`
+		Settled   bool  `json:"is_paid"`
+		Expiry    int64 `json:"expiry"`
+		Value     int64 `json:"amount"`
+		ValueMsat int64 `json:"amount_msat"`
 	}
 
 	Info struct {
 		OnChain  bool     `json:"on-chain"`
 		OffChain bool     `json:"off-chain"`
 		Uris     []string `json:"uris"`
+
+		// Readiness of each backend invoicer depends on, ex: {"lnd": true, "bitcoind": false}
+		Ready map[string]bool `json:"ready"`
 	}
 
 	AddrStatus struct {
-		Address       string   `json:"address"`
-		Amount        float64  `json:"amount"`
+		Address string `json:"address"`
+		Amount  Sats   `json:"amount"` // in JSON, BTC decimal
+
 		Confirmations int64    `json:"confirmations"`
 		Label         string   `json:"label,omitempty"`
 		TxIds         []string `json:"txids"`
@@ -86,7 +163,51 @@ type (
 
 	AddrsStatus []AddrStatus
 
+	LndHealth struct {
+		Reachable bool `json:"reachable"`
+
+		// Whether invoicer currently receives invoice updates from lnd
+		Subscribed bool `json:"invoice_subscription"`
+
+		// Unix timestamps of the last connection check, and the last successful one
+		LastCheck   int64 `json:"last_check,omitempty"`
+		LastSuccess int64 `json:"last_success,omitempty"`
+
+		Error string `json:"error,omitempty"`
+	}
+
+	BitcoindHealth struct {
+		Reachable bool `json:"reachable"`
+
+		// Block height, and number of headers known to bitcoind
+		Blocks  int64 `json:"blocks"`
+		Headers int64 `json:"headers"`
+
+		// false during Initial Block Download, or if bitcoind is still catching up to known headers
+		Synced               bool    `json:"synced"`
+		VerificationProgress float64 `json:"verification_progress"`
+
+		// Unix timestamps of the last connection check, and the last successful one
+		LastCheck   int64 `json:"last_check,omitempty"`
+		LastSuccess int64 `json:"last_success,omitempty"`
+
+		Error string `json:"error,omitempty"`
+	}
+
+	Health struct {
+		// One of: `ok`, `degraded` (on-chain payments unavailable), or `unavailable`
+		Status string `json:"status"`
+
+		Version string `json:"version"`
+		Uptime  int64  `json:"uptime"`
+
+		Lnd      LndHealth       `json:"lnd"`
+		Bitcoind *BitcoindHealth `json:"bitcoind,omitempty"`
+	}
+
 	StatusReply struct {
+		OrderInfo
+
 		Code    int         `json:"-"`
 		Error   string      `json:"error,omitempty"`
 		Ln      *Status     `json:"ln,omitempty"`
@@ -102,9 +223,13 @@ func (p *Payment) ApplyLn(invoice Invoice) {
 	p.NewPayment = invoice.NewPayment
 	p.Description = invoice.Description
 	p.Amount = invoice.Amount
+	p.AmountMsat = invoice.AmountMsat
 	p.Expired = invoice.Expired
 	p.Expiry = invoice.Expiry
 	p.LnPaid = invoice.Paid
+	p.LnAmount = invoice.Received
+	p.LnAmountMsat = invoice.ReceivedMsat
+	p.Preimage = invoice.Preimage
 
 	p.Paid = p.Paid || invoice.Paid
 
@@ -113,7 +238,7 @@ func (p *Payment) ApplyLn(invoice Invoice) {
 
 func (p *Payment) ApplyBtc(s AddrStatus) {
 	p.Address = s.Address
-	p.BtcAmount = int64(s.Amount * 1e8)
+	p.BtcAmount = int64(s.Amount)
 	p.Confirmations = s.Confirmations
 	p.TxIds = s.TxIds
 
@@ -130,6 +255,75 @@ func (p *Payment) checkBtcPaid() {
 		p.BtcPaid = true
 		p.Paid = true
 	}
+
+	if p.BtcAmount > p.Amount {
+		p.Overpaid = p.BtcAmount - p.Amount
+	}
+}
+
+// ApplyRefunds records `refunds` of the payment, and fees paid for them
+func (p *Payment) ApplyRefunds(refunds []Refund) {
+	p.Refunds = refunds
+
+	for _, r := range refunds {
+		if r.Counts() {
+			p.Refunded += r.Amount
+		}
+
+		p.Fees += r.Fee
+	}
+}
+
+// Received returns amount received over both rails
+func (p Payment) Received() int64 {
+	return p.LnAmount + p.BtcAmount
+}
+
+// Refundable returns amount received that can be refunded: over LN, and on-chain once all deposits are confirmed,
+// as unconfirmed ones can still be double-spent
+func (p Payment) Refundable() int64 {
+	if p.BtcAmount > 0 && p.Confirmations == 0 {
+		return p.LnAmount
+	}
+
+	return p.Received()
+}
+
+// ReceivedMsat returns amount received over both rails in millisatoshis
+func (p Payment) ReceivedMsat() int64 {
+	return p.LnAmountMsat + p.BtcAmount*1000
+}
+
+// ApplyTolerance marks on-chain deposits short of the requested amount by no more than `o` allows as paid.
+// Needs to be called after both `ApplyLn`, and `ApplyBtc`.
+func (p *Payment) ApplyTolerance(o OnChain) {
+	if p.BtcPaid || p.Amount == 0 || p.BtcAmount == 0 {
+		return
+	}
+
+	if p.BtcAmount >= o.MinAmount(p.Amount) {
+		p.BtcPaid = true
+		p.Paid = true
+	}
+}
+
+// ApplyOpenAmount settles an open-amount payment once enough was received over both rails, and sets its amount to
+// what was received, up to `b.MaxAmount`.  The rest is overpaid.  Needs to be called after both `ApplyLn`, and
+// `ApplyBtc`.
+func (p *Payment) ApplyOpenAmount(b AmountBounds) {
+	p.OpenAmount, p.AmountBounds = true, b
+
+	received := p.Received()
+	enough, over := b.Check(received)
+
+	// LN invoices for any amount are settled by lnd no matter how much was paid
+	p.Paid = enough
+	p.BtcPaid = enough && p.BtcAmount > 0
+	if !enough {
+		return
+	}
+
+	p.Amount, p.AmountMsat, p.Overpaid = received-over, p.ReceivedMsat()-over*1000, over
 }
 
 // deprecatedConfigLocationCheck checks for a config file in a previously default location.  Checking there will be
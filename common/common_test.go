@@ -0,0 +1,97 @@
+package common
+
+import "testing"
+
+func TestMinAmount(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		onChain  OnChain
+		amount   int64
+		expected int64
+	}{
+		{"no tolerance", OnChain{}, 10000, 10000},
+		{"percent", OnChain{TolerancePercent: 1}, 10000, 9900},
+		{"fraction of percent", OnChain{TolerancePercent: 0.5}, 10000, 9950},
+		{"sats", OnChain{ToleranceSats: 300}, 10000, 9700},
+		{"larger of both", OnChain{TolerancePercent: 1, ToleranceSats: 300}, 10000, 9700},
+		{"larger of both", OnChain{TolerancePercent: 5, ToleranceSats: 300}, 10000, 9500},
+		{"above amount", OnChain{ToleranceSats: 20000}, 10000, 1},
+		{"percent not representable as float64", OnChain{TolerancePercent: 0.57}, 10000, 9943},
+		{"all bitcoin", OnChain{TolerancePercent: 99.99}, 2100000000000000, 210000000000},
+	} {
+		if min := tc.onChain.MinAmount(tc.amount); min != tc.expected {
+			t.Errorf("%s: MinAmount(%d) = %d, expected %d", tc.name, tc.amount, min, tc.expected)
+		}
+	}
+}
+
+func TestRefundable(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		payment    Payment
+		refundable int64
+	}{
+		{"ln", Payment{LnAmount: 1000}, 1000},
+		{"confirmed", Payment{LnAmount: 1000, BtcAmount: 2000, Confirmations: 1}, 3000},
+		{"unconfirmed", Payment{LnAmount: 1000, BtcAmount: 2000}, 1000},
+	} {
+		if refundable := tc.payment.Refundable(); refundable != tc.refundable {
+			t.Errorf("%s: Refundable() = %d, expected %d", tc.name, refundable, tc.refundable)
+		}
+	}
+}
+
+func TestApplyBtc(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		received  Sats
+		tolerance OnChain
+		paid      bool
+		overpaid  int64
+	}{
+		{"nothing", 0, OnChain{}, false, 0},
+		{"partial", 5000, OnChain{}, false, 0},
+		{"exact", 10000, OnChain{}, true, 0},
+		{"overpaid", 12000, OnChain{}, true, 2000},
+		{"within tolerance", 9900, OnChain{TolerancePercent: 1}, true, 0},
+		{"below tolerance", 9800, OnChain{TolerancePercent: 1}, false, 0},
+	} {
+		p := Payment{Amount: 10000}
+		p.ApplyBtc(AddrStatus{Address: "addr", Amount: tc.received})
+		p.ApplyTolerance(tc.tolerance)
+
+		if p.BtcPaid != tc.paid || p.Paid != tc.paid || p.Overpaid != tc.overpaid {
+			t.Errorf("%s: paid = %v, overpaid = %d, expected %v, and %d", tc.name, p.BtcPaid, p.Overpaid, tc.paid, tc.overpaid)
+		}
+	}
+}
+
+func TestApplyOpenAmount(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		payment  Payment
+		bounds   AmountBounds
+		paid     bool
+		amount   int64
+		overpaid int64
+	}{
+		{"nothing received", Payment{}, AmountBounds{}, false, 0, 0},
+		{"any amount", Payment{LnPaid: true, LnAmount: 500, LnAmountMsat: 500000}, AmountBounds{}, true, 500, 0},
+		{"below minimum", Payment{LnPaid: true, LnAmount: 500, LnAmountMsat: 500000}, AmountBounds{MinAmount: 1000}, false, 0, 0},
+		{"on-chain within bounds", Payment{BtcAmount: 1500}, AmountBounds{MinAmount: 1000, MaxAmount: 2000}, true, 1500, 0},
+		{"above maximum", Payment{BtcAmount: 2500}, AmountBounds{MinAmount: 1000, MaxAmount: 2000}, true, 2000, 500},
+		{"both rails add up", Payment{LnAmount: 600, LnAmountMsat: 600000, BtcAmount: 600}, AmountBounds{MinAmount: 1000}, true, 1200, 0},
+	} {
+		p := tc.payment
+		p.Paid = p.LnPaid
+		p.ApplyOpenAmount(tc.bounds)
+
+		if p.Paid != tc.paid || p.Amount != tc.amount || p.Overpaid != tc.overpaid || !p.OpenAmount {
+			t.Errorf("%s: paid = %v, amount = %d, overpaid = %d, expected %v, %d, and %d", tc.name, p.Paid, p.Amount, p.Overpaid, tc.paid, tc.amount, tc.overpaid)
+		}
+
+		if p.Paid && p.AmountMsat != p.Amount*1000 {
+			t.Errorf("%s: amount_msat = %d, expected %d", tc.name, p.AmountMsat, p.Amount*1000)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"math"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -19,29 +20,188 @@ type (
 		// Location of a log file
 		LogFile string `toml:"log-file"`
 
+		// Time (in seconds) given to open requests to finish after SIGTERM, or SIGINT is received
+		ShutdownTimeout int64 `toml:"shutdown-timeout"`
+
+		// Location of a file where invoicer keeps its own state (ex. API keys)
+		DataFile string `toml:"data-file"`
+
+		// Time (in seconds) within which repeated payment requests with the same `Idempotency-Key` header, or
+		// `order_id` return the original payment, instead of creating a new one
+		IdempotencyWindow int64 `toml:"idempotency-window"`
+
+		// Time (in seconds) after expiry during which on-chain payments are still watched.  Deposits completing them
+		// within it are recorded as paid late, and reported to `[webhook]`.  0 disables watching.
+		LatePaymentGrace int64 `toml:"late-payment-grace"`
+
 		// Currently only `lnd` supported
 		LnClient string `toml:"ln-client"`
 
 		// Allows for disabling the possibility of on-chain payments.
 		OffChainOnly bool `toml:"off-chain-only"`
 
+		// Expose Prometheus metrics at `/metrics`
+		Metrics bool `toml:"metrics"`
+
+		// Serve Swagger UI at `/api/docs`.  OpenAPI document is always served at `/api/openapi.json`.
+		SwaggerUI bool `toml:"swagger-ui"`
+
+		// IPs, or CIDRs of reverse proxies allowed to pass client IP via `X-Forwarded-For`, or `X-Real-IP` headers, and
+		// scheme via `X-Forwarded-Proto`
+		TrustedProxies []string `toml:"trusted-proxies"`
+
+		// [tls] section in the `--config` file that defines how the API is served over HTTPS
+		TLS TLS `toml:"tls"`
+
+		// [rate-limit] section in the `--config` file that defines limits protecting invoicer from abuse
+		RateLimit RateLimit `toml:"rate-limit"`
+
 		// [bitcoind] section in the `--config` file that defines Bitcoind's setup
 		Bitcoind Bitcoind `toml:"bitcoind"`
 
 		// [lnd] section in the `--config` file that defines Lnd's setup
 		Lnd LndConfig `toml:"lnd"`
 
+		// [auth] section in the `--config` file that defines which endpoints require an API key
+		Auth Auth `toml:"auth"`
+
+		// [fiat] section in the `--config` file that defines where exchange rates recorded with payments come from
+		Fiat Fiat `toml:"fiat"`
+
+		// [on-chain] section in the `--config` file that defines how on-chain deposits are accepted
+		OnChain OnChain `toml:"on-chain"`
+
+		// [webhook] section in the `--config` file that defines where events (ex. late payments) are sent
+		Webhook Webhook `toml:"webhook"`
+
+		// [[links]] sections in the `--config` file that define payment links, in addition to ones created via the API
+		Links []PaymentLink `toml:"links"`
+
+		// DEPRECATED: use API keys with `read-history` scope instead.
 		// An optional list of user:password pairs that will get granted access to the /history endpoint
 		Users map[string]string `toml:"users"`
+
+		// DEPRECATED: use API keys with `read-history` scope instead.
+		// File with additional `user:password` pairs (one per line) to be added to `[users]`
+		UsersFile string `toml:"users-file"`
+	}
+
+	TLS struct {
+		// Serve the API over HTTPS only
+		Enabled bool `toml:"enabled"`
+
+		// Certificate, and key files.  Both are reloaded whenever changed on disk.  If neither exists,
+		// a self-signed certificate is generated, and saved there.
+		Cert string `toml:"cert"`
+		Key  string `toml:"key"`
+
+		// Additional hostnames, or IPs to include in a generated self-signed certificate
+		Hosts []string `toml:"hosts"`
+
+		// If set, clients presenting a certificate signed by this CA are granted access to admin routes
+		ClientCA string `toml:"client-ca"`
+	}
+
+	RateLimit struct {
+		// Number of payments a single IP address can create per minute, and the size of allowed bursts.
+		// Only applies to requests without an API key.  0 disables the limit.
+		PerIP      int64 `toml:"per-ip"`
+		PerIPBurst int64 `toml:"per-ip-burst"`
+
+		// Number of payments a single API key can create per minute, and the size of allowed bursts.
+		// 0 disables the limit.
+		PerKey      int64 `toml:"per-key"`
+		PerKeyBurst int64 `toml:"per-key-burst"`
+
+		// Maximum number of concurrently open status long-polls.  0 means unlimited.
+		MaxStatusWaiters int64 `toml:"max-status-waiters"`
+
+		// If set, requests without an API key need to pass a proof-of-work with this many leading zero bits
+		// to create a payment.  Challenges are issued by `GET /api/pow`.
+		PowDifficulty int64 `toml:"pow-difficulty"`
+
+		// [rate-limit.captcha] section that (if set) requires a solved captcha to create a payment
+		Captcha Captcha `toml:"captcha"`
+	}
+
+	// Captcha can be any service compatible with `siteverify` API, ex. hCaptcha, reCAPTCHA, or Turnstile
+	Captcha struct {
+		// ex. https://hcaptcha.com/siteverify
+		VerifyURL string `toml:"verify-url"`
+		Secret    string `toml:"secret"`
+
+		// File to read `secret` from.  Takes precedence over `secret`.
+		SecretFile string `toml:"secret-file"`
+	}
+
+	Fiat struct {
+		// Currency rates are expressed in, ex. `USD`
+		Currency string `toml:"currency"`
+
+		// URL returning JSON with the price of 1 BTC, ex.
+		// https://api.coingecko.com/api/v3/simple/price?ids=bitcoin&vs_currencies=usd
+		RateURL string `toml:"rate-url"`
+
+		// Dot-separated path to the price within returned JSON, ex. `bitcoin.usd`
+		RatePath string `toml:"rate-path"`
+	}
+
+	// OnChain payments accumulate all deposits made to their address until they expire.  Deposits short of the
+	// requested amount by no more than the larger of both tolerances are accepted as paid.
+	OnChain struct {
+		// Percentage of the requested amount, ex. `1` accepts 9900 sats for a 10000 sat payment.  Rounded to
+		// hundredths of a percent.
+		TolerancePercent float64 `toml:"tolerance-percent"`
+
+		// Fixed number of sats
+		ToleranceSats int64 `toml:"tolerance-sats"`
+	}
+
+	Webhook struct {
+		// URL events are POSTed to as JSON.  Disabled if empty.
+		URL string `toml:"url"`
+
+		// If set, events are signed with HMAC-SHA256 of the body in `X-Invoicer-Signature` header
+		Secret string `toml:"secret"`
+
+		// File to read `secret` from.  Takes precedence over `secret`.
+		SecretFile string `toml:"secret-file"`
+	}
+
+	Auth struct {
+		// Scopes that require a valid API key to be passed.  Can only be `create-payment`, and `read-status`, as
+		// both `read-history`, and `admin` are always required.
+		Require []string `toml:"require"`
 	}
 
 	// Bitcoind config
-	// NOTE: Keep in mind that this is **not yet encrypted**, so best to keep it _local_
+	// NOTE: Unless `tls` is enabled, connection is **not encrypted**, so best to keep it _local_
 	Bitcoind struct {
 		Host string `toml:"host"`
 		Port int64  `toml:"port"`
 		User string `toml:"user"`
 		Pass string `toml:"pass"`
+
+		// File to read `pass` from (ex. a Docker secret).  Takes precedence over `pass`.
+		PassFile string `toml:"pass-file"`
+
+		// Path to bitcoind's `.cookie` file.  If set, `user`, and `pass` are ignored.
+		Cookie string `toml:"cookie"`
+
+		// Name of the wallet to use, if bitcoind has more than one loaded
+		Wallet string `toml:"wallet"`
+
+		// Connect over HTTPS (ex. to bitcoind behind a TLS-terminating proxy).  Implied if `tls-cert` is set.
+		TLS bool `toml:"tls"`
+
+		// Certificate (or CA) to verify HTTPS connection with, if it's not signed by a publicly trusted CA
+		TLSCert string `toml:"tls-cert"`
+
+		// Proxy to connect through, ex. `socks5://127.0.0.1:9050`
+		Proxy string `toml:"proxy"`
+
+		// Timeout of a single call, in seconds
+		Timeout int64 `toml:"timeout"`
 	}
 
 	Macaroons struct {
@@ -50,6 +210,9 @@ type (
 
 		// This is needed to check status of invoices (and if enabled access `/history` endpoint)
 		ReadOnly string `toml:"readonly"`
+
+		// Only needed to pay refunds.  Refunds are disabled if not set.
+		Admin string `toml:"admin"`
 	}
 
 	LndConfig struct {
@@ -64,6 +227,27 @@ type (
 	}
 )
 
+// basisPointsPerUnit is the number of hundredths of a percent in a whole
+const basisPointsPerUnit = 100 * 100
+
+// MinAmount returns the smallest on-chain deposit accepted as payment of `amount`.  Only integers are used, so that
+// precision of float64 can't shift the bound by a satoshi.
+func (o OnChain) MinAmount(amount int64) int64 {
+	bps := int64(math.Round(o.TolerancePercent * 100))
+
+	// split, so that amounts up to all bitcoin ever can't overflow
+	tolerance := amount/basisPointsPerUnit*bps + amount%basisPointsPerUnit*bps/basisPointsPerUnit
+	if o.ToleranceSats > tolerance {
+		tolerance = o.ToleranceSats
+	}
+
+	if tolerance >= amount {
+		return 1
+	}
+
+	return amount - tolerance
+}
+
 // CleanAndExpandPath converts passed file system paths into absolute ones.
 func CleanAndExpandPath(path string) string {
 	if path == "" {
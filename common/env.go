@@ -0,0 +1,237 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// All config values can be overridden with environment variables named after their TOML path, ex:
+// `INVOICER_PORT`, `INVOICER_BITCOIND_PASS`, or `INVOICER_RATE_LIMIT_PER_IP`.  Appending `_FILE` to any of them
+// (ex. `INVOICER_BITCOIND_PASS_FILE`) reads the value from a file instead (ex. a Docker, or Kubernetes secret).
+const EnvPrefix = "INVOICER_"
+
+const redacted = "<redacted>"
+
+// EnvName returns name of the environment variable overriding config value at TOML `path`
+func EnvName(path ...string) string {
+	name := strings.ToUpper(strings.Join(path, "_"))
+	return EnvPrefix + strings.NewReplacer("-", "_", ".", "_").Replace(name)
+}
+
+// ApplyEnv overrides values of `c` with environment variables.  Variables pointing to files take precedence over
+// the config file, but plain variables take precedence over everything.
+func ApplyEnv(c *Config) error {
+	return applyEnv(reflect.ValueOf(c).Elem(), nil)
+}
+
+func applyEnv(v reflect.Value, path []string) error {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("toml")
+		if key == "" || key == "-" {
+			continue
+		}
+
+		fieldPath := append(append([]string{}, path...), key)
+		field := v.Field(i)
+
+		if field.Kind() == reflect.Struct {
+			err := applyEnv(field, fieldPath)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		// Lists of tables (ex. `[[links]]`) can only be set in the config file
+		if field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct {
+			continue
+		}
+
+		name := EnvName(fieldPath...)
+
+		if file, ok := os.LookupEnv(name + "_FILE"); ok {
+			value, err := ReadSecretFile(file)
+			if err != nil {
+				return fmt.Errorf("%s_FILE: %w", name, err)
+			}
+
+			err = setFromString(field, value)
+			if err != nil {
+				return fmt.Errorf("%s_FILE: %w", name, err)
+			}
+		}
+
+		if value, ok := os.LookupEnv(name); ok {
+			err := setFromString(field, value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// setFromString parses `value` according to the kind of `field`.  Lists are comma-separated, and maps are
+// comma-separated `key:value` pairs.
+func setFromString(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean: %q", value)
+		}
+
+		field.SetBool(b)
+
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer: %q", value)
+		}
+
+		field.SetInt(n)
+
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number: %q", value)
+		}
+
+		field.SetFloat(f)
+
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+
+		field.Set(reflect.ValueOf(items))
+
+	case reflect.Map:
+		m, err := parsePairs(strings.Split(value, ","))
+		if err != nil {
+			return err
+		}
+
+		field.Set(reflect.ValueOf(m))
+
+	default:
+		return fmt.Errorf("unsupported type: %s", field.Type())
+	}
+
+	return nil
+}
+
+// parsePairs parses `key:value` pairs, skipping empty ones
+func parsePairs(pairs []string) (map[string]string, error) {
+	m := make(map[string]string)
+
+	for _, pair := range pairs {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid pair %q, expected `key:value`", pair)
+		}
+
+		m[parts[0]] = parts[1]
+	}
+
+	return m, nil
+}
+
+// ReadSecretFile returns content of a file, without the trailing newline
+func ReadSecretFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(CleanAndExpandPath(path))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// ResolveSecretFiles reads values of all `*-file` options from their files.  Values read this way take precedence
+// over the ones set directly in the config file.
+func ResolveSecretFiles(c *Config) (err error) {
+	if c.Bitcoind.PassFile != "" {
+		c.Bitcoind.Pass, err = ReadSecretFile(c.Bitcoind.PassFile)
+		if err != nil {
+			return fmt.Errorf("bitcoind.pass-file: %w", err)
+		}
+	}
+
+	if c.Webhook.SecretFile != "" {
+		c.Webhook.Secret, err = ReadSecretFile(c.Webhook.SecretFile)
+		if err != nil {
+			return fmt.Errorf("webhook.secret-file: %w", err)
+		}
+	}
+
+	if c.RateLimit.Captcha.SecretFile != "" {
+		c.RateLimit.Captcha.Secret, err = ReadSecretFile(c.RateLimit.Captcha.SecretFile)
+		if err != nil {
+			return fmt.Errorf("rate-limit.captcha.secret-file: %w", err)
+		}
+	}
+
+	if c.UsersFile != "" {
+		content, err := ReadSecretFile(c.UsersFile)
+		if err != nil {
+			return fmt.Errorf("users-file: %w", err)
+		}
+
+		users, err := parsePairs(strings.Split(content, "\n"))
+		if err != nil {
+			return fmt.Errorf("users-file: %w", err)
+		}
+
+		if c.Users == nil {
+			c.Users = make(map[string]string)
+		}
+
+		for user, pass := range users {
+			c.Users[user] = pass
+		}
+	}
+
+	return nil
+}
+
+// Redacted returns a copy of config with all secrets replaced, so that it's safe to be shown
+func (c Config) Redacted() Config {
+	redact := func(s string) string {
+		if s == "" {
+			return ""
+		}
+
+		return redacted
+	}
+
+	c.Bitcoind.Pass = redact(c.Bitcoind.Pass)
+	c.RateLimit.Captcha.Secret = redact(c.RateLimit.Captcha.Secret)
+	c.Webhook.Secret = redact(c.Webhook.Secret)
+
+	users := make(map[string]string, len(c.Users))
+	for user, pass := range c.Users {
+		users[user] = redact(pass)
+	}
+	c.Users = users
+
+	return c
+}
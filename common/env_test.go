@@ -0,0 +1,122 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEnvName(t *testing.T) {
+	tests := []struct {
+		path []string
+		want string
+	}{
+		{[]string{"port"}, "INVOICER_PORT"},
+		{[]string{"bitcoind", "pass"}, "INVOICER_BITCOIND_PASS"},
+		{[]string{"rate-limit", "per-ip"}, "INVOICER_RATE_LIMIT_PER_IP"},
+		{[]string{"lnd", "macaroon", "invoice"}, "INVOICER_LND_MACAROON_INVOICE"},
+	}
+
+	for _, test := range tests {
+		if got := EnvName(test.path...); got != test.want {
+			t.Errorf("EnvName(%v) = %s, want %s", test.path, got, test.want)
+		}
+	}
+}
+
+func TestEnvPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "invoicer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		return path
+	}
+
+	var c Config
+	c.Port = 1
+	c.Bitcoind.Pass = "config"
+	c.Bitcoind.PassFile = write("pass", "config-file\n")
+	c.RateLimit.Captcha.Secret = "config"
+	c.RateLimit.Captcha.SecretFile = write("secret", "config-file\n")
+	c.Webhook.SecretFile = write("webhook-secret", "webhook-file\n")
+	c.Lnd.Host = "config"
+	c.UsersFile = write("users", "alice:a\nbob:b\n")
+
+	env := map[string]string{
+		"INVOICER_PORT":                           "2",
+		"INVOICER_BITCOIND_PASS_FILE":             write("env-pass", "env-file\n"),
+		"INVOICER_BITCOIND_PASS":                  "env",
+		"INVOICER_RATE_LIMIT_CAPTCHA_SECRET_FILE": write("env-secret", "env-file\n"),
+		"INVOICER_TRUSTED_PROXIES":                "10.0.0.0/8, 1.2.3.4",
+		"INVOICER_OFF_CHAIN_ONLY":                 "true",
+	}
+
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	if err := ResolveSecretFiles(&c); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ApplyEnv(&c); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Port != 2 {
+		t.Errorf("port = %d, want 2", c.Port)
+	}
+
+	if c.Bitcoind.Pass != "env" {
+		t.Errorf("bitcoind.pass = %q, want value of INVOICER_BITCOIND_PASS", c.Bitcoind.Pass)
+	}
+
+	if c.RateLimit.Captcha.Secret != "env-file" {
+		t.Errorf("captcha secret = %q, want content of INVOICER_RATE_LIMIT_CAPTCHA_SECRET_FILE", c.RateLimit.Captcha.Secret)
+	}
+
+	if c.Webhook.Secret != "webhook-file" {
+		t.Errorf("webhook secret = %q, want content of webhook.secret-file", c.Webhook.Secret)
+	}
+
+	if c.Lnd.Host != "config" {
+		t.Errorf("lnd.host = %q, want value from config", c.Lnd.Host)
+	}
+
+	if !c.OffChainOnly {
+		t.Error("off-chain-only should be set from env")
+	}
+
+	if want := []string{"10.0.0.0/8", "1.2.3.4"}; !reflect.DeepEqual(c.TrustedProxies, want) {
+		t.Errorf("trusted-proxies = %v, want %v", c.TrustedProxies, want)
+	}
+
+	if want := map[string]string{"alice": "a", "bob": "b"}; !reflect.DeepEqual(c.Users, want) {
+		t.Errorf("users = %v, want %v", c.Users, want)
+	}
+
+	if r := c.Redacted(); r.Bitcoind.Pass == c.Bitcoind.Pass || r.Webhook.Secret == c.Webhook.Secret || r.Users["alice"] == "a" || c.Users["alice"] != "a" {
+		t.Error("Redacted() should hide secrets without modifying the original")
+	}
+}
+
+func TestApplyEnvInvalid(t *testing.T) {
+	os.Setenv("INVOICER_PORT", "abc")
+	defer os.Unsetenv("INVOICER_PORT")
+
+	var c Config
+	if err := ApplyEnv(&c); err == nil {
+		t.Error("invalid integer should be rejected")
+	}
+}
@@ -0,0 +1,87 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Slugs of payment links appear in their URLs, ex. `/pay/coffee`
+var slugRe = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,63}$`)
+
+// PaymentLink is a reusable link (`/pay/<slug>`) that creates a new payment for each visitor.  Links are defined
+// in `[[links]]` sections of the config file, or via the API.
+type PaymentLink struct {
+	Slug        string `json:"slug" toml:"slug" doc:"Lowercase letters, digits, and dashes, ex. coffee"`
+	Description string `json:"description,omitempty" toml:"description"`
+
+	// In satoshis.  Links without amount create open-amount payments, limited by `MinAmount`, and `MaxAmount`.
+	Amount    int64 `json:"amount,omitempty" toml:"amount" doc:"In satoshis.  Payments are open-amount, if not set"`
+	MinAmount int64 `json:"min_amount,omitempty" toml:"min-amount" doc:"Least amount accepted by open-amount payments"`
+	MaxAmount int64 `json:"max_amount,omitempty" toml:"max-amount" doc:"Most amount accepted by open-amount payments"`
+
+	Only string `json:"only,omitempty" toml:"only" doc:"Create payments on a single rail only: ln, or btc"`
+
+	// Unix timestamp after which the link no longer creates payments.  Never, if not set.
+	ExpiresAt int64 `json:"expires_at,omitempty" toml:"expires-at" doc:"Unix timestamp after which the link no longer creates payments"`
+
+	// Number of payments that can be paid through the link.  Unlimited, if not set.
+	Stock int64 `json:"stock,omitempty" toml:"stock" doc:"Number of payments that can be paid through the link.  Pending ones reserve it until they expire."`
+
+	CreatedAt int64 `json:"created_at,omitempty" toml:"-"`
+
+	// Set for links defined in the config file.  These can only be changed there.
+	FromConfig bool `json:"from_config,omitempty" toml:"-"`
+}
+
+// LinkCounts keeps track of payments created through a payment link, so that its stock can be checked without
+// asking LN, and Bitcoin nodes about each of them
+type LinkCounts struct {
+	Created int64 `json:"created"`
+	Paid    int64 `json:"paid"`
+}
+
+// Validate checks that link can create valid payments
+func (l PaymentLink) Validate() error {
+	switch {
+	case !slugRe.MatchString(l.Slug):
+		return fmt.Errorf("slug %q can only have lowercase letters, digits, and dashes (up to 64)", l.Slug)
+
+	case l.Amount < 0 || l.MinAmount < 0 || l.MaxAmount < 0:
+		return errors.New("amounts can't be negative")
+
+	case l.Amount > 0 && (l.MinAmount > 0 || l.MaxAmount > 0):
+		return errors.New("min-amount, and max-amount can only be set for links without amount")
+
+	case l.MaxAmount > 0 && l.MinAmount > l.MaxAmount:
+		return errors.New("min-amount can't be above max-amount")
+
+	case l.Only != "" && l.Only != "ln" && l.Only != "btc":
+		return fmt.Errorf("only can be either `ln`, or `btc`, got %q", l.Only)
+
+	case l.Stock < 0:
+		return errors.New("stock can't be negative")
+
+	case len(l.Description) > MaxInvoiceDescLen:
+		return fmt.Errorf("description too long. Max length is %d", MaxInvoiceDescLen)
+	}
+
+	return nil
+}
+
+// Expired returns true if the link no longer creates payments at `now`
+func (l PaymentLink) Expired(now time.Time) bool {
+	return l.ExpiresAt > 0 && now.Unix() > l.ExpiresAt
+}
+
+// Owns returns true if payment record `r` was created through the link, and not through an earlier one with the same
+// slug, that was since deleted
+func (l PaymentLink) Owns(r PaymentRecord) bool {
+	return r.Link == l.Slug && r.CreatedAt >= l.CreatedAt
+}
+
+// Bounds returns bounds of open-amount payments created by the link
+func (l PaymentLink) Bounds() AmountBounds {
+	return AmountBounds{MinAmount: l.MinAmount, MaxAmount: l.MaxAmount}
+}
@@ -0,0 +1,49 @@
+package common
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateLink(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		link  PaymentLink
+		valid bool
+	}{
+		{"fixed amount", PaymentLink{Slug: "coffee", Amount: 1000}, true},
+		{"open amount", PaymentLink{Slug: "tip-jar", MinAmount: 100, MaxAmount: 1000}, true},
+		{"no slug", PaymentLink{Amount: 1000}, false},
+		{"uppercase slug", PaymentLink{Slug: "Coffee"}, false},
+		{"slug starting with dash", PaymentLink{Slug: "-coffee"}, false},
+		{"slug too long", PaymentLink{Slug: strings.Repeat("a", 65)}, false},
+		{"negative amount", PaymentLink{Slug: "coffee", Amount: -1}, false},
+		{"bounds with amount", PaymentLink{Slug: "coffee", Amount: 1000, MinAmount: 100}, false},
+		{"minimum above maximum", PaymentLink{Slug: "coffee", MinAmount: 2, MaxAmount: 1}, false},
+		{"only ln", PaymentLink{Slug: "coffee", Only: "ln"}, true},
+		{"only unknown", PaymentLink{Slug: "coffee", Only: "eth"}, false},
+		{"negative stock", PaymentLink{Slug: "coffee", Stock: -1}, false},
+		{"description too long", PaymentLink{Slug: "coffee", Description: strings.Repeat("a", MaxInvoiceDescLen+1)}, false},
+	} {
+		if err := tc.link.Validate(); (err == nil) != tc.valid {
+			t.Errorf("%s: Validate() = %v, expected valid: %t", tc.name, err, tc.valid)
+		}
+	}
+}
+
+func TestLinkExpired(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	if (PaymentLink{}).Expired(now) {
+		t.Error("link without expiry shouldn't expire")
+	}
+
+	if (PaymentLink{ExpiresAt: 1000}).Expired(now) {
+		t.Error("link shouldn't expire at its expiry")
+	}
+
+	if !(PaymentLink{ExpiresAt: 999}).Expired(now) {
+		t.Error("link should be expired after its expiry")
+	}
+}
@@ -0,0 +1,101 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// All payment IDs start with this, so that they can't be confused with LN hashes
+const PaymentIDPrefix = "pay_"
+
+// All IDs of events sent to webhooks start with this
+const EventIDPrefix = "evt_"
+
+const paymentIDLen = 12 // bytes
+
+// Limits of merchant's data attached to payments
+const (
+	MaxOrderIDLen  = 255
+	MaxMetadataLen = 4096 // bytes of JSON
+)
+
+// OrderInfo is merchant's data attached to a payment.  It's never embedded in the invoice, or anywhere else
+// the payer could see it.
+type OrderInfo struct {
+	OrderID       string                 `json:"order_id,omitempty" doc:"Merchant's ID of the order"`
+	CustomerEmail string                 `json:"customer_email,omitempty"`
+	Metadata      map[string]interface{} `json:"metadata,omitempty" doc:"Any JSON object, up to 4096 bytes"`
+}
+
+// AmountBounds limit how much can be paid to an open-amount payment (one created without amount), in satoshis.
+// 0 means no limit.
+type AmountBounds struct {
+	MinAmount int64 `json:"min_amount,omitempty" doc:"Least accepted amount of an open-amount payment, in satoshis"`
+	MaxAmount int64 `json:"max_amount,omitempty" doc:"Most accepted amount of an open-amount payment, in satoshis.  Anything above is overpaid."`
+}
+
+// Check returns whether `received` is enough, and how much of it is above the maximum
+func (b AmountBounds) Check(received int64) (enough bool, over int64) {
+	if b.MaxAmount > 0 && received > b.MaxAmount {
+		over = received - b.MaxAmount
+	}
+
+	return received > 0 && received >= b.MinAmount, over
+}
+
+// PaymentRecord is what invoicer stores about each payment it creates.  Its current state is always fetched
+// from lnd, and bitcoind.
+type PaymentRecord struct {
+	NewPayment
+	OrderInfo
+	AmountBounds
+
+	Description string `json:"description,omitempty"`
+	Amount      int64  `json:"amount"`
+	AmountMsat  int64  `json:"amount_msat,omitempty"`
+
+	// Slug of the payment link the payment was created through, if any
+	Link string `json:"link,omitempty"`
+
+	// Key of the request that created the payment (scoped to the API key used), and hash of the request itself,
+	// so that retries can be told apart from different requests reusing the key
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	RequestHash    string `json:"request_hash,omitempty"`
+}
+
+// RequestedMsat returns the requested amount in millisatoshis.  Records made before msat amounts were supported
+// only have `Amount`.
+func (r PaymentRecord) RequestedMsat() int64 {
+	if r.AmountMsat == 0 {
+		return r.Amount * 1000
+	}
+
+	return r.AmountMsat
+}
+
+// OpenAmount returns true if the payment was created without an amount.  Placeholder records, with only LN hash set
+// for invoices invoicer didn't create, never are, even if their invoices don't specify an amount.
+func (r PaymentRecord) OpenAmount() bool {
+	return r.CreatedAt > 0 && r.RequestedMsat() == 0
+}
+
+// NewPaymentID returns a random, unique ID of a payment
+func NewPaymentID() (string, error) {
+	return randomID(PaymentIDPrefix, paymentIDLen)
+}
+
+// NewEventID returns a random, unique ID of an event, so that receivers can recognize repeated deliveries
+func NewEventID() (string, error) {
+	return randomID(EventIDPrefix, paymentIDLen)
+}
+
+func randomID(prefix string, length int) (string, error) {
+	id := make([]byte, length)
+
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+
+	return prefix + hex.EncodeToString(id), nil
+}
@@ -0,0 +1,98 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// All refund IDs start with this
+const RefundIDPrefix = "ref_"
+
+const (
+	refundIDLen = 12 // bytes
+	refundK1Len = 32 // bytes
+)
+
+// Ways refunds can be paid
+const (
+	// Customer's bolt11 invoice is paid
+	RefundLn = "ln"
+
+	// Customer withdraws the refund with their wallet, using LNURL-withdraw link issued by invoicer
+	RefundLnurl = "lnurl"
+
+	// Refund is sent to customer's Bitcoin address
+	RefundOnChain = "onchain"
+)
+
+// Refund states
+const (
+	// Being paid, or (LNURL-withdraw) waiting for customer to withdraw
+	RefundPending = "pending"
+
+	RefundSucceeded = "succeeded"
+	RefundFailed    = "failed"
+
+	// Payment was attempted, but lnd didn't say whether it went through (ex. connection was lost while it was in
+	// flight).  Has to be checked in lnd.
+	RefundUnknown = "unknown"
+)
+
+// Refund returns (a part of) funds received for a payment.  Refunds of a payment that didn't fail can't add up to
+// more than it has received.
+type Refund struct {
+	ID        string `json:"id"`
+	PaymentID string `json:"payment_id"`
+	Method    string `json:"method" doc:"One of: ln, lnurl, or onchain"`
+	Status    string `json:"status" doc:"One of: pending, succeeded, failed, or unknown"`
+	Reason    string `json:"reason,omitempty"`
+
+	// Amount in satoshis received by the customer, and fees paid by invoicer on top of it
+	Amount int64 `json:"amount"`
+	Fee    int64 `json:"fee"`
+
+	// `ln` only
+	Bolt11   string `json:"bolt11,omitempty"`
+	Preimage string `json:"preimage,omitempty"`
+
+	// `onchain` only
+	Address string `json:"address,omitempty"`
+	TxID    string `json:"txid,omitempty"`
+
+	// `lnurl` only.  Link is only returned once, when the refund is created, as anyone who has it can withdraw
+	// the refund.  Only a hash of its secret `k1` is stored.
+	LNURL  string `json:"lnurl,omitempty" doc:"LNURL-withdraw link to pass to the customer"`
+	K1Hash string `json:"k1_hash,omitempty"`
+
+	Error string `json:"error,omitempty" doc:"Set if the refund failed, or its outcome is unknown"`
+
+	// Unix timestamps
+	CreatedAt   int64 `json:"created_at"`
+	CompletedAt int64 `json:"completed_at,omitempty"`
+}
+
+// NewRefundID returns a random, unique ID of a refund
+func NewRefundID() (string, error) {
+	return randomID(RefundIDPrefix, refundIDLen)
+}
+
+// NewRefundK1 returns secret identifying LNURL-withdraw refund, and its hash to be stored
+func NewRefundK1() (k1, hash string, err error) {
+	k1, err = randomID("", refundK1Len)
+	if err != nil {
+		return "", "", err
+	}
+
+	return k1, HashRefundK1(k1), nil
+}
+
+func HashRefundK1(k1 string) string {
+	sum := sha256.Sum256([]byte(k1))
+	return hex.EncodeToString(sum[:])
+}
+
+// Counts returns false for refunds that failed, and so don't count towards the refunded amount.  Ones with unknown
+// outcome do, as they might've been paid.
+func (r Refund) Counts() bool {
+	return r.Status != RefundFailed
+}
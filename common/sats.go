@@ -0,0 +1,102 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const satsPerBtc = 100000000
+
+// ErrInvalidAmount is returned when a BTC amount can't be represented in whole satoshis
+var ErrInvalidAmount = errors.New("invalid BTC amount")
+
+// Sats is an amount in satoshis.  In JSON it's a BTC decimal (ex. `0.0001`), the way bitcoind uses, and it's
+// parsed exactly, without going through float64.
+type Sats int64
+
+// ParseSats parses a BTC decimal, ex. `0.00010000`, into satoshis.  More than 8 decimal places are only accepted if
+// they're all zeros.
+func ParseSats(s string) (Sats, error) {
+	invalid := fmt.Errorf("%q: %w", s, ErrInvalidAmount)
+
+	negative := strings.HasPrefix(s, "-")
+	whole, frac := strings.TrimPrefix(s, "-"), ""
+	if i := strings.IndexByte(whole, '.'); i >= 0 {
+		whole, frac = whole[:i], whole[i+1:]
+	}
+
+	if whole == "" || !isDigits(whole) || !isDigits(frac) {
+		return 0, invalid
+	}
+
+	if len(frac) > 8 {
+		if strings.Trim(frac[8:], "0") != "" {
+			return 0, invalid
+		}
+
+		frac = frac[:8]
+	}
+
+	btc, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || btc > (1<<63-1)/satsPerBtc {
+		return 0, invalid
+	}
+
+	var sats int64
+	if frac != "" {
+		sats, _ = strconv.ParseInt(frac+strings.Repeat("0", 8-len(frac)), 10, 64)
+	}
+
+	total := btc*satsPerBtc + sats
+	if negative {
+		total = -total
+	}
+
+	return Sats(total), nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// String returns amount as a BTC decimal without trailing zeros, ex. `0.0001`
+func (s Sats) String() string {
+	sign, abs := "", int64(s)
+	if abs < 0 {
+		sign, abs = "-", -abs
+	}
+
+	frac := strings.TrimRight(fmt.Sprintf("%08d", abs%satsPerBtc), "0")
+	if frac == "" {
+		return fmt.Sprintf("%s%d", sign, abs/satsPerBtc)
+	}
+
+	return fmt.Sprintf("%s%d.%s", sign, abs/satsPerBtc, frac)
+}
+
+func (s Sats) MarshalJSON() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *Sats) UnmarshalJSON(data []byte) (err error) {
+	*s, err = ParseSats(string(data))
+	return
+}
+
+// MsatToSat returns `msat` in whole satoshis, rounded up, as that's the least that can be paid on-chain
+func MsatToSat(msat int64) int64 {
+	return (msat + 999) / 1000
+}
+
+// OpenAPIType tells OpenAPI document generator that, in JSON, Sats is a decimal number
+func (Sats) OpenAPIType() string {
+	return "number"
+}
@@ -0,0 +1,74 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseSats(t *testing.T) {
+	for _, tc := range []struct {
+		in       string
+		expected Sats
+		err      bool
+	}{
+		{"0", 0, false},
+		{"0.0001", 10000, false},
+		{"0.00010000", 10000, false},
+		{"0.00000001", 1, false},
+		{"1", 100000000, false},
+		{"1.5", 150000000, false},
+		{"21000000.00000000", 2100000000000000, false},
+		{"0.29", 29000000, false}, // 0.29 * 1e8 is 28999999.999999996 as float64
+		{"0.000000010", 1, false},
+		{"-0.0001", -10000, false},
+		{"0.000000001", 0, true},
+		{"1e-4", 0, true},
+		{".5", 0, true},
+		{"", 0, true},
+		{"abc", 0, true},
+		{"1.2.3", 0, true},
+		{"99999999999999999999", 0, true},
+	} {
+		sats, err := ParseSats(tc.in)
+		if tc.err {
+			if !errors.Is(err, ErrInvalidAmount) {
+				t.Errorf("ParseSats(%q) should fail, got %d, %v", tc.in, sats, err)
+			}
+
+			continue
+		}
+
+		if err != nil || sats != tc.expected {
+			t.Errorf("ParseSats(%q) = %d, %v, expected %d", tc.in, sats, err, tc.expected)
+		}
+	}
+}
+
+func TestSatsJSON(t *testing.T) {
+	for sats, expected := range map[Sats]string{
+		0:         "0",
+		1:         "0.00000001",
+		10000:     "0.0001",
+		100000000: "1",
+		150000000: "1.5",
+		-10000:    "-0.0001",
+	} {
+		out, err := json.Marshal(sats)
+		if err != nil || string(out) != expected {
+			t.Errorf("json.Marshal(%d) = %s, %v, expected %s", sats, out, err, expected)
+		}
+
+		var parsed Sats
+		if err := json.Unmarshal(out, &parsed); err != nil || parsed != sats {
+			t.Errorf("json.Unmarshal(%s) = %d, %v, expected %d", out, parsed, err, sats)
+		}
+	}
+
+	// as returned by bitcoind's `listreceivedbyaddress`
+	var statuses AddrsStatus
+	err := json.Unmarshal([]byte(`[{"address": "bc1q", "amount": 0.00029000, "confirmations": 1, "label": "", "txids": []}]`), &statuses)
+	if err != nil || statuses[0].Amount != 29000 {
+		t.Errorf("unexpected statuses: %+v, %v", statuses, err)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pelletier/go-toml"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/lncm/invoicer/common"
+)
+
+const (
+	DefaultInvoicerPort    = 8080
+	DefaultShutdownTimeout = 30 // seconds
+)
+
+var (
+	// Only requests from these are allowed to pass client IP in headers
+	DefaultTrustedProxies = []string{"127.0.0.1", "::1"}
+
+	// Guards settings that can be changed on reload.  These have to be read via `currentConf()`.
+	confMu sync.RWMutex
+
+	// Makes sure only one reload happens at a time
+	reloadMu sync.Mutex
+)
+
+// configFileDefault returns config file location set via `INVOICER_CONFIG`, or the default one
+func configFileDefault() string {
+	if path, ok := os.LookupEnv(common.EnvName("config")); ok {
+		return path
+	}
+
+	return common.DefaultConfigFile
+}
+
+// loadConfig reads, validates, and fills defaults of the config file at `filePath`.  Problems that don't prevent
+// invoicer from running are only logged.
+func loadConfig(filePath string) (c common.Config, err error) {
+	c, tree, err := parseConfig(filePath)
+	if err != nil {
+		return c, err
+	}
+
+	checks := configError{file: filePath, tree: tree, problems: checkValues(c)}
+	checks.logWarnings()
+
+	if len(checks.errors()) > 0 {
+		return c, checks
+	}
+
+	return c, nil
+}
+
+// parseConfig reads config file at `filePath`, applies env overrides, and fills defaults.  Unknown keys, and
+// values of wrong types are returned as `configError`.
+func parseConfig(filePath string) (c common.Config, tree *toml.Tree, err error) {
+	// Expand configFile file path and load it
+	tree, err = toml.LoadFile(common.CleanAndExpandPath(filePath))
+	if err != nil {
+		tree, err = common.DeprecatedConfigLocationCheck(filePath, err)
+		switch {
+		case err == nil:
+			log.Warningln("WARNING: Default config location (~/.invoicer/) has been changed to ~/.lncm/ !\n" +
+				"\tPlease rename it, as future versions will no longer check for the config file there.")
+
+		// No config file in the default location is fine, if everything is set via environment variables
+		case errors.Is(err, os.ErrNotExist) && filePath == common.DefaultConfigFile:
+			log.Warningf("config file %s not found.  Using environment variables, and defaults only", filePath)
+
+			tree, err = toml.TreeFromMap(map[string]interface{}{})
+			if err != nil {
+				return c, nil, err
+			}
+
+		default:
+			return c, nil, fmt.Errorf("unable to load %s:\n\t%w", filePath, err)
+		}
+	}
+
+	// Catch typos, and leftovers that would otherwise be silently ignored
+	problems := checkKeys(tree, reflect.TypeOf(c), "")
+	if len(problems) > 0 {
+		return c, tree, configError{file: filePath, tree: tree, problems: problems}
+	}
+
+	// Try to understand the config file
+	err = tree.Unmarshal(&c)
+	if err != nil {
+		return c, tree, fmt.Errorf("unable to process %s:\n\t%w", filePath, err)
+	}
+
+	// Precedence is: config file < `*-file` options < `INVOICER_*_FILE` env vars < `INVOICER_*` env vars
+	err = common.ResolveSecretFiles(&c)
+	if err != nil {
+		return c, tree, fmt.Errorf("unable to read secret file:\n\t%w", err)
+	}
+
+	err = common.ApplyEnv(&c)
+	if err != nil {
+		return c, tree, fmt.Errorf("invalid environment variable:\n\t%w", err)
+	}
+
+	if c.TrustedProxies == nil {
+		c.TrustedProxies = DefaultTrustedProxies
+	}
+
+	if c.Port == 0 {
+		c.Port = DefaultInvoicerPort
+	}
+
+	if c.LogFile == "" {
+		c.LogFile = common.DefaultLogFile
+	}
+
+	if c.DataFile == "" {
+		c.DataFile = common.DefaultDataFile
+	}
+
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = DefaultShutdownTimeout
+	}
+
+	if c.IdempotencyWindow == 0 {
+		c.IdempotencyWindow = common.DefaultInvoiceExpiry
+	}
+
+	for i := range c.Links {
+		c.Links[i].FromConfig = true
+	}
+
+	return c, tree, nil
+}
+
+// currentConf returns a copy of the current config.  Settings that can be changed on reload have to be read
+// this way.
+func currentConf() common.Config {
+	confMu.RLock()
+	defer confMu.RUnlock()
+
+	return conf
+}
+
+// restartRequired lists settings that differ between `a`, and `b`, but can't be changed without a restart
+func restartRequired(a, b common.Config) (changed []string) {
+	for key, values := range map[string][2]interface{}{
+		"port":            {a.Port, b.Port},
+		"ln-client":       {a.LnClient, b.LnClient},
+		"off-chain-only":  {a.OffChainOnly, b.OffChainOnly},
+		"metrics":         {a.Metrics, b.Metrics},
+		"swagger-ui":      {a.SwaggerUI, b.SwaggerUI},
+		"trusted-proxies": {a.TrustedProxies, b.TrustedProxies},
+		"data-file":       {a.DataFile, b.DataFile},
+		"tls":             {a.TLS, b.TLS},
+		"fiat":            {a.Fiat, b.Fiat},
+		"webhook":         {a.Webhook, b.Webhook},
+		"bitcoind":        {a.Bitcoind, b.Bitcoind},
+		"lnd":             {a.Lnd, b.Lnd},
+	} {
+		if !reflect.DeepEqual(values[0], values[1]) {
+			changed = append(changed, key)
+		}
+	}
+
+	return
+}
+
+// reloadConfig re-reads the config file, and applies all settings that can be changed at runtime.  Changes to
+// the ones requiring a restart are ignored, and returned.
+func reloadConfig() (ignored []string, err error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	newConf, err := loadConfig(*configFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	ignored = restartRequired(conf, newConf)
+	if len(ignored) > 0 {
+		log.WithField("keys", ignored).Warningln("changes to these settings require a restart, and were not applied")
+	}
+
+	confMu.Lock()
+	logFileChanged := conf.LogFile != newConf.LogFile
+
+	conf.StaticDir = newConf.StaticDir
+	conf.LogFile = newConf.LogFile
+	conf.ShutdownTimeout = newConf.ShutdownTimeout
+	conf.IdempotencyWindow = newConf.IdempotencyWindow
+	conf.OnChain = newConf.OnChain
+	conf.LatePaymentGrace = newConf.LatePaymentGrace
+	conf.Links = newConf.Links
+	conf.RateLimit = newConf.RateLimit
+	conf.Auth = newConf.Auth
+	conf.Users = newConf.Users
+	confMu.Unlock()
+
+	ipLimiter.SetLimit(newConf.RateLimit.PerIP, newConf.RateLimit.PerIPBurst)
+	keyLimiter.SetLimit(newConf.RateLimit.PerKey, newConf.RateLimit.PerKeyBurst)
+
+	if logFileChanged {
+		setLogOutput(newConf.LogFile)
+	}
+
+	log.WithField("conf-file", *configFilePath).Println("config reloaded")
+
+	return ignored, nil
+}
+
+// setLogOutput redirects all logging to `logFilePath` (in JSON), or to stdout if it's `none`
+func setLogOutput(logFilePath string) {
+	prevLogFile := logFile
+
+	if logFilePath == "none" {
+		logFile = nil
+
+		log.SetOutput(gin.DefaultWriter)
+		log.SetFormatter(&log.TextFormatter{
+			FullTimestamp: true,
+		})
+	} else {
+		logFile = &lumberjack.Logger{
+			Filename:  common.CleanAndExpandPath(logFilePath),
+			LocalTime: true,
+			Compress:  true,
+		}
+
+		log.SetOutput(logFile)
+		log.SetFormatter(&log.JSONFormatter{
+			PrettyPrint: false, // Having `false` here makes sure that `jq` always works on `tail -f`.
+		})
+	}
+
+	if prevLogFile != nil {
+		_ = prevLogFile.Close()
+	}
+}
+
+// index serves `index.html` from `static-dir`, if set
+func index(c *gin.Context) {
+	staticDir := currentConf().StaticDir
+	if staticDir == "" {
+		c.AbortWithStatus(404)
+		return
+	}
+
+	c.File(path.Join(staticDir, "index.html"))
+}
+
+type reloadReply struct {
+	Reloaded bool     `json:"reloaded"`
+	Ignored  []string `json:"ignored,omitempty" doc:"Changed settings that require a restart"`
+}
+
+func reload(c *gin.Context) {
+	ignored, err := reloadConfig()
+	if err != nil {
+		replyStatus(c, common.StatusReply{
+			Code:  400,
+			Error: fmt.Errorf("config not reloaded: %w", err).Error(),
+		})
+		return
+	}
+
+	c.JSON(200, reloadReply{
+		Reloaded: true,
+		Ignored:  ignored,
+	})
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/macaroon.v2"
+
+	"github.com/lncm/invoicer/bitcoind"
+	"github.com/lncm/invoicer/common"
+	"github.com/lncm/invoicer/ln"
+)
+
+type (
+	// configProblem is a single issue with the config, pointing at the offending key
+	configProblem struct {
+		key string
+		msg string
+
+		// Warnings don't prevent invoicer from starting (ex. macaroons lnd hasn't created yet)
+		warning bool
+
+		// Set for keys `tree` can't locate on its own, ex. in arrays of tables
+		line int
+	}
+
+	// configError lists all problems found in a config file.  `tree` is used to point at lines of offending keys.
+	configError struct {
+		file     string
+		tree     *toml.Tree
+		problems []configProblem
+	}
+)
+
+func problemf(key, format string, args ...interface{}) configProblem {
+	return configProblem{key: key, msg: fmt.Sprintf(format, args...)}
+}
+
+func warningf(key, format string, args ...interface{}) configProblem {
+	return configProblem{key: key, msg: fmt.Sprintf(format, args...), warning: true}
+}
+
+// describe returns problem prefixed with the location of its key, ex: `invoicer.conf:12: bitcoind.port: …`
+func (e configError) describe(p configProblem) string {
+	location := e.file
+
+	switch {
+	case p.line > 0:
+		location = fmt.Sprintf("%s:%d", e.file, p.line)
+
+	case e.tree != nil:
+		if pos := e.tree.GetPosition(p.key); !pos.Invalid() {
+			location = fmt.Sprintf("%s:%d", e.file, pos.Line)
+		}
+	}
+
+	msg := fmt.Sprintf("%s: %s: %s", location, p.key, p.msg)
+
+	// Value not coming from the config file is likely set via env
+	if name := common.EnvName(strings.Split(p.key, ".")...); os.Getenv(name) != "" {
+		msg += fmt.Sprintf(" (set via %s)", name)
+	}
+
+	return msg
+}
+
+// errors returns only the problems that are not warnings
+func (e configError) errors() (errs []configProblem) {
+	for _, p := range e.problems {
+		if !p.warning {
+			errs = append(errs, p)
+		}
+	}
+
+	return errs
+}
+
+func (e configError) Error() string {
+	var lines []string
+	for _, p := range e.errors() {
+		lines = append(lines, e.describe(p))
+	}
+
+	return fmt.Sprintf("invalid config:\n\t%s", strings.Join(lines, "\n\t"))
+}
+
+// logWarnings logs all problems that don't prevent invoicer from running
+func (e configError) logWarnings() {
+	for _, p := range e.problems {
+		if p.warning {
+			log.Warningln(e.describe(p))
+		}
+	}
+}
+
+// checkKeys reports keys in `tree` that don't exist in `t`, or have values of a wrong type
+func checkKeys(tree *toml.Tree, t reflect.Type, prefix string) (problems []configProblem) {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		if key := t.Field(i).Tag.Get("toml"); key != "" && key != "-" {
+			fields[key] = t.Field(i)
+		}
+	}
+
+	// Report problems in the order they appear in the file
+	keys := tree.Keys()
+	sort.Slice(keys, func(i, j int) bool {
+		return tree.GetPosition(keys[i]).Line < tree.GetPosition(keys[j]).Line
+	})
+
+	for _, key := range keys {
+		path := prefix + key
+		value := tree.Get(key)
+
+		field, ok := fields[key]
+		if !ok {
+			problems = append(problems, problemf(path, "unknown key"))
+			continue
+		}
+
+		if expected, ok := checkType(field.Type, value); !ok {
+			problems = append(problems, problemf(path, "expected %s, got %s", expected, tomlType(value)))
+			continue
+		}
+
+		switch field.Type.Kind() {
+		case reflect.Struct:
+			problems = append(problems, checkKeys(value.(*toml.Tree), field.Type, path+".")...)
+
+		case reflect.Slice:
+			tables, _ := value.([]*toml.Tree)
+			for i, table := range tables {
+				tablePrefix := fmt.Sprintf("%s[%d].", path, i)
+
+				for _, p := range checkKeys(table, field.Type.Elem(), tablePrefix) {
+					if p.line == 0 {
+						p.line = table.GetPosition(strings.TrimPrefix(p.key, tablePrefix)).Line
+					}
+
+					problems = append(problems, p)
+				}
+			}
+
+		case reflect.Map:
+			sub := value.(*toml.Tree)
+			for _, k := range sub.Keys() {
+				if _, ok := sub.Get(k).(string); !ok {
+					problems = append(problems, problemf(path+"."+k, "expected string, got %s", tomlType(sub.Get(k))))
+				}
+			}
+		}
+	}
+
+	return problems
+}
+
+// checkType returns whether `value` can be stored in a field of type `t`, and name of the expected type
+func checkType(t reflect.Type, value interface{}) (string, bool) {
+	switch t.Kind() {
+	case reflect.String:
+		_, ok := value.(string)
+		return "string", ok
+
+	case reflect.Bool:
+		_, ok := value.(bool)
+		return "boolean", ok
+
+	case reflect.Int, reflect.Int64:
+		_, ok := value.(int64)
+		return "integer", ok
+
+	case reflect.Float64:
+		switch value.(type) {
+		case float64, int64:
+			return "number", true
+		}
+
+		return "number", false
+
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Struct {
+			_, ok := value.([]*toml.Tree)
+			return "array of tables", ok
+		}
+
+		list, ok := value.([]interface{})
+		for _, item := range list {
+			if _, isString := item.(string); !isString {
+				ok = false
+			}
+		}
+
+		return "list of strings", ok
+
+	case reflect.Struct, reflect.Map:
+		_, ok := value.(*toml.Tree)
+		return "table", ok
+	}
+
+	return t.String(), false
+}
+
+func tomlType(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case int64:
+		return "integer"
+	case float64:
+		return "float"
+	case []interface{}:
+		return "list"
+	case *toml.Tree:
+		return "table"
+	case []*toml.Tree:
+		return "array of tables"
+	}
+
+	return fmt.Sprintf("%T", value)
+}
+
+// checkValues reports values that are invalid, or point at files that can't be used
+func checkValues(c common.Config) (problems []configProblem) {
+	checkPort := func(key string, port int64) {
+		if port < 0 || port > 65535 {
+			problems = append(problems, problemf(key, "%d is not a valid port", port))
+		}
+	}
+
+	checkPort("port", c.Port)
+	checkPort("bitcoind.port", c.Bitcoind.Port)
+	checkPort("lnd.port", c.Lnd.Port)
+
+	if c.IdempotencyWindow < 0 {
+		problems = append(problems, problemf("idempotency-window", "can't be negative"))
+	}
+
+	if c.OnChain.TolerancePercent < 0 || c.OnChain.TolerancePercent >= 100 {
+		problems = append(problems, problemf("on-chain.tolerance-percent", "has to be between 0, and 100"))
+	}
+
+	if c.OnChain.ToleranceSats < 0 {
+		problems = append(problems, problemf("on-chain.tolerance-sats", "can't be negative"))
+	}
+
+	if c.LatePaymentGrace < 0 {
+		problems = append(problems, problemf("late-payment-grace", "can't be negative"))
+	}
+
+	if c.Webhook.URL != "" {
+		u, err := url.Parse(c.Webhook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, problemf("webhook.url", "%q is not an http(s) URL", c.Webhook.URL))
+		}
+	}
+
+	slugs := make(map[string]bool, len(c.Links))
+	for i, l := range c.Links {
+		key := fmt.Sprintf("links[%d]", i)
+
+		if err := l.Validate(); err != nil {
+			problems = append(problems, problemf(key, "%v", err))
+		}
+
+		if slugs[l.Slug] {
+			problems = append(problems, problemf(key, "slug %q is used more than once", l.Slug))
+		}
+
+		slugs[l.Slug] = true
+	}
+
+	if c.LnClient != "" && c.LnClient != "lnd" {
+		problems = append(problems, problemf("ln-client", "%q is not supported.  Only `lnd` is", c.LnClient))
+	}
+
+	for _, scope := range c.Auth.Require {
+		if scope != common.ScopeCreatePayment && scope != common.ScopeReadStatus {
+			problems = append(problems, problemf("auth.require", "invalid scope %q.  Only `%s`, and `%s` can be listed",
+				scope, common.ScopeCreatePayment, common.ScopeReadStatus))
+		}
+	}
+
+	for _, proxy := range c.TrustedProxies {
+		_, _, cidrErr := net.ParseCIDR(proxy)
+		if cidrErr != nil && net.ParseIP(proxy) == nil {
+			problems = append(problems, problemf("trusted-proxies", "%q is neither an IP, nor CIDR", proxy))
+		}
+	}
+
+	if c.StaticDir != "" {
+		if info, err := os.Stat(c.StaticDir); err != nil || !info.IsDir() {
+			problems = append(problems, warningf("static-dir", "%s is not a directory", c.StaticDir))
+		}
+	}
+
+	// lnd creates its cert, and macaroons on its own, so missing ones might still show up later
+	lndFiles := []struct{ key, path, def string }{
+		{"lnd.tls", c.Lnd.TLS, ln.DefaultTLS},
+		{"lnd.macaroon.invoice", c.Lnd.Macaroons.Invoice, ln.DefaultInvoice},
+		{"lnd.macaroon.readonly", c.Lnd.Macaroons.ReadOnly, ln.DefaultReadOnly},
+	}
+
+	// admin macaroon is optional, as it's only needed for refunds
+	if c.Lnd.Macaroons.Admin != "" {
+		lndFiles = append(lndFiles, struct{ key, path, def string }{"lnd.macaroon.admin", c.Lnd.Macaroons.Admin, ""})
+	}
+
+	for _, f := range lndFiles {
+		if f.path == "" {
+			f.path = f.def
+		}
+
+		content, err := ioutil.ReadFile(common.CleanAndExpandPath(f.path))
+		switch {
+		case os.IsNotExist(err):
+			problems = append(problems, warningf(f.key, "%s doesn't exist (yet)", f.path))
+
+		case err != nil:
+			problems = append(problems, problemf(f.key, "unable to read: %v", err))
+
+		case f.key == "lnd.tls":
+			if !x509.NewCertPool().AppendCertsFromPEM(content) {
+				problems = append(problems, problemf(f.key, "%s is not a PEM certificate", f.path))
+			}
+
+		default:
+			if err := (&macaroon.Macaroon{}).UnmarshalBinary(content); err != nil {
+				problems = append(problems, problemf(f.key, "%s is not a valid macaroon: %v", f.path, err))
+			}
+		}
+	}
+
+	if !c.OffChainOnly && c.Bitcoind.Cookie != "" {
+		_, err := ioutil.ReadFile(common.CleanAndExpandPath(c.Bitcoind.Cookie))
+		switch {
+		case os.IsNotExist(err):
+			problems = append(problems, warningf("bitcoind.cookie", "%s doesn't exist (yet)", c.Bitcoind.Cookie))
+
+		case err != nil:
+			problems = append(problems, problemf("bitcoind.cookie", "unable to read: %v", err))
+		}
+	}
+
+	certFiles := []struct{ key, path string }{
+		{"bitcoind.tls-cert", c.Bitcoind.TLSCert},
+		{"tls.client-ca", c.TLS.ClientCA},
+	}
+
+	for _, f := range certFiles {
+		if f.path == "" {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(common.CleanAndExpandPath(f.path))
+		if err != nil {
+			problems = append(problems, problemf(f.key, "unable to read: %v", err))
+			continue
+		}
+
+		if !x509.NewCertPool().AppendCertsFromPEM(content) {
+			problems = append(problems, problemf(f.key, "%s is not a PEM certificate", f.path))
+		}
+	}
+
+	if c.TLS.Enabled {
+		problems = append(problems, checkTLSFiles(c.TLS)...)
+	}
+
+	return problems
+}
+
+// checkTLSFiles makes sure invoicer's own cert, and key are either both usable, or both missing (and generated)
+func checkTLSFiles(c common.TLS) []configProblem {
+	if c.Cert == "" {
+		c.Cert = DefaultTLSCert
+	}
+
+	if c.Key == "" {
+		c.Key = DefaultTLSKey
+	}
+
+	cert, key := common.CleanAndExpandPath(c.Cert), common.CleanAndExpandPath(c.Key)
+
+	certExists, keyExists := fileExists(cert), fileExists(key)
+	switch {
+	case !certExists && !keyExists:
+		return nil
+
+	case !certExists:
+		return []configProblem{problemf("tls.cert", "%s doesn't exist, but key does", c.Cert)}
+
+	case !keyExists:
+		return []configProblem{problemf("tls.key", "%s doesn't exist, but cert does", c.Key)}
+	}
+
+	_, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return []configProblem{problemf("tls.cert", "unable to load cert, and key: %v", err)}
+	}
+
+	return nil
+}
+
+// checkPortFree reports if invoicer's port is already taken by something else
+func checkPortFree(c common.Config) []configProblem {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", c.Port))
+	if err != nil {
+		return []configProblem{problemf("port", "%d can't be used: %v", c.Port, err)}
+	}
+
+	_ = l.Close()
+
+	return nil
+}
+
+// checkBackends reports backends that can't be reached with the provided config
+func checkBackends(c common.Config) (problems []configProblem) {
+	lnd, err := ln.Start(c.Lnd)
+	if err != nil {
+		problems = append(problems, problemf("lnd", "%v", err))
+	} else {
+		if !lnd.Ready() {
+			problems = append(problems, problemf("lnd.host", "lnd unreachable: %s", lnd.Health().Error))
+		}
+
+		_ = lnd.Close()
+	}
+
+	if c.OffChainOnly {
+		return problems
+	}
+
+	btc, err := bitcoind.New(c.Bitcoind)
+	if err != nil {
+		return append(problems, problemf("bitcoind", "%v", err))
+	}
+
+	if !btc.Ready() {
+		problems = append(problems, problemf("bitcoind.host", "bitcoind unreachable: %s", btc.Health().Error))
+	}
+
+	return problems
+}
+
+// checkConfigCommand validates config, checks if invoicer's port is free, and if backends are reachable.  All
+// problems found are printed.
+func checkConfigCommand(args []string) error {
+	fs := flag.NewFlagSet("check-config", flag.ExitOnError)
+	_ = fs.Parse(args)
+
+	filePath := *configFilePath
+
+	// Backend clients log their own failures, which are reported below anyway
+	log.SetLevel(log.ErrorLevel)
+
+	c, tree, err := parseConfig(filePath)
+
+	checks, ok := err.(configError)
+	switch {
+	case ok:
+		// Unknown keys, or values of wrong types are listed below
+
+	case err != nil:
+		return err
+
+	default:
+		checks = configError{file: filePath, tree: tree, problems: checkValues(c)}
+		if len(checks.errors()) == 0 {
+			checks.problems = append(checks.problems, checkPortFree(c)...)
+			checks.problems = append(checks.problems, checkBackends(c)...)
+		}
+	}
+
+	for _, p := range checks.problems {
+		prefix := "error:  "
+		if p.warning {
+			prefix = "warning:"
+		}
+
+		fmt.Println(prefix, checks.describe(p))
+	}
+
+	if n := len(checks.errors()); n > 0 {
+		return fmt.Errorf("%d problem(s) found in %s", n, filePath)
+	}
+
+	fmt.Println("config OK")
+	return nil
+}
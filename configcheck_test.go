@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pelletier/go-toml"
+
+	"github.com/lncm/invoicer/common"
+)
+
+func TestExampleConfigValid(t *testing.T) {
+	tree, err := toml.LoadFile("invoicer.example.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range checkKeys(tree, reflect.TypeOf(common.Config{}), "") {
+		t.Errorf("invoicer.example.conf: %s: %s", p.key, p.msg)
+	}
+}
+
+func TestCheckKeys(t *testing.T) {
+	tree, err := toml.Load(`
+port = "8080"
+kill-count = 4
+trusted-proxies = ["127.0.0.1"]
+
+[lnd]
+host = "localhost"
+kill-count = 4
+
+[rate-limit]
+per-ip = 1.5
+
+[users]
+alice = 1
+
+[on-chain]
+tolerance-percent = 1
+tolerance-sats = 0.5
+
+[[links]]
+slug = "coffee"
+amount = 1000
+
+[[links]]
+slug = "tea"
+kill-count = 4
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int{
+		"port":                    2,
+		"kill-count":              3,
+		"lnd.kill-count":          8,
+		"rate-limit.per-ip":       11,
+		"users.alice":             14,
+		"on-chain.tolerance-sats": 18,
+		"links[1].kill-count":     26,
+	}
+
+	problems := checkKeys(tree, reflect.TypeOf(common.Config{}), "")
+	if len(problems) != len(want) {
+		t.Fatalf("expected %d problems, got %d: %v", len(want), len(problems), problems)
+	}
+
+	for _, p := range problems {
+		line, ok := want[p.key]
+		if !ok {
+			t.Errorf("unexpected problem with %s: %s", p.key, p.msg)
+			continue
+		}
+
+		actual := p.line
+		if actual == 0 {
+			actual = tree.GetPosition(p.key).Line
+		}
+
+		if actual != line {
+			t.Errorf("%s: expected line %d, got %d", p.key, line, actual)
+		}
+	}
+}
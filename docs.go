@@ -0,0 +1,472 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"path"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/lncm/invoicer/common"
+	"github.com/lncm/invoicer/lnurl"
+	"github.com/lncm/invoicer/openapi"
+	"github.com/lncm/invoicer/swaggerui"
+)
+
+// Swagger UI is bundled with invoicer, and served from `/api/docs/`, so that nothing is loaded from third-party
+// origins.  There are no inline scripts, so that the page works under a strict Content-Security-Policy.
+var swaggerUIPage = `<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>invoicer API</title>
+	<link rel="stylesheet" href="docs/swagger-ui.css?v=` + swaggerui.Version + `">
+</head>
+<body>
+	<div id="swagger-ui"></div>
+	<script src="docs/swagger-ui-bundle.js?v=` + swaggerui.Version + `"></script>
+	<script src="docs/` + swaggerUIInitFile + `"></script>
+</body>
+</html>
+`
+
+const (
+	swaggerUIInitFile = "init.js"
+	swaggerUIInit     = `SwaggerUIBundle({url: "openapi.json", dom_id: "#swagger-ui"});`
+)
+
+var securitySchemes = map[string]openapi.SecurityScheme{
+	"bearer": {Type: "http", Scheme: "bearer", Description: "API key created with `invoicer apikey add`"},
+	"apiKey": {Type: "apiKey", In: "header", Name: "X-Api-Key", Description: "API key created with `invoicer apikey add`"},
+	"basic":  {Type: "http", Scheme: "basic", Description: "Deprecated `[users]` credentials.  Only grant access to history."},
+}
+
+// security returns security requirements of routes guarded by `scope`.  Scopes that aren't required (see
+// `[auth]`) can also be accessed anonymously.
+func security(scope string) []map[string][]string {
+	reqs := []map[string][]string{{"bearer": {}}, {"apiKey": {}}}
+
+	if scope == common.ScopeReadHistory {
+		reqs = append(reqs, map[string][]string{"basic": {}})
+	}
+
+	if scope != "" && !isScopeRequired(scope) {
+		reqs = append(reqs, map[string][]string{})
+	}
+
+	return reqs
+}
+
+func errorReplies(codes ...int) map[int]openapi.Response {
+	descriptions := map[int]string{
+		400: "Invalid request",
+		401: "Missing, or invalid API key",
+		403: "API key lacks the required scope",
+		404: "Not found",
+		409: "Request with the same idempotency key is still being processed",
+		422: "Idempotency key was already used with a different request",
+		429: "Rate limit exceeded.  See `Retry-After` header",
+		500: "Unexpected error",
+		503: "Backend needed to fulfil the request is unavailable.  See `Retry-After` header",
+	}
+
+	replies := make(map[int]openapi.Response)
+	for _, code := range codes {
+		replies[code] = openapi.Response{Description: descriptions[code], Body: common.StatusReply{}}
+	}
+
+	return replies
+}
+
+// v2ErrorReplies is `errorReplies()` for `/api/v2`
+func v2ErrorReplies(codes ...int) map[int]openapi.Response {
+	replies := errorReplies(codes...)
+	for code, r := range replies {
+		r.Body = errorReply{}
+		replies[code] = r
+	}
+
+	return replies
+}
+
+func withReplies(replies map[int]openapi.Response, extra map[int]openapi.Response) map[int]openapi.Response {
+	for code, r := range extra {
+		replies[code] = r
+	}
+
+	return replies
+}
+
+var paymentHeaders = map[string]string{
+	idempotencyHeader: "Repeated requests with the same key (within `idempotency-window`) return the original payment with `" +
+		replayedHeader + ": true` header, instead of creating a new one",
+}
+
+// apiOperations describes all routes `newRouter()` defines with config `c`
+func apiOperations(c common.Config) []openapi.Operation {
+	ops := []openapi.Operation{{
+		Method:    "GET",
+		Path:      "/healthz",
+		Summary:   "Liveness, and health of backends",
+		Tags:      []string{"health"},
+		Responses: map[int]openapi.Response{200: {Description: "Always", Body: common.Health{}}},
+	}, {
+		Method:  "GET",
+		Path:    "/readyz",
+		Summary: "Readiness to accept payments",
+		Tags:    []string{"health"},
+		Responses: map[int]openapi.Response{
+			200: {Description: "Ready", Body: common.Health{}},
+			503: {Description: "lnd is unavailable", Body: common.Health{}},
+		},
+	}, {
+		Method:      "POST",
+		Path:        "/api/payment",
+		Summary:     "Create a new payment",
+		Description: "Requests without an API key may need to pass a proof-of-work (`X-Pow-Challenge`, `X-Pow-Nonce`), or captcha (`X-Captcha-Token`)",
+		Tags:        []string{"payments"},
+		Headers:     paymentHeaders,
+		Body:        paymentRequest{},
+		Security:    security(common.ScopeCreatePayment),
+		Responses: withReplies(errorReplies(400, 401, 403, 409, 422, 429, 500, 503), map[int]openapi.Response{
+			200: {Description: "Payment created", Body: common.NewPayment{}},
+		}),
+	}, {
+		Method:      "GET",
+		Path:        "/api/payment",
+		Summary:     "Wait for a payment",
+		Description: "Long-poll returning once the payment is paid, or expires.  At least one of `hash`, or `address` is required.",
+		Tags:        []string{"payments"},
+		Query:       statusQuery{},
+		Security:    security(common.ScopeReadStatus),
+		Responses: withReplies(errorReplies(400, 401, 403, 429, 503), map[int]openapi.Response{
+			200: {Description: "Paid", Body: common.StatusReply{}},
+			202: {Description: "Paid more than requested on-chain", Body: common.StatusReply{}},
+			402: {Description: "Paid less than requested on-chain", Body: common.StatusReply{}},
+			408: {Description: "Expired", Body: common.StatusReply{}},
+			500: {Description: "Neither `hash`, nor `address` provided, or unexpected error", Body: common.StatusReply{}},
+		}),
+	}, {
+		Method:      "GET",
+		Path:        "/api/payments/:id",
+		Summary:     "Get a payment",
+		Description: "Returns current state of a payment right away.  Invoices created before payment IDs were introduced can be fetched by their LN hash.",
+		Tags:        []string{"payments"},
+		Security:    security(common.ScopeReadStatus),
+		Responses: withReplies(errorReplies(401, 403, 404, 500, 503), map[int]openapi.Response{
+			200: {Description: "Payment", Body: common.Payment{}},
+		}),
+	}, {
+		Method:      "GET",
+		Path:        "/api/payments",
+		Summary:     "Find a payment",
+		Description: "Returns current state of a payment with LN hash, Bitcoin address, or order ID right away.  Exactly one of them is required.",
+		Tags:        []string{"payments"},
+		Query:       paymentQuery{},
+		Security:    security(common.ScopeReadHistory),
+		Responses: withReplies(errorReplies(400, 401, 403, 404, 500, 503), map[int]openapi.Response{
+			200: {Description: "Payment", Body: common.Payment{}},
+		}),
+	}, {
+		Method:   "GET",
+		Path:     "/api/info",
+		Summary:  "Node info, and available payment methods",
+		Tags:     []string{"info"},
+		Security: security(common.ScopeReadStatus),
+		Responses: withReplies(errorReplies(401, 403, 500, 503), map[int]openapi.Response{
+			200: {Description: "Info", Body: common.Info{}},
+		}),
+	}, {
+		Method:  "GET",
+		Path:    "/api/pow",
+		Summary: "Get a proof-of-work challenge",
+		Tags:    []string{"payments"},
+		Responses: withReplies(errorReplies(404, 500), map[int]openapi.Response{
+			200: {Description: "Challenge", Body: powReply{}},
+		}),
+	}, {
+		Method:   "GET",
+		Path:     "/api/history",
+		Summary:  "List payments, newest first",
+		Tags:     []string{"history"},
+		Query:    historyQuery{},
+		Security: security(common.ScopeReadHistory),
+		Responses: withReplies(errorReplies(400, 401, 403, 500, 503), map[int]openapi.Response{
+			200: {Description: "Payments", Body: historyReply{}},
+		}),
+	}, {
+		Method:   "GET",
+		Path:     "/api/history/export",
+		Summary:  "Export payments for accounting",
+		Tags:     []string{"history"},
+		Query:    exportQuery{},
+		Security: security(common.ScopeReadHistory),
+		Responses: withReplies(errorReplies(400, 401, 403, 500, 503), map[int]openapi.Response{
+			200: {Description: "File with one row per payment", Body: []exportRow{}, ContentTypes: []string{
+				exportFormats["csv"], exportFormats["ods"], exportFormats["json"],
+			}},
+		}),
+	}, {
+		Method:   "POST",
+		Path:     "/api/admin/reload",
+		Summary:  "Reload config file",
+		Tags:     []string{"admin"},
+		Security: security(common.ScopeAdmin),
+		Responses: withReplies(errorReplies(400, 401, 403), map[int]openapi.Response{
+			200: {Description: "Reloaded", Body: reloadReply{}},
+		}),
+	}, {
+		Method:  "GET",
+		Path:    "/api/openapi.json",
+		Summary: "This document",
+		Tags:    []string{"info"},
+		Responses: map[int]openapi.Response{
+			200: {Description: "OpenAPI document", ContentTypes: []string{"application/json"}},
+		},
+	}}
+
+	ops = append(ops, []openapi.Operation{{
+		Method:      "POST",
+		Path:        "/api/v2/payments",
+		Summary:     "Create a new payment",
+		Description: "Same as `POST /api/payment`, but replies with the created payment resource",
+		Tags:        []string{"v2"},
+		Headers:     paymentHeaders,
+		Body:        paymentRequest{},
+		Security:    security(common.ScopeCreatePayment),
+		Responses: withReplies(v2ErrorReplies(400, 401, 403, 409, 422, 429, 500, 503), map[int]openapi.Response{
+			201: {Description: "Payment created.  See `Location` header", Body: v2Payment{}},
+		}),
+	}, {
+		Method:      "GET",
+		Path:        "/api/v2/payments",
+		Summary:     "List payments, newest first",
+		Description: "`Warning` header is set if on-chain state couldn't be fetched",
+		Tags:        []string{"v2"},
+		Query:       v2PaymentsQuery{},
+		Security:    security(common.ScopeReadHistory),
+		Responses: withReplies(v2ErrorReplies(400, 401, 403, 500, 503), map[int]openapi.Response{
+			200: {Description: "Payments", Body: v2PaymentList{}},
+		}),
+	}, {
+		Method:      "GET",
+		Path:        "/api/v2/payments/:id",
+		Summary:     "Get a payment",
+		Description: "Returns current state of the payment, or with `wait` set, waits for a pending one to get paid, or expire.  `Warning` header is set if on-chain state couldn't be fetched.",
+		Tags:        []string{"v2"},
+		Query:       v2PaymentQuery{},
+		Security:    security(common.ScopeReadStatus),
+		Responses: withReplies(v2ErrorReplies(400, 401, 403, 404, 429, 500, 503), map[int]openapi.Response{
+			200: {Description: "Payment", Body: v2Payment{}},
+		}),
+	}}...)
+
+	if c.Metrics {
+		ops = append(ops, openapi.Operation{
+			Method:   "GET",
+			Path:     "/metrics",
+			Summary:  "Prometheus metrics",
+			Tags:     []string{"admin"},
+			Security: security(common.ScopeAdmin),
+			Responses: withReplies(errorReplies(401, 403), map[int]openapi.Response{
+				200: {Description: "Metrics in Prometheus text format", ContentTypes: []string{"text/plain"}},
+			}),
+		})
+	}
+
+	if c.Lnd.Macaroons.Admin != "" {
+		ops = append(ops, []openapi.Operation{{
+			Method:      "POST",
+			Path:        "/api/payments/:id/refunds",
+			Summary:     "Refund a payment",
+			Description: "Pays (a part of) received funds back to customer's bolt11, or Bitcoin address, or issues LNURL-withdraw link for the customer to withdraw them with.  Refunds of a payment can't add up to more than it has received.  Failed refunds are replied with `200`, and `status` set to `failed`.",
+			Tags:        []string{"refunds"},
+			Body:        refundRequest{},
+			Security:    security(common.ScopeAdmin),
+			Responses: withReplies(errorReplies(400, 401, 403, 404, 500, 503), map[int]openapi.Response{
+				200: {Description: "Refund", Body: common.Refund{}},
+				422: {Description: "Refunds would exceed received amount", Body: common.StatusReply{}},
+			}),
+		}, {
+			Method:   "GET",
+			Path:     "/api/payments/:id/refunds",
+			Summary:  "List refunds of a payment, oldest first",
+			Tags:     []string{"refunds"},
+			Security: security(common.ScopeReadHistory),
+			Responses: withReplies(errorReplies(401, 403, 404, 500), map[int]openapi.Response{
+				200: {Description: "Refunds", Body: refundList{}},
+			}),
+		}, {
+			Method:      "POST",
+			Path:        "/api/payments/:id/refunds/:refund_id/resolve",
+			Summary:     "Resolve refund with unknown outcome",
+			Description: "Asks lnd whether a refund marked `unknown` (ex. because connection to lnd was lost while paying it) was paid.  Refunds lnd is still paying stay `unknown`.",
+			Tags:        []string{"refunds"},
+			Security:    security(common.ScopeAdmin),
+			Responses: withReplies(errorReplies(401, 403, 404, 500, 503), map[int]openapi.Response{
+				200: {Description: "Refund with its outcome", Body: common.Refund{}},
+				409: {Description: "Outcome of the refund is already known", Body: common.StatusReply{}},
+			}),
+		}, {
+			Method:      "GET",
+			Path:        "/api/refunds/lnurl",
+			Summary:     "LNURL-withdraw request",
+			Description: "Called by customer's wallet.  Errors are replied with `200`, and `status` set to `ERROR`, as LNURL requires.",
+			Tags:        []string{"refunds"},
+			Query:       withdrawQuery{},
+			Responses: map[int]openapi.Response{
+				200: {Description: "Withdraw request", Body: lnurl.WithdrawRequest{}},
+			},
+		}, {
+			Method:      "GET",
+			Path:        "/api/refunds/lnurl/callback",
+			Summary:     "LNURL-withdraw callback",
+			Description: "Called by customer's wallet with an invoice to pay the refund to",
+			Tags:        []string{"refunds"},
+			Query:       withdrawCallbackQuery{},
+			Responses: map[int]openapi.Response{
+				200: {Description: "Outcome of the withdrawal", Body: lnurl.Reply{}},
+			},
+		}}...)
+	}
+
+	ops = append(ops, []openapi.Operation{{
+		Method:      "POST",
+		Path:        "/api/links",
+		Summary:     "Create a payment link",
+		Description: "Each visitor of `/pay/<slug>` gets a new payment.  Links can also be defined in `[[links]]` of the config file.",
+		Tags:        []string{"links"},
+		Body:        common.PaymentLink{},
+		Security:    security(common.ScopeAdmin),
+		Responses: withReplies(errorReplies(400, 401, 403, 500), map[int]openapi.Response{
+			201: {Description: "Payment link created", Body: linkReply{}},
+			409: {Description: "Payment link with the same slug already exists", Body: common.StatusReply{}},
+		}),
+	}, {
+		Method:      "GET",
+		Path:        "/api/links",
+		Summary:     "List payment links, and their sales",
+		Description: "`Warning` header is set if on-chain state couldn't be fetched",
+		Tags:        []string{"links"},
+		Security:    security(common.ScopeReadHistory),
+		Responses: withReplies(errorReplies(401, 403, 500, 503), map[int]openapi.Response{
+			200: {Description: "Payment links", Body: linkList{}},
+		}),
+	}, {
+		Method:      "GET",
+		Path:        "/api/links/:slug",
+		Summary:     "Get a payment link, and its sales",
+		Description: "`Warning` header is set if on-chain state couldn't be fetched",
+		Tags:        []string{"links"},
+		Security:    security(common.ScopeReadHistory),
+		Responses: withReplies(errorReplies(401, 403, 404, 500, 503), map[int]openapi.Response{
+			200: {Description: "Payment link", Body: linkReply{}},
+		}),
+	}, {
+		Method:      "DELETE",
+		Path:        "/api/links/:slug",
+		Summary:     "Remove a payment link",
+		Description: "Payments the link has created are kept",
+		Tags:        []string{"links"},
+		Security:    security(common.ScopeAdmin),
+		Responses: withReplies(errorReplies(401, 403, 404, 500), map[int]openapi.Response{
+			200: {Description: "Removed payment link", Body: linkReply{}},
+			409: {Description: "Payment link is defined in the config file", Body: common.StatusReply{}},
+		}),
+	}, {
+		Method:      "GET",
+		Path:        "/pay/:slug",
+		Summary:     "Pay through a payment link",
+		Description: "Creates a new payment for the visitor.  The same proof-of-work, and captcha checks as for anonymous `POST /api/payment` apply.  Pending payments reserve stock of the link, and a visitor can only have a few of them.",
+		Tags:        []string{"links"},
+		Responses: withReplies(errorReplies(400, 403, 404, 429, 500, 503), map[int]openapi.Response{
+			200: {Description: "Payment created.  See `Location` header", Body: v2Payment{}},
+			410: {Description: "Payment link has expired, or is sold out", Body: common.StatusReply{}},
+		}),
+	}}...)
+
+	if c.SwaggerUI {
+		ops = append(ops, openapi.Operation{
+			Method:  "GET",
+			Path:    "/api/docs",
+			Summary: "Swagger UI",
+			Tags:    []string{"info"},
+			Responses: map[int]openapi.Response{
+				200: {Description: "Swagger UI page", ContentTypes: []string{"text/html"}},
+			},
+		}, openapi.Operation{
+			Method:  "GET",
+			Path:    "/api/docs/:file",
+			Summary: "Scripts, and styles of Swagger UI",
+			Tags:    []string{"info"},
+			Responses: withReplies(errorReplies(404), map[int]openapi.Response{
+				200: {Description: "Bundled file", ContentTypes: []string{"text/css", "text/javascript"}},
+			}),
+		})
+	}
+
+	return ops
+}
+
+// Routes not meant to be used by API clients
+var undocumentedRoutes = map[openapi.Route]bool{
+	{Method: "GET", Path: "/"}:  true,
+	{Method: "HEAD", Path: "/"}: true,
+}
+
+// checkDocumented logs routes that are missing from, or described but not defined in the OpenAPI document
+func checkDocumented(routes gin.RoutesInfo) (undocumented, missing []openapi.Route) {
+	var registered []openapi.Route
+	for _, r := range routes {
+		if route := (openapi.Route{Method: r.Method, Path: r.Path}); !undocumentedRoutes[route] {
+			registered = append(registered, route)
+		}
+	}
+
+	undocumented, missing = openapi.Diff(apiOperations(conf), registered)
+
+	for _, r := range undocumented {
+		log.WithField("route", fmt.Sprintf("%s %s", r.Method, r.Path)).Warningln("route missing from OpenAPI document")
+	}
+
+	for _, r := range missing {
+		log.WithField("route", fmt.Sprintf("%s %s", r.Method, r.Path)).Warningln("OpenAPI document describes undefined route")
+	}
+
+	return undocumented, missing
+}
+
+// openAPISpec serves OpenAPI document of the API, as currently configured
+func openAPISpec(c *gin.Context) {
+	doc := openapi.New(openapi.Info{
+		Title:       "invoicer",
+		Description: "Accept Bitcoin payments on-chain, and over Lightning Network",
+		Version:     versionString,
+	}, apiOperations(currentConf()), securitySchemes)
+
+	c.JSON(200, doc)
+}
+
+func swaggerUI(c *gin.Context) {
+	c.Data(200, "text/html; charset=utf-8", []byte(swaggerUIPage))
+}
+
+// swaggerUIFile serves files Swagger UI page needs from the ones bundled with invoicer
+func swaggerUIFile(c *gin.Context) {
+	file := c.Param("file")
+	if file == swaggerUIInitFile {
+		c.Data(200, mime.TypeByExtension(".js"), []byte(swaggerUIInit))
+		return
+	}
+
+	content, ok := swaggerui.Asset(file)
+	if !ok {
+		replyStatus(c, common.StatusReply{Code: 404, Error: fmt.Sprintf("%s not found", file)})
+		return
+	}
+
+	// URLs change with the bundled version, so files can be cached for long
+	c.Header("Cache-Control", "public, max-age=604800")
+	c.Data(200, mime.TypeByExtension(path.Ext(file)), content)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lncm/invoicer/common"
+)
+
+func TestRoutesDocumented(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	withRefunds := common.Config{Metrics: true, SwaggerUI: true}
+	withRefunds.Lnd.Macaroons.Admin = "admin.macaroon"
+
+	for _, c := range []common.Config{{}, withRefunds} {
+		conf = c
+
+		undocumented, missing := checkDocumented(newRouter().Routes())
+		for _, r := range undocumented {
+			t.Errorf("%s %s: route missing from apiOperations()", r.Method, r.Path)
+		}
+
+		for _, r := range missing {
+			t.Errorf("%s %s: documented, but not routed", r.Method, r.Path)
+		}
+	}
+
+	conf = common.Config{}
+}
+
+func TestSwaggerUIBundled(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(prev common.Config) { conf = prev }(conf)
+
+	conf = common.Config{SwaggerUI: true}
+	router := newRouter()
+
+	for path, expected := range map[string]string{
+		"/api/docs":                      "text/html",
+		"/api/docs/swagger-ui-bundle.js": "javascript",
+		"/api/docs/swagger-ui.css":       "text/css",
+		"/api/docs/init.js":              "javascript",
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+		if w.Code != 200 || !strings.Contains(w.Header().Get("Content-Type"), expected) || w.Body.Len() == 0 {
+			t.Errorf("%s: got %d %s, expected %s", path, w.Code, w.Header().Get("Content-Type"), expected)
+		}
+
+		if strings.Contains(w.Body.String(), "https://unpkg.com") {
+			t.Errorf("%s: loads files from a CDN", path)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/docs/missing.js", nil))
+
+	if w.Code != 404 {
+		t.Errorf("missing file: got %d, expected 404", w.Code)
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lncm/invoicer/common"
+)
+
+const (
+	RailLn      = "ln"
+	RailOnChain = "onchain"
+
+	odsMimeType = "application/vnd.oasis.opendocument.spreadsheet"
+)
+
+// Content types of supported export formats
+var exportFormats = map[string]string{
+	"csv":  "text/csv; charset=utf-8",
+	"json": "application/json; charset=utf-8",
+	"ods":  odsMimeType,
+}
+
+type (
+	// exportRow is a single payment, as seen by a bookkeeper
+	exportRow struct {
+		CreatedAt    string   `json:"created_at"`
+		PaidAt       string   `json:"paid_at,omitempty"`
+		Status       string   `json:"status"`
+		Rail         string   `json:"rail,omitempty"`
+		Requested    int64    `json:"requested_sats"`
+		Received     int64    `json:"received_sats"`
+		FiatValue    *float64 `json:"fiat_value,omitempty"`
+		FiatCurrency string   `json:"fiat_currency,omitempty"`
+		FiatRate     float64  `json:"fiat_rate,omitempty"`
+		Fees         int64    `json:"fee_sats"`
+		Refunded     int64    `json:"refunded_sats"`
+		TxIds        []string `json:"txids,omitempty"`
+		Preimage     string   `json:"preimage,omitempty"`
+		Hash         string   `json:"hash,omitempty"`
+		Address      string   `json:"address,omitempty"`
+		Description  string   `json:"description"`
+		OrderID      string   `json:"order_id,omitempty"`
+	}
+
+	// cell is a single value in a spreadsheet.  `kind` is one of ODS value types: string, float, or date.
+	cell struct {
+		kind, value string
+	}
+)
+
+// Column names of CSV, and ODS exports.  Have to be kept in sync with `exportRow.cells()`.
+var exportHeader = []string{
+	"created_at", "paid_at", "status", "rail", "requested_sats", "received_sats", "fiat_value", "fiat_currency",
+	"fiat_rate", "fee_sats", "refunded_sats", "txids", "preimage", "hash", "address", "description", "order_id",
+}
+
+func newExportRow(p common.Payment) exportRow {
+	row := exportRow{
+		CreatedAt:   formatTimestamp(p.CreatedAt),
+		PaidAt:      formatTimestamp(p.PaidAt),
+		Status:      "pending",
+		Requested:   p.Amount,
+		Fees:        p.Fees,
+		Refunded:    p.Refunded,
+		TxIds:       p.TxIds,
+		Preimage:    p.Preimage,
+		Hash:        p.Hash,
+		Address:     p.Address,
+		Description: p.Description,
+		OrderID:     p.OrderID,
+	}
+
+	switch {
+	case p.Paid:
+		row.Status = "paid"
+
+	case p.Expired:
+		row.Status = "expired"
+	}
+
+	var rails []string
+	if p.LnPaid {
+		rails = append(rails, RailLn)
+		row.Received += p.LnAmount
+	}
+
+	if p.BtcAmount > 0 {
+		rails = append(rails, RailOnChain)
+		row.Received += p.BtcAmount
+	}
+
+	row.Rail = strings.Join(rails, "+")
+
+	if p.FiatRate > 0 && row.Received > 0 {
+		// Rounded to cents, as that's what accounting cares about
+		value := float64(int64(float64(row.Received)*p.FiatRate/1e6+0.5)) / 100
+		row.FiatValue, row.FiatCurrency, row.FiatRate = &value, p.FiatCurrency, p.FiatRate
+	}
+
+	return row
+}
+
+func (r exportRow) cells() []cell {
+	str := func(s string) cell { return cell{"string", s} }
+	num := func(n int64) cell { return cell{"float", strconv.FormatInt(n, 10)} }
+	date := func(s string) cell {
+		if s == "" {
+			return str("")
+		}
+
+		return cell{"date", s}
+	}
+
+	fiatValue, fiatRate := str(""), str("")
+	if r.FiatValue != nil {
+		fiatValue = cell{"float", strconv.FormatFloat(*r.FiatValue, 'f', 2, 64)}
+		fiatRate = cell{"float", strconv.FormatFloat(r.FiatRate, 'f', -1, 64)}
+	}
+
+	return []cell{
+		date(r.CreatedAt),
+		date(r.PaidAt),
+		str(r.Status),
+		str(r.Rail),
+		num(r.Requested),
+		num(r.Received),
+		fiatValue,
+		str(r.FiatCurrency),
+		fiatRate,
+		num(r.Fees),
+		num(r.Refunded),
+		str(strings.Join(r.TxIds, " ")),
+		str(r.Preimage),
+		str(r.Hash),
+		str(r.Address),
+		str(r.Description),
+		str(r.OrderID),
+	}
+}
+
+// writePayments writes payments to `w` as `json`, `csv`, or `ods`, one row per payment
+func writePayments(w io.Writer, format string, payments []common.Payment) error {
+	rows := make([]exportRow, 0, len(payments))
+	for _, p := range payments {
+		rows = append(rows, newExportRow(p))
+	}
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rows)
+
+	case "csv":
+		return writeCSV(w, rows)
+
+	case "ods":
+		return writeODS(w, rows)
+	}
+
+	return fmt.Errorf("unsupported format: %s", format)
+}
+
+func writeCSV(w io.Writer, rows []exportRow) error {
+	cw := csv.NewWriter(w)
+
+	err := cw.Write(exportHeader)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		var record []string
+		for _, c := range row.cells() {
+			if c.kind == "string" {
+				c.value = escapeFormula(c.value)
+			}
+
+			record = append(record, c.value)
+		}
+
+		err = cw.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// escapeFormula prefixes text that spreadsheets would otherwise evaluate as a formula (ex. `=HYPERLINK(…)` set as
+// payment's description) with `'`, so that it's shown as is
+func escapeFormula(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+
+	return s
+}
+
+// writeODS writes the smallest valid OpenDocument spreadsheet: mimetype, manifest, and a single table
+func writeODS(w io.Writer, rows []exportRow) error {
+	zw := zip.NewWriter(w)
+
+	// mimetype has to be the first, uncompressed entry
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(f, odsMimeType)
+	if err != nil {
+		return err
+	}
+
+	f, err = zw.Create("META-INF/manifest.xml")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(f, xml.Header+`<manifest:manifest xmlns:manifest="urn:oasis:names:tc:opendocument:xmlns:manifest:1.0" manifest:version="1.2">`+
+		`<manifest:file-entry manifest:full-path="/" manifest:media-type="`+odsMimeType+`"/>`+
+		`<manifest:file-entry manifest:full-path="content.xml" manifest:media-type="text/xml"/>`+
+		`</manifest:manifest>`)
+	if err != nil {
+		return err
+	}
+
+	f, err = zw.Create("content.xml")
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" ` +
+		`xmlns:table="urn:oasis:names:tc:opendocument:xmlns:table:1.0" ` +
+		`xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0" office:version="1.2">`)
+	b.WriteString(`<office:body><office:spreadsheet><table:table table:name="Payments">`)
+
+	writeRow := func(cells []cell) {
+		b.WriteString("<table:table-row>")
+		for _, c := range cells {
+			switch {
+			case c.value == "":
+				b.WriteString("<table:table-cell/>")
+				continue
+
+			case c.kind == "float":
+				fmt.Fprintf(&b, `<table:table-cell office:value-type="float" office:value="%s">`, c.value)
+
+			case c.kind == "date":
+				// ODS dates have no timezone, and exports are always in UTC
+				fmt.Fprintf(&b, `<table:table-cell office:value-type="date" office:date-value="%s">`,
+					strings.TrimSuffix(c.value, "Z"))
+
+			default:
+				b.WriteString(`<table:table-cell office:value-type="string">`)
+			}
+
+			b.WriteString("<text:p>")
+			_ = xml.EscapeText(&b, []byte(c.value))
+			b.WriteString("</text:p></table:table-cell>")
+		}
+		b.WriteString("</table:table-row>")
+	}
+
+	var header []cell
+	for _, name := range exportHeader {
+		header = append(header, cell{"string", name})
+	}
+
+	writeRow(header)
+
+	for _, row := range rows {
+		writeRow(row.cells())
+	}
+
+	b.WriteString(`</table:table></office:spreadsheet></office:body></office:document-content>`)
+
+	_, err = io.WriteString(f, b.String())
+	if err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// formatTimestamp returns unix timestamp as RFC3339 in UTC, or nothing if it's not set
+func formatTimestamp(ts int64) string {
+	if ts == 0 {
+		return ""
+	}
+
+	return time.Unix(ts, 0).UTC().Format(time.RFC3339)
+}
+
+// parseTime accepts a unix timestamp, date (ex. `2020-04-01`), or RFC3339 timestamp.  If `endOfDay` is set, dates
+// mean the end of that day, so that `from=2020-04-01&to=2020-04-30` covers all of April.
+func parseTime(s string, endOfDay bool) (time.Time, error) {
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		if endOfDay {
+			t = t.Add(24*time.Hour - time.Second)
+		}
+
+		return t, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid time %q: use a date (ex. 2020-04-01), RFC3339, or unix timestamp", s)
+	}
+
+	return t, nil
+}
+
+// filterPayments returns payments created between `from`, and `to` (inclusive).  Zero values mean no limit.
+func filterPayments(payments []common.Payment, from, to time.Time) (filtered []common.Payment) {
+	for _, p := range payments {
+		if !from.IsZero() && p.CreatedAt < from.Unix() {
+			continue
+		}
+
+		if !to.IsZero() && p.CreatedAt > to.Unix() {
+			continue
+		}
+
+		filtered = append(filtered, p)
+	}
+
+	return filtered
+}
+
+// exportQuery selects format, and time range of an export
+type exportQuery struct {
+	Format string `form:"format" validate:"omitempty,oneof=csv ods json" doc:"Defaults to csv"`
+	From   string `form:"from" doc:"Only payments created since, ex. 2020-04-01.  RFC3339, and unix timestamps work too"`
+	To     string `form:"to" doc:"Only payments created until (inclusive), ex. 2020-04-30"`
+}
+
+// exportHistory serves payment history as a file for accounting
+func exportHistory(c *gin.Context) {
+	var queryParams exportQuery
+
+	err := c.BindQuery(&queryParams)
+	if err != nil {
+		replyStatus(c, common.StatusReply{
+			Code:  400,
+			Error: fmt.Errorf("invalid request: %w", err).Error(),
+		})
+		return
+	}
+
+	if queryParams.Format == "" {
+		queryParams.Format = "csv"
+	}
+
+	contentType, ok := exportFormats[queryParams.Format]
+	if !ok {
+		replyStatus(c, common.StatusReply{
+			Code:  400,
+			Error: "format= can only take `csv`, `ods`, and `json` as values",
+		})
+		return
+	}
+
+	var from, to time.Time
+
+	if queryParams.From != "" {
+		from, err = parseTime(queryParams.From, false)
+	}
+
+	if err == nil && queryParams.To != "" {
+		to, err = parseTime(queryParams.To, true)
+	}
+
+	if err != nil {
+		replyStatus(c, common.StatusReply{
+			Code:  400,
+			Error: err.Error(),
+		})
+		return
+	}
+
+	if !requireBackends(c, false) {
+		return
+	}
+
+	history, warning, err := fetchHistory(c, "")
+	if err != nil {
+		replyStatus(c, common.StatusReply{
+			Code:  errCode(err),
+			Error: err.Error(),
+		})
+		return
+	}
+
+	if warning != "" {
+		c.Header("Warning", fmt.Sprintf(`199 invoicer %q`, warning))
+	}
+
+	filename := fmt.Sprintf("invoicer-history-%s.%s", time.Now().UTC().Format("2006-01-02"), queryParams.Format)
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	c.Status(200)
+
+	err = writePayments(c.Writer, queryParams.Format, filterPayments(history, from, to))
+	if err != nil {
+		_ = c.Error(err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lncm/invoicer/common"
+)
+
+func testPayments() []common.Payment {
+	var ln, btc common.Payment
+
+	ln.CreatedAt = 1585823400
+	ln.Hash = "abc"
+	ln.Description = "coffee, black"
+	ln.Amount = 1000
+	ln.Paid, ln.LnPaid, ln.LnAmount, ln.PaidAt = true, true, 1000, 1585823460
+	ln.Preimage = "def"
+	ln.OrderID = "order-1"
+	ln.FiatRate, ln.FiatCurrency = 6543.21, "USD"
+
+	btc.CreatedAt = 1585909800
+	btc.Address = "bc1q"
+	btc.Description = "<tea>"
+	btc.Amount = 50000
+	btc.Expired = true
+	btc.BtcAmount = 20000
+	btc.TxIds = []string{"tx1", "tx2"}
+	btc.ApplyRefunds([]common.Refund{
+		{Amount: 5000, Fee: 150, Status: common.RefundSucceeded},
+		{Amount: 20000, Status: common.RefundFailed},
+	})
+
+	return []common.Payment{ln, btc}
+}
+
+func TestWritePaymentsCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writePayments(&buf, "csv", testPayments()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		strings.Join(exportHeader, ","),
+		`2020-04-02T10:30:00Z,2020-04-02T10:31:00Z,paid,ln,1000,1000,0.07,USD,6543.21,0,0,,def,abc,,"coffee, black",order-1`,
+		`2020-04-03T10:30:00Z,,expired,onchain,50000,20000,,,,150,5000,tx1 tx2,,,bc1q,<tea>,`,
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("expected %d lines, got %d:\n%s", len(want), len(lines), buf.String())
+	}
+
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("unexpected line %d:\n got: %s\nwant: %s", i, lines[i], want[i])
+		}
+	}
+
+	if err := writePayments(&buf, "xml", nil); err == nil {
+		t.Error("unsupported format should be rejected")
+	}
+}
+
+func TestWritePaymentsCSVFormulas(t *testing.T) {
+	for _, tc := range []struct {
+		description, orderID string
+		expected             string
+	}{
+		{`=HYPERLINK("http://evil")`, "order-1", `"'=HYPERLINK(""http://evil"")",order-1`},
+		{"+1+1", "-1", "'+1+1,'-1"},
+		{"@SUM(A1)", "\tx", "'@SUM(A1),'\tx"},
+		{"\rx", "1-1", "\"'\rx\",1-1"},
+		{"coffee", "", "coffee,"},
+	} {
+		var p common.Payment
+		p.Description, p.OrderID = tc.description, tc.orderID
+
+		var buf bytes.Buffer
+		if err := writePayments(&buf, "csv", []common.Payment{p}); err != nil {
+			t.Fatal(err)
+		}
+
+		lines := strings.SplitN(strings.TrimSpace(buf.String()), "\n", 2)
+		if len(lines) != 2 || !strings.HasSuffix(lines[1], tc.expected) {
+			t.Errorf("%q, %q: expected row ending with %s, got:\n%s", tc.description, tc.orderID, tc.expected, buf.String())
+		}
+	}
+}
+
+func TestWritePaymentsODS(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writePayments(&buf, "ods", testPayments()); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if zr.File[0].Name != "mimetype" || zr.File[0].Method != zip.Store {
+		t.Error("mimetype has to be the first, uncompressed entry")
+	}
+
+	for _, f := range zr.File {
+		if f.Name != "content.xml" {
+			continue
+		}
+
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, _ := ioutil.ReadAll(r)
+		for _, expected := range []string{
+			`office:date-value="2020-04-02T10:30:00"`,
+			`office:value="6543.21"`,
+			`&lt;tea&gt;`,
+		} {
+			if !bytes.Contains(content, []byte(expected)) {
+				t.Errorf("content.xml doesn't contain %s", expected)
+			}
+		}
+	}
+}
+
+func TestFilterPayments(t *testing.T) {
+	from, _ := parseTime("2020-04-02", false)
+	to, _ := parseTime("2020-04-02", true)
+
+	filtered := filterPayments(testPayments(), from, to)
+	if len(filtered) != 1 || filtered[0].Hash != "abc" {
+		t.Errorf("expected only the payment from 2020-04-02, got %v", filtered)
+	}
+
+	if len(filterPayments(testPayments(), time.Time{}, time.Time{})) != 2 {
+		t.Error("no limits should return all payments")
+	}
+}
+
+func TestExportOnChainOnly(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer useTestStore(t)()
+	defer func(prevConf common.Config, prevLn LightningClient, prevBtc BitcoinClient) {
+		conf, lnClient, btcClient = prevConf, prevLn, prevBtc
+	}(conf, lnClient, btcClient)
+
+	conf = common.Config{}
+	lnClient = fakeLn{}
+	btcClient = fakeBtc{common.AddrsStatus{{Address: "bc1qonchain", Amount: 20000, Label: "tea"}}}
+
+	err := db.AddPayment(common.PaymentRecord{
+		NewPayment:  common.NewPayment{ID: "pay_1", Address: "bc1qonchain", CreatedAt: 1585909800, Expiry: 3600},
+		Description: "tea",
+		Amount:      20000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/api/history/export?format=csv", nil)
+
+	exportHistory(c)
+
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if w.Code != 200 || len(lines) != 2 {
+		t.Fatalf("expected header, and one payment, got %d:\n%s", w.Code, w.Body)
+	}
+
+	if expected := "2020-04-03T10:30:00Z,,paid,onchain,20000,20000,"; !strings.HasPrefix(lines[1], expected) || !strings.Contains(lines[1], "bc1qonchain") {
+		t.Errorf("unexpected on-chain only payment:\n got: %s\nwant: %s…bc1qonchain…", lines[1], expected)
+	}
+}
@@ -0,0 +1,133 @@
+// Package fiat fetches BTC exchange rates from a configurable JSON source.
+package fiat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lncm/invoicer/common"
+)
+
+const (
+	// Rates are re-fetched at most this often
+	cacheDuration = time.Minute
+
+	requestTimeout = 10 * time.Second
+)
+
+var ErrNotConfigured = errors.New("fiat rate source not configured")
+
+type Source struct {
+	url, currency string
+	path          []string
+	client        *http.Client
+
+	mu        sync.Mutex
+	rate      float64
+	fetchedAt time.Time
+}
+
+// New returns a rate source, or nil if no `rate-url` is configured
+func New(conf common.Fiat) *Source {
+	if conf.RateURL == "" {
+		return nil
+	}
+
+	var path []string
+	if conf.RatePath != "" {
+		path = strings.Split(conf.RatePath, ".")
+	}
+
+	return &Source{
+		url:      conf.RateURL,
+		currency: strings.ToUpper(conf.Currency),
+		path:     path,
+		client:   &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// Currency returns the currency rates are expressed in
+func (s *Source) Currency() string {
+	return s.currency
+}
+
+// Rate returns the current price of 1 BTC
+func (s *Source) Rate(ctx context.Context) (float64, error) {
+	if s == nil {
+		return 0, ErrNotConfigured
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.fetchedAt) < cacheDuration {
+		return s.rate, nil
+	}
+
+	rate, err := s.fetch(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	s.rate, s.fetchedAt = rate, time.Now()
+
+	return rate, nil
+}
+
+func (s *Source) fetch(ctx context.Context) (float64, error) {
+	req, err := http.NewRequest(http.MethodGet, s.url, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, fmt.Errorf("unable to fetch rate: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unable to fetch rate: %s", resp.Status)
+	}
+
+	var body interface{}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse rate: %w", err)
+	}
+
+	return extract(body, s.path)
+}
+
+// extract follows `path` through nested JSON objects, and returns the number found at its end.  Numbers passed
+// as strings are accepted too.
+func extract(value interface{}, path []string) (float64, error) {
+	for i, key := range path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return 0, fmt.Errorf("%s is not an object", strings.Join(path[:i], "."))
+		}
+
+		value, ok = object[key]
+		if !ok {
+			return 0, fmt.Errorf("%s not found", strings.Join(path[:i+1], "."))
+		}
+	}
+
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+
+	return 0, fmt.Errorf("%s is not a number", strings.Join(path, "."))
+}
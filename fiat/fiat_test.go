@@ -0,0 +1,73 @@
+package fiat
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lncm/invoicer/common"
+)
+
+func TestRate(t *testing.T) {
+	var requests int
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write([]byte(`{"bitcoin": {"usd": 6543.21, "eur": "6012.5"}}`))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		path    string
+		want    float64
+		wantErr bool
+	}{
+		{"bitcoin.usd", 6543.21, false},
+		{"bitcoin.eur", 6012.5, false},
+		{"bitcoin.gbp", 0, true},
+		{"bitcoin", 0, true},
+		{"bitcoin.usd.value", 0, true},
+	}
+
+	for _, test := range tests {
+		s := New(common.Fiat{Currency: "usd", RateURL: server.URL, RatePath: test.path})
+
+		rate, err := s.Rate(context.Background())
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: unexpected error: %v", test.path, err)
+			continue
+		}
+
+		if rate != test.want {
+			t.Errorf("%s: expected %f, got %f", test.path, test.want, rate)
+		}
+
+		if s.Currency() != "USD" {
+			t.Errorf("expected currency to be upper-cased, got %s", s.Currency())
+		}
+	}
+
+	s := New(common.Fiat{RateURL: server.URL, RatePath: "bitcoin.usd"})
+	before := requests
+
+	for i := 0; i < 3; i++ {
+		_, _ = s.Rate(context.Background())
+	}
+
+	if requests-before != 1 {
+		t.Errorf("expected rate to be cached, got %d requests", requests-before)
+	}
+}
+
+func TestNotConfigured(t *testing.T) {
+	s := New(common.Fiat{})
+	if s != nil {
+		t.Fatal("source without rate-url should be nil")
+	}
+
+	_, err := s.Rate(context.Background())
+	if err != ErrNotConfigured {
+		t.Errorf("expected ErrNotConfigured, got %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lncm/invoicer/common"
+)
+
+const (
+	HealthOk          = "ok"
+	HealthDegraded    = "degraded"
+	HealthUnavailable = "unavailable"
+)
+
+var startedAt = time.Now()
+
+// health gathers the state of all backends.  Clients check their connections periodically in the background,
+// so calling this is cheap, and never blocks on unreachable backends.
+func health() (h common.Health) {
+	h.Version = versionString
+	h.Uptime = int64(time.Since(startedAt).Seconds())
+	h.Lnd = lnClient.Health()
+	h.Status = HealthOk
+
+	if !conf.OffChainOnly {
+		btcHealth := btcClient.Health()
+		h.Bitcoind = &btcHealth
+
+		// LN payments can still be accepted, but on-chain ones can't be (reliably) detected
+		if !btcHealth.Reachable || !btcHealth.Synced {
+			h.Status = HealthDegraded
+		}
+	}
+
+	if !h.Lnd.Reachable || !h.Lnd.Subscribed {
+		h.Status = HealthUnavailable
+	}
+
+	return
+}
+
+// healthz is a liveness probe: as long as invoicer is able to respond, it's alive
+func healthz(c *gin.Context) {
+	c.JSON(200, health())
+}
+
+// readyz is a readiness probe: returns 503 if no payments can be created, or tracked
+func readyz(c *gin.Context) {
+	h := health()
+
+	code := 200
+	if h.Status == HealthUnavailable {
+		code = 503
+	}
+
+	c.JSON(code, h)
+}
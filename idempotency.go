@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/lncm/invoicer/common"
+	"github.com/lncm/invoicer/store"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	replayedHeader    = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLen = 255
+
+	// How often idempotency keys past `idempotency-window` are removed from the data file
+	idempotencyPruneInterval = time.Hour
+)
+
+var (
+	// Idempotency keys of requests currently being processed.  Guards against creating two payments, when a retry
+	// arrives before the original request has finished.
+	inFlight   = make(map[string]bool)
+	inFlightMu sync.Mutex
+)
+
+// idempotencyKey returns key under which a payment request is deduplicated: `Idempotency-Key` header, or
+// `order_id`, if the header is not set.  Keys are scoped to the API key used, so that clients can't see each
+// other's payments.
+func idempotencyKey(c *gin.Context, data paymentRequest) (string, *common.StatusReply) {
+	key := c.GetHeader(idempotencyHeader)
+	if len(key) > maxIdempotencyKeyLen {
+		return "", &common.StatusReply{
+			Code:  400,
+			Error: fmt.Sprintf("%s can't be longer than %d characters", idempotencyHeader, maxIdempotencyKeyLen),
+		}
+	}
+
+	switch {
+	case key != "":
+		key = "key:" + key
+
+	case data.OrderID != "":
+		key = "order:" + data.OrderID
+
+	default:
+		return "", nil
+	}
+
+	owner := "anonymous"
+	if apiKey, ok := requestKey(c); ok {
+		owner = apiKey.ID
+	}
+
+	return owner + ":" + key, nil
+}
+
+// requestHash fingerprints a payment request, so that a reused idempotency key can be detected
+func requestHash(data paymentRequest) string {
+	content, _ := json.Marshal(data)
+	sum := sha256.Sum256(content)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// createPaymentOnce creates a payment, unless one was already created with the same idempotency `key` within
+// `idempotency-window`.  In that case, the original payment is returned, and `replayed` is set.
+func createPaymentOnce(ctx context.Context, data paymentRequest, key string) (payment common.NewPayment, replayed bool, fail *common.StatusReply) {
+	if key == "" {
+		payment, fail = createPayment(ctx, data, "")
+		return payment, false, fail
+	}
+
+	inFlightMu.Lock()
+	if inFlight[key] {
+		inFlightMu.Unlock()
+		return payment, false, &common.StatusReply{
+			Code:  409,
+			Error: "a request with the same idempotency key is still being processed, retry later",
+		}
+	}
+
+	inFlight[key] = true
+	inFlightMu.Unlock()
+
+	defer func() {
+		inFlightMu.Lock()
+		delete(inFlight, key)
+		inFlightMu.Unlock()
+	}()
+
+	since := time.Now().Add(-time.Duration(currentConf().IdempotencyWindow) * time.Second).Unix()
+
+	r, err := db.IdempotentPayment(key, since)
+	switch {
+	case err == nil:
+		if r.RequestHash != requestHash(data) {
+			return payment, false, &common.StatusReply{
+				Code:  422,
+				Error: "idempotency key was already used with a different request",
+			}
+		}
+
+		log.WithField("id", r.ID).Println("Payment request replayed")
+		return r.NewPayment, true, nil
+
+	case !errors.Is(err, store.ErrNotFound):
+		return payment, false, &common.StatusReply{
+			Code:  500,
+			Error: fmt.Errorf("can't look up idempotency key: %w", err).Error(),
+		}
+	}
+
+	payment, fail = createPayment(ctx, data, key)
+	return payment, false, fail
+}
+
+func setReplayed(c *gin.Context, replayed bool) {
+	if replayed {
+		c.Header(replayedHeader, "true")
+	}
+}
+
+// pruneIdempotencyKeys keeps removing idempotency keys past `idempotency-window`, so that the data file doesn't
+// keep growing with keys that can't be replayed anymore
+func pruneIdempotencyKeys() {
+	ticker := time.NewTicker(idempotencyPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		pruneIdempotencyKeysBefore(time.Now())
+		<-ticker.C
+	}
+}
+
+// pruneIdempotencyKeysBefore removes idempotency keys that can no longer be replayed at `now`
+func pruneIdempotencyKeysBefore(now time.Time) {
+	before := now.Add(-time.Duration(currentConf().IdempotencyWindow) * time.Second).Unix()
+
+	pruned, err := db.PruneIdempotencyKeys(before)
+	if err != nil {
+		log.WithError(err).Errorln("unable to prune idempotency keys")
+		return
+	}
+
+	if pruned > 0 {
+		log.WithField("count", pruned).Println("expired idempotency keys pruned")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lncm/invoicer/common"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	for _, tc := range []struct {
+		header, orderID string
+		apiKey          *common.APIKey
+		expected        string
+	}{
+		{"", "", nil, ""},
+		{"abc", "", nil, "anonymous:key:abc"},
+		{"", "order-1", nil, "anonymous:order:order-1"},
+		{"abc", "order-1", &common.APIKey{ID: "k1"}, "k1:key:abc"},
+		{"", "order-1", &common.APIKey{ID: "k1"}, "k1:order:order-1"},
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("POST", "/api/payment", nil)
+
+		if tc.header != "" {
+			c.Request.Header.Set(idempotencyHeader, tc.header)
+		}
+
+		if tc.apiKey != nil {
+			c.Set(apiKeyCtxKey, *tc.apiKey)
+		}
+
+		key, fail := idempotencyKey(c, paymentRequest{OrderInfo: common.OrderInfo{OrderID: tc.orderID}})
+		if fail != nil || key != tc.expected {
+			t.Errorf("header=%q order_id=%q: got %q (%v), expected %q", tc.header, tc.orderID, key, fail, tc.expected)
+		}
+	}
+}
+
+func TestCreatePaymentOnce(t *testing.T) {
+	defer useTestStore(t)()
+
+	conf = common.Config{IdempotencyWindow: 3600}
+	defer func() { conf = common.Config{} }()
+
+	data := paymentRequest{Amount: 1000, Description: "coffee", OrderInfo: common.OrderInfo{OrderID: "order-1"}}
+	original := common.NewPayment{ID: "pay_1", Hash: "abc", CreatedAt: time.Now().Unix()}
+
+	err := db.AddPayment(common.PaymentRecord{
+		NewPayment:     original,
+		Amount:         1000,
+		IdempotencyKey: "anonymous:order:order-1",
+		RequestHash:    requestHash(data),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payment, replayed, fail := createPaymentOnce(context.Background(), data, "anonymous:order:order-1")
+	if fail != nil || !replayed || payment != original {
+		t.Errorf("retry: got %+v, replayed=%v (%v), expected the original payment", payment, replayed, fail)
+	}
+
+	changed := data
+	changed.Amount = 2000
+
+	_, _, fail = createPaymentOnce(context.Background(), changed, "anonymous:order:order-1")
+	if fail == nil || fail.Code != 422 {
+		t.Errorf("changed request: got %v, expected 422", fail)
+	}
+
+	inFlight["anonymous:key:busy"] = true
+	defer delete(inFlight, "anonymous:key:busy")
+
+	_, _, fail = createPaymentOnce(context.Background(), data, "anonymous:key:busy")
+	if fail == nil || fail.Code != 409 {
+		t.Errorf("concurrent request: got %v, expected 409", fail)
+	}
+}
+
+func TestPruneIdempotencyKeys(t *testing.T) {
+	defer useTestStore(t)()
+
+	conf = common.Config{IdempotencyWindow: 3600}
+	defer func() { conf = common.Config{} }()
+
+	now := time.Now()
+
+	for _, r := range []common.PaymentRecord{
+		{NewPayment: common.NewPayment{ID: "pay_old", CreatedAt: now.Add(-2 * time.Hour).Unix()}, IdempotencyKey: "anonymous:key:old", RequestHash: "a"},
+		{NewPayment: common.NewPayment{ID: "pay_new", CreatedAt: now.Add(-time.Minute).Unix()}, IdempotencyKey: "anonymous:key:new", RequestHash: "b"},
+	} {
+		if err := db.AddPayment(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pruneIdempotencyKeysBefore(now)
+
+	old, err := db.Payment("pay_old")
+	if err != nil || old.IdempotencyKey != "" || old.RequestHash != "" {
+		t.Errorf("key past idempotency window should be pruned, got %+v (%v)", old, err)
+	}
+
+	recent, err := db.Payment("pay_new")
+	if err != nil || recent.IdempotencyKey != "anonymous:key:new" || recent.RequestHash != "b" {
+		t.Errorf("key within idempotency window should be kept, got %+v (%v)", recent, err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/lncm/invoicer/common"
+	"github.com/lncm/invoicer/metrics"
+)
+
+// How often on-chain payments are checked by `watchPayments`
+const watchInterval = time.Minute
+
+// watchPayments keeps checking on-chain payments until they're paid, or `late-payment-grace` after their expiry
+// runs out.  Nobody waits for an expired payment's status, so without it deposits made after expiry would go
+// unnoticed.  Outcomes of payments that nobody has looked at are recorded once they're final.
+func watchPayments() {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-shuttingDown:
+			return
+
+		case <-ticker.C:
+		}
+
+		err := checkPayments(time.Now())
+		if err != nil {
+			log.WithError(err).Warningln("unable to check for late payments")
+		}
+
+		err = checkExpired(time.Now())
+		if err != nil {
+			log.WithError(err).Warningln("unable to record outcomes of expired payments")
+		}
+	}
+}
+
+// checkExpired records outcomes of payments that expired (on-chain ones `late-payment-grace` after that) since
+// invoicer was started, and whose outcome nobody has seen yet, so that they're counted no matter if anybody looks
+// at them
+func checkExpired(now time.Time) error {
+	if !lnClient.Ready() {
+		return nil
+	}
+
+	records, err := db.Payments()
+	if err != nil {
+		return fmt.Errorf("can't read payment records: %w", err)
+	}
+
+	settlements, err := db.Settlements()
+	if err != nil {
+		return fmt.Errorf("can't read recorded settlements: %w", err)
+	}
+
+	expirations, err := db.Expirations()
+	if err != nil {
+		return fmt.Errorf("can't read recorded expirations: %w", err)
+	}
+
+	for _, r := range records {
+		until := payableUntil(r.NewPayment)
+		if r.ID == "" || until < startedAt.Unix() || now.Unix() <= until {
+			continue
+		}
+
+		if _, ok := expirations[r.ID]; ok || isSettled(settlements, r.Hash, r.Address) {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+
+		// records the outcome
+		_, _, err := fetchPayment(ctx, r)
+		cancel()
+
+		if err != nil {
+			return fmt.Errorf("can't fetch payment %s: %w", r.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// watchedPayments returns records of on-chain payments that haven't been seen settled yet, and are either still
+// open, or have expired less than `grace` seconds before `now`
+func watchedPayments(records []common.PaymentRecord, settlements map[string]common.Settlement, now time.Time, grace int64) (watched []common.PaymentRecord) {
+	for _, r := range records {
+		expiresAt := r.CreatedAt + r.Expiry
+		if r.Address == "" || now.Unix() > expiresAt+grace {
+			continue
+		}
+
+		if _, ok := settlements[r.Address]; ok {
+			continue
+		}
+
+		if _, ok := settlements[r.Hash]; ok && r.Hash != "" {
+			continue
+		}
+
+		watched = append(watched, r)
+	}
+
+	return
+}
+
+// checkPayments records settlements of watched payments that got paid on-chain.  Ones paid after expiry are
+// recorded as late, and reported to `[webhook]`.
+func checkPayments(now time.Time) error {
+	grace := currentConf().LatePaymentGrace
+	if grace <= 0 || !btcReady() {
+		return nil
+	}
+
+	records, err := db.Payments()
+	if err != nil {
+		return fmt.Errorf("can't read payment records: %w", err)
+	}
+
+	settlements, err := db.Settlements()
+	if err != nil {
+		return fmt.Errorf("can't read recorded settlements: %w", err)
+	}
+
+	watched := watchedPayments(records, settlements, now, grace)
+	if len(watched) == 0 {
+		return nil
+	}
+
+	btcStatuses, err := btcClient.CheckAddress("")
+	if err != nil {
+		return fmt.Errorf("can't fetch Bitcoin history: %w", err)
+	}
+
+	byAddress := make(map[string]common.AddrStatus, len(btcStatuses))
+	for _, s := range btcStatuses {
+		byAddress[s.Address] = s
+	}
+
+	for _, r := range watched {
+		btcStatus, ok := byAddress[r.Address]
+		if !ok {
+			continue
+		}
+
+		payment := common.Payment{NewPayment: r.NewPayment, OrderInfo: r.OrderInfo}
+		payment.Description = r.Description
+		payment.Amount, payment.AmountMsat = r.Amount, r.RequestedMsat()
+		payment.ApplyBtc(btcStatus)
+		payment.ApplyTolerance(currentConf().OnChain)
+
+		// open-amount payments accept any deposit within their bounds
+		if r.OpenAmount() {
+			payment.ApplyOpenAmount(r.AmountBounds)
+		}
+
+		if !payment.BtcPaid {
+			continue
+		}
+
+		late := now.Unix() > r.CreatedAt+r.Expiry
+		settlement, err := saveSettlement(r.Address, common.Settlement{PaidAt: now.Unix(), Late: late})
+		if err != nil || settlement == nil || settlement.OverStock {
+			continue
+		}
+
+		countSettlement(metrics.RailBtc, r.CreatedAt, settlement.PaidAt)
+
+		if !late {
+			continue
+		}
+
+		payment.Expired, payment.Paid = true, true
+		payment.PaidAt, payment.PaidLate = settlement.PaidAt, true
+		payment.FiatRate, payment.FiatCurrency = settlement.Rate, settlement.Currency
+
+		log.WithFields(log.Fields{"id": r.ID, "address": r.Address, "amount": payment.BtcAmount}).
+			Warningln("payment completed after expiry")
+
+		emitEvent(EventPaidLate, payment)
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lncm/invoicer/common"
+)
+
+// fakeBtc reports fixed statuses of addresses
+type fakeBtc struct {
+	statuses common.AddrsStatus
+}
+
+func (f fakeBtc) Ready() bool                                     { return true }
+func (f fakeBtc) Health() common.BitcoindHealth                   { return common.BitcoindHealth{} }
+func (f fakeBtc) Address(bool) (string, error)                    { return "", nil }
+func (f fakeBtc) BlockCount() (int64, error)                      { return 0, nil }
+func (f fakeBtc) ImportAddress(string, string) error              { return nil }
+func (f fakeBtc) CheckAddress(string) (common.AddrsStatus, error) { return f.statuses, nil }
+
+func TestWatchedPayments(t *testing.T) {
+	now := time.Unix(100000, 0)
+
+	records := []common.PaymentRecord{
+		{NewPayment: common.NewPayment{ID: "open", Address: "a1", CreatedAt: 99000, Expiry: 3600}},
+		{NewPayment: common.NewPayment{ID: "in grace", Address: "a2", CreatedAt: 90000, Expiry: 3600}},
+		{NewPayment: common.NewPayment{ID: "past grace", Address: "a3", CreatedAt: 1000, Expiry: 3600}},
+		{NewPayment: common.NewPayment{ID: "ln only", Hash: "h4", CreatedAt: 99000, Expiry: 3600}},
+		{NewPayment: common.NewPayment{ID: "settled on-chain", Address: "a5", CreatedAt: 99000, Expiry: 3600}},
+		{NewPayment: common.NewPayment{ID: "settled on LN", Hash: "h6", Address: "a6", CreatedAt: 99000, Expiry: 3600}},
+	}
+
+	settlements := map[string]common.Settlement{"a5": {PaidAt: 99500}, "h6": {PaidAt: 99500}}
+
+	watched := watchedPayments(records, settlements, now, 86400)
+	if len(watched) != 2 || watched[0].ID != "open" || watched[1].ID != "in grace" {
+		t.Errorf("unexpected payments watched: %+v", watched)
+	}
+}
+
+func TestCheckPayments(t *testing.T) {
+	defer useTestStore(t)()
+	defer func(prevConf common.Config, prevBtc BitcoinClient) { conf, btcClient = prevConf, prevBtc }(conf, btcClient)
+
+	events := make(chan webhookEvent, 10)
+	webhooks.queue = events
+	defer func() { webhooks.queue = nil }()
+
+	conf = common.Config{LatePaymentGrace: 86400}
+	btcClient = fakeBtc{common.AddrsStatus{
+		{Address: "on-time", Amount: 10000},
+		{Address: "late", Amount: 10000},
+		{Address: "underpaid", Amount: 5000},
+	}}
+
+	now := time.Now()
+	for _, r := range []common.PaymentRecord{
+		{NewPayment: common.NewPayment{ID: "pay_1", Address: "on-time", CreatedAt: now.Unix() - 60, Expiry: 3600}, Amount: 10000},
+		{NewPayment: common.NewPayment{ID: "pay_2", Address: "late", CreatedAt: now.Unix() - 7200, Expiry: 3600}, Amount: 10000},
+		{NewPayment: common.NewPayment{ID: "pay_3", Address: "underpaid", CreatedAt: now.Unix() - 7200, Expiry: 3600}, Amount: 10000},
+	} {
+		if err := db.AddPayment(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := checkPayments(now); err != nil {
+		t.Fatal(err)
+	}
+
+	settlements, err := db.Settlements()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s, ok := settlements["on-time"]; !ok || s.Late {
+		t.Errorf("payment paid on time should be settled, but not late: %+v", s)
+	}
+
+	if s, ok := settlements["late"]; !ok || !s.Late {
+		t.Errorf("payment paid after expiry should be settled late: %+v", s)
+	}
+
+	if _, ok := settlements["underpaid"]; ok {
+		t.Error("underpaid payment shouldn't be settled")
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+
+	if e := <-events; e.Type != EventPaidLate || e.Payment.ID != "pay_2" || !e.Payment.PaidLate {
+		t.Errorf("unexpected event: %+v", e)
+	}
+
+	// settled payments aren't reported again
+	if err := checkPayments(now.Add(time.Minute)); err != nil || len(events) != 0 {
+		t.Errorf("late payment reported twice: %v", err)
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/lncm/invoicer/common"
+	"github.com/lncm/invoicer/metrics"
+	"github.com/lncm/invoicer/store"
+)
+
+type (
+	// linkSales aggregates payments created through a payment link
+	linkSales struct {
+		Payments int64 `json:"payments" doc:"Number of payments created through the link"`
+		Paid     int64 `json:"paid"`
+		Pending  int64 `json:"pending" doc:"Payments that can still be paid"`
+		Received int64 `json:"received" doc:"Sum received by paid payments, in satoshis"`
+
+		Remaining *int64 `json:"remaining,omitempty" doc:"Stock left, after paid, and pending payments.  Not set for links without stock limit."`
+	}
+
+	// linkReservation is a pending payment reserving stock of payment link `slug` for a visitor from `ip`
+	linkReservation struct {
+		slug, ip string
+	}
+
+	linkReply struct {
+		common.PaymentLink
+
+		URL   string    `json:"url" doc:"Link to share with customers"`
+		Sales linkSales `json:"sales"`
+	}
+
+	linkList struct {
+		Links []linkReply `json:"links"`
+	}
+)
+
+// Pending payments of a link with stock a single visitor (client IP) can have, so that visits alone can't reserve all
+// of it
+const linkReservationsPerIP = 2
+
+var (
+	// Visits to a link with stock are serialized, so that they can't reserve more of it together
+	linkLocks sync.Map
+
+	// Visitors of links with stock, keyed by ID of the payment created for them
+	reservationsMu sync.Mutex
+	reservations   = make(map[string]linkReservation)
+)
+
+// count adds `p` to sales
+func (s *linkSales) count(p common.Payment) {
+	s.Payments++
+
+	switch {
+	case p.Paid:
+		s.Paid++
+		s.Received += p.Received()
+
+	case !p.Expired:
+		s.Pending++
+	}
+}
+
+// soldOut returns true if paid, and pending payments have used up `stock`
+func (s linkSales) soldOut(stock int64) bool {
+	return stock > 0 && s.Paid+s.Pending >= stock
+}
+
+// lockLink locks payment link with `slug` until the returned function is called
+func lockLink(slug string) (unlock func()) {
+	mu, _ := linkLocks.LoadOrStore(slug, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+
+	return mu.(*sync.Mutex).Unlock
+}
+
+// reservedBy returns payments from `pending` created for a visitor from `ip`.  Reservations of the link's other
+// payments are forgotten, as these no longer reserve stock.
+func reservedBy(slug, ip string, pending []common.PaymentRecord) (reserved []common.PaymentRecord) {
+	reservationsMu.Lock()
+	defer reservationsMu.Unlock()
+
+	stillPending := make(map[string]bool, len(pending))
+	for _, r := range pending {
+		stillPending[r.ID] = true
+	}
+
+	for id, res := range reservations {
+		if res.slug == slug && !stillPending[id] {
+			delete(reservations, id)
+		}
+	}
+
+	for _, r := range pending {
+		if res, ok := reservations[r.ID]; ok && res.ip == ip {
+			reserved = append(reserved, r)
+		}
+	}
+
+	return reserved
+}
+
+// reserve records that payment `id` of link `slug` was created for a visitor from `ip`
+func reserve(id, slug, ip string) {
+	reservationsMu.Lock()
+	defer reservationsMu.Unlock()
+
+	reservations[id] = linkReservation{slug: slug, ip: ip}
+}
+
+// allLinks returns payment links from the config file, followed by ones created via the API
+func allLinks() ([]common.PaymentLink, error) {
+	stored, err := db.Links()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append([]common.PaymentLink{}, currentConf().Links...), stored...), nil
+}
+
+// findLink returns payment link with `slug`.  Ones from the config file take precedence.
+func findLink(slug string) (common.PaymentLink, error) {
+	links, err := allLinks()
+	if err != nil {
+		return common.PaymentLink{}, err
+	}
+
+	for _, l := range links {
+		if l.Slug == slug {
+			return l, nil
+		}
+	}
+
+	return common.PaymentLink{}, fmt.Errorf("payment link %s: %w", slug, store.ErrNotFound)
+}
+
+// fetchLinkSales aggregates current state of payments created through `links`, keyed by link's slug.  Payments of
+// deleted links with the same slug aren't counted.  If on-chain state can't be fetched, warning is returned.
+func fetchLinkSales(ctx context.Context, links []common.PaymentLink) (sales map[string]linkSales, warning string, err error) {
+	records, err := db.Payments()
+	if err != nil {
+		return nil, "", fmt.Errorf("can't read payment records: %w", err)
+	}
+
+	var linked []common.PaymentRecord
+	for _, r := range records {
+		for _, l := range links {
+			if l.Owns(r) {
+				linked = append(linked, r)
+				break
+			}
+		}
+	}
+
+	sales = make(map[string]linkSales)
+	if len(linked) == 0 {
+		return sales, "", nil
+	}
+
+	// All payments come from a single history call, only ones missing from it are fetched one by one
+	history, warning, err := fetchHistory(ctx, "")
+	if err != nil {
+		return nil, "", err
+	}
+
+	byID := make(map[string]common.Payment, len(history))
+	for _, p := range history {
+		if p.ID != "" {
+			byID[p.ID] = p
+		}
+	}
+
+	for _, r := range linked {
+		p, ok := byID[r.ID]
+		if !ok {
+			var w string
+			p, w, err = fetchPayment(ctx, r)
+			if err != nil {
+				return nil, "", err
+			}
+
+			if w != "" {
+				warning = w
+			}
+		}
+
+		s := sales[r.Link]
+		s.count(p)
+		sales[r.Link] = s
+	}
+
+	return sales, warning, nil
+}
+
+func newLinkReply(c *gin.Context, l common.PaymentLink, sales linkSales) linkReply {
+	if l.Stock > 0 {
+		remaining := l.Stock - sales.Paid - sales.Pending
+		if remaining < 0 {
+			remaining = 0
+		}
+
+		sales.Remaining = &remaining
+	}
+
+	return linkReply{PaymentLink: l, URL: fmt.Sprintf("%s/pay/%s", baseURL(c), l.Slug), Sales: sales}
+}
+
+// replyLinkError replies with 404 for unknown links, and 500 otherwise
+func replyLinkError(c *gin.Context, err error) {
+	code := 500
+	if errors.Is(err, store.ErrNotFound) {
+		code = 404
+	}
+
+	replyStatus(c, common.StatusReply{Code: code, Error: err.Error()})
+}
+
+// createLink adds a payment link.  Links from the config file can't be overridden.
+func createLink(c *gin.Context) {
+	var l common.PaymentLink
+
+	err := c.ShouldBindJSON(&l)
+	if err == nil {
+		err = l.Validate()
+	}
+
+	if err != nil {
+		replyStatus(c, common.StatusReply{
+			Code:  400,
+			Error: fmt.Errorf("invalid request: %w", err).Error(),
+		})
+		return
+	}
+
+	if _, err := findLink(l.Slug); err == nil {
+		replyStatus(c, common.StatusReply{
+			Code:  409,
+			Error: fmt.Errorf("%s: %w", l.Slug, store.ErrLinkExists).Error(),
+		})
+		return
+	}
+
+	l.CreatedAt, l.FromConfig = time.Now().Unix(), false
+
+	err = db.AddLink(l)
+	if err != nil {
+		code := 500
+		if errors.Is(err, store.ErrLinkExists) {
+			code = 409
+		}
+
+		replyStatus(c, common.StatusReply{Code: code, Error: fmt.Errorf("can't save payment link: %w", err).Error()})
+		return
+	}
+
+	c.JSON(201, newLinkReply(c, l, linkSales{}))
+}
+
+// listLinks returns all payment links, together with their sales
+func listLinks(c *gin.Context) {
+	links, err := allLinks()
+	if err != nil {
+		replyLinkError(c, err)
+		return
+	}
+
+	if !requireBackends(c, false) {
+		return
+	}
+
+	sales, warning, err := fetchLinkSales(c, links)
+	if err != nil {
+		replyStatus(c, common.StatusReply{Code: errCode(err), Error: err.Error()})
+		return
+	}
+
+	list := linkList{Links: []linkReply{}}
+	for _, l := range links {
+		list.Links = append(list.Links, newLinkReply(c, l, sales[l.Slug]))
+	}
+
+	setWarning(c, warning)
+	c.JSON(200, list)
+}
+
+// getLink returns payment link with slug passed in the path, together with its sales
+func getLink(c *gin.Context) {
+	l, err := findLink(c.Param("slug"))
+	if err != nil {
+		replyLinkError(c, err)
+		return
+	}
+
+	if !requireBackends(c, false) {
+		return
+	}
+
+	sales, warning, err := fetchLinkSales(c, []common.PaymentLink{l})
+	if err != nil {
+		replyStatus(c, common.StatusReply{Code: errCode(err), Error: err.Error()})
+		return
+	}
+
+	setWarning(c, warning)
+	c.JSON(200, newLinkReply(c, l, sales[l.Slug]))
+}
+
+// deleteLink removes payment link created via the API.  Payments it has created are kept.
+func deleteLink(c *gin.Context) {
+	l, err := findLink(c.Param("slug"))
+	if err != nil {
+		replyLinkError(c, err)
+		return
+	}
+
+	if l.FromConfig {
+		replyStatus(c, common.StatusReply{
+			Code:  409,
+			Error: fmt.Sprintf("payment link %s is defined in the config file, and can only be removed there", l.Slug),
+		})
+		return
+	}
+
+	err = db.DeleteLink(l.Slug)
+	if err != nil {
+		replyLinkError(c, err)
+		return
+	}
+
+	c.JSON(200, newLinkReply(c, l, linkSales{}))
+}
+
+// payLink creates a new payment for a visitor of payment link with slug passed in the path
+func payLink(c *gin.Context) {
+	l, err := findLink(c.Param("slug"))
+	if err != nil {
+		replyLinkError(c, err)
+		return
+	}
+
+	if l.Expired(time.Now()) {
+		replyStatus(c, common.StatusReply{Code: 410, Error: "payment link has expired"})
+		return
+	}
+
+	data := paymentRequest{
+		Amount:       l.Amount,
+		Description:  l.Description,
+		Only:         l.Only,
+		AmountBounds: l.Bounds(),
+		link:         l.Slug,
+	}
+
+	if fail := data.validate(); fail != nil {
+		replyStatus(c, *fail)
+		return
+	}
+
+	if !requireBackends(c, data.Only != "ln") {
+		return
+	}
+
+	// Pending payments reserve stock until they expire, so that it can't be oversold by visitors paying at the same
+	// time.  Records kept in the store are checked, as asking nodes about each payment would make every visit
+	// expensive.
+	if l.Stock > 0 {
+		unlock := lockLink(l.Slug)
+		defer unlock()
+
+		if !checkStock(c, l) {
+			return
+		}
+	}
+
+	payment, fail := createPayment(c, data, "")
+	if fail != nil {
+		replyStatus(c, *fail)
+		return
+	}
+
+	if l.Stock > 0 {
+		reserve(payment.ID, l.Slug, c.ClientIP())
+	}
+
+	c.Header("Location", "/api/v2/payments/"+payment.ID)
+	c.JSON(200, newV2Payment(common.Payment{
+		NewPayment:   payment,
+		Description:  data.Description,
+		Amount:       data.Amount,
+		AmountMsat:   data.AmountMsat,
+		AmountBounds: data.AmountBounds,
+		OpenAmount:   data.AmountMsat == 0,
+		Link:         l.Slug,
+	}))
+}
+
+// checkStock replies with 410, if stock of link `l` is used up by paid, and pending payments, or with 429, if the
+// visitor already has too many of the pending ones.  Has to be called with the link locked.
+func checkStock(c *gin.Context, l common.PaymentLink) bool {
+	counts, err := db.LinkCounts(l.Slug)
+	if err != nil {
+		replyStatus(c, common.StatusReply{Code: 500, Error: fmt.Errorf("can't read link sales: %w", err).Error()})
+		return false
+	}
+
+	now := time.Now()
+
+	pending, err := db.LinkPending(l.Slug, now.Unix(), currentConf().LatePaymentGrace)
+	if err != nil {
+		replyStatus(c, common.StatusReply{Code: 500, Error: fmt.Errorf("can't read link sales: %w", err).Error()})
+		return false
+	}
+
+	if (linkSales{Paid: counts.Paid, Pending: int64(len(pending))}).soldOut(l.Stock) {
+		replyStatus(c, common.StatusReply{Code: 410, Error: "payment link is sold out"})
+		return false
+	}
+
+	// API keys have limits of their own
+	if _, ok := requestKey(c); ok {
+		return true
+	}
+
+	// oldest one expires first
+	if reserved := reservedBy(l.Slug, c.ClientIP(), pending); len(reserved) >= linkReservationsPerIP {
+		wait := time.Duration(reserved[0].CreatedAt+reserved[0].Expiry-now.Unix()) * time.Second
+		tooManyRequests(c, wait, "too many pending payments of this payment link, pay or wait for one of them to expire")
+		return false
+	}
+
+	return true
+}
+
+// overStock returns true if payment `r`, created through payment link with stock, would be settled after the stock
+// ran out.  Payments already settled on the other rail were counted then.  Has to be called with the link locked.
+func overStock(r common.PaymentRecord, stock int64) (bool, error) {
+	settlements, err := db.Settlements()
+	if err != nil {
+		return false, err
+	}
+
+	if isSettled(settlements, r.Hash, r.Address) {
+		return false, nil
+	}
+
+	counts, err := db.LinkCounts(r.Link)
+	if err != nil {
+		return false, err
+	}
+
+	return counts.Paid >= stock, nil
+}
+
+// recordLinkSale records settlement of payment `p` created through a payment link, unless it was already recorded
+// (ex. by a status long-poll), so that the link's stock is used up even if nobody waits for the payment's status.
+// It's recorded before `p` is returned, as ones settled beyond stock aren't paid.
+func recordLinkSale(r common.PaymentRecord, p common.Payment) {
+	if r.Link == "" || !p.Paid {
+		return
+	}
+
+	settlements, err := db.Settlements()
+	if err != nil {
+		log.WithError(err).WithField("id", r.ID).Warningln("unable to check settlement of a payment link sale")
+		return
+	}
+
+	if isSettled(settlements, r.Hash, r.Address) {
+		return
+	}
+
+	rail, id := metrics.RailLn, r.Hash
+	if !p.LnPaid {
+		rail, id = metrics.RailBtc, r.Address
+	}
+
+	if saved, _ := saveSettlement(id, common.Settlement{PaidAt: time.Now().Unix()}); saved != nil && !saved.OverStock {
+		countSettlement(rail, r.CreatedAt, saved.PaidAt)
+	}
+}
+
+// filterLink returns only payments created through payment link with `slug`, or all of them if it's empty
+func filterLink(payments []common.Payment, slug string) []common.Payment {
+	if slug == "" {
+		return payments
+	}
+
+	var filtered []common.Payment
+	for _, p := range payments {
+		if p.Link == slug {
+			filtered = append(filtered, p)
+		}
+	}
+
+	return filtered
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lncm/invoicer/common"
+	"github.com/lncm/invoicer/store"
+)
+
+func TestLinkSales(t *testing.T) {
+	var sales linkSales
+	for _, p := range []common.Payment{
+		{Paid: true, LnAmount: 1000},
+		{Paid: true, BtcAmount: 2000, Expired: true},
+		{},
+		{Expired: true},
+	} {
+		sales.count(p)
+	}
+
+	if sales.Payments != 4 || sales.Paid != 2 || sales.Pending != 1 || sales.Received != 3000 {
+		t.Errorf("unexpected sales: %+v", sales)
+	}
+
+	for _, tc := range []struct {
+		stock   int64
+		soldOut bool
+	}{
+		{0, false},
+		{4, false},
+		{3, true},
+		{2, true},
+	} {
+		if soldOut := sales.soldOut(tc.stock); soldOut != tc.soldOut {
+			t.Errorf("stock %d: soldOut() = %t, expected %t", tc.stock, soldOut, tc.soldOut)
+		}
+	}
+}
+
+func TestFilterLink(t *testing.T) {
+	payments := []common.Payment{{Link: "coffee"}, {}, {Link: "tea"}, {Link: "coffee"}}
+
+	if filtered := filterLink(payments, ""); len(filtered) != 4 {
+		t.Errorf("expected all payments without slug, got %d", len(filtered))
+	}
+
+	if filtered := filterLink(payments, "coffee"); len(filtered) != 2 {
+		t.Errorf("expected 2 payments, got %d", len(filtered))
+	}
+}
+
+func TestFindLink(t *testing.T) {
+	defer useTestStore(t)()
+	defer func(prev common.Config) { conf = prev }(conf)
+
+	conf = common.Config{Links: []common.PaymentLink{{Slug: "coffee", Amount: 1000, FromConfig: true}}}
+
+	if err := db.AddLink(common.PaymentLink{Slug: "tea", Amount: 500}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.AddLink(common.PaymentLink{Slug: "tea", Amount: 600}); !errors.Is(err, store.ErrLinkExists) {
+		t.Errorf("expected ErrLinkExists, got %v", err)
+	}
+
+	l, err := findLink("coffee")
+	if err != nil || !l.FromConfig {
+		t.Errorf("expected link from the config file, got %+v (%v)", l, err)
+	}
+
+	l, err = findLink("tea")
+	if err != nil || l.Amount != 500 {
+		t.Errorf("expected stored link, got %+v (%v)", l, err)
+	}
+
+	if err := db.DeleteLink("tea"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := findLink("tea"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("expected ErrNotFound after delete, got %v", err)
+	}
+
+	if err := db.DeleteLink("tea"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("expected ErrNotFound deleting twice, got %v", err)
+	}
+}
+
+func TestPayLinkStock(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer useTestStore(t)()
+	defer func(prev LightningClient) { lnClient = prev }(lnClient)
+	defer func(prev common.Config) { conf = prev }(conf)
+
+	conf = common.Config{Links: []common.PaymentLink{{Slug: "coffee", Amount: 1000, Only: "ln", Stock: 3, FromConfig: true}}}
+
+	defer func(prev BitcoinClient) { btcClient = prev }(btcClient)
+
+	ln := fakeLn{invoices: map[string]common.Invoice{}}
+	lnClient, btcClient = ln, fakeBtc{}
+
+	visit := func(ip string) int {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "/pay/coffee", nil)
+		c.Request.RemoteAddr = ip + ":1234"
+		c.Params = gin.Params{{Key: "slug", Value: "coffee"}}
+
+		payLink(c)
+
+		return w.Code
+	}
+
+	for i, tc := range []struct {
+		ip   string
+		code int
+	}{
+		{"192.0.2.1", 200},
+		{"192.0.2.1", 200},
+		{"192.0.2.1", 429}, // can't reserve the whole stock alone
+		{"192.0.2.2", 200},
+		{"192.0.2.3", 410}, // pending payments reserve stock
+	} {
+		if code := visit(tc.ip); code != tc.code {
+			t.Fatalf("visit %d: got %d, expected %d", i, code, tc.code)
+		}
+	}
+
+	records, err := db.Payments()
+	if err != nil || len(records) != 3 {
+		t.Fatalf("expected 3 payments, got %d (%v)", len(records), err)
+	}
+
+	for _, r := range records[:2] {
+		invoice := ln.invoices[r.Hash]
+		invoice.Paid, invoice.Received, invoice.ReceivedMsat = true, 1000, 1000000
+		ln.invoices[r.Hash] = invoice
+	}
+
+	// a long-poll seeing the first one paid
+	if _, err := db.AddSettlement(records[0].Hash, common.Settlement{PaidAt: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// nobody waiting for the second one, so it's only recorded when its state is fetched
+
+	if _, _, err := fetchPayment(context.Background(), records[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	counts, err := db.LinkCounts("coffee")
+	if err != nil || counts.Created != 3 || counts.Paid != 2 {
+		t.Errorf("unexpected counts: %+v (%v)", counts, err)
+	}
+
+	if code := visit("192.0.2.3"); code != 410 {
+		t.Errorf("sold out link: got %d, expected 410", code)
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/api/links/coffee", nil)
+	c.Params = gin.Params{{Key: "slug", Value: "coffee"}}
+
+	getLink(c)
+
+	var reply linkReply
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil || reply.Sales.Remaining == nil || *reply.Sales.Remaining != 0 ||
+		reply.Sales.Paid != 2 || reply.Sales.Pending != 1 {
+		t.Errorf("unexpected sales: %s", w.Body)
+	}
+}
+
+func TestOverStock(t *testing.T) {
+	defer useTestStore(t)()
+	defer func(prev common.Config) { conf = prev }(conf)
+
+	conf = common.Config{Links: []common.PaymentLink{{Slug: "coffee", Amount: 1000, Stock: 1, FromConfig: true}}}
+
+	for _, id := range []string{"1", "2"} {
+		err := db.AddPayment(common.PaymentRecord{
+			NewPayment: common.NewPayment{ID: "pay_" + id, Hash: "h" + id, Address: "a" + id},
+			Link:       "coffee",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		id        string
+		overStock bool
+	}{
+		{"h1", false},
+		{"a1", false}, // the same payment, paid on the other rail too
+		{"a2", true},  // paid late, after the only one was sold
+	} {
+		saved, err := saveSettlement(tc.id, common.Settlement{PaidAt: 1})
+		if err != nil || saved == nil || saved.OverStock != tc.overStock {
+			t.Errorf("%s: got %+v (%v), expected over stock: %t", tc.id, saved, err, tc.overStock)
+		}
+	}
+
+	if counts, err := db.LinkCounts("coffee"); err != nil || counts.Paid != 1 {
+		t.Errorf("unexpected counts: %+v (%v)", counts, err)
+	}
+
+	payments := []common.Payment{
+		{NewPayment: common.NewPayment{Hash: "h1", Address: "a1"}, Paid: true},
+		{NewPayment: common.NewPayment{Hash: "h2", Address: "a2"}, Paid: true},
+	}
+
+	if err := applySettlements(payments); err != nil {
+		t.Fatal(err)
+	}
+
+	if !payments[0].Paid || payments[0].OverStock || payments[1].Paid || !payments[1].OverStock {
+		t.Errorf("unexpected payments: %+v", payments)
+	}
+}
@@ -7,14 +7,23 @@ import (
 )
 
 type LightningClient interface {
+	Ready() bool
+	Health() common.LndHealth
 	NewAddress(ctx context.Context, bech32 bool) (string, error)
 	Info(ctx context.Context) (common.Info, error)
-	NewInvoice(ctx context.Context, amount int64, desc string) (string, string, error)
+	NewInvoice(ctx context.Context, amountMsat int64, desc string) (string, string, error)
 	Status(ctx context.Context, hash string) (common.Status, error)
 	StatusWait(ctx context.Context, hash string) (common.Status, error)
+	Invoice(ctx context.Context, hash string) (common.Invoice, error)
 	History(ctx context.Context) (common.Invoices, error)
+	DecodeInvoice(ctx context.Context, bolt11 string) (common.Invoice, error)
+	PayInvoice(ctx context.Context, bolt11 string, amount, feeLimit int64) (preimage string, fee int64, err error)
+	SendCoins(ctx context.Context, address string, amount int64) (txid string, fee int64, err error)
+	PaymentOutcome(ctx context.Context, bolt11 string) (preimage string, fee int64, err error)
+	SentCoins(ctx context.Context, address string, amount int64) (fees map[string]int64, err error)
+	Close() error
 }
 
-func Start(conf common.LndConfig) (Lnd, error) {
+func Start(conf common.LndConfig) (*Lnd, error) {
 	return startClient(conf)
 }
@@ -1,8 +1,16 @@
 package ln
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"testing"
 
+	"github.com/lncm/lnd-rpc/v0.9.0/lnrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
 	"github.com/lncm/invoicer/common"
 )
 
@@ -16,3 +24,64 @@ func TestNew(t *testing.T) {
 
 	_, _ = Start(conf)
 }
+
+func TestToInvoice(t *testing.T) {
+	inv := &lnrpc.Invoice{Value: 1, ValueMsat: 1500, AmtPaidSat: 1, AmtPaidMsat: 1500, State: lnrpc.Invoice_SETTLED}
+
+	invoice := toInvoice(inv)
+	if invoice.Amount != 2 || invoice.AmountMsat != 1500 || invoice.Received != 1 || invoice.ReceivedMsat != 1500 {
+		t.Errorf("unexpected amounts: %+v", invoice)
+	}
+
+	status := toStatus(inv)
+	if status.Value != 1 || status.ValueMsat != 1500 || !status.Settled {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	// invoices without amount report what was paid
+	status = toStatus(&lnrpc.Invoice{AmtPaidSat: 2, AmtPaidMsat: 2500})
+	if status.Value != 2 || status.ValueMsat != 2500 {
+		t.Errorf("unexpected status of invoice without amount: %+v", status)
+	}
+}
+
+func TestIsTransportError(t *testing.T) {
+	for err, expected := range map[error]bool{
+		status.Error(codes.Unavailable, "transport is closing"): true,
+		status.Error(codes.DeadlineExceeded, "deadline"):        true,
+		fmt.Errorf("sending: %w", context.Canceled):             true,
+		status.Error(codes.Unknown, "insufficient funds"):       false,
+		errors.New("checksum mismatch"):                         false,
+	} {
+		if isTransportError(err) != expected {
+			t.Errorf("isTransportError(%v) = %t, expected %t", err, !expected, expected)
+		}
+	}
+}
+
+func TestObserveRPC(t *testing.T) {
+	for _, tc := range []struct {
+		err         error
+		unavailable bool
+	}{
+		{nil, false},
+		{status.Error(codes.Unknown, "insufficient funds"), false},
+		{status.Error(codes.Unavailable, "connection refused"), true},
+	} {
+		lnd := &Lnd{connected: true, reachable: true}
+
+		invoker := func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+			return tc.err
+		}
+
+		err := lnd.observeRPC(context.Background(), "/lnrpc.Lightning/GetInfo", nil, nil, nil, invoker)
+		if errors.Is(err, common.ErrBackendUnavailable) != tc.unavailable || lnd.Ready() == tc.unavailable {
+			t.Errorf("%v: got %v, ready: %t", tc.err, err, lnd.Ready())
+		}
+
+		// callers can still tell what happened
+		if status.Code(err) != status.Code(tc.err) || isTransportError(err) != tc.unavailable {
+			t.Errorf("%v: gRPC status lost: %v", tc.err, err)
+		}
+	}
+}
@@ -3,18 +3,25 @@ package ln
 import (
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 	"gopkg.in/macaroon.v2"
 
 	"github.com/lncm/lnd-rpc/v0.9.0/lnrpc"
 
 	"github.com/lncm/invoicer/common"
+	"github.com/lncm/invoicer/metrics"
 )
 
 const (
@@ -23,24 +30,118 @@ const (
 	DefaultTLS      = "~/.lncm/tls.cert"
 	DefaultInvoice  = "~/.lncm/invoice.macaroon"
 	DefaultReadOnly = "~/.lncm/readonly.macaroon"
+
+	// Number of invoices fetched from lnd at once
+	historyPageSize = 100
+
+	// How often connection to lnd is re-attempted when it's not (yet) available
+	reconnectInterval = 10 * time.Second
+
+	// Number of blocks on-chain refunds are expected to confirm within
+	sendCoinsTargetConf = 6
 )
 
+// ErrNoAdminMacaroon is returned by calls that send funds, if `[lnd.macaroon] admin` is not configured
+var ErrNoAdminMacaroon = errors.New("lnd: admin macaroon not configured")
+
 // LndConfig config
 type Lnd struct {
+	conf common.LndConfig
+
+	mu sync.RWMutex
+
 	// Used to generate invoices and monitor their status
 	invoiceClient lnrpc.LightningClient
 
 	// Used to access history and lnd's connection string
 	readOnlyClient lnrpc.LightningClient
 
+	// Used to pay refunds.  nil, unless admin macaroon is configured.
+	adminClient lnrpc.LightningClient
+
 	notifier InvoiceMonitor
+
+	conns []*grpc.ClientConn
+
+	// Set once both clients are connected, and the invoice subscription is running
+	connected bool
+
+	// Result of the most recent connection check
+	reachable bool
+
+	lastCheck, lastSuccess time.Time
+	lastErr                error
+}
+
+// Ready returns true if lnd is connected, and was reachable during the last connection check
+func (lnd *Lnd) Ready() bool {
+	lnd.mu.RLock()
+	defer lnd.mu.RUnlock()
+
+	return lnd.connected && lnd.reachable
+}
+
+// Health returns the outcome of the most recent connection check, and the state of the invoice subscription
+func (lnd *Lnd) Health() (h common.LndHealth) {
+	lnd.mu.RLock()
+	defer lnd.mu.RUnlock()
+
+	h.Reachable = lnd.connected && lnd.reachable
+	h.Subscribed = lnd.connected && lnd.notifier.Subscribed()
+
+	if !lnd.lastCheck.IsZero() {
+		h.LastCheck = lnd.lastCheck.Unix()
+	}
+
+	if !lnd.lastSuccess.IsZero() {
+		h.LastSuccess = lnd.lastSuccess.Unix()
+	}
+
+	if lnd.lastErr != nil {
+		h.Error = lnd.lastErr.Error()
+	}
+
+	return
+}
+
+func (lnd *Lnd) clients() (invoiceClient, readOnlyClient lnrpc.LightningClient, err error) {
+	lnd.mu.RLock()
+	defer lnd.mu.RUnlock()
+
+	if !lnd.connected {
+		return nil, nil, fmt.Errorf("lnd: %w", common.ErrBackendUnavailable)
+	}
+
+	return lnd.invoiceClient, lnd.readOnlyClient, nil
 }
 
-func (lnd Lnd) NewInvoice(ctx context.Context, amount int64, desc string) (invoice, hash string, err error) {
-	inv, err := lnd.invoiceClient.AddInvoice(ctx, &lnrpc.Invoice{
-		Memo:   desc,
-		Value:  amount,
-		Expiry: common.DefaultInvoiceExpiry,
+// admin returns client able to send funds
+func (lnd *Lnd) admin() (lnrpc.LightningClient, error) {
+	lnd.mu.RLock()
+	defer lnd.mu.RUnlock()
+
+	if !lnd.connected {
+		return nil, fmt.Errorf("lnd: %w", common.ErrBackendUnavailable)
+	}
+
+	if lnd.adminClient == nil {
+		return nil, ErrNoAdminMacaroon
+	}
+
+	return lnd.adminClient, nil
+}
+
+// NewInvoice creates an invoice for `amountMsat` millisatoshis, or for any amount, if it's 0
+func (lnd *Lnd) NewInvoice(ctx context.Context, amountMsat int64, desc string) (invoice, hash string, err error) {
+	invoiceClient, _, err := lnd.clients()
+	if err != nil {
+		return
+	}
+
+	inv, err := invoiceClient.AddInvoice(ctx, &lnrpc.Invoice{
+		Memo:      desc,
+		ValueMsat: amountMsat,
+		Expiry:    common.DefaultInvoiceExpiry,
 	})
 	if err != nil {
 		return
@@ -48,56 +149,51 @@ func (lnd Lnd) NewInvoice(ctx context.Context, amount int64, desc string) (invoi
 	return inv.GetPaymentRequest(), hex.EncodeToString(inv.GetRHash()), nil
 }
 
-func (lnd Lnd) StatusWait(ctx context.Context, hash string) (s common.Status, err error) {
-	inv, err := lnd.notifier.Status(ctx, hash)
+func (lnd *Lnd) StatusWait(ctx context.Context, hash string) (s common.Status, err error) {
+	_, _, err = lnd.clients()
 	if err != nil {
-		return common.Status{}, err
+		return
 	}
 
-	val := inv.GetValue()
-	if val == 0 {
-		val = inv.GetAmtPaidSat()
+	inv, err := lnd.notifier.Status(ctx, hash)
+	if err != nil {
+		return common.Status{}, err
 	}
 
-	return common.Status{
-		Ts:      inv.GetCreationDate(),
-		Settled: inv.GetState() == lnrpc.Invoice_SETTLED,
-		Expiry:  inv.GetExpiry(),
-		Value:   val,
-	}, nil
+	return toStatus(inv), nil
 }
 
-func (lnd Lnd) Status(ctx context.Context, hash string) (s common.Status, err error) {
-	invID, err := hex.DecodeString(hash)
+func (lnd *Lnd) Status(ctx context.Context, hash string) (s common.Status, err error) {
+	invoiceClient, _, err := lnd.clients()
 	if err != nil {
 		return
 	}
 
-	inv, err := lnd.invoiceClient.LookupInvoice(ctx, &lnrpc.PaymentHash{RHash: invID})
+	invID, err := hex.DecodeString(hash)
 	if err != nil {
 		return
 	}
 
-	val := inv.GetValue()
-	if val == 0 {
-		val = inv.GetAmtPaidSat()
+	inv, err := invoiceClient.LookupInvoice(ctx, &lnrpc.PaymentHash{RHash: invID})
+	if err != nil {
+		return
 	}
 
-	return common.Status{
-		Ts:      inv.GetCreationDate(),
-		Settled: inv.GetState() == lnrpc.Invoice_SETTLED,
-		Expiry:  inv.GetExpiry(),
-		Value:   val,
-	}, nil
+	return toStatus(inv), nil
 }
 
-func (lnd Lnd) NewAddress(ctx context.Context, bech32 bool) (address string, err error) {
+func (lnd *Lnd) NewAddress(ctx context.Context, bech32 bool) (address string, err error) {
+	invoiceClient, _, err := lnd.clients()
+	if err != nil {
+		return
+	}
+
 	addrType := lnrpc.AddressType_NESTED_PUBKEY_HASH
 	if bech32 {
 		addrType = lnrpc.AddressType_WITNESS_PUBKEY_HASH
 	}
 
-	addrResp, err := lnd.invoiceClient.NewAddress(ctx, &lnrpc.NewAddressRequest{
+	addrResp, err := invoiceClient.NewAddress(ctx, &lnrpc.NewAddressRequest{
 		Type: addrType,
 	})
 	if err != nil {
@@ -107,8 +203,13 @@ func (lnd Lnd) NewAddress(ctx context.Context, bech32 bool) (address string, err
 	return addrResp.GetAddress(), nil
 }
 
-func (lnd Lnd) Info(ctx context.Context) (info common.Info, err error) {
-	i, err := lnd.readOnlyClient.GetInfo(ctx, &lnrpc.GetInfoRequest{})
+func (lnd *Lnd) Info(ctx context.Context) (info common.Info, err error) {
+	_, readOnlyClient, err := lnd.clients()
+	if err != nil {
+		return
+	}
+
+	i, err := readOnlyClient.GetInfo(ctx, &lnrpc.GetInfoRequest{})
 	if err != nil {
 		return
 	}
@@ -116,35 +217,297 @@ func (lnd Lnd) Info(ctx context.Context) (info common.Info, err error) {
 	return common.Info{Uris: i.GetUris()}, nil
 }
 
-func (lnd Lnd) History(ctx context.Context) (invoices common.Invoices, err error) {
-	invoiceList, err := lnd.readOnlyClient.ListInvoices(ctx, &lnrpc.ListInvoiceRequest{
-		NumMaxInvoices: 100,
-		Reversed:       true,
-	})
+func (lnd *Lnd) History(ctx context.Context) (invoices common.Invoices, err error) {
+	_, readOnlyClient, err := lnd.clients()
 	if err != nil {
 		return
 	}
 
-	for _, inv := range invoiceList.Invoices {
-		invoices = append(invoices, common.Invoice{
-			Description: inv.GetMemo(),
-			Amount:      inv.GetValue(),
-			Paid:        inv.GetState() == lnrpc.Invoice_SETTLED,
-			PaidAt:      inv.GetSettleDate(),
-			Expired:     inv.GetCreationDate()+inv.GetExpiry() < time.Now().Unix(),
-			NewPayment: common.NewPayment{
-				Bolt11:    inv.GetPaymentRequest(),
-				Hash:      hex.EncodeToString(inv.GetRHash()),
-				CreatedAt: inv.GetCreationDate(),
-				Expiry:    inv.GetExpiry(),
-			},
+	// Fetch all invoices, page by page, starting from the newest
+	var offset uint64
+	for {
+		invoiceList, err := readOnlyClient.ListInvoices(ctx, &lnrpc.ListInvoiceRequest{
+			NumMaxInvoices: historyPageSize,
+			IndexOffset:    offset,
+			Reversed:       true,
 		})
+		if err != nil {
+			return nil, err
+		}
+
+		var page common.Invoices
+		for _, inv := range invoiceList.Invoices {
+			page = append(page, toInvoice(inv))
+		}
+
+		// Pages come oldest-first, so older ones go in front
+		invoices = append(page, invoices...)
+
+		if len(invoiceList.Invoices) < historyPageSize || invoiceList.GetFirstIndexOffset() <= 1 {
+			return invoices, nil
+		}
+
+		offset = invoiceList.GetFirstIndexOffset()
 	}
+}
 
-	return
+// Invoice returns a single invoice with all the details `History` has
+func (lnd *Lnd) Invoice(ctx context.Context, hash string) (invoice common.Invoice, err error) {
+	invoiceClient, _, err := lnd.clients()
+	if err != nil {
+		return
+	}
+
+	invID, err := hex.DecodeString(hash)
+	if err != nil {
+		return
+	}
+
+	inv, err := invoiceClient.LookupInvoice(ctx, &lnrpc.PaymentHash{RHash: invID})
+	if err != nil {
+		// lnd doesn't use NotFound code for missing invoices, only the message tells
+		if status.Code(err) == codes.NotFound || strings.Contains(err.Error(), "unable to locate invoice") {
+			err = fmt.Errorf("%s: %w", hash, common.ErrInvoiceNotFound)
+		}
+
+		return
+	}
+
+	return toInvoice(inv), nil
+}
+
+// DecodeInvoice returns amount, hash, and expiry of someone else's `bolt11` invoice.  Invoices for other networks
+// are rejected by lnd.
+func (lnd *Lnd) DecodeInvoice(ctx context.Context, bolt11 string) (invoice common.Invoice, err error) {
+	_, readOnlyClient, err := lnd.clients()
+	if err != nil {
+		return
+	}
+
+	payReq, err := readOnlyClient.DecodePayReq(ctx, &lnrpc.PayReqString{PayReq: bolt11})
+	if err != nil {
+		return
+	}
+
+	return common.Invoice{
+		Description: payReq.GetDescription(),
+		Amount:      payReq.GetNumSatoshis(),
+		AmountMsat:  payReq.GetNumMsat(),
+		Expired:     payReq.GetTimestamp()+payReq.GetExpiry() < time.Now().Unix(),
+		NewPayment: common.NewPayment{
+			Bolt11:    bolt11,
+			Hash:      payReq.GetPaymentHash(),
+			CreatedAt: payReq.GetTimestamp(),
+			Expiry:    payReq.GetExpiry(),
+		},
+	}, nil
 }
 
-func (lnd Lnd) checkConnectionStatus() {
+// PayInvoice pays `bolt11`, and waits for the payment to complete.  `amount` is only used if `bolt11` doesn't
+// specify one.  Routing fees can't exceed `feeLimit`.  Only failures lnd reports in `payment_error` wrap
+// `common.ErrPaymentFailed`, as with other errors the payment might still be in flight.
+func (lnd *Lnd) PayInvoice(ctx context.Context, bolt11 string, amount, feeLimit int64) (preimage string, fee int64, err error) {
+	adminClient, err := lnd.admin()
+	if err != nil {
+		return "", 0, fmt.Errorf("%w: %s", common.ErrPaymentFailed, err)
+	}
+
+	res, err := adminClient.SendPaymentSync(ctx, &lnrpc.SendRequest{
+		PaymentRequest: bolt11,
+		Amt:            amount,
+		FeeLimit:       &lnrpc.FeeLimit{Limit: &lnrpc.FeeLimit_Fixed{Fixed: feeLimit}},
+	})
+	if err != nil {
+		return
+	}
+
+	if res.GetPaymentError() != "" {
+		return "", 0, fmt.Errorf("%w: %s", common.ErrPaymentFailed, res.GetPaymentError())
+	}
+
+	return hex.EncodeToString(res.GetPaymentPreimage()), res.GetPaymentRoute().GetTotalFeesMsat() / 1000, nil
+}
+
+// SendCoins sends `amount` on-chain to `address` at a fee rate lnd estimates for confirmation within
+// `sendCoinsTargetConf` blocks.  Errors wrap `common.ErrPaymentFailed`, unless lnd couldn't be reached while sending.
+func (lnd *Lnd) SendCoins(ctx context.Context, address string, amount int64) (txid string, fee int64, err error) {
+	adminClient, err := lnd.admin()
+	if err != nil {
+		return "", 0, fmt.Errorf("%w: %s", common.ErrPaymentFailed, err)
+	}
+
+	estimate, err := adminClient.EstimateFee(ctx, &lnrpc.EstimateFeeRequest{
+		AddrToAmount: map[string]int64{address: amount},
+		TargetConf:   sendCoinsTargetConf,
+	})
+	if err != nil {
+		return "", 0, fmt.Errorf("%w: unable to estimate fee: %s", common.ErrPaymentFailed, err)
+	}
+
+	res, err := adminClient.SendCoins(ctx, &lnrpc.SendCoinsRequest{
+		Addr:       address,
+		Amount:     amount,
+		SatPerByte: estimate.GetFeerateSatPerByte(),
+	})
+	if err != nil {
+		if !isTransportError(err) {
+			// lnd replied, so it rejected the transaction, and didn't broadcast it
+			err = fmt.Errorf("%w: %s", common.ErrPaymentFailed, err)
+		}
+
+		return
+	}
+
+	return res.GetTxid(), estimate.GetFeeSat(), nil
+}
+
+// PaymentOutcome returns preimage, and fee of payment of `bolt11` made by lnd.  Errors wrap
+// `common.ErrPaymentFailed`, if lnd gave up on the payment, or has never started it, and `common.ErrPaymentInFlight`,
+// if it's not complete yet.
+func (lnd *Lnd) PaymentOutcome(ctx context.Context, bolt11 string) (preimage string, fee int64, err error) {
+	adminClient, err := lnd.admin()
+	if err != nil {
+		return
+	}
+
+	res, err := adminClient.ListPayments(ctx, &lnrpc.ListPaymentsRequest{IncludeIncomplete: true})
+	if err != nil {
+		return
+	}
+
+	for _, p := range res.GetPayments() {
+		if p.GetPaymentRequest() != bolt11 {
+			continue
+		}
+
+		switch p.GetStatus() {
+		case lnrpc.Payment_SUCCEEDED:
+			return p.GetPaymentPreimage(), p.GetFeeSat(), nil
+
+		case lnrpc.Payment_FAILED:
+			return "", 0, fmt.Errorf("%w: lnd gave up on it", common.ErrPaymentFailed)
+		}
+
+		return "", 0, common.ErrPaymentInFlight
+	}
+
+	return "", 0, fmt.Errorf("%w: lnd has never started it", common.ErrPaymentFailed)
+}
+
+// SentCoins returns fees of transactions lnd has sent exactly `amount` to `address` in, keyed by their IDs.  Errors
+// wrap `common.ErrPaymentFailed`, if there are none.
+func (lnd *Lnd) SentCoins(ctx context.Context, address string, amount int64) (fees map[string]int64, err error) {
+	adminClient, err := lnd.admin()
+	if err != nil {
+		return
+	}
+
+	res, err := adminClient.GetTransactions(ctx, &lnrpc.GetTransactionsRequest{})
+	if err != nil {
+		return
+	}
+
+	fees = make(map[string]int64)
+	for _, tx := range res.GetTransactions() {
+		// amounts of sent transactions are negative, and include fees
+		if -tx.GetAmount()-tx.GetTotalFees() != amount {
+			continue
+		}
+
+		for _, dest := range tx.GetDestAddresses() {
+			if dest == address {
+				fees[tx.GetTxHash()] = tx.GetTotalFees()
+			}
+		}
+	}
+
+	if len(fees) == 0 {
+		return nil, fmt.Errorf("%w: lnd's wallet has no such transaction", common.ErrPaymentFailed)
+	}
+
+	return fees, nil
+}
+
+// isTransportError returns true for errors that don't come from lnd itself, ex. a lost connection, or a timeout.
+// Whatever was requested might've been done anyway.
+func isTransportError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled:
+		return true
+	}
+
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// toStatus returns amount requested by `inv`, or (for invoices without amount) paid to it
+func toStatus(inv *lnrpc.Invoice) common.Status {
+	val, valMsat := inv.GetValue(), inv.GetValueMsat()
+	if valMsat == 0 {
+		val, valMsat = inv.GetAmtPaidSat(), inv.GetAmtPaidMsat()
+	}
+
+	return common.Status{
+		Ts:        inv.GetCreationDate(),
+		Settled:   inv.GetState() == lnrpc.Invoice_SETTLED,
+		Expiry:    inv.GetExpiry(),
+		Value:     val,
+		ValueMsat: valMsat,
+	}
+}
+
+func toInvoice(inv *lnrpc.Invoice) common.Invoice {
+	invoice := common.Invoice{
+		Description:  inv.GetMemo(),
+		Amount:       common.MsatToSat(inv.GetValueMsat()),
+		AmountMsat:   inv.GetValueMsat(),
+		Paid:         inv.GetState() == lnrpc.Invoice_SETTLED,
+		PaidAt:       inv.GetSettleDate(),
+		Expired:      inv.GetCreationDate()+inv.GetExpiry() < time.Now().Unix(),
+		Received:     inv.GetAmtPaidSat(),
+		ReceivedMsat: inv.GetAmtPaidMsat(),
+		NewPayment: common.NewPayment{
+			Bolt11:    inv.GetPaymentRequest(),
+			Hash:      hex.EncodeToString(inv.GetRHash()),
+			CreatedAt: inv.GetCreationDate(),
+			Expiry:    inv.GetExpiry(),
+		},
+	}
+
+	if invoice.Paid {
+		invoice.Preimage = hex.EncodeToString(inv.GetRPreimage())
+	}
+
+	return invoice
+}
+
+// setCheckResult records the outcome of a connection check
+func (lnd *Lnd) setCheckResult(err error) {
+	lnd.mu.Lock()
+	defer lnd.mu.Unlock()
+
+	lnd.lastCheck = time.Now()
+	lnd.lastErr = err
+	lnd.reachable = err == nil
+
+	if err == nil {
+		lnd.lastSuccess = lnd.lastCheck
+	}
+}
+
+// setUnreachable marks lnd as not ready until the next successful connection check
+func (lnd *Lnd) setUnreachable(err error) {
+	lnd.mu.Lock()
+	defer lnd.mu.Unlock()
+
+	if lnd.connected && lnd.reachable {
+		log.WithError(err).Warningln("lnd connection lost")
+	}
+
+	lnd.reachable = false
+	lnd.lastErr = err
+}
+
+func (lnd *Lnd) checkConnectionStatus() {
 	failures := 0
 
 	for {
@@ -162,23 +525,130 @@ func (lnd Lnd) checkConnectionStatus() {
 
 		cancel()
 
+		lnd.setCheckResult(err)
+
 		if failures > 0 {
 			log.WithField("count", failures).Printf("lnd unreachable")
 		}
 
-		time.Sleep(time.Minute)
+		// requests that find lnd unreachable get it re-checked sooner
+		time.Sleep(reconnectInterval)
+		for slept := reconnectInterval; failures == 0 && slept < time.Minute && lnd.Ready(); slept += reconnectInterval {
+			time.Sleep(reconnectInterval)
+		}
+	}
+}
+
+// connect reads all credentials, establishes connections to lnd, and starts the invoice subscription.  Nothing is
+// changed if any of these steps fail.
+func (lnd *Lnd) connect() (err error) {
+	transportCredentials, err := credentials.NewClientTLSFromFile(lnd.conf.TLS, lnd.conf.Host)
+	if err != nil {
+		return fmt.Errorf("unable to read TLS certificate: %w", err)
+	}
+
+	hostname := fmt.Sprintf("%s:%d", lnd.conf.Host, lnd.conf.Port)
+
+	readOnlyConn, err := lnd.getConn(transportCredentials, hostname, lnd.conf.Macaroons.ReadOnly)
+	if err != nil {
+		return err
+	}
+
+	invoiceConn, err := lnd.getConn(transportCredentials, hostname, lnd.conf.Macaroons.Invoice)
+	if err != nil {
+		_ = readOnlyConn.Close()
+		return err
+	}
+
+	conns := []*grpc.ClientConn{readOnlyConn, invoiceConn}
+
+	var adminClient lnrpc.LightningClient
+	if lnd.conf.Macaroons.Admin != "" {
+		adminConn, err := lnd.getConn(transportCredentials, hostname, lnd.conf.Macaroons.Admin)
+		if err != nil {
+			_ = readOnlyConn.Close()
+			_ = invoiceConn.Close()
+			return err
+		}
+
+		adminClient = lnrpc.NewLightningClient(adminConn)
+		conns = append(conns, adminConn)
+	}
+
+	invoiceClient := lnrpc.NewLightningClient(invoiceConn)
+
+	notifier, err := NewNotifier(invoiceClient)
+	if err != nil {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+
+		return fmt.Errorf("unable to subscribe to invoices: %w", err)
+	}
+
+	lnd.mu.Lock()
+	lnd.invoiceClient = invoiceClient
+	lnd.readOnlyClient = lnrpc.NewLightningClient(readOnlyConn)
+	lnd.notifier = notifier
+	lnd.adminClient = adminClient
+	lnd.conns = conns
+	lnd.connected = true
+	lnd.reachable = true
+	lnd.lastCheck = time.Now()
+	lnd.lastSuccess = lnd.lastCheck
+	lnd.lastErr = nil
+	lnd.mu.Unlock()
+
+	return nil
+}
+
+// Close ends invoice subscription, and closes all connections to lnd
+func (lnd *Lnd) Close() (err error) {
+	lnd.mu.Lock()
+	defer lnd.mu.Unlock()
+
+	if !lnd.connected {
+		return nil
+	}
+
+	lnd.connected = false
+	lnd.notifier.Stop()
+
+	for _, conn := range lnd.conns {
+		if closeErr := conn.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+
+	return
+}
+
+// reconnect keeps trying to connect to lnd until it succeeds
+func (lnd *Lnd) reconnect() {
+	for failures := 1; ; failures++ {
+		time.Sleep(reconnectInterval)
+
+		err := lnd.connect()
+		if err == nil {
+			log.WithField("count", failures).Println("lnd connection established")
+			return
+		}
+
+		lnd.setCheckResult(err)
+
+		log.WithError(err).WithField("count", failures).Warningln("lnd still unavailable")
 	}
 }
 
-func getClient(transportCredentials credentials.TransportCredentials, fullHostname, file string) lnrpc.LightningClient {
+func (lnd *Lnd) getConn(transportCredentials credentials.TransportCredentials, fullHostname, file string) (*grpc.ClientConn, error) {
 	macaroonBytes, err := ioutil.ReadFile(file)
 	if err != nil {
-		panic(fmt.Sprintln("Cannot read macaroon file", err))
+		return nil, fmt.Errorf("cannot read macaroon file: %w", err)
 	}
 
 	mac := &macaroon.Macaroon{}
 	if err = mac.UnmarshalBinary(macaroonBytes); err != nil {
-		panic(fmt.Sprintln("Cannot unmarshal macaroon", err))
+		return nil, fmt.Errorf("cannot unmarshal macaroon (%s): %w", file, err)
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -188,15 +658,18 @@ func getClient(transportCredentials credentials.TransportCredentials, fullHostna
 		grpc.WithBlock(),
 		grpc.WithTransportCredentials(transportCredentials),
 		grpc.WithPerRPCCredentials(newCreds(macaroonBytes)),
+		grpc.WithUnaryInterceptor(lnd.observeRPC),
 	}...)
 	if err != nil {
-		panic(fmt.Errorf("unable to connect to %s: %w", fullHostname, err))
+		return nil, fmt.Errorf("unable to connect to %s: %w", fullHostname, err)
 	}
 
-	return lnrpc.NewLightningClient(connection)
+	return connection, nil
 }
 
-func startClient(conf common.LndConfig) (c Lnd, err error) {
+// startClient never fails on lnd being unavailable.  Instead, the returned client reports itself as not ready,
+// and keeps trying to connect in the background.
+func startClient(conf common.LndConfig) (c *Lnd, err error) {
 	if conf.Host == "" {
 		conf.Host = DefaultHostname
 	}
@@ -219,33 +692,57 @@ func startClient(conf common.LndConfig) (c Lnd, err error) {
 		conf.Macaroons.ReadOnly = DefaultReadOnly
 	}
 	conf.Macaroons.ReadOnly = common.CleanAndExpandPath(conf.Macaroons.ReadOnly)
+	conf.Macaroons.Admin = common.CleanAndExpandPath(conf.Macaroons.Admin)
+
+	c = &Lnd{conf: conf}
 
-	transportCredentials, err := credentials.NewClientTLSFromFile(conf.TLS, conf.Host)
+	err = c.connect()
 	if err != nil {
-		return c, err
+		log.WithError(err).Warningln("lnd unavailable, starting in degraded mode")
+		c.setCheckResult(err)
+
+		go func() {
+			c.reconnect()
+			c.checkConnectionStatus()
+		}()
+
+		return c, nil
 	}
 
-	hostname := fmt.Sprintf("%s:%d", conf.Host, conf.Port)
+	go c.checkConnectionStatus()
 
-	readOnlyClient := getClient(transportCredentials, hostname, conf.Macaroons.ReadOnly)
-	invoiceClient := getClient(transportCredentials, hostname, conf.Macaroons.Invoice)
+	return c, nil
+}
 
-	notifier, err := NewNotifier(invoiceClient)
-	if err != nil {
-		return c, err
-	}
+// observeRPC records latency, and errors of all unary calls made to lnd.  Calls that find lnd unreachable mark it as
+// not ready, and return `unavailableError`.
+func (lnd *Lnd) observeRPC(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
 
-	c = Lnd{
-		invoiceClient:  invoiceClient,
-		readOnlyClient: readOnlyClient,
-		notifier:       notifier,
+	// `/lnrpc.Lightning/AddInvoice` -> `AddInvoice`
+	metrics.ObserveRPC(metrics.BackendLnd, path.Base(method), start, err)
+
+	if status.Code(err) == codes.Unavailable {
+		lnd.setUnreachable(err)
+		return unavailableError{err}
 	}
 
-	go c.checkConnectionStatus()
+	return err
+}
 
-	return c, nil
+// unavailableError is a gRPC error returned when lnd can't be reached.  It matches `common.ErrBackendUnavailable`,
+// and keeps its gRPC status.
+type unavailableError struct{ error }
+
+func (e unavailableError) Error() string {
+	return fmt.Sprintf("lnd: %s: %s", common.ErrBackendUnavailable, e.error)
 }
 
+func (e unavailableError) Is(target error) bool { return target == common.ErrBackendUnavailable }
+
+func (e unavailableError) GRPCStatus() *status.Status { return status.Convert(e.error) }
+
 type rpcCreds map[string]string
 
 func (m rpcCreds) RequireTransportSecurity() bool { return true }
@@ -4,57 +4,142 @@ import (
 	"context"
 	"encoding/hex"
 	"errors"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/lncm/lnd-rpc/v0.9.0/lnrpc"
+
+	"github.com/lncm/invoicer/metrics"
 )
 
+// How long to wait before trying to restore a failed invoice subscription
+const resubscribeInterval = 10 * time.Second
+
 type (
 	subscriber struct {
 		hash    string
 		invoice chan *lnrpc.Invoice
 	}
 
+	subscriptionState struct {
+		mu     sync.RWMutex
+		active bool
+	}
+
 	InvoiceMonitor struct {
 		lnClient lnrpc.LightningClient
 		subs     chan []subscriber
+		state    *subscriptionState
+
+		// Cancelling ends the subscription for good
+		ctx    context.Context
+		cancel context.CancelFunc
 	}
 )
 
+// Subscribed returns true if invoice updates are currently being received from lnd
+func (im InvoiceMonitor) Subscribed() bool {
+	if im.state == nil {
+		return false
+	}
+
+	im.state.mu.RLock()
+	defer im.state.mu.RUnlock()
+
+	return im.state.active
+}
+
+func (im InvoiceMonitor) setSubscribed(active bool) {
+	im.state.mu.Lock()
+	im.state.active = active
+	im.state.mu.Unlock()
+}
+
 func (im InvoiceMonitor) checkForInvoices(invSub lnrpc.Lightning_SubscribeInvoicesClient) {
+	// Index of the most recently settled invoice, used to replay settlements missed while resubscribing
+	var settleIndex uint64
+
 	for {
 		var inv *lnrpc.Invoice
 		inv, err := invSub.Recv()
 		if err != nil {
+			im.setSubscribed(false)
+
+			if im.ctx.Err() != nil {
+				log.Println("invoice subscriber service stopped")
+				return
+			}
+
 			log.WithError(err).Error("invoice subscriber service has failed")
-			return
+
+			invSub = im.resubscribe(settleIndex)
+			if invSub == nil {
+				return
+			}
+
+			continue
+		}
+
+		if inv.GetSettleIndex() > settleIndex {
+			settleIndex = inv.GetSettleIndex()
 		}
 
 		im.notifyAll(inv)
 	}
 }
 
-func (im InvoiceMonitor) start() error {
-	ctx := context.Background()
+// resubscribe blocks until invoice subscription is restored (ex. after lnd restart), or monitor is stopped, in
+// which case nil is returned
+func (im InvoiceMonitor) resubscribe(settleIndex uint64) lnrpc.Lightning_SubscribeInvoicesClient {
+	for failures := 1; ; failures++ {
+		select {
+		case <-time.After(resubscribeInterval):
+		case <-im.ctx.Done():
+			return nil
+		}
+
+		invSub, err := im.lnClient.SubscribeInvoices(im.ctx, &lnrpc.InvoiceSubscription{
+			SettleIndex: settleIndex,
+		})
+		if err == nil {
+			log.WithField("count", failures).Println("invoice subscriber service restored")
+			im.setSubscribed(true)
+			return invSub
+		}
 
-	invSub, err := im.lnClient.SubscribeInvoices(ctx, &lnrpc.InvoiceSubscription{})
+		log.WithError(err).WithField("count", failures).Warningln("unable to restore invoice subscriber service")
+	}
+}
+
+func (im InvoiceMonitor) start() error {
+	invSub, err := im.lnClient.SubscribeInvoices(im.ctx, &lnrpc.InvoiceSubscription{})
 	if err != nil {
 		return err
 	}
 
 	im.subs <- []subscriber{}
+	im.setSubscribed(true)
 
 	go im.checkForInvoices(invSub)
 
 	return nil
 }
 
+// Stop ends the invoice subscription
+func (im InvoiceMonitor) Stop() {
+	im.cancel()
+}
+
 func (im InvoiceMonitor) add(hash string, status chan *lnrpc.Invoice) {
-	im.subs <- append(<-im.subs, subscriber{
+	subs := append(<-im.subs, subscriber{
 		hash:    hash,
 		invoice: status,
 	})
+
+	metrics.InvoiceSubscribers.Set(float64(len(subs)))
+	im.subs <- subs
 }
 
 func (im InvoiceMonitor) remove(hash string, status chan *lnrpc.Invoice) {
@@ -67,6 +152,7 @@ func (im InvoiceMonitor) remove(hash string, status chan *lnrpc.Invoice) {
 		}
 	}
 
+	metrics.InvoiceSubscribers.Set(float64(len(remainingSubs)))
 	im.subs <- remainingSubs
 }
 
@@ -84,6 +170,7 @@ func (im InvoiceMonitor) notifyAll(inv *lnrpc.Invoice) {
 		remainingSubs = append(remainingSubs, x)
 	}
 
+	metrics.InvoiceSubscribers.Set(float64(len(remainingSubs)))
 	im.subs <- remainingSubs
 }
 
@@ -107,13 +194,19 @@ func NewNotifier(client lnrpc.LightningClient) (InvoiceMonitor, error) {
 		return InvoiceMonitor{}, errors.New("valid Lightning Client has to be provided")
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+
 	n := InvoiceMonitor{
 		lnClient: client,
 		subs:     make(chan []subscriber, 1),
+		state:    &subscriptionState{},
+		ctx:      ctx,
+		cancel:   cancel,
 	}
 
 	err := n.start()
 	if err != nil {
+		cancel()
 		return InvoiceMonitor{}, err
 	}
 
@@ -0,0 +1,123 @@
+// Package lnurl encodes LNURL links (LUD-01), and defines messages of LNURL-withdraw (LUD-03) flow.
+package lnurl
+
+import "strings"
+
+const (
+	hrp     = "lnurl"
+	charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+	// TagWithdraw marks replies to the first request of LNURL-withdraw flow
+	TagWithdraw = "withdrawRequest"
+)
+
+type (
+	// WithdrawRequest tells customer's wallet how much can be withdrawn, and where to send an invoice for it.
+	// Amounts are in millisatoshis.
+	WithdrawRequest struct {
+		Tag                string `json:"tag"`
+		Callback           string `json:"callback"`
+		K1                 string `json:"k1"`
+		DefaultDescription string `json:"defaultDescription"`
+		MinWithdrawable    int64  `json:"minWithdrawable"`
+		MaxWithdrawable    int64  `json:"maxWithdrawable"`
+	}
+
+	// Reply is what any LNURL endpoint replies with, if it has nothing else to say
+	Reply struct {
+		Status string `json:"status"`
+		Reason string `json:"reason,omitempty"`
+	}
+)
+
+func OK() Reply {
+	return Reply{Status: "OK"}
+}
+
+func Error(reason string) Reply {
+	return Reply{Status: "ERROR", Reason: reason}
+}
+
+// Encode returns `url` as bech32-encoded LNURL.  Unlike regular bech32, there's no limit on length.
+func Encode(url string) string {
+	data := convertBits([]byte(url))
+	data = append(data, checksum(data)...)
+
+	var b strings.Builder
+	b.WriteString(hrp + "1")
+
+	for _, d := range data {
+		b.WriteByte(charset[d])
+	}
+
+	return strings.ToUpper(b.String())
+}
+
+// convertBits regroups 8-bit bytes into 5-bit ones, padding the last one with zeros
+func convertBits(data []byte) (out []byte) {
+	var acc, bits uint
+
+	for _, b := range data {
+		acc = acc<<8 | uint(b)
+		bits += 8
+
+		for bits >= 5 {
+			bits -= 5
+			out = append(out, byte(acc>>bits&31))
+		}
+	}
+
+	if bits > 0 {
+		out = append(out, byte(acc<<(5-bits)&31))
+	}
+
+	return out
+}
+
+func checksum(data []byte) []byte {
+	values := append(expandHrp(), data...)
+	values = append(values, 0, 0, 0, 0, 0, 0)
+
+	mod := polymod(values) ^ 1
+
+	sum := make([]byte, 6)
+	for i := range sum {
+		sum[i] = byte(mod >> uint(5*(5-i)) & 31)
+	}
+
+	return sum
+}
+
+func expandHrp() []byte {
+	out := make([]byte, 0, len(hrp)*2+1)
+
+	for i := 0; i < len(hrp); i++ {
+		out = append(out, hrp[i]>>5)
+	}
+
+	out = append(out, 0)
+
+	for i := 0; i < len(hrp); i++ {
+		out = append(out, hrp[i]&31)
+	}
+
+	return out
+}
+
+func polymod(values []byte) uint32 {
+	gen := []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+
+		for i := 0; i < 5; i++ {
+			if top>>uint(i)&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+
+	return chk
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"path"
+	"sort"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -18,11 +21,16 @@ import (
 
 	"github.com/lncm/invoicer/bitcoind"
 	"github.com/lncm/invoicer/common"
+	"github.com/lncm/invoicer/fiat"
 	"github.com/lncm/invoicer/ln"
+	"github.com/lncm/invoicer/metrics"
+	"github.com/lncm/invoicer/store"
 )
 
 type (
 	BitcoinClient interface {
+		Ready() bool
+		Health() common.BitcoindHealth
 		Address(bech32 bool) (string, error)
 		BlockCount() (int64, error)
 		ImportAddress(address, label string) error
@@ -30,88 +38,94 @@ type (
 	}
 
 	LightningClient interface {
+		Ready() bool
+		Health() common.LndHealth
 		NewAddress(ctx context.Context, bech32 bool) (string, error)
 		Info(ctx context.Context) (common.Info, error)
-		NewInvoice(ctx context.Context, amount int64, desc string) (string, string, error)
+		NewInvoice(ctx context.Context, amountMsat int64, desc string) (string, string, error)
 		Status(ctx context.Context, hash string) (common.Status, error)
 		StatusWait(ctx context.Context, hash string) (common.Status, error)
+		Invoice(ctx context.Context, hash string) (common.Invoice, error)
 		History(ctx context.Context) (common.Invoices, error)
+		DecodeInvoice(ctx context.Context, bolt11 string) (common.Invoice, error)
+		PayInvoice(ctx context.Context, bolt11 string, amount, feeLimit int64) (preimage string, fee int64, err error)
+		SendCoins(ctx context.Context, address string, amount int64) (txid string, fee int64, err error)
+		PaymentOutcome(ctx context.Context, bolt11 string) (preimage string, fee int64, err error)
+		SentCoins(ctx context.Context, address string, amount int64) (fees map[string]int64, err error)
+		Close() error
 	}
 
 	lnStatusFn func(c context.Context, hash string) (common.Status, error)
 )
 
-const DefaultInvoicerPort = 8080
+const (
+	// Suggested delay (in seconds) before retrying a request that failed due to an unavailable backend
+	backendRetryAfter = 10
+)
 
 var (
 	version, gitHash string
+	versionString    = "debug"
 
 	lnClient  LightningClient
 	btcClient BitcoinClient
 	conf      common.Config
+	db        *store.Store
+	logFile   *lumberjack.Logger
 
-	configFilePath = flag.String("config", common.DefaultConfigFile, "Path to a config file in TOML format")
+	configFilePath = flag.String("config", configFileDefault(), "Path to a config file in TOML format")
 	showVersion    = flag.Bool("version", false, "Show version and exit")
+	printConfig    = flag.Bool("print-config", false, "Print effective config (with secrets redacted), and exit")
 )
 
-func init() {
-	flag.Parse()
-
-	versionString := "debug"
-	if version != "" && gitHash != "" {
-		versionString = fmt.Sprintf("%s (git: %s)", version, gitHash)
-	}
-
-	// if `--version` flag set, just show the version, and exit
-	if *showVersion {
-		fmt.Println(versionString)
-		os.Exit(0)
-	}
-
-	log.SetFormatter(&log.TextFormatter{
-		FullTimestamp: true,
-	})
-
-	// Expand configFile file path and load it
-	configFile, err := toml.LoadFile(common.CleanAndExpandPath(*configFilePath))
+// setup loads config, and opens the data file.  All commands, except for `check-config`, need it.
+func setup() (err error) {
+	conf, err = loadConfig(*configFilePath)
 	if err != nil {
-		configFile, err = common.DeprecatedConfigLocationCheck(*configFilePath, err)
-		if err != nil {
-			panic(fmt.Errorf("unable to load %s:\n\t%w", *configFilePath, err))
-		}
-
-		log.Warningln("WARNING: Default config location (~/.invoicer/) has been changed to ~/.lncm/ !\n" +
-			"\tPlease rename it, as future versions will no longer check for the config file there.")
+		return err
 	}
 
-	// Try to understand the config file
-	err = configFile.Unmarshal(&conf)
+	db, err = store.Open(conf.DataFile)
 	if err != nil {
-		panic(fmt.Errorf("unable to process %s:\n\t%w", *configFilePath, err))
+		return err
 	}
 
+	fiatSource = fiat.New(conf.Fiat)
+	return nil
+}
+
+// connect starts clients of all enabled backends.  Unavailable backends don't cause an error, as clients keep
+// reconnecting in the background.
+func connect() (err error) {
 	// init specified LN client
 	lnClient, err = ln.Start(conf.Lnd)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	// Init BTC client for monitoring on-chain payments
 	if !conf.OffChainOnly {
 		btcClient, err = bitcoind.New(conf.Bitcoind)
 		if err != nil {
-			panic(err)
+			return err
 		}
 	}
 
-	if conf.LogFile == "" {
-		conf.LogFile = common.DefaultLogFile
+	return nil
+}
+
+// start connects to backends, and (unless disabled) redirects all further logging to the log file
+func start() {
+	err := connect()
+	if err != nil {
+		panic(err)
 	}
 
 	fields := log.Fields{
 		"version":   versionString,
 		"client":    conf.LnClient,
 		"users":     len(conf.Users),
+		"data-file": conf.DataFile,
 		"conf-file": *configFilePath,
 		"log-file":  conf.LogFile,
 	}
@@ -121,43 +135,82 @@ func init() {
 		log.WithFields(fields).Println("invoicer started")
 
 		// After all initialization has been done, start logging to log file
-		log.SetOutput(&lumberjack.Logger{
-			Filename:  common.CleanAndExpandPath(conf.LogFile),
-			LocalTime: true,
-			Compress:  true,
-		})
-
-		log.SetFormatter(&log.JSONFormatter{
-			PrettyPrint: false, // Having `false` here makes sure that `jq` always works on `tail -f`.
-		})
+		setLogOutput(conf.LogFile)
 	}
 
 	// Write current config to log file
 	log.WithFields(fields).Println("invoicer started")
+
+	if len(conf.Users) > 0 {
+		log.Warningln("[users] section is deprecated, and will be removed in a future version. " +
+			"Create an API key with `read-history` scope instead: invoicer apikey add -scopes read-history")
+	}
 }
 
-func newPayment(c *gin.Context) {
-	var data struct {
-		Amount      int64  `json:"amount"`
-		Description string `json:"desc"`
-		Only        string `json:"only"`
+// btcReady returns true if on-chain payments are enabled, and bitcoind is available
+func btcReady() bool {
+	return !conf.OffChainOnly && btcClient.Ready()
+}
+
+// requireBackends replies with 503 and returns false if any of the backends needed to fulfil the request
+// is not available.  lnd is required in all cases, as it also provides on-chain addresses.
+func requireBackends(c *gin.Context, needBtc bool) bool {
+	var unavailable string
+
+	switch {
+	case !lnClient.Ready():
+		unavailable = "lnd"
+
+	case needBtc && !btcReady():
+		unavailable = "bitcoind"
+
+	default:
+		return true
 	}
 
-	err := c.ShouldBindJSON(&data)
-	if err != nil {
-		replyStatus(c, common.StatusReply{
-			Code:  400,
-			Error: err.Error(),
-		})
-		return
+	c.Header("Retry-After", fmt.Sprint(backendRetryAfter))
+	replyStatus(c, common.StatusReply{
+		Code:  503,
+		Error: fmt.Sprintf("%s is currently unavailable, try again later", unavailable),
+	})
+
+	return false
+}
+
+// errCode returns a status code appropriate for errors returned by backend clients
+func errCode(err error) int {
+	if errors.Is(err, common.ErrBackendUnavailable) {
+		return 503
 	}
 
+	return 500
+}
+
+// paymentRequest is what's needed to create a new payment.  `Only` can limit it to a single rail: `ln`, or `btc`.
+type paymentRequest struct {
+	Amount      int64  `json:"amount" doc:"Amount in satoshis"`
+	AmountMsat  int64  `json:"amount_msat" doc:"Amount in millisatoshis, instead of amount.  Fractions of a satoshi can only be requested over LN."`
+	Description string `json:"desc"`
+	Only        string `json:"only" validate:"omitempty,oneof=ln btc" doc:"Create payment on a single rail only"`
+
+	// Never shown to the payer.  Repeated requests with the same `order_id` return the original payment, unless
+	// Idempotency-Key is set.
+	common.OrderInfo
+
+	// Only for open-amount payments, ie. without `Amount`
+	common.AmountBounds
+
+	// Set for payments created through payment link with this slug
+	link string
+}
+
+// validate checks request, and forces LN-only if on-chain payments are disabled
+func (data *paymentRequest) validate() *common.StatusReply {
 	if data.Only != "" && data.Only != "btc" && data.Only != "ln" {
-		replyStatus(c, common.StatusReply{
+		return &common.StatusReply{
 			Code:  400,
 			Error: "only= is an optional parameter that can only take `btc` and `ln` as values",
-		})
-		return
+		}
 	}
 
 	// Force LN-only, no matter what the request was
@@ -165,49 +218,101 @@ func newPayment(c *gin.Context) {
 		data.Only = "ln"
 	}
 
-	var payment common.NewPayment
+	if fail := validateOrderInfo(data.OrderInfo); fail != nil {
+		return fail
+	}
 
-	if data.Only != "btc" {
-		if len(data.Description) > common.MaxInvoiceDescLen {
-			replyStatus(c, common.StatusReply{
-				Code:  400,
-				Error: fmt.Errorf("description too long. Max length is %d", common.MaxInvoiceDescLen).Error(),
-			})
-			return
+	if fail := data.normalizeAmount(); fail != nil {
+		return fail
+	}
+
+	if data.Only != "btc" && len(data.Description) > common.MaxInvoiceDescLen {
+		return &common.StatusReply{
+			Code:  400,
+			Error: fmt.Errorf("description too long. Max length is %d", common.MaxInvoiceDescLen).Error(),
 		}
+	}
+
+	return nil
+}
+
+// normalizeAmount sets both `Amount`, and `AmountMsat` from whichever one was provided.  `Amount` is rounded up, as
+// that's the least that can be paid on-chain.
+func (data *paymentRequest) normalizeAmount() *common.StatusReply {
+	switch {
+	case data.Amount < 0 || data.AmountMsat < 0 || data.MinAmount < 0 || data.MaxAmount < 0:
+		return &common.StatusReply{Code: 400, Error: "amount can't be negative"}
+
+	case (data.MinAmount > 0 || data.MaxAmount > 0) && (data.Amount > 0 || data.AmountMsat > 0):
+		return &common.StatusReply{Code: 400, Error: "`min_amount`, and `max_amount` can only be set for open-amount payments"}
 
+	case data.MaxAmount > 0 && data.MinAmount > data.MaxAmount:
+		return &common.StatusReply{Code: 400, Error: "`min_amount` can't be above `max_amount`"}
+
+	case data.AmountMsat == 0:
+		data.AmountMsat = data.Amount * 1000
+		return nil
+
+	case data.Amount > 0 && data.Amount*1000 != data.AmountMsat:
+		return &common.StatusReply{Code: 400, Error: "`amount`, and `amount_msat` don't match, only one is needed"}
+
+	case data.Only == "btc" && data.AmountMsat%1000 != 0:
+		return &common.StatusReply{Code: 400, Error: "on-chain payments can't be for fractions of a satoshi"}
+	}
+
+	data.Amount = common.MsatToSat(data.AmountMsat)
+	return nil
+}
+
+// createPayment creates LN invoice, and/or Bitcoin address for a validated request, and records it together with
+// `idempotencyKey`, if any.  On failure, returned reply explains what went wrong.
+func createPayment(ctx context.Context, data paymentRequest, idempotencyKey string) (payment common.NewPayment, fail *common.StatusReply) {
+	var err error
+
+	payment.ID, err = common.NewPaymentID()
+	if err != nil {
+		return payment, &common.StatusReply{
+			Code:  500,
+			Error: fmt.Errorf("can't generate payment ID: %w", err).Error(),
+		}
+	}
+
+	if data.Only != "btc" {
 		// Generate new LN invoice
-		payment.Bolt11, payment.Hash, err = lnClient.NewInvoice(c, data.Amount, data.Description)
+		payment.Bolt11, payment.Hash, err = lnClient.NewInvoice(ctx, data.AmountMsat, data.Description)
 		if err != nil {
-			replyStatus(c, common.StatusReply{
-				Code:  500,
+			return payment, &common.StatusReply{
+				Code:  errCode(err),
 				Error: fmt.Errorf("can't create new LN invoice: %w", err).Error(),
-			})
-			return
+			}
 		}
 
 		// Extract invoice's creation date & expiry
-		invoice, err := lnClient.Status(c, payment.Hash)
+		invoice, err := lnClient.Status(ctx, payment.Hash)
 		if err != nil {
-			replyStatus(c, common.StatusReply{
-				Code:  500,
+			return payment, &common.StatusReply{
+				Code:  errCode(err),
 				Error: fmt.Errorf("can't get LN invoice: %w", err).Error(),
-			})
-			return
+			}
 		}
 		payment.CreatedAt = invoice.Ts
 		payment.Expiry = invoice.Expiry
 	}
 
+	// on-chain only payments expire the same way LN invoices do
+	if data.Only == "btc" {
+		payment.CreatedAt = time.Now().Unix()
+		payment.Expiry = common.DefaultInvoiceExpiry
+	}
+
 	if data.Only != "ln" {
 		// get BTC address
-		payment.Address, err = lnClient.NewAddress(c, false)
+		payment.Address, err = lnClient.NewAddress(ctx, false)
 		if err != nil {
-			replyStatus(c, common.StatusReply{
-				Code:  500,
+			return payment, &common.StatusReply{
+				Code:  errCode(err),
 				Error: fmt.Errorf("can't get Bitcoin address: %w", err).Error(),
-			})
-			return
+			}
 		}
 
 		label := data.Description
@@ -217,19 +322,88 @@ func newPayment(c *gin.Context) {
 
 		err = btcClient.ImportAddress(payment.Address, label)
 		if err != nil {
-			replyStatus(c, common.StatusReply{
-				Code:  500,
+			return payment, &common.StatusReply{
+				Code:  errCode(err),
 				Error: fmt.Errorf("can't import address (%s) to Bitcoin node: %w", payment.Address, err).Error(),
-			})
-			return
+			}
 		}
 	}
 
+	record := common.PaymentRecord{
+		NewPayment:     payment,
+		OrderInfo:      data.OrderInfo,
+		Description:    data.Description,
+		Amount:         data.Amount,
+		AmountMsat:     data.AmountMsat,
+		AmountBounds:   data.AmountBounds,
+		Link:           data.link,
+		IdempotencyKey: idempotencyKey,
+	}
+
+	if idempotencyKey != "" {
+		record.RequestHash = requestHash(data)
+	}
+
+	err = db.AddPayment(record)
+	if err != nil {
+		return payment, &common.StatusReply{
+			Code:  500,
+			Error: fmt.Errorf("can't save payment: %w", err).Error(),
+		}
+	}
+
+	if payment.Hash != "" {
+		metrics.PaymentsCreated.Inc(metrics.RailLn)
+	}
+
+	if payment.Address != "" {
+		metrics.PaymentsCreated.Inc(metrics.RailBtc)
+	}
+
+	// Customer's email, and metadata are kept out of logs
 	log.WithFields(log.Fields{
-		"in":  data,
-		"out": payment,
+		"id":       payment.ID,
+		"amount":   data.Amount,
+		"order_id": data.OrderID,
 	}).Println("Payment requested")
 
+	return payment, nil
+}
+
+func newPayment(c *gin.Context) {
+	var data paymentRequest
+
+	err := c.ShouldBindJSON(&data)
+	if err != nil {
+		replyStatus(c, common.StatusReply{
+			Code:  400,
+			Error: err.Error(),
+		})
+		return
+	}
+
+	if fail := data.validate(); fail != nil {
+		replyStatus(c, *fail)
+		return
+	}
+
+	key, fail := idempotencyKey(c, data)
+	if fail != nil {
+		replyStatus(c, *fail)
+		return
+	}
+
+	if !requireBackends(c, data.Only != "ln") {
+		return
+	}
+
+	payment, replayed, fail := createPaymentOnce(c, data, key)
+	if fail != nil {
+		replyStatus(c, *fail)
+		return
+	}
+
+	setReplayed(c, replayed)
 	c.JSON(200, payment)
 }
 
@@ -237,7 +411,7 @@ func checkLnStatus(c context.Context, hash string, statusFn lnStatusFn) *common.
 	status, err := statusFn(c, hash)
 	if err != nil {
 		return &common.StatusReply{
-			Code:  500,
+			Code:  errCode(err),
 			Error: fmt.Sprintf("unable to fetch invoice: %s", err),
 		}
 	}
@@ -258,21 +432,58 @@ func checkLnStatus(c context.Context, hash string, statusFn lnStatusFn) *common.
 	return &common.StatusReply{Ln: &status}
 }
 
-func checkBtcStatus(ctx context.Context, fin time.Time, addr string, lnProvided, flexible bool, desiredAmount int64) *common.StatusReply {
-	for time.Now().Before(fin) {
-		time.Sleep(2 * time.Second)
+// checkLnBounds replies to settled open-amount invoices paid outside of `bounds` the way on-chain payments are:
+// with 402 if less than the minimum was paid, and with 202 if more than the maximum
+func checkLnBounds(status *common.StatusReply, flexible bool, bounds common.AmountBounds) *common.StatusReply {
+	if flexible || status.Code != 200 || status.Ln == nil || status.Ln.Value == 0 {
+		return status
+	}
 
-		if ctx.Err() != nil {
-			return &common.StatusReply{
-				Error: ctx.Err().Error(),
-			}
+	switch boundsCode(status.Ln.Value, bounds) {
+	case 402:
+		status.Code, status.Error = 402, "not enough"
+
+	case 202:
+		status.Code = 202
+	}
+
+	return status
+}
+
+// boundsCode returns 200 if `received` is within `bounds`, 402 if it's below, and 202 if above
+func boundsCode(received int64, bounds common.AmountBounds) int {
+	enough, over := bounds.Check(received)
+
+	switch {
+	case !enough:
+		return 402
+
+	case over > 0:
+		return 202
+	}
+
+	return 200
+}
+
+// checkBtcStatus polls `addr` until deposits made to it add up to the requested amount.  Partial deposits keep
+// the payment open for top-ups, so nil is returned if `ctx` is done before that happens.
+func checkBtcStatus(ctx context.Context, addr string, lnProvided, flexible bool, desiredAmount int64, bounds common.AmountBounds) *common.StatusReply {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-ticker.C:
 		}
 
 		btcStatuses, err := btcClient.CheckAddress(addr)
 		if err != nil {
 			if !lnProvided {
 				return &common.StatusReply{
-					Code:  500,
+					Code:  errCode(err),
 					Error: fmt.Sprintf("unable to check status: %s", err),
 				}
 			}
@@ -281,43 +492,136 @@ func checkBtcStatus(ctx context.Context, fin time.Time, addr string, lnProvided,
 			return nil
 		}
 
-		btcStatus := btcStatuses[0]
-
-		receivedAmount := int64(btcStatus.Amount) * 1e8
-		if btcStatus.Amount == 0 {
+		// address isn't known to bitcoind (yet); keep waiting, as for one with nothing deposited
+		if len(btcStatuses) == 0 {
 			continue
 		}
 
-		// no need to return it now; might be useful later
-		btcStatus.Label = ""
+		status := btcPaymentStatus(btcStatuses[0], flexible, desiredAmount, bounds)
+		if status != nil && status.Code != 402 {
+			return status
+		}
+	}
+}
+
+// btcPaymentStatus compares the sum of all deposits made to an address with the requested amount (or `bounds` of
+// open-amount payments).  Deposits short of it by no more than `[on-chain]` tolerance are accepted, and ones above
+// it are replied with 202, so that the difference can be refunded.  nil is returned if nothing was deposited yet.
+func btcPaymentStatus(btcStatus common.AddrStatus, flexible bool, desiredAmount int64, bounds common.AmountBounds) *common.StatusReply {
+	receivedAmount := int64(btcStatus.Amount)
+	if receivedAmount == 0 {
+		return nil
+	}
+
+	// no need to return it now; might be useful later
+	btcStatus.Label = ""
 
-		if flexible || desiredAmount == receivedAmount {
-			return &common.StatusReply{
-				Code:    200,
-				Bitcoin: &btcStatus,
-			}
+	switch {
+	case flexible || receivedAmount == desiredAmount:
+		return &common.StatusReply{Code: 200, Bitcoin: &btcStatus}
+
+	case desiredAmount == 0:
+		if code := boundsCode(receivedAmount, bounds); code != 402 {
+			return &common.StatusReply{Code: code, Bitcoin: &btcStatus}
 		}
 
-		if receivedAmount > desiredAmount {
-			return &common.StatusReply{
-				Code:    202,
-				Bitcoin: &btcStatus,
-			}
+	case receivedAmount > desiredAmount:
+		return &common.StatusReply{Code: 202, Bitcoin: &btcStatus}
+
+	case receivedAmount >= currentConf().OnChain.MinAmount(desiredAmount):
+		return &common.StatusReply{Code: 200, Bitcoin: &btcStatus}
+	}
+
+	return &common.StatusReply{
+		Code:    402,
+		Error:   "not enough",
+		Bitcoin: &btcStatus,
+	}
+}
+
+// expiredStatus checks `addr` one last time after the payment has expired, so that partial deposits are replied
+// with 402 instead of 408
+func expiredStatus(addr string, flexible bool, desiredAmount int64, bounds common.AmountBounds) *common.StatusReply {
+	expired := &common.StatusReply{
+		Code:  408,
+		Error: "expired",
+	}
+
+	if conf.OffChainOnly || len(addr) == 0 || !btcReady() {
+		return expired
+	}
+
+	btcStatuses, err := btcClient.CheckAddress(addr)
+	if err != nil || len(btcStatuses) == 0 {
+		return expired
+	}
+
+	status := btcPaymentStatus(btcStatuses[0], flexible, desiredAmount, bounds)
+	if status == nil {
+		return expired
+	}
+
+	return status
+}
+
+// recordStatus records settlement, or expiry reported by `status`, unless it was already recorded
+func recordStatus(status *common.StatusReply, hash, addr string, createdAt int64) {
+	switch status.Code {
+	case 200, 202:
+		rail, id := metrics.RailLn, hash
+		if status.Bitcoin != nil {
+			rail, id = metrics.RailBtc, addr
 		}
 
-		if desiredAmount > receivedAmount {
-			return &common.StatusReply{
-				Code:    402,
-				Error:   "not enough",
-				Bitcoin: &btcStatus,
-			}
+		recordSettlement(id, rail, createdAt)
+
+	case 408:
+		// only payments created by invoicer have IDs to record their expiry by
+		if r, err := db.FindPayment(hash, addr); err == nil && r.ID != "" {
+			recordExpiration(recordPayment(r))
 		}
 	}
+}
 
-	return nil
+// observeStatus records the outcome of a status long-poll
+func observeStatus(status *common.StatusReply, hash, addr string, createdAt int64, waitStart time.Time) {
+	recordStatus(status, hash, addr, createdAt)
+
+	outcome := "pending"
+
+	switch status.Code {
+	case 200, 202:
+		outcome = "paid"
+
+	case 402:
+		outcome = "underpaid"
+
+	case 408:
+		outcome = "expired"
+
+	case 499:
+		outcome = "cancelled"
+
+	default:
+		if status.Code >= 400 {
+			outcome = "error"
+		}
+	}
+
+	metrics.StatusWaitDuration.Observe(time.Since(waitStart).Seconds(), outcome)
 }
 
+// replyStatus replies with `status`.  Errors in `/api/v2` are replied with `errorReply` instead.
 func replyStatus(c *gin.Context, status common.StatusReply) {
+	if status.Code == 503 && c.Writer.Header().Get("Retry-After") == "" {
+		c.Header("Retry-After", fmt.Sprint(backendRetryAfter))
+	}
+
+	if c.GetBool(v2CtxKey) && status.Code >= 300 {
+		replyError(c, status.Code, errorCode(status.Code), status.Error)
+		return
+	}
+
 	if status.Code >= 300 {
 		c.AbortWithStatusJSON(status.Code, status)
 		return
@@ -326,12 +630,14 @@ func replyStatus(c *gin.Context, status common.StatusReply) {
 	c.JSON(status.Code, status)
 }
 
+type statusQuery struct {
+	Hash     string `form:"hash" doc:"LN payment hash"`
+	Addr     string `form:"address" doc:"Bitcoin address"`
+	Flexible bool   `form:"flexible" doc:"Accept any on-chain amount"`
+}
+
 func status(c *gin.Context) {
-	var queryParams struct {
-		Hash     string `form:"hash"`
-		Addr     string `form:"address"`
-		Flexible bool   `form:"flexible"`
-	}
+	var queryParams statusQuery
 
 	err := c.BindQuery(&queryParams)
 	if err != nil {
@@ -354,37 +660,84 @@ func status(c *gin.Context) {
 		return
 	}
 
-	var desiredAmount int64
+	// lnd is needed whenever hash is provided, bitcoind only if there's no LN invoice to fall back on
+	if len(hash) > 0 && !requireBackends(c, false) {
+		return
+	}
+
+	if len(hash) == 0 && !requireBackends(c, !conf.OffChainOnly) {
+		return
+	}
+
+	var desiredAmount, createdAt int64
 	fin := time.Now().Add(common.DefaultInvoiceExpiry * time.Second)
 
+	// open-amount payments created by invoicer might have bounds set
+	var bounds common.AmountBounds
+	if r, err := db.FindPayment(hash, addr); err == nil {
+		bounds = r.AmountBounds
+	}
+
 	// do initial LN invoice check, and adjust expiration if available
 	if len(hash) > 0 {
-		status := checkLnStatus(c, hash, lnClient.Status)
+		status := checkLnBounds(checkLnStatus(c, hash, lnClient.Status), flexible, bounds)
 		if status.Code > 0 {
+			// expired invoices have no status
+			if status.Ln != nil {
+				createdAt = status.Ln.Ts
+			}
+
+			recordStatus(status, hash, addr, createdAt)
+
+			if mayReadOrderInfo(c) {
+				addOrderInfo(status, hash, addr)
+			}
+
 			replyStatus(c, *status)
 			return
 		}
 
 		fin = time.Unix(status.Ln.Ts, 0).Add(time.Duration(status.Ln.Expiry) * time.Second)
-		desiredAmount = status.Ln.Value
+		desiredAmount = common.MsatToSat(status.Ln.ValueMsat)
+		createdAt = status.Ln.Ts
+	} else if r, err := db.FindPayment("", addr); err == nil {
+		// on-chain-only payments created by invoicer have their amount, and expiry recorded
+		fin = time.Unix(r.CreatedAt+r.Expiry, 0)
+		desiredAmount = r.Amount
+		createdAt = r.CreatedAt
+	}
+
+	if !acquireStatusWaiter() {
+		tooManyRequests(c, backendRetryAfter*time.Second, "too many open status requests")
+		return
 	}
 
+	defer releaseStatusWaiter()
+
+	metrics.StatusWaiters.Inc()
+	defer metrics.StatusWaiters.Dec()
+
+	waitStart := time.Now()
+
 	ctx, cancel := context.WithDeadline(c, fin)
 	defer cancel()
 
-	paymentStatus := make(chan *common.StatusReply)
+	// buffered, so that checks finishing after the reply was sent don't block forever
+	paymentStatus := make(chan *common.StatusReply, 2)
 
 	// subscribe to LN invoice status changes
 	if len(hash) > 0 {
 		go func() {
-			paymentStatus <- checkLnStatus(ctx, hash, lnClient.StatusWait)
+			paymentStatus <- checkLnBounds(checkLnStatus(ctx, hash, lnClient.StatusWait), flexible, bounds)
 		}()
 	}
 
 	// keep polling for status update every N seconds
 	if !conf.OffChainOnly && len(addr) > 0 {
 		go func() {
-			paymentStatus <- checkBtcStatus(ctx, fin, addr, len(hash) > 0, flexible, desiredAmount)
+			if status := checkBtcStatus(ctx, addr, len(hash) > 0, flexible, desiredAmount, bounds); status != nil {
+				paymentStatus <- status
+			}
 		}()
 	}
 
@@ -395,12 +748,9 @@ func status(c *gin.Context) {
 	// … payment is received successfully
 	case status = <-paymentStatus:
 
-	// … payment expires
+	// … payment expires, possibly with not enough deposited on-chain
 	case <-ctx.Done():
-		status = &common.StatusReply{
-			Code:  408,
-			Error: "expired",
-		}
+		status = expiredStatus(addr, flexible, desiredAmount, bounds)
 
 	// … payment is cancelled by user
 	case <-c.Request.Context().Done():
@@ -409,48 +759,45 @@ func status(c *gin.Context) {
 			Code:  499,
 			Error: "cancelled by client",
 		}
+
+	// … invoicer is shutting down
+	case <-shuttingDown:
+		cancel()
+		c.Header("Retry-After", fmt.Sprint(backendRetryAfter))
+		status = &common.StatusReply{
+			Code:  503,
+			Error: "invoicer is restarting, try again later",
+		}
+	}
+
+	observeStatus(status, hash, addr, createdAt, waitStart)
+
+	if mayReadOrderInfo(c) {
+		addOrderInfo(status, hash, addr)
 	}
 
+	logged := *status
+	logged.OrderInfo = common.OrderInfo{}
+
 	log.WithFields(log.Fields{
 		"in":     queryParams,
-		"status": *status,
+		"status": logged,
 	}).Println("Payment updated")
 
 	replyStatus(c, *status)
 }
 
-// TODO: pagination
-// TODO: limit
-// TODO: bitcoin transactions
-func history(c *gin.Context) {
-	var queryParams struct {
-		Limit      int64  `form:"limit"`
-		Offset     int64  `form:"offset"`
-		OnlyStatus string `form:"only_status" validate:"omitempty,oneof=paid expired pending"`
-	}
-
-	err := c.BindQuery(&queryParams)
-	if err != nil {
-		replyStatus(c, common.StatusReply{
-			Code:  400,
-			Error: fmt.Errorf("invalid request: %w", err).Error(),
-		})
-		return
-	}
+// fetchHistory returns all payments (newest on top) merged from both rails, optionally limited to ones that are
+// `paid`, `expired`, or `pending`.  If only on-chain history can't be fetched, warning is returned instead of error.
+func fetchHistory(ctx context.Context, onlyStatus string) (history []common.Payment, warning string, err error) {
+	btcHistory := make(map[string]common.AddrStatus)
+	btcByAddress := make(map[string]common.AddrStatus)
 
-	err = validator.New().Struct(queryParams)
-	if err != nil {
-		replyStatus(c, common.StatusReply{
-			Code:  400,
-			Error: fmt.Errorf("invalid request: %w", err).Error(),
-		})
-		return
+	if !conf.OffChainOnly && !btcClient.Ready() {
+		warning = "Bitcoin node is currently unavailable. Only showing LN."
 	}
 
-	var warning string
-	btcHistory := make(map[string]common.AddrStatus)
-
-	if !conf.OffChainOnly {
+	if btcReady() {
 		// fetch bitcoin history
 		btcAllAddresses, err := btcClient.CheckAddress("")
 		if err != nil {
@@ -462,21 +809,18 @@ func history(c *gin.Context) {
 			if payment.Label != "" {
 				btcHistory[payment.Label] = payment
 			}
+
+			btcByAddress[payment.Address] = payment
 		}
 	}
 
 	// fetch LN history
-	lnHistory, err := lnClient.History(c)
+	lnHistory, err := lnClient.History(ctx)
 	if err != nil {
-		replyStatus(c, common.StatusReply{
-			Code:  500,
-			Error: fmt.Errorf("can't get history from LN node: %w", err).Error(),
-		})
-		return
+		return nil, "", fmt.Errorf("can't get history from LN node: %w", err)
 	}
 
 	// merge histories
-	var history []common.Payment
 	for _, invoice := range lnHistory {
 		var payment common.Payment
 		payment.ApplyLn(invoice)
@@ -485,98 +829,455 @@ func history(c *gin.Context) {
 		if !conf.OffChainOnly {
 			if btcStatus, ok := btcHistory[payment.Hash]; ok {
 				payment.ApplyBtc(btcStatus)
+				payment.ApplyTolerance(currentConf().OnChain)
 			}
 		}
 
-		switch queryParams.OnlyStatus {
+		history = append(history, payment)
+	}
+
+	// open-amount payments are only known to be paid once their bounds are applied
+	records, err := applyRecords(history)
+	if err != nil {
+		return nil, "", fmt.Errorf("can't read payment records: %w", err)
+	}
+
+	// lnd only knows about payments with an LN invoice, so on-chain only ones are added from records
+	for _, r := range records {
+		if r.Hash == "" {
+			history = append(history, onChainPayment(r, btcByAddress))
+		}
+	}
+
+	err = recordOutcomes(history)
+	if err != nil {
+		return nil, "", fmt.Errorf("can't read recorded outcomes: %w", err)
+	}
+
+	history = filterStatus(history, onlyStatus)
+
+	err = applySettlements(history)
+	if err != nil {
+		return nil, "", fmt.Errorf("can't read recorded settlements: %w", err)
+	}
+
+	err = applyRefunds(history)
+	if err != nil {
+		return nil, "", fmt.Errorf("can't read recorded refunds: %w", err)
+	}
+
+	// reverse order before returning (newest on top), and put on-chain only payments in their place
+	for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+		history[i], history[j] = history[j], history[i]
+	}
+
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].CreatedAt > history[j].CreatedAt
+	})
+
+	return history, warning, nil
+}
+
+// onChainPayment returns current state of on-chain only payment `r`, given statuses of all watched addresses
+func onChainPayment(r common.PaymentRecord, btcByAddress map[string]common.AddrStatus) common.Payment {
+	payment := recordPayment(r)
+
+	if btcStatus, ok := btcByAddress[r.Address]; ok {
+		payment.ApplyBtc(btcStatus)
+		payment.ApplyTolerance(currentConf().OnChain)
+	}
+
+	if r.OpenAmount() {
+		payment.ApplyOpenAmount(r.AmountBounds)
+	}
+
+	return payment
+}
+
+// filterStatus returns only `paid`, `expired`, or `pending` payments, or all of them if `onlyStatus` is empty
+func filterStatus(payments []common.Payment, onlyStatus string) (filtered []common.Payment) {
+	for _, p := range payments {
+		switch onlyStatus {
 		case "paid":
-			if !payment.Paid {
+			if !p.Paid {
 				continue
 			}
 
 		case "expired":
-			if !payment.Expired {
+			if !p.Expired {
 				continue
 			}
 
 		case "pending":
-			if payment.Paid || payment.Expired {
+			if p.Paid || p.Expired {
 				continue
 			}
 		}
 
-		history = append(history, payment)
+		filtered = append(filtered, p)
 	}
 
-	// reverse order before returning (newest on top)
-	for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
-		history[i], history[j] = history[j], history[i]
+	return
+}
+
+// applyRecords adds IDs, and order info of payments created by invoicer to payments fetched from lnd, and settles
+// open-amount ones within their bounds.  All records are returned.
+func applyRecords(payments []common.Payment) ([]common.PaymentRecord, error) {
+	records, err := db.Payments()
+	if err != nil {
+		return nil, err
 	}
 
-	c.JSON(200, struct {
-		History []common.Payment `json:"history"`
-		Error   string           `json:"error,omitempty"`
-	}{
-		History: history,
-		Error:   warning,
-	})
+	byHash := make(map[string]common.PaymentRecord, len(records))
+	for _, r := range records {
+		if r.Hash != "" {
+			byHash[r.Hash] = r
+		}
+	}
+
+	for i, p := range payments {
+		r, ok := byHash[p.Hash]
+		if ok {
+			payments[i].ID = r.ID
+			payments[i].OrderInfo = r.OrderInfo
+			payments[i].Link = r.Link
+		}
+
+		// other invoices without amount (ex. donations created directly in lnd) are left as lnd reports them
+		if ok && r.OpenAmount() {
+			payments[i].ApplyOpenAmount(r.AmountBounds)
+		}
+	}
+
+	return records, nil
 }
 
-func info(c *gin.Context) {
-	info, err := lnClient.Info(c)
+// recordPayment returns payment `r` the way it was requested, before anything was paid
+func recordPayment(r common.PaymentRecord) (payment common.Payment) {
+	payment.NewPayment = r.NewPayment
+	payment.OrderInfo = r.OrderInfo
+	payment.Link = r.Link
+	payment.Description = r.Description
+	payment.Amount = r.Amount
+	payment.AmountMsat = r.RequestedMsat()
+	payment.Expired = time.Now().Unix() > r.CreatedAt+r.Expiry
+
+	return payment
+}
+
+// fetchPayment returns current state of a single payment merged from both rails.  If only on-chain state can't
+// be fetched, warning is returned instead of error.
+func fetchPayment(ctx context.Context, r common.PaymentRecord) (payment common.Payment, warning string, err error) {
+	payment = recordPayment(r)
+
+	if r.Hash != "" {
+		invoice, err := lnClient.Invoice(ctx, r.Hash)
+		if err != nil {
+			return payment, "", fmt.Errorf("can't get invoice from LN node: %w", err)
+		}
+
+		payment.ApplyLn(invoice)
+		payment.ID, payment.Address = r.ID, r.Address
+	}
+
+	if r.Address != "" && !conf.OffChainOnly {
+		if !btcReady() {
+			warning = "Bitcoin node is currently unavailable. Only showing LN."
+		} else if btcStatuses, err := btcClient.CheckAddress(r.Address); err != nil {
+			warning = "Unable to fetch Bitcoin status. Only showing LN."
+		} else if len(btcStatuses) > 0 {
+			payment.ApplyBtc(btcStatuses[0])
+			payment.ApplyTolerance(currentConf().OnChain)
+		}
+	}
+
+	if r.OpenAmount() {
+		payment.ApplyOpenAmount(r.AmountBounds)
+	}
+
+	recordLinkSale(r, payment)
+
+	payments := []common.Payment{payment}
+
+	err = recordOutcomes(payments)
+	if err != nil {
+		return payment, "", fmt.Errorf("can't read recorded outcomes: %w", err)
+	}
+
+	err = applySettlements(payments)
+	if err != nil {
+		return payment, "", fmt.Errorf("can't read recorded settlements: %w", err)
+	}
+
+	err = applyRefunds(payments)
+	if err != nil {
+		return payment, "", fmt.Errorf("can't read recorded refunds: %w", err)
+	}
+
+	return payments[0], warning, nil
+}
+
+type (
+	historyQuery struct {
+		Limit      int64  `form:"limit" doc:"Maximum number of payments returned.  All, if not set"`
+		Offset     int64  `form:"offset" doc:"Number of newest payments to skip"`
+		OnlyStatus string `form:"only_status" validate:"omitempty,oneof=paid expired pending"`
+		Link       string `form:"link" doc:"Only payments created through payment link with this slug"`
+
+		orderQuery
+	}
+
+	historyReply struct {
+		History []common.Payment `json:"history"`
+		Error   string           `json:"error,omitempty" doc:"Set if on-chain history couldn't be fetched"`
+	}
+)
+
+// TODO: bitcoin transactions
+func history(c *gin.Context) {
+	var queryParams historyQuery
+
+	err := c.BindQuery(&queryParams)
 	if err != nil {
 		replyStatus(c, common.StatusReply{
-			Code:  500,
-			Error: fmt.Errorf("can't get info from LN node: %w", err).Error(),
+			Code:  400,
+			Error: fmt.Errorf("invalid request: %w", err).Error(),
 		})
 		return
 	}
 
-	info.OnChain = true
-	info.OffChain = true
+	err = validator.New().Struct(queryParams)
+	if err != nil {
+		replyStatus(c, common.StatusReply{
+			Code:  400,
+			Error: fmt.Errorf("invalid request: %w", err).Error(),
+		})
+		return
+	}
 
-	if conf.OffChainOnly {
-		info.OnChain = false
+	if fail := queryParams.orderQuery.validate(); fail != nil {
+		replyStatus(c, *fail)
+		return
+	}
+
+	if !requireBackends(c, false) {
+		return
+	}
+
+	history, warning, err := fetchHistory(c, queryParams.OnlyStatus)
+	if err != nil {
+		replyStatus(c, common.StatusReply{
+			Code:  errCode(err),
+			Error: err.Error(),
+		})
+		return
+	}
+
+	history = queryParams.orderQuery.filter(history)
+	history = filterLink(history, queryParams.Link)
+
+	// newest on top, so offset skips the most recent ones
+	if queryParams.Offset > 0 {
+		if queryParams.Offset > int64(len(history)) {
+			queryParams.Offset = int64(len(history))
+		}
+
+		history = history[queryParams.Offset:]
+	}
+
+	if queryParams.Limit > 0 && queryParams.Limit < int64(len(history)) {
+		history = history[:queryParams.Limit]
+	}
+
+	c.JSON(200, historyReply{
+		History: history,
+		Error:   warning,
+	})
+}
+
+// info always succeeds, but if lnd is unavailable, only backend readiness is returned
+func info(c *gin.Context) {
+	var info common.Info
+
+	if lnClient.Ready() {
+		var err error
+		info, err = lnClient.Info(c)
+		if err != nil {
+			replyStatus(c, common.StatusReply{
+				Code:  errCode(err),
+				Error: fmt.Errorf("can't get info from LN node: %w", err).Error(),
+			})
+			return
+		}
+	}
+
+	info.Ready = map[string]bool{"lnd": lnClient.Ready()}
+	if !conf.OffChainOnly {
+		info.Ready["bitcoind"] = btcClient.Ready()
 	}
 
+	// Only advertise payment methods that can currently be fulfilled
+	info.OffChain = lnClient.Ready()
+	info.OnChain = lnClient.Ready() && btcReady()
+
 	c.JSON(200, info)
 }
 
 func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if version != "" && gitHash != "" {
+		versionString = fmt.Sprintf("%s (git: %s)", version, gitHash)
+	}
+
+	// if `--version` flag set, just show the version, and exit
+	if *showVersion {
+		fmt.Println(versionString)
+		os.Exit(0)
+	}
+
+	log.SetFormatter(&log.TextFormatter{
+		FullTimestamp: true,
+	})
+
+	// if `--print-config` flag set, show config after env overrides, and defaults are applied, and exit
+	if *printConfig {
+		c, err := loadConfig(*configFilePath)
+		if err != nil {
+			exit(err)
+		}
+
+		out, err := toml.Marshal(c.Redacted())
+		if err != nil {
+			exit(err)
+		}
+
+		fmt.Print(string(out))
+		return
+	}
+
+	// `serve` is the default command
+	cmd, args := "serve", []string{}
+	if flag.NArg() > 0 {
+		cmd, args = flag.Arg(0), flag.Args()[1:]
+	}
+
+	exit(runCommand(cmd, args))
+}
+
+// newRouter defines all routes.  Optional ones (ex. `/metrics`) are only added if enabled in config.
+func newRouter() *gin.Engine {
 	// gin.SetMode(gin.ReleaseMode)
 
 	router := gin.Default()
+	router.TrustedProxies = conf.TrustedProxies
 	router.Use(cors.Default())
 	router.Use(gzip.Gzip(gzip.DefaultCompression))
 
+	router.GET("/healthz", healthz)
+	router.GET("/readyz", readyz)
+
+	if conf.Metrics {
+		router.GET("/metrics", authorize(common.ScopeAdmin), gin.WrapH(metrics.Handler()))
+	}
+
 	r := router.Group("/api")
-	r.POST("/payment", newPayment)
-	r.GET("/payment", status)
-	r.GET("/info", info)
+	r.POST("/payment", authorize(common.ScopeCreatePayment), limitPayments, newPayment)
+	r.GET("/payment", authorize(common.ScopeReadStatus), status)
+	r.GET("/payments", authorize(common.ScopeReadHistory), findPayment)
+	r.GET("/payments/:id", authorize(common.ScopeReadStatus), getPayment)
+	r.GET("/info", authorize(common.ScopeReadStatus), info)
+	r.GET("/pow", powChallenge)
+	r.GET("/history", authorize(common.ScopeReadHistory), history)
+	r.GET("/history/export", authorize(common.ScopeReadHistory), exportHistory)
+	r.POST("/admin/reload", authorize(common.ScopeAdmin), reload)
+	r.GET("/openapi.json", openAPISpec)
+
+	if conf.SwaggerUI {
+		r.GET("/docs", swaggerUI)
+		r.GET("/docs/:file", swaggerUIFile)
+	}
 
-	// history only available if Basic Auth is enabled
-	if len(conf.Users) > 0 {
-		r.GET("/history", gin.BasicAuth(conf.Users), history)
+	// Refunds need lnd's admin macaroon.  LNURL-withdraw endpoints are public, as `k1` authorizes the withdrawal.
+	if conf.Lnd.Macaroons.Admin != "" {
+		r.POST("/payments/:id/refunds", authorize(common.ScopeAdmin), createRefund)
+		r.GET("/payments/:id/refunds", authorize(common.ScopeReadHistory), listRefunds)
+		r.POST("/payments/:id/refunds/:refund_id/resolve", authorize(common.ScopeAdmin), resolveRefund)
+		r.GET("/refunds/lnurl", lnurlWithdraw)
+		r.GET("/refunds/lnurl/callback", lnurlWithdrawCallback)
+	}
+
+	r.POST("/links", authorize(common.ScopeAdmin), createLink)
+	r.GET("/links", authorize(common.ScopeReadHistory), listLinks)
+	r.GET("/links/:slug", authorize(common.ScopeReadHistory), getLink)
+	r.DELETE("/links/:slug", authorize(common.ScopeAdmin), deleteLink)
+
+	// Payment links are shared with customers, so each visit creates a payment the way anonymous requests do
+	router.GET("/pay/:slug", limitPayments, payLink)
+
+	v2 := router.Group("/api/v2", apiV2)
+	v2.POST("/payments", authorize(common.ScopeCreatePayment), limitPayments, createPaymentV2)
+	v2.GET("/payments", authorize(common.ScopeReadHistory), listPaymentsV2)
+	v2.GET("/payments/:id", authorize(common.ScopeReadStatus), getPaymentV2)
+
+	// `static-dir` can be changed on reload, so `/` is always routed
+	router.GET("/", index)
+	router.HEAD("/", index)
+
+	return router
+}
+
+// serveCommand runs the API server until it's shut down
+func serveCommand(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	_ = fs.Parse(args)
+
+	err := setup()
+	if err != nil {
+		return err
 	}
 
+	// Fail early, before connecting to backends
+	if problems := checkPortFree(conf); len(problems) > 0 {
+		return configError{file: *configFilePath, problems: problems}
+	}
+
+	start()
+	startLimiters()
+
+	onShutdown(waitSettlements)
+	startWebhooks(conf.Webhook)
+
+	go pruneIdempotencyKeys()
+
+	go watchPayments()
+
+	router := newRouter()
+	checkDocumented(router.Routes())
+
 	var staticFilePath string
 	if conf.StaticDir != "" {
 		staticFilePath = path.Join(conf.StaticDir, "index.html")
-		router.StaticFile("/", staticFilePath)
 	}
 
-	if conf.Port == 0 {
-		conf.Port = DefaultInvoicerPort
+	tlsConf, err := tlsConfig(conf.TLS)
+	if err != nil {
+		return err
 	}
 
 	log.WithFields(log.Fields{
 		"routes":      common.FormatRoutes(router.Routes()),
 		"port":        conf.Port,
+		"tls":         tlsConf != nil,
 		"static-file": staticFilePath,
 	}).Println("gin router defined")
 
-	err := router.Run(fmt.Sprintf(":%d", conf.Port))
-	if err != nil {
-		panic(err)
-	}
+	serve(&http.Server{
+		Addr:      fmt.Sprintf(":%d", conf.Port),
+		Handler:   router,
+		TLSConfig: tlsConf,
+	})
+
+	return nil
 }
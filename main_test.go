@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lncm/invoicer/common"
+)
+
+func TestBtcPaymentStatus(t *testing.T) {
+	defer func(prev common.Config) { conf = prev }(conf)
+	conf.OnChain = common.OnChain{ToleranceSats: 100}
+
+	for _, tc := range []struct {
+		name     string
+		received common.Sats
+		flexible bool
+		desired  int64
+		bounds   common.AmountBounds
+		expected int
+	}{
+		{"nothing received", 0, false, 10000, common.AmountBounds{}, 0},
+		{"exact", 10000, false, 10000, common.AmountBounds{}, 200},
+		{"exact, not representable as float64", 29000000, false, 29000000, common.AmountBounds{}, 200},
+		{"overpaid", 20000, false, 10000, common.AmountBounds{}, 202},
+		{"overpaid by 1 sat", 10001, false, 10000, common.AmountBounds{}, 202},
+		{"underpaid", 5000, false, 10000, common.AmountBounds{}, 402},
+		{"underpaid beyond tolerance", 9899, false, 10000, common.AmountBounds{}, 402},
+		{"within tolerance", 9900, false, 10000, common.AmountBounds{}, 200},
+		{"flexible", 5000, true, 10000, common.AmountBounds{}, 200},
+		{"any amount", 5000, false, 0, common.AmountBounds{}, 200},
+		{"open, below minimum", 500, false, 0, common.AmountBounds{MinAmount: 1000}, 402},
+		{"open, within bounds", 1500, false, 0, common.AmountBounds{MinAmount: 1000, MaxAmount: 2000}, 200},
+		{"open, above maximum", 2500, false, 0, common.AmountBounds{MinAmount: 1000, MaxAmount: 2000}, 202},
+		{"open, flexible", 500, true, 0, common.AmountBounds{MinAmount: 1000}, 200},
+	} {
+		status := btcPaymentStatus(common.AddrStatus{Address: "addr", Amount: tc.received, Label: "hash"}, tc.flexible, tc.desired, tc.bounds)
+
+		code := 0
+		if status != nil {
+			code = status.Code
+
+			if status.Bitcoin == nil || status.Bitcoin.Label != "" {
+				t.Errorf("%s: unexpected bitcoin status: %+v", tc.name, status.Bitcoin)
+			}
+		}
+
+		if code != tc.expected {
+			t.Errorf("%s: code = %d, expected %d", tc.name, code, tc.expected)
+		}
+	}
+}
+
+func TestCheckBtcStatusUnknownAddress(t *testing.T) {
+	defer func(prev BitcoinClient) { btcClient = prev }(btcClient)
+	btcClient = fakeBtc{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	status := checkBtcStatus(ctx, "addr", false, false, 10000, common.AmountBounds{})
+	if status != nil {
+		t.Errorf("got %+v, expected to keep waiting", status)
+	}
+}
+
+func TestApplyRecordsOpenAmount(t *testing.T) {
+	defer useTestStore(t)()
+
+	err := db.AddPayment(common.PaymentRecord{
+		NewPayment:   common.NewPayment{ID: "pay_1", Hash: "h1", CreatedAt: 1000, Expiry: 3600},
+		AmountBounds: common.AmountBounds{MinAmount: 500},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paid := common.Payment{Paid: true, LnPaid: true, LnAmount: 100, LnAmountMsat: 100000}
+	payments := []common.Payment{paid, paid}
+	payments[0].Hash, payments[1].Hash = "h1", "not-invoicers"
+
+	if _, err := applyRecords(payments); err != nil {
+		t.Fatal(err)
+	}
+
+	if p := payments[0]; !p.OpenAmount || p.Paid || p.ID != "pay_1" {
+		t.Errorf("open-amount payment below its minimum shouldn't be paid: %+v", p)
+	}
+
+	if p := payments[1]; p.OpenAmount || !p.Paid {
+		t.Errorf("invoice invoicer didn't create should be left as lnd reports it: %+v", p)
+	}
+}
+
+func TestNormalizeAmount(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		in         paymentRequest
+		amount     int64
+		amountMsat int64
+		code       int
+	}{
+		{"no amount", paymentRequest{}, 0, 0, 0},
+		{"sats", paymentRequest{Amount: 1000}, 1000, 1000000, 0},
+		{"msat", paymentRequest{AmountMsat: 1000000}, 1000, 1000000, 0},
+		{"fraction of sat", paymentRequest{AmountMsat: 1500}, 2, 1500, 0},
+		{"both matching", paymentRequest{Amount: 1, AmountMsat: 1000}, 1, 1000, 0},
+		{"both different", paymentRequest{Amount: 1, AmountMsat: 1500}, 0, 0, 400},
+		{"negative", paymentRequest{AmountMsat: -1}, 0, 0, 400},
+		{"fraction of sat on-chain", paymentRequest{AmountMsat: 1500, Only: "btc"}, 0, 0, 400},
+		{"whole sats on-chain", paymentRequest{AmountMsat: 2000, Only: "btc"}, 2, 2000, 0},
+		{"open with bounds", paymentRequest{AmountBounds: common.AmountBounds{MinAmount: 1, MaxAmount: 2}}, 0, 0, 0},
+		{"bounds with amount", paymentRequest{Amount: 1000, AmountBounds: common.AmountBounds{MinAmount: 1}}, 0, 0, 400},
+		{"minimum above maximum", paymentRequest{AmountBounds: common.AmountBounds{MinAmount: 2, MaxAmount: 1}}, 0, 0, 400},
+		{"only minimum", paymentRequest{AmountBounds: common.AmountBounds{MinAmount: 2}}, 0, 0, 0},
+	} {
+		data := tc.in
+		fail := data.normalizeAmount()
+
+		code := 0
+		if fail != nil {
+			code = fail.Code
+		}
+
+		if code != tc.code {
+			t.Errorf("%s: code = %d, expected %d", tc.name, code, tc.code)
+			continue
+		}
+
+		if code == 0 && (data.Amount != tc.amount || data.AmountMsat != tc.amountMsat) {
+			t.Errorf("%s: amount = %d, and %d msat, expected %d, and %d msat", tc.name, data.Amount, data.AmountMsat, tc.amount, tc.amountMsat)
+		}
+	}
+}
+
+func TestCheckLnBounds(t *testing.T) {
+	bounds := common.AmountBounds{MinAmount: 1000, MaxAmount: 2000}
+
+	for _, tc := range []struct {
+		name     string
+		status   common.StatusReply
+		flexible bool
+		expected int
+	}{
+		{"pending", common.StatusReply{Ln: &common.Status{}}, false, 0},
+		{"below minimum", common.StatusReply{Code: 200, Ln: &common.Status{Settled: true, Value: 500}}, false, 402},
+		{"within bounds", common.StatusReply{Code: 200, Ln: &common.Status{Settled: true, Value: 1000}}, false, 200},
+		{"above maximum", common.StatusReply{Code: 200, Ln: &common.Status{Settled: true, Value: 3000}}, false, 202},
+		{"flexible", common.StatusReply{Code: 200, Ln: &common.Status{Settled: true, Value: 500}}, true, 200},
+		{"expired", common.StatusReply{Code: 408, Error: "expired"}, false, 408},
+	} {
+		status := tc.status
+		if code := checkLnBounds(&status, tc.flexible, bounds).Code; code != tc.expected {
+			t.Errorf("%s: code = %d, expected %d", tc.name, code, tc.expected)
+		}
+	}
+}
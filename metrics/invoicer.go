@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"time"
+)
+
+const (
+	RailLn  = "ln"
+	RailBtc = "btc"
+
+	BackendLnd      = "lnd"
+	BackendBitcoind = "bitcoind"
+)
+
+// Buckets (in seconds) suitable for durations of payments: from a few seconds, to the default invoice expiry
+var PaymentBuckets = []float64{5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600}
+
+var (
+	PaymentsCreated = NewCounter("invoicer_payments_created_total",
+		"Number of payments created, per rail.", "rail")
+
+	PaymentsPaid = NewCounter("invoicer_payments_paid_total",
+		"Number of payments settled, per rail.  Each payment is counted once, when its settlement is first recorded.", "rail")
+
+	PaymentsExpired = NewCounter("invoicer_payments_expired_total",
+		"Number of payments expired without being paid, per rail.  Each payment is counted once, when its expiry is first recorded.", "rail")
+
+	SettlementLatency = NewHistogram("invoicer_settlement_latency_seconds",
+		"Time between payment creation, and its settlement being first recorded, per rail.", PaymentBuckets, "rail")
+
+	StatusWaiters = NewGauge("invoicer_status_waiters",
+		"Number of currently open status long-polls.")
+
+	StatusWaitDuration = NewHistogram("invoicer_status_wait_seconds",
+		"Duration of status long-polls, per outcome.", PaymentBuckets, "outcome")
+
+	InvoiceSubscribers = NewGauge("invoicer_invoice_monitor_subscribers",
+		"Number of subscribers waiting for LN invoice updates.")
+
+	RPCDuration = NewHistogram("invoicer_rpc_duration_seconds",
+		"Latency of RPC calls to backends, per method.", DefBuckets, "backend", "method")
+
+	RPCErrors = NewCounter("invoicer_rpc_errors_total",
+		"Number of failed RPC calls to backends, per method.", "backend", "method")
+)
+
+// ObserveRPC records duration of an RPC call started at `start`, and counts it as failed if `err` is not nil
+func ObserveRPC(backend, method string, start time.Time, err error) {
+	RPCDuration.Observe(time.Since(start).Seconds(), backend, method)
+
+	if err != nil {
+		RPCErrors.Inc(backend, method)
+	}
+}
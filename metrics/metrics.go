@@ -0,0 +1,342 @@
+// Package metrics implements a minimal subset of Prometheus metric types, and their text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+
+	ContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+type (
+	collector interface {
+		write(w io.Writer)
+	}
+
+	desc struct {
+		name, help, kind string
+		labels           []string
+	}
+
+	// Counter is a monotonically increasing value, optionally partitioned by labels
+	Counter struct {
+		desc
+
+		mu     sync.Mutex
+		values map[string]float64
+	}
+
+	// Gauge is a value that can go up and down, optionally partitioned by labels
+	Gauge struct {
+		desc
+
+		mu     sync.Mutex
+		values map[string]float64
+	}
+
+	// GaugeFunc is a gauge whose value is only computed when metrics are collected
+	GaugeFunc struct {
+		desc
+
+		fn func() float64
+	}
+
+	histogramValue struct {
+		counts []uint64
+		sum    float64
+		count  uint64
+	}
+
+	// Histogram counts observations in configurable buckets, optionally partitioned by labels
+	Histogram struct {
+		desc
+
+		buckets []float64
+
+		mu     sync.Mutex
+		values map[string]*histogramValue
+	}
+)
+
+var (
+	DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+	registryMu sync.Mutex
+	registry   []collector
+)
+
+func register(c collector) {
+	registryMu.Lock()
+	registry = append(registry, c)
+	registryMu.Unlock()
+}
+
+// key joins label values into a single map key.  Missing values are treated as empty strings.
+func (d desc) key(labelValues []string) string {
+	if len(labelValues) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labels), len(labelValues)))
+	}
+
+	return strings.Join(labelValues, "\xff")
+}
+
+// labelString formats labels for exposition, ex: `{rail="ln",le="0.5"}`
+func (d desc) labelString(key string, extra ...string) string {
+	var pairs []string
+
+	if len(d.labels) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, d.labels[i], escape(v)))
+		}
+	}
+
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escape(extra[i+1])))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (d desc) writeHeader(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, d.kind)
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		desc:   desc{name: name, help: help, kind: typeCounter, labels: labels},
+		values: make(map[string]float64),
+	}
+
+	register(c)
+
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("metrics: counter %s can't be decreased", c.name))
+	}
+
+	key := c.key(labelValues)
+
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+// Value returns current value of the counter with `labelValues`
+func (c *Counter) Value(labelValues ...string) float64 {
+	key := c.key(labelValues)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.values[key]
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeValues(w, c.desc, c.values)
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{
+		desc:   desc{name: name, help: help, kind: typeGauge, labels: labels},
+		values: make(map[string]float64),
+	}
+
+	register(g)
+
+	return g
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	key := g.key(labelValues)
+
+	g.mu.Lock()
+	g.values[key] = v
+	g.mu.Unlock()
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	key := g.key(labelValues)
+
+	g.mu.Lock()
+	g.values[key] += v
+	g.mu.Unlock()
+}
+
+func (g *Gauge) Inc(labelValues ...string) { g.Add(1, labelValues...) }
+func (g *Gauge) Dec(labelValues ...string) { g.Add(-1, labelValues...) }
+
+func (g *Gauge) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	writeValues(w, g.desc, g.values)
+}
+
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{
+		desc: desc{name: name, help: help, kind: typeGauge},
+		fn:   fn,
+	}
+
+	register(g)
+
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.writeHeader(w)
+	_, _ = fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.fn()))
+}
+
+// NewHistogram creates a histogram with upper bounds of buckets passed in increasing order.  `+Inf` bucket is
+// always added implicitly.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: buckets of %s have to be sorted", name))
+	}
+
+	h := &Histogram{
+		desc:    desc{name: name, help: help, kind: typeHistogram, labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+
+	register(h)
+
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+
+	for i, upperBound := range h.buckets {
+		if v <= upperBound {
+			hv.counts[i]++
+		}
+	}
+
+	hv.sum += v
+	hv.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.writeHeader(w)
+
+	for _, key := range sortedKeys(h.values) {
+		hv := h.values[key]
+
+		for i, upperBound := range h.buckets {
+			_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", formatFloat(upperBound)), hv.counts[i])
+		}
+
+		_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", "+Inf"), hv.count)
+		_, _ = fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(key), formatFloat(hv.sum))
+		_, _ = fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(key), hv.count)
+	}
+}
+
+func writeValues(w io.Writer, d desc, values map[string]float64) {
+	d.writeHeader(w)
+
+	// metrics without labels are always exposed, even if never touched
+	if len(d.labels) == 0 && len(values) == 0 {
+		_, _ = fmt.Fprintf(w, "%s 0\n", d.name)
+		return
+	}
+
+	for _, key := range sortedKeys(values) {
+		_, _ = fmt.Fprintf(w, "%s%s %s\n", d.name, d.labelString(key), formatFloat(values[key]))
+	}
+}
+
+func sortedKeys(m interface{}) (keys []string) {
+	switch v := m.(type) {
+	case map[string]float64:
+		for k := range v {
+			keys = append(keys, k)
+		}
+
+	case map[string]*histogramValue:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+// WriteTo writes all registered metrics in Prometheus text exposition format
+func WriteTo(w io.Writer) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	for _, c := range registry {
+		c.write(w)
+	}
+}
+
+// Handler serves all registered metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		WriteTo(w)
+	})
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHistogramExposition(t *testing.T) {
+	h := &Histogram{
+		desc:    desc{name: "test_seconds", help: "Test.", kind: typeHistogram, labels: []string{"method"}},
+		buckets: []float64{1, 5},
+		values:  make(map[string]*histogramValue),
+	}
+
+	h.Observe(0.5, "a")
+	h.Observe(3, "a")
+	h.Observe(7, "a")
+
+	var buf bytes.Buffer
+	h.write(&buf)
+
+	expected := `# HELP test_seconds Test.
+# TYPE test_seconds histogram
+test_seconds_bucket{method="a",le="1"} 1
+test_seconds_bucket{method="a",le="5"} 2
+test_seconds_bucket{method="a",le="+Inf"} 3
+test_seconds_sum{method="a"} 10.5
+test_seconds_count{method="a"} 3
+`
+
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	c := &Counter{
+		desc:   desc{name: "test_total", help: "Test.", kind: typeCounter, labels: []string{"method"}},
+		values: make(map[string]float64),
+	}
+
+	c.Inc("a\"b\\c\nd")
+
+	var buf bytes.Buffer
+	c.write(&buf)
+
+	if !strings.Contains(buf.String(), `test_total{method="a\"b\\c\nd"} 1`) {
+		t.Errorf("label not escaped properly:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,437 @@
+// Package openapi generates an OpenAPI 3 document from a list of operations, and Go types they take, and return.
+//
+// Schemas are derived from `json` (bodies), and `form` (query parameters) struct tags, so that the document
+// can't drift away from what handlers actually bind.  Field descriptions can be added with a `doc` tag.
+package openapi
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const Version = "3.0.3"
+
+type (
+	// Operation describes a single route.  `Query`, `Body`, and values of `Responses` are zero values of the types
+	// used by the handler, ex. `paymentRequest{}`.
+	Operation struct {
+		Method      string
+		Path        string // gin-style, ex. `/api/payments/:id`
+		Summary     string
+		Description string
+		Tags        []string
+
+		Query     interface{}
+		Headers   map[string]string // request header name -> description
+		Body      interface{}
+		Responses map[int]Response
+
+		// Alternative sets of security requirements.  An empty one means the operation can be accessed anonymously.
+		Security []map[string][]string
+
+		Deprecated bool
+	}
+
+	// Typer is implemented by types whose JSON type differs from their Go kind, ex. integers encoded as decimals
+	Typer interface {
+		OpenAPIType() string
+	}
+
+	Response struct {
+		Description  string
+		Body         interface{}
+		ContentTypes []string // `application/json`, if not set
+	}
+
+	Document struct {
+		OpenAPI    string              `json:"openapi"`
+		Info       Info                `json:"info"`
+		Servers    []Server            `json:"servers,omitempty"`
+		Paths      map[string]PathItem `json:"paths"`
+		Components Components          `json:"components"`
+	}
+
+	Info struct {
+		Title       string `json:"title"`
+		Description string `json:"description,omitempty"`
+		Version     string `json:"version"`
+	}
+
+	Server struct {
+		URL string `json:"url"`
+	}
+
+	PathItem map[string]*operationObject
+
+	Components struct {
+		Schemas         map[string]*Schema        `json:"schemas"`
+		SecuritySchemes map[string]SecurityScheme `json:"securitySchemes,omitempty"`
+	}
+
+	SecurityScheme struct {
+		Type        string `json:"type"`
+		Scheme      string `json:"scheme,omitempty"`
+		In          string `json:"in,omitempty"`
+		Name        string `json:"name,omitempty"`
+		Description string `json:"description,omitempty"`
+	}
+
+	Schema struct {
+		Ref                  string             `json:"$ref,omitempty"`
+		Type                 string             `json:"type,omitempty"`
+		Format               string             `json:"format,omitempty"`
+		Description          string             `json:"description,omitempty"`
+		Enum                 []string           `json:"enum,omitempty"`
+		Items                *Schema            `json:"items,omitempty"`
+		Properties           map[string]*Schema `json:"properties,omitempty"`
+		AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+		Required             []string           `json:"required,omitempty"`
+		Nullable             bool               `json:"nullable,omitempty"`
+	}
+
+	operationObject struct {
+		Summary     string                    `json:"summary,omitempty"`
+		Description string                    `json:"description,omitempty"`
+		OperationID string                    `json:"operationId"`
+		Tags        []string                  `json:"tags,omitempty"`
+		Parameters  []parameter               `json:"parameters,omitempty"`
+		RequestBody *requestBody              `json:"requestBody,omitempty"`
+		Responses   map[string]responseObject `json:"responses"`
+		Security    []map[string][]string     `json:"security,omitempty"`
+		Deprecated  bool                      `json:"deprecated,omitempty"`
+	}
+
+	parameter struct {
+		Name        string  `json:"name"`
+		In          string  `json:"in"`
+		Description string  `json:"description,omitempty"`
+		Required    bool    `json:"required,omitempty"`
+		Schema      *Schema `json:"schema"`
+	}
+
+	requestBody struct {
+		Required bool                 `json:"required"`
+		Content  map[string]mediaType `json:"content"`
+	}
+
+	responseObject struct {
+		Description string               `json:"description"`
+		Content     map[string]mediaType `json:"content,omitempty"`
+	}
+
+	mediaType struct {
+		Schema *Schema `json:"schema,omitempty"`
+	}
+)
+
+// New builds a document describing all `ops`
+func New(info Info, ops []Operation, security map[string]SecurityScheme) Document {
+	g := generator{schemas: make(map[string]*Schema)}
+
+	doc := Document{
+		OpenAPI: Version,
+		Info:    info,
+		Paths:   make(map[string]PathItem),
+		Components: Components{
+			Schemas:         g.schemas,
+			SecuritySchemes: security,
+		},
+	}
+
+	for _, op := range ops {
+		path, pathParams := convertPath(op.Path)
+
+		item, ok := doc.Paths[path]
+		if !ok {
+			item = make(PathItem)
+			doc.Paths[path] = item
+		}
+
+		o := &operationObject{
+			Summary:     op.Summary,
+			Description: op.Description,
+			OperationID: operationID(op.Method, op.Path),
+			Tags:        op.Tags,
+			Responses:   make(map[string]responseObject),
+			Security:    op.Security,
+			Deprecated:  op.Deprecated,
+		}
+
+		for _, name := range pathParams {
+			o.Parameters = append(o.Parameters, parameter{
+				Name: name, In: "path", Required: true, Schema: &Schema{Type: "string"},
+			})
+		}
+
+		if op.Query != nil {
+			o.Parameters = append(o.Parameters, g.queryParams(reflect.TypeOf(op.Query))...)
+		}
+
+		var headers []string
+		for name := range op.Headers {
+			headers = append(headers, name)
+		}
+
+		sort.Strings(headers)
+
+		for _, name := range headers {
+			o.Parameters = append(o.Parameters, parameter{
+				Name: name, In: "header", Description: op.Headers[name], Schema: &Schema{Type: "string"},
+			})
+		}
+
+		if op.Body != nil {
+			o.RequestBody = &requestBody{
+				Required: true,
+				Content:  map[string]mediaType{"application/json": {Schema: g.schema(reflect.TypeOf(op.Body))}},
+			}
+		}
+
+		for code, resp := range op.Responses {
+			r := responseObject{Description: resp.Description}
+
+			if resp.Body != nil || len(resp.ContentTypes) > 0 {
+				contentTypes := resp.ContentTypes
+				if len(contentTypes) == 0 {
+					contentTypes = []string{"application/json"}
+				}
+
+				var schema *Schema
+				if resp.Body != nil {
+					schema = g.schema(reflect.TypeOf(resp.Body))
+				}
+
+				r.Content = make(map[string]mediaType)
+				for _, contentType := range contentTypes {
+					r.Content[contentType] = mediaType{Schema: schema}
+				}
+			}
+
+			o.Responses[statusKey(code)] = r
+		}
+
+		item[strings.ToLower(op.Method)] = o
+	}
+
+	return doc
+}
+
+// Route is a method, and gin-style path pair
+type Route struct {
+	Method, Path string
+}
+
+// Diff compares routes described by `ops` with routes actually registered.  It returns routes that are
+// registered, but not described, and described, but not registered.
+func Diff(ops []Operation, registered []Route) (undocumented, missing []Route) {
+	described := make(map[Route]bool)
+	for _, op := range ops {
+		described[Route{op.Method, op.Path}] = true
+	}
+
+	seen := make(map[Route]bool)
+	for _, r := range registered {
+		seen[r] = true
+
+		if !described[r] {
+			undocumented = append(undocumented, r)
+		}
+	}
+
+	for _, op := range ops {
+		if r := (Route{op.Method, op.Path}); !seen[r] {
+			missing = append(missing, r)
+		}
+	}
+
+	return undocumented, missing
+}
+
+// convertPath turns gin-style path params (`:id`) into OpenAPI ones (`{id}`)
+func convertPath(path string) (string, []string) {
+	var params []string
+
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, ":") || strings.HasPrefix(part, "*") {
+			params = append(params, part[1:])
+			parts[i] = "{" + part[1:] + "}"
+		}
+	}
+
+	return strings.Join(parts, "/"), params
+}
+
+// operationID returns a stable identifier usable as a function name by SDK generators, ex. `getApiPaymentsId`
+func operationID(method, path string) string {
+	id := strings.ToLower(method)
+
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '-' || r == '_' }) {
+		part = strings.TrimLeft(part, ":*")
+		if part != "" {
+			id += strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+
+	return id
+}
+
+func statusKey(code int) string {
+	if code == 0 {
+		return "default"
+	}
+
+	return strconv.Itoa(code)
+}
+
+type generator struct {
+	schemas map[string]*Schema
+}
+
+// queryParams describes fields of `t` tagged with `form` as query parameters
+func (g generator) queryParams(t reflect.Type) (params []parameter) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		name := strings.Split(f.Tag.Get("form"), ",")[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			params = append(params, g.queryParams(f.Type)...)
+			continue
+		}
+
+		if name == "" || name == "-" {
+			continue
+		}
+
+		schema := g.schema(f.Type)
+		schema.Enum = enumOf(f)
+
+		params = append(params, parameter{
+			Name:        name,
+			In:          "query",
+			Description: f.Tag.Get("doc"),
+			Required:    strings.Contains(f.Tag.Get("binding"), "required"),
+			Schema:      schema,
+		})
+	}
+
+	return params
+}
+
+var typerType = reflect.TypeOf((*Typer)(nil)).Elem()
+
+// schema returns schema of `t`.  Named structs are added to components, and referenced.
+func (g generator) schema(t reflect.Type) *Schema {
+	if t.Kind() != reflect.Ptr && t.Implements(typerType) {
+		return &Schema{Type: reflect.Zero(t).Interface().(Typer).OpenAPIType()}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := g.schema(t.Elem())
+		if s.Ref == "" {
+			s.Nullable = true
+		}
+
+		return s
+
+	case reflect.String:
+		return &Schema{Type: "string"}
+
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int32"}
+
+	case reflect.Int64, reflect.Uint, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: g.schema(t.Elem())}
+
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: g.schema(t.Elem())}
+
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+
+		// Unexported handler types (ex. `paymentRequest`) are capitalized, as SDK generators make classes out of them
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := g.schemas[name]; !ok {
+			// Placeholder prevents infinite recursion on self-referencing types
+			g.schemas[name] = &Schema{}
+			*g.schemas[name] = *g.object(t)
+		}
+
+		return &Schema{Ref: "#/components/schemas/" + name}
+	}
+
+	return &Schema{}
+}
+
+// object describes struct fields tagged with `json`.  Embedded structs without a tag are flattened, the same
+// way encoding/json does it.
+func (g generator) object(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		tag := f.Tag.Get("json")
+		name := strings.Split(tag, ",")[0]
+
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			embedded := g.object(f.Type)
+			for k, v := range embedded.Properties {
+				s.Properties[k] = v
+			}
+
+			s.Required = append(s.Required, embedded.Required...)
+			continue
+		}
+
+		if name == "-" || f.PkgPath != "" {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		// NOTE: descriptions next to `$ref` are ignored by the spec, but most tools (incl. Swagger UI) show them
+		prop := g.schema(f.Type)
+		prop.Description = f.Tag.Get("doc")
+
+		prop.Enum = enumOf(f)
+		s.Properties[name] = prop
+
+		if strings.Contains(f.Tag.Get("binding"), "required") {
+			s.Required = append(s.Required, name)
+		}
+	}
+
+	sort.Strings(s.Required)
+
+	return s
+}
+
+// enumOf returns values allowed by `oneof=` validation of a field, if any
+func enumOf(f reflect.StructField) []string {
+	for _, tag := range []string{f.Tag.Get("validate"), f.Tag.Get("binding")} {
+		for _, rule := range strings.Split(tag, ",") {
+			if strings.HasPrefix(rule, "oneof=") {
+				return strings.Fields(strings.TrimPrefix(rule, "oneof="))
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package openapi
+
+import (
+	"reflect"
+	"testing"
+)
+
+type (
+	base struct {
+		ID      string `json:"id" binding:"required"`
+		private string
+	}
+
+	item struct {
+		base
+		Amount int64    `json:"amount" doc:"In satoshis"`
+		Price  btc      `json:"price"`
+		Kind   string   `json:"kind" validate:"oneof=ln btc"`
+		Parent *item    `json:"parent,omitempty"`
+		Tags   []string `json:"tags"`
+		Skip   string   `json:"-"`
+	}
+
+	// encoded as a BTC decimal
+	btc int64
+
+	itemQuery struct {
+		Limit int    `form:"limit" doc:"Max items"`
+		Kind  string `form:"kind" binding:"required" validate:"oneof=ln btc"`
+		Other string
+	}
+)
+
+func (btc) OpenAPIType() string { return "number" }
+
+func TestNew(t *testing.T) {
+	doc := New(Info{Title: "test", Version: "1"}, []Operation{{
+		Method:    "GET",
+		Path:      "/items/:id",
+		Query:     itemQuery{},
+		Responses: map[int]Response{200: {Body: item{}}},
+	}, {
+		Method:    "POST",
+		Path:      "/items",
+		Headers:   map[string]string{"X-B": "second", "X-A": "first"},
+		Body:      item{},
+		Responses: map[int]Response{201: {Body: item{}}, 0: {ContentTypes: []string{"text/plain"}}},
+	}}, nil)
+
+	get := doc.Paths["/items/{id}"]["get"]
+	if get == nil {
+		t.Fatalf("path not converted: %v", doc.Paths)
+	}
+
+	if get.OperationID != "getItemsId" {
+		t.Errorf("operationId = %q", get.OperationID)
+	}
+
+	var names []string
+	for _, p := range get.Parameters {
+		names = append(names, p.In+":"+p.Name)
+	}
+
+	if expected := []string{"path:id", "query:limit", "query:kind"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("parameters = %v, expected %v", names, expected)
+	}
+
+	if kind := get.Parameters[2]; !kind.Required || !reflect.DeepEqual(kind.Schema.Enum, []string{"ln", "btc"}) {
+		t.Errorf("kind param = %+v, schema = %+v", kind, kind.Schema)
+	}
+
+	ref := get.Responses["200"].Content["application/json"].Schema.Ref
+	if ref != "#/components/schemas/Item" {
+		t.Errorf("response not referenced: %q", ref)
+	}
+
+	s := doc.Components.Schemas["Item"]
+	if s == nil {
+		t.Fatal("item missing from components")
+	}
+
+	var props []string
+	for name := range s.Properties {
+		props = append(props, name)
+	}
+
+	if len(props) != 6 || s.Properties["id"] == nil || s.Properties["parent"].Ref == "" {
+		t.Errorf("item properties = %v", props)
+	}
+
+	if !reflect.DeepEqual(s.Required, []string{"id"}) {
+		t.Errorf("required = %v", s.Required)
+	}
+
+	if s.Properties["amount"].Description != "In satoshis" || s.Properties["amount"].Format != "int64" {
+		t.Errorf("amount = %+v", s.Properties["amount"])
+	}
+
+	if s.Properties["price"].Type != "number" || s.Properties["price"].Format != "" {
+		t.Errorf("price = %+v", s.Properties["price"])
+	}
+
+	post := doc.Paths["/items"]["post"]
+	if len(post.Parameters) != 2 || post.Parameters[0].Name != "X-A" || post.Parameters[0].In != "header" {
+		t.Errorf("header parameters = %+v", post.Parameters)
+	}
+
+	if post.RequestBody == nil || post.Responses["default"].Content["text/plain"].Schema != nil {
+		t.Errorf("post = %+v", post)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	ops := []Operation{{Method: "GET", Path: "/a"}, {Method: "POST", Path: "/a"}}
+	registered := []Route{{"GET", "/a"}, {"GET", "/b"}}
+
+	undocumented, missing := Diff(ops, registered)
+	if !reflect.DeepEqual(undocumented, []Route{{"GET", "/b"}}) {
+		t.Errorf("undocumented = %v", undocumented)
+	}
+
+	if !reflect.DeepEqual(missing, []Route{{"POST", "/a"}}) {
+		t.Errorf("missing = %v", missing)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+
+	"github.com/lncm/invoicer/common"
+)
+
+// orderQuery selects payments by merchant's data attached to them.  Empty fields match all payments.
+type orderQuery struct {
+	OrderID       string   `form:"order_id" doc:"Only payments for this order"`
+	CustomerEmail string   `form:"customer_email" doc:"Only payments of this customer (case-insensitive)"`
+	Metadata      []string `form:"metadata" doc:"Only payments with metadata matching key:value.  Can be repeated, all have to match"`
+}
+
+// validateOrderInfo checks merchant's data attached to a payment
+func validateOrderInfo(info common.OrderInfo) *common.StatusReply {
+	if len(info.OrderID) > common.MaxOrderIDLen {
+		return &common.StatusReply{
+			Code:  400,
+			Error: fmt.Sprintf("order_id can't be longer than %d characters", common.MaxOrderIDLen),
+		}
+	}
+
+	if info.CustomerEmail != "" && validator.New().Var(info.CustomerEmail, "email") != nil {
+		return &common.StatusReply{
+			Code:  400,
+			Error: "customer_email is not a valid email address",
+		}
+	}
+
+	if info.Metadata != nil {
+		content, err := json.Marshal(info.Metadata)
+		if err != nil || len(content) > common.MaxMetadataLen {
+			return &common.StatusReply{
+				Code:  400,
+				Error: fmt.Sprintf("metadata can't be larger than %d bytes", common.MaxMetadataLen),
+			}
+		}
+	}
+
+	return nil
+}
+
+// mayReadOrderInfo returns true if the request can see merchant's data attached to payments, and their preimages.
+// They're only shown to ones made with `read-history`, or `admin` scope, as `read-status` routes are usually open
+// to payers.
+func mayReadOrderInfo(c *gin.Context) bool {
+	if hasClientCert(c.Request) {
+		return true
+	}
+
+	if apiKey, ok := requestKey(c); ok {
+		return apiKey.Allows(common.ScopeReadHistory)
+	}
+
+	return basicAuthorized(c.Request)
+}
+
+// redactPayment removes merchant's data, and LN preimage from `p`, unless the request can see them.  Preimage proves
+// the payment was made, and anyone can get its hash from bolt11, so showing it would let them claim the purchase.
+func redactPayment(c *gin.Context, p *common.Payment) {
+	if mayReadOrderInfo(c) {
+		return
+	}
+
+	p.OrderInfo, p.Preimage = common.OrderInfo{}, ""
+}
+
+// addOrderInfo adds merchant's data to replies describing a payment invoicer has created.  Replies to requests
+// have to be checked with `mayReadOrderInfo` first.
+func addOrderInfo(status *common.StatusReply, hash, addr string) {
+	switch status.Code {
+	case 0, 200, 202, 402, 408:
+	default:
+		return
+	}
+
+	r, err := db.FindPayment(hash, addr)
+	if err != nil {
+		return
+	}
+
+	status.OrderInfo = r.OrderInfo
+}
+
+func (q orderQuery) validate() *common.StatusReply {
+	for _, m := range q.Metadata {
+		if !strings.Contains(m, ":") {
+			return &common.StatusReply{
+				Code:  400,
+				Error: fmt.Sprintf("metadata= has to be in a form of `key:value`, got %q", m),
+			}
+		}
+	}
+
+	return nil
+}
+
+// matches returns true if `info` matches all the set criteria
+func (q orderQuery) matches(info common.OrderInfo) bool {
+	if q.OrderID != "" && q.OrderID != info.OrderID {
+		return false
+	}
+
+	if q.CustomerEmail != "" && !strings.EqualFold(q.CustomerEmail, info.CustomerEmail) {
+		return false
+	}
+
+	for _, m := range q.Metadata {
+		parts := strings.SplitN(m, ":", 2)
+
+		value, ok := info.Metadata[parts[0]]
+		if !ok || formatMetadata(value) != parts[1] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// filter returns only the payments matching the query
+func (q orderQuery) filter(payments []common.Payment) []common.Payment {
+	if q.OrderID == "" && q.CustomerEmail == "" && len(q.Metadata) == 0 {
+		return payments
+	}
+
+	var filtered []common.Payment
+	for _, p := range payments {
+		if q.matches(p.OrderInfo) {
+			filtered = append(filtered, p)
+		}
+	}
+
+	return filtered
+}
+
+// formatMetadata returns metadata value the way it's compared with filters.  Numbers are formatted without
+// exponents, so that ex. `qty:5` matches `{"qty": 5}`.
+func formatMetadata(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+
+	case nil:
+		return "null"
+	}
+
+	content, _ := json.Marshal(value)
+	return string(content)
+}
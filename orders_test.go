@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lncm/invoicer/common"
+)
+
+func TestOrderQueryBinding(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/api/history?order_id=o1&customer_email=A@b.c&metadata=a:1&metadata=b:x", nil)
+
+	var q historyQuery
+
+	err := c.ShouldBindQuery(&q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if q.OrderID != "o1" || q.CustomerEmail != "A@b.c" || len(q.Metadata) != 2 {
+		t.Errorf("query bound incorrectly: %+v", q)
+	}
+}
+
+func TestOrderQueryMatches(t *testing.T) {
+	info := common.OrderInfo{
+		OrderID:       "o1",
+		CustomerEmail: "alice@example.com",
+		Metadata: map[string]interface{}{
+			"qty":   float64(5),
+			"size":  "L",
+			"gift":  true,
+			"notes": nil,
+			"tags":  []interface{}{"a", "b"},
+		},
+	}
+
+	for _, tc := range []struct {
+		query    orderQuery
+		expected bool
+	}{
+		{orderQuery{}, true},
+		{orderQuery{OrderID: "o1"}, true},
+		{orderQuery{OrderID: "o2"}, false},
+		{orderQuery{CustomerEmail: "Alice@Example.com"}, true},
+		{orderQuery{CustomerEmail: "bob@example.com"}, false},
+		{orderQuery{Metadata: []string{"qty:5", "size:L", "gift:true"}}, true},
+		{orderQuery{Metadata: []string{"notes:null", `tags:["a","b"]`}}, true},
+		{orderQuery{Metadata: []string{"qty:5", "size:M"}}, false},
+		{orderQuery{Metadata: []string{"color:red"}}, false},
+		{orderQuery{OrderID: "o1", Metadata: []string{"size:L:XL"}}, false},
+	} {
+		if matches := tc.query.matches(info); matches != tc.expected {
+			t.Errorf("%+v: matches = %v, expected %v", tc.query, matches, tc.expected)
+		}
+	}
+}
+
+func TestValidateOrderInfo(t *testing.T) {
+	large := make(map[string]interface{})
+	for i := 0; i < 500; i++ {
+		large[string(rune('a'+i%26))+string(rune('a'+i/26))] = "0123456789"
+	}
+
+	for _, tc := range []struct {
+		name  string
+		info  common.OrderInfo
+		valid bool
+	}{
+		{"empty", common.OrderInfo{}, true},
+		{"all set", common.OrderInfo{OrderID: "o1", CustomerEmail: "a@b.co", Metadata: map[string]interface{}{"a": 1}}, true},
+		{"invalid email", common.OrderInfo{CustomerEmail: "alice"}, false},
+		{"metadata too large", common.OrderInfo{Metadata: large}, false},
+	} {
+		if fail := validateOrderInfo(tc.info); (fail == nil) != tc.valid {
+			t.Errorf("%s: got %v, expected valid=%v", tc.name, fail, tc.valid)
+		}
+	}
+}
+
+// Preimage of the payment `useOrderPayment` stores
+const testPreimage = "5ad0b1c3e1d4b6a7f0c9d8e2a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6"
+
+// useOrderPayment stores a paid payment with merchant's data attached, and returns its LN hash
+func useOrderPayment(t *testing.T) string {
+	const hash = "102d05bebcc9a178112ab6eb92dc9cc14651d993d38b5cfe19799494c9fc29e4"
+
+	payment := common.NewPayment{ID: "pay_1", Hash: hash, CreatedAt: time.Now().Unix() - 60, Expiry: 3600}
+
+	err := db.AddPayment(common.PaymentRecord{
+		NewPayment: payment,
+		OrderInfo:  common.OrderInfo{OrderID: "order-1", CustomerEmail: "alice@example.com"},
+		Amount:     1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lnClient = fakeLn{invoices: map[string]common.Invoice{
+		hash: {NewPayment: payment, Amount: 1000, AmountMsat: 1000000, Paid: true, Received: 1000, ReceivedMsat: 1000000, Preimage: testPreimage},
+	}}
+
+	return hash
+}
+
+func TestOrderInfoVisibility(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer useTestStore(t)()
+	defer func(prev LightningClient) { lnClient = prev }(lnClient)
+
+	hash := useOrderPayment(t)
+
+	for _, tc := range []struct {
+		name     string
+		handler  gin.HandlerFunc
+		url      string
+		preimage bool
+	}{
+		{"status", status, "/api/payment?hash=" + hash, false},
+		{"v1", getPayment, "/api/payments/pay_1", true},
+		{"v2", getPaymentV2, "/api/v2/payments/pay_1", true},
+	} {
+		for _, scopes := range [][]string{nil, {common.ScopeReadStatus}, {common.ScopeReadHistory}, {common.ScopeAdmin}} {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("GET", tc.url, nil)
+			c.Params = gin.Params{{Key: "id", Value: "pay_1"}}
+
+			if scopes != nil {
+				c.Set(apiKeyCtxKey, common.APIKey{ID: "key_1", Scopes: scopes})
+			}
+
+			tc.handler(c)
+			settling.Wait()
+
+			expected := len(scopes) > 0 && scopes[0] != common.ScopeReadStatus
+			if w.Code != 200 || strings.Contains(w.Body.String(), "alice@example.com") != expected {
+				t.Errorf("%s with %v: got %d %s, expected order info shown: %t", tc.name, scopes, w.Code, w.Body, expected)
+			}
+
+			if tc.preimage && strings.Contains(w.Body.String(), testPreimage) != expected {
+				t.Errorf("%s with %v: got %s, expected preimage shown: %t", tc.name, scopes, w.Body, expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lncm/invoicer/common"
+	"github.com/lncm/invoicer/store"
+)
+
+var hashRe = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// paymentQuery looks up a single payment.  Exactly one of the fields has to be set.
+type paymentQuery struct {
+	Hash    string `form:"hash" doc:"LN payment hash"`
+	Addr    string `form:"address" doc:"Bitcoin address"`
+	OrderID string `form:"order_id" doc:"If there are multiple payments for the order, the newest one is returned"`
+}
+
+// lookupRecord returns record of payment with `id`.  Invoices created before IDs were introduced can be looked up
+// by their LN hash.
+func lookupRecord(id string) (common.PaymentRecord, error) {
+	r, err := db.Payment(id)
+	if errors.Is(err, store.ErrNotFound) && hashRe.MatchString(id) {
+		return lookupByHash(id)
+	}
+
+	return r, err
+}
+
+// lookupByHash returns record of payment with LN `hash`.  Invoices invoicer has no record of (ex. created before
+// records were kept) only have the hash set.
+func lookupByHash(hash string) (common.PaymentRecord, error) {
+	r, err := db.FindPayment(hash, "")
+	if errors.Is(err, store.ErrNotFound) {
+		return common.PaymentRecord{NewPayment: common.NewPayment{Hash: hash}}, nil
+	}
+
+	return r, err
+}
+
+func (q paymentQuery) lookup() (common.PaymentRecord, error) {
+	switch {
+	case q.Hash != "":
+		return lookupByHash(q.Hash)
+
+	case q.Addr != "":
+		return db.FindPayment("", q.Addr)
+	}
+
+	return db.PaymentByOrderID(q.OrderID)
+}
+
+// replyPayment replies with current state of payment `r` without waiting for anything
+func replyPayment(c *gin.Context, r common.PaymentRecord) {
+	if !requireBackends(c, false) {
+		return
+	}
+
+	payment, warning, err := fetchPayment(c, r)
+	if errors.Is(err, common.ErrInvoiceNotFound) {
+		replyStatus(c, common.StatusReply{
+			Code:  404,
+			Error: err.Error(),
+		})
+		return
+	}
+
+	if err != nil {
+		replyStatus(c, common.StatusReply{
+			Code:  errCode(err),
+			Error: err.Error(),
+		})
+		return
+	}
+
+	redactPayment(c, &payment)
+
+	setWarning(c, warning)
+	c.JSON(200, payment)
+}
+
+// replyLookupError replies with 404 if a payment wasn't found, or 500 if it couldn't be looked up
+func replyLookupError(c *gin.Context, err error) {
+	code := 500
+	if errors.Is(err, store.ErrNotFound) {
+		code = 404
+	}
+
+	replyStatus(c, common.StatusReply{
+		Code:  code,
+		Error: err.Error(),
+	})
+}
+
+// getPayment returns the payment with ID (or LN hash) passed in the path
+func getPayment(c *gin.Context) {
+	r, err := lookupRecord(c.Param("id"))
+	if err != nil {
+		replyLookupError(c, err)
+		return
+	}
+
+	replyPayment(c, r)
+}
+
+// findPayment returns the payment with LN hash, Bitcoin address, or order ID passed in the query
+func findPayment(c *gin.Context) {
+	var queryParams paymentQuery
+
+	err := c.ShouldBindQuery(&queryParams)
+	if err != nil {
+		replyStatus(c, common.StatusReply{
+			Code:  400,
+			Error: fmt.Errorf("invalid request: %w", err).Error(),
+		})
+		return
+	}
+
+	var set int
+	for _, v := range []string{queryParams.Hash, queryParams.Addr, queryParams.OrderID} {
+		if v != "" {
+			set++
+		}
+	}
+
+	if set != 1 {
+		replyStatus(c, common.StatusReply{
+			Code:  400,
+			Error: "Exactly one of `hash`, `address`, or `order_id` needs to be provided",
+		})
+		return
+	}
+
+	r, err := queryParams.lookup()
+	if err != nil {
+		replyLookupError(c, err)
+		return
+	}
+
+	replyPayment(c, r)
+}
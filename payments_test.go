@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lncm/invoicer/common"
+	"github.com/lncm/invoicer/store"
+)
+
+// useTestStore points `db` at an empty store in a temporary directory, and returns a function removing it
+func useTestStore(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "invoicer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = store.Open(filepath.Join(dir, "invoicer.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// settlements recorded in the background would otherwise end up in the store of the next test
+	return func() {
+		settling.Wait()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestPaymentLookup(t *testing.T) {
+	defer useTestStore(t)()
+
+	const hash = "102d05bebcc9a178112ab6eb92dc9cc14651d993d38b5cfe19799494c9fc29e4"
+
+	for _, r := range []common.PaymentRecord{
+		{NewPayment: common.NewPayment{ID: "pay_1", Hash: hash, Address: "bc1qa"}, OrderInfo: common.OrderInfo{OrderID: "o1"}},
+		{NewPayment: common.NewPayment{ID: "pay_2", Address: "bc1qb"}, OrderInfo: common.OrderInfo{OrderID: "o1"}},
+	} {
+		if err := db.AddPayment(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	legacy := "0000000000000000000000000000000000000000000000000000000000000000"
+
+	for _, tc := range []struct {
+		name     string
+		lookup   func() (common.PaymentRecord, error)
+		expected string
+	}{
+		{"by ID", func() (common.PaymentRecord, error) { return lookupRecord("pay_2") }, "pay_2"},
+		{"by hash as ID", func() (common.PaymentRecord, error) { return lookupRecord(hash) }, "pay_1"},
+		{"by hash", paymentQuery{Hash: hash}.lookup, "pay_1"},
+		{"by address", paymentQuery{Addr: "bc1qb"}.lookup, "pay_2"},
+		{"by order ID", paymentQuery{OrderID: "o1"}.lookup, "pay_2"},
+	} {
+		r, err := tc.lookup()
+		if err != nil || r.ID != tc.expected {
+			t.Errorf("%s: got %q (%v), expected %q", tc.name, r.ID, err, tc.expected)
+		}
+	}
+
+	r, err := lookupRecord(legacy)
+	if err != nil || r.ID != "" || r.Hash != legacy {
+		t.Errorf("invoices invoicer has no record of should be looked up by hash, got %+v (%v)", r, err)
+	}
+
+	for _, lookup := range []func() (common.PaymentRecord, error){
+		func() (common.PaymentRecord, error) { return lookupRecord("pay_3") },
+		paymentQuery{Addr: "bc1qc"}.lookup,
+		paymentQuery{OrderID: "o2"}.lookup,
+	} {
+		if _, err := lookup(); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("expected not found, got %v", err)
+		}
+	}
+}
+
+func TestFindPaymentRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer useTestStore(t)()
+
+	for _, tc := range []struct {
+		query string
+		code  int
+	}{
+		{"", 400},
+		{"?hash=abc&address=bc1q", 400},
+		{"?order_id=missing", 404},
+		{"?address=bc1q", 404},
+	} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "/api/payments"+tc.query, nil)
+
+		findPayment(c)
+
+		var reply common.StatusReply
+		_ = json.Unmarshal(w.Body.Bytes(), &reply)
+
+		if w.Code != tc.code || reply.Error == "" {
+			t.Errorf("%q: got %d %s, expected %d with an error", tc.query, w.Code, w.Body, tc.code)
+		}
+	}
+}
+
+func TestPaymentLookupAnonymous(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer useTestStore(t)()
+	defer func(prev LightningClient) { lnClient = prev }(lnClient)
+	defer func(prev common.Config) { conf = prev }(conf)
+
+	conf = common.Config{}
+	hash := useOrderPayment(t)
+	router := newRouter()
+
+	for _, tc := range []struct {
+		url  string
+		code int
+	}{
+		{"/api/payments?order_id=order-1", 401},
+		{"/api/payments?hash=" + hash, 401},
+		{"/api/payments/pay_1", 200},
+		{"/api/payments/" + hash, 200},
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", tc.url, nil))
+		settling.Wait()
+
+		if w.Code != tc.code || strings.Contains(w.Body.String(), "alice@example.com") || strings.Contains(w.Body.String(), testPreimage) {
+			t.Errorf("%s: got %d %s, expected %d without customer_email, and preimage", tc.url, w.Code, w.Body, tc.code)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Package ratelimit implements token-bucket rate limiting, with a separate bucket kept for each key
+// (ex. IP address, or API key ID).
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Buckets idle for this long are full again, and get removed to free memory
+const cleanupInterval = 10 * time.Minute
+
+type (
+	bucket struct {
+		tokens float64
+		last   time.Time
+	}
+
+	Limiter struct {
+		mu sync.Mutex
+
+		// tokens added per second
+		rate  float64
+		burst float64
+
+		buckets map[string]*bucket
+	}
+)
+
+// New creates a limiter allowing `perMinute` requests per minute for each key, with bursts of up to `burst`
+// requests.  If `perMinute` is 0, all requests are allowed.
+func New(perMinute, burst int64) *Limiter {
+	l := &Limiter{buckets: make(map[string]*bucket)}
+	l.SetLimit(perMinute, burst)
+
+	go l.cleanup()
+
+	return l
+}
+
+// SetLimit changes limits of an existing limiter.  Current state of buckets is preserved.
+func (l *Limiter) SetLimit(perMinute, burst int64) {
+	if burst < 1 {
+		burst = 1
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate = float64(perMinute) / 60
+	l.burst = float64(burst)
+}
+
+// Allow takes a token from the bucket of `key`.  If there's none, returns false, and time after which
+// the next one will be available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate == 0 {
+		return true, 0
+	}
+
+	now := time.Now()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+
+	b.tokens--
+
+	return true, 0
+}
+
+func (l *Limiter) cleanup() {
+	for range time.Tick(cleanupInterval) {
+		l.mu.Lock()
+
+		for key, b := range l.buckets {
+			if l.rate == 0 || b.tokens+time.Since(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, key)
+			}
+		}
+
+		l.mu.Unlock()
+	}
+}
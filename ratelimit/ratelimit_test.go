@@ -0,0 +1,38 @@
+package ratelimit
+
+import (
+	"testing"
+)
+
+func TestAllow(t *testing.T) {
+	l := New(60, 3)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("request %d within burst should be allowed", i+1)
+		}
+	}
+
+	ok, wait := l.Allow("a")
+	if ok {
+		t.Fatal("request exceeding burst should be denied")
+	}
+
+	if wait <= 0 {
+		t.Errorf("expected positive wait time, got %s", wait)
+	}
+
+	if ok, _ := l.Allow("b"); !ok {
+		t.Error("other keys should not be affected")
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	l := New(0, 0)
+
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatal("limiter with rate of 0 should allow everything")
+		}
+	}
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/lncm/invoicer/common"
+	"github.com/lncm/invoicer/lnurl"
+	"github.com/lncm/invoicer/store"
+)
+
+const (
+	// Routing fees paid for LN refunds can't exceed this percentage of the refund, or `minRefundFeeLimit` sats,
+	// whichever is larger
+	refundFeeLimitPercent = 1
+	minRefundFeeLimit     = 10
+)
+
+type (
+	// refundRequest has to set exactly one of: `Bolt11`, `Address`, or `LNURL`
+	refundRequest struct {
+		Amount  int64  `json:"amount" validate:"min=0" doc:"Amount in satoshis.  Can be omitted, if bolt11 specifies it."`
+		Bolt11  string `json:"bolt11" doc:"Customer's invoice to pay"`
+		Address string `json:"address" doc:"Customer's Bitcoin address to send to"`
+		LNURL   bool   `json:"lnurl" doc:"Issue LNURL-withdraw link, for the customer to withdraw the refund with"`
+		Reason  string `json:"reason" validate:"max=255"`
+	}
+
+	refundList struct {
+		Refunds []common.Refund `json:"refunds"`
+	}
+
+	withdrawQuery struct {
+		K1 string `form:"k1" binding:"required"`
+	}
+
+	withdrawCallbackQuery struct {
+		K1     string `form:"k1" binding:"required"`
+		Bolt11 string `form:"pr" binding:"required" doc:"Invoice to pay the refund to"`
+	}
+)
+
+func (r refundRequest) validate() *common.StatusReply {
+	err := validator.New().Struct(r)
+	if err != nil {
+		return &common.StatusReply{
+			Code:  400,
+			Error: fmt.Errorf("invalid request: %w", err).Error(),
+		}
+	}
+
+	var set int
+	for _, isSet := range []bool{r.Bolt11 != "", r.Address != "", r.LNURL} {
+		if isSet {
+			set++
+		}
+	}
+
+	if set != 1 {
+		return &common.StatusReply{
+			Code:  400,
+			Error: "Exactly one of `bolt11`, `address`, or `lnurl` needs to be provided",
+		}
+	}
+
+	if r.Bolt11 == "" && r.Amount == 0 {
+		return &common.StatusReply{
+			Code:  400,
+			Error: "`amount` is required, unless `bolt11` specifies it",
+		}
+	}
+
+	return nil
+}
+
+// refundKey returns ID refunds of a payment are recorded under.  Invoices created before IDs were introduced use
+// their LN hash.
+func refundKey(id, hash string) string {
+	if id != "" {
+		return id
+	}
+
+	return hash
+}
+
+func refundFeeLimit(amount int64) int64 {
+	limit := amount * refundFeeLimitPercent / 100
+	if limit < minRefundFeeLimit {
+		return minRefundFeeLimit
+	}
+
+	return limit
+}
+
+// applyRefunds adds refunds, and fees paid for them to payments
+func applyRefunds(payments []common.Payment) error {
+	refunds, err := db.Refunds()
+	if err != nil {
+		return err
+	}
+
+	for i, p := range payments {
+		payments[i].ApplyRefunds(refunds[refundKey(p.ID, p.Hash)])
+	}
+
+	return nil
+}
+
+// fromTrustedProxy returns true if `r` was made by one of `trusted-proxies`, whose headers can be relied on
+func fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, proxy := range conf.TrustedProxies {
+		if _, cidr, err := net.ParseCIDR(proxy); err == nil {
+			if cidr.Contains(ip) {
+				return true
+			}
+
+			continue
+		}
+
+		if ip.Equal(net.ParseIP(proxy)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// baseURL returns scheme, and host the request was made to, so that LNURL links point back at this invoicer.
+// `X-Forwarded-Proto` is only honored when set by a trusted proxy.
+func baseURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil || (c.GetHeader("X-Forwarded-Proto") == "https" && fromTrustedProxy(c.Request)) {
+		scheme = "https"
+	}
+
+	return fmt.Sprintf("%s://%s", scheme, c.Request.Host)
+}
+
+// decodeRefundInvoice checks customer's `bolt11`, and returns amount it's going to be paid with.  `fixed` is set if
+// `bolt11` specifies the amount itself.
+func decodeRefundInvoice(ctx context.Context, bolt11 string, amount int64) (_ int64, fixed bool, fail *common.StatusReply) {
+	invoice, err := lnClient.DecodeInvoice(ctx, bolt11)
+	if err != nil {
+		return 0, false, &common.StatusReply{
+			Code:  400,
+			Error: fmt.Errorf("invalid bolt11: %w", err).Error(),
+		}
+	}
+
+	switch {
+	case invoice.Expired:
+		return 0, false, &common.StatusReply{Code: 400, Error: "bolt11 has expired"}
+
+	case invoice.Amount > 0 && amount > 0 && invoice.Amount != amount:
+		return 0, false, &common.StatusReply{
+			Code:  400,
+			Error: fmt.Sprintf("bolt11 is for %d sat, but %d sat was requested", invoice.Amount, amount),
+		}
+
+	case invoice.Amount > 0:
+		return invoice.Amount, true, nil
+
+	case amount == 0:
+		return 0, false, &common.StatusReply{Code: 400, Error: "`amount` is required, as bolt11 doesn't specify it"}
+	}
+
+	return amount, false, nil
+}
+
+// payRefund pays pending refund `r` to its bolt11 (which might specify the amount itself), or address, and records
+// the outcome.  Request context is not used, so that a client disconnecting can't leave the refund in an unknown
+// state.  Only refunds lnd definitely didn't pay are marked failed, while ones it might have are marked unknown, and
+// keep counting towards the refunded amount.  LNURL-withdraw refunds that failed become pending again, so that
+// the customer can retry withdrawing them.
+func payRefund(r common.Refund, fixedAmount bool) common.Refund {
+	ctx := context.Background()
+
+	var err error
+	switch r.Method {
+	case common.RefundOnChain:
+		r.TxID, r.Fee, err = lnClient.SendCoins(ctx, r.Address, r.Amount)
+
+	default:
+		amount := r.Amount
+		if fixedAmount {
+			amount = 0
+		}
+
+		r.Preimage, r.Fee, err = lnClient.PayInvoice(ctx, r.Bolt11, amount, refundFeeLimit(r.Amount))
+	}
+
+	return finishRefund(r, err)
+}
+
+// finishRefund records outcome of refund `r`, given `err` of paying it
+func finishRefund(r common.Refund, err error) common.Refund {
+	logger := log.WithFields(log.Fields{"id": r.ID, "payment": r.PaymentID, "amount": r.Amount, "fee": r.Fee})
+
+	switch {
+	case err == nil:
+		r.Status, r.Error, r.CompletedAt = common.RefundSucceeded, "", time.Now().Unix()
+		logger.Println("refund paid")
+
+	case errors.Is(err, common.ErrPaymentFailed) && r.Method == common.RefundLnurl:
+		r.Status, r.Bolt11, r.Error = common.RefundPending, "", err.Error()
+		logger.WithError(err).Warningln("refund withdrawal failed, can be retried")
+
+	case errors.Is(err, common.ErrPaymentFailed):
+		r.Status, r.Error, r.CompletedAt = common.RefundFailed, err.Error(), time.Now().Unix()
+		logger.WithError(err).Warningln("refund failed")
+
+	default:
+		r.Status, r.Error = common.RefundUnknown, err.Error()
+		logger.WithError(err).Errorln("refund outcome unknown, resolve it once lnd can tell")
+	}
+
+	if err := db.UpdateRefund(r); err != nil {
+		logger.WithError(err).Errorln("unable to record refund outcome")
+	}
+
+	return r
+}
+
+// createRefund refunds (a part of) funds received for the payment with ID (or LN hash) passed in the path
+func createRefund(c *gin.Context) {
+	var data refundRequest
+
+	err := c.ShouldBindJSON(&data)
+	if err != nil {
+		replyStatus(c, common.StatusReply{
+			Code:  400,
+			Error: fmt.Errorf("invalid request: %w", err).Error(),
+		})
+		return
+	}
+
+	if fail := data.validate(); fail != nil {
+		replyStatus(c, *fail)
+		return
+	}
+
+	r, err := lookupRecord(c.Param("id"))
+	if err != nil {
+		replyLookupError(c, err)
+		return
+	}
+
+	if !requireBackends(c, false) {
+		return
+	}
+
+	payment, _, err := fetchPayment(c, r)
+	if err != nil {
+		code := errCode(err)
+		if errors.Is(err, common.ErrInvoiceNotFound) {
+			code = 404
+		}
+
+		replyStatus(c, common.StatusReply{Code: code, Error: err.Error()})
+		return
+	}
+
+	refund := common.Refund{
+		PaymentID: refundKey(r.ID, r.Hash),
+		Status:    common.RefundPending,
+		Reason:    data.Reason,
+		Amount:    data.Amount,
+		Bolt11:    data.Bolt11,
+		Address:   data.Address,
+		CreatedAt: time.Now().Unix(),
+	}
+
+	var (
+		k1          string
+		fixedAmount bool
+	)
+
+	switch {
+	case data.Bolt11 != "":
+		var fail *common.StatusReply
+		refund.Method = common.RefundLn
+		refund.Amount, fixedAmount, fail = decodeRefundInvoice(c, data.Bolt11, data.Amount)
+		if fail != nil {
+			replyStatus(c, *fail)
+			return
+		}
+
+	case data.Address != "":
+		refund.Method = common.RefundOnChain
+
+	default:
+		refund.Method = common.RefundLnurl
+		k1, refund.K1Hash, err = common.NewRefundK1()
+	}
+
+	if err == nil {
+		refund.ID, err = common.NewRefundID()
+	}
+
+	if err != nil {
+		replyStatus(c, common.StatusReply{
+			Code:  500,
+			Error: fmt.Errorf("can't generate refund ID: %w", err).Error(),
+		})
+		return
+	}
+
+	// Recorded before paying, so that concurrent requests can't refund more than was received
+	err = db.AddRefund(refund, payment.Refundable())
+	if err != nil {
+		code := 500
+		if errors.Is(err, store.ErrRefundExceeded) {
+			code = 422
+		}
+
+		if code == 422 && payment.Refundable() < payment.Received() {
+			err = fmt.Errorf("%w (unconfirmed on-chain deposits can't be refunded yet)", err)
+		}
+
+		replyStatus(c, common.StatusReply{Code: code, Error: fmt.Errorf("can't record refund: %w", err).Error()})
+		return
+	}
+
+	if refund.Method == common.RefundLnurl {
+		refund.LNURL = lnurl.Encode(fmt.Sprintf("%s/api/refunds/lnurl?k1=%s", baseURL(c), k1))
+		c.JSON(200, refund)
+		return
+	}
+
+	c.JSON(200, payRefund(refund, fixedAmount))
+}
+
+// listRefunds returns refunds of the payment with ID (or LN hash) passed in the path, oldest first
+func listRefunds(c *gin.Context) {
+	r, err := lookupRecord(c.Param("id"))
+	if err != nil {
+		replyLookupError(c, err)
+		return
+	}
+
+	refunds, err := db.Refunds()
+	if err != nil {
+		replyLookupError(c, err)
+		return
+	}
+
+	list := refundList{Refunds: refunds[refundKey(r.ID, r.Hash)]}
+	if list.Refunds == nil {
+		list.Refunds = []common.Refund{}
+	}
+
+	c.JSON(200, list)
+}
+
+// resolveRefund asks lnd about the outcome of refund with ID passed in the path, whose outcome was unknown, ex.
+// because connection to lnd was lost while paying it.  If the payment is still in flight, the refund stays unknown.
+func resolveRefund(c *gin.Context) {
+	r, err := lookupRecord(c.Param("id"))
+	if err != nil {
+		replyLookupError(c, err)
+		return
+	}
+
+	refunds, err := db.Refunds()
+	if err != nil {
+		replyLookupError(c, err)
+		return
+	}
+
+	var (
+		refund common.Refund
+		txIDs  = make(map[string]bool)
+	)
+
+	for _, stored := range refunds[refundKey(r.ID, r.Hash)] {
+		if stored.ID == c.Param("refund_id") {
+			refund = stored
+		}
+
+		txIDs[stored.TxID] = true
+	}
+
+	switch {
+	case refund.ID == "":
+		replyStatus(c, common.StatusReply{Code: 404, Error: fmt.Sprintf("refund %s: %s", c.Param("refund_id"), store.ErrNotFound)})
+		return
+
+	case refund.Status != common.RefundUnknown:
+		replyStatus(c, common.StatusReply{Code: 409, Error: fmt.Sprintf("refund is already %s", refund.Status)})
+		return
+	}
+
+	if !requireBackends(c, false) {
+		return
+	}
+
+	switch refund.Method {
+	case common.RefundOnChain:
+		var fees map[string]int64
+		fees, err = lnClient.SentCoins(c, refund.Address, refund.Amount)
+
+		// transactions of other refunds to the same address, and of the same amount don't count
+		for txID, fee := range fees {
+			if !txIDs[txID] {
+				refund.TxID, refund.Fee = txID, fee
+				break
+			}
+		}
+
+		if err == nil && refund.TxID == "" {
+			err = fmt.Errorf("%w: lnd's wallet has no other such transaction", common.ErrPaymentFailed)
+		}
+
+	default:
+		refund.Preimage, refund.Fee, err = lnClient.PaymentOutcome(c, refund.Bolt11)
+	}
+
+	// lnd couldn't be asked
+	if err != nil && !errors.Is(err, common.ErrPaymentFailed) && !errors.Is(err, common.ErrPaymentInFlight) {
+		replyStatus(c, common.StatusReply{
+			Code:  errCode(err),
+			Error: fmt.Errorf("can't get refund outcome from lnd: %w", err).Error(),
+		})
+		return
+	}
+
+	c.JSON(200, finishRefund(refund, err))
+}
+
+// pendingWithdrawal returns LNURL-withdraw refund identified by `k1`, unless it was already withdrawn
+func pendingWithdrawal(k1 string) (common.Refund, string) {
+	r, err := db.RefundByK1Hash(common.HashRefundK1(k1))
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return r, "unknown refund"
+
+	case err != nil:
+		return r, "unable to look up refund"
+
+	case r.Status != common.RefundPending || r.Bolt11 != "":
+		return r, "refund was already withdrawn"
+	}
+
+	return r, ""
+}
+
+// lnurlWithdraw is the first step of LNURL-withdraw flow.  Errors are replied with 200, as LNURL requires.
+func lnurlWithdraw(c *gin.Context) {
+	var queryParams withdrawQuery
+
+	err := c.ShouldBindQuery(&queryParams)
+	if err != nil {
+		c.JSON(200, lnurl.Error("k1 is required"))
+		return
+	}
+
+	r, problem := pendingWithdrawal(queryParams.K1)
+	if problem != "" {
+		c.JSON(200, lnurl.Error(problem))
+		return
+	}
+
+	description := "Refund"
+	if r.Reason != "" {
+		description += ": " + r.Reason
+	}
+
+	c.JSON(200, lnurl.WithdrawRequest{
+		Tag:                lnurl.TagWithdraw,
+		Callback:           baseURL(c) + "/api/refunds/lnurl/callback",
+		K1:                 queryParams.K1,
+		DefaultDescription: description,
+		MinWithdrawable:    r.Amount * 1000,
+		MaxWithdrawable:    r.Amount * 1000,
+	})
+}
+
+// lnurlWithdrawCallback pays the invoice customer's wallet sent for an LNURL-withdraw refund
+func lnurlWithdrawCallback(c *gin.Context) {
+	var queryParams withdrawCallbackQuery
+
+	err := c.ShouldBindQuery(&queryParams)
+	if err != nil {
+		c.JSON(200, lnurl.Error("k1, and pr are required"))
+		return
+	}
+
+	_, problem := pendingWithdrawal(queryParams.K1)
+	if problem != "" {
+		c.JSON(200, lnurl.Error(problem))
+		return
+	}
+
+	if !lnClient.Ready() {
+		c.JSON(200, lnurl.Error("lnd is currently unavailable, try again later"))
+		return
+	}
+
+	invoice, err := lnClient.DecodeInvoice(c, queryParams.Bolt11)
+	if err != nil {
+		c.JSON(200, lnurl.Error(fmt.Sprintf("invalid invoice: %s", err)))
+		return
+	}
+
+	// Claiming the refund makes sure it's only paid once, no matter how many callbacks arrive
+	r, err := db.ClaimRefund(common.HashRefundK1(queryParams.K1), queryParams.Bolt11, invoice.Amount)
+	if err != nil {
+		c.JSON(200, lnurl.Error(err.Error()))
+		return
+	}
+
+	r = payRefund(r, true)
+	switch r.Status {
+	case common.RefundSucceeded:
+		c.JSON(200, lnurl.OK())
+
+	case common.RefundPending:
+		c.JSON(200, lnurl.Error(fmt.Sprintf("%s, try again", r.Error)))
+
+	default:
+		c.JSON(200, lnurl.Error(r.Error))
+	}
+}
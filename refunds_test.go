@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lncm/invoicer/common"
+	"github.com/lncm/invoicer/lnurl"
+	"github.com/lncm/invoicer/store"
+)
+
+func TestRefundRequestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		req      refundRequest
+		expected int
+	}{
+		{"bolt11", refundRequest{Bolt11: "lnbc1"}, 0},
+		{"bolt11 with amount", refundRequest{Bolt11: "lnbc1", Amount: 100}, 0},
+		{"address", refundRequest{Address: "bc1q", Amount: 100}, 0},
+		{"address without amount", refundRequest{Address: "bc1q"}, 400},
+		{"lnurl", refundRequest{LNURL: true, Amount: 100}, 0},
+		{"nothing", refundRequest{Amount: 100}, 400},
+		{"two methods", refundRequest{Bolt11: "lnbc1", Address: "bc1q", Amount: 100}, 400},
+		{"negative amount", refundRequest{Address: "bc1q", Amount: -1}, 400},
+	} {
+		code := 0
+		if fail := tc.req.validate(); fail != nil {
+			code = fail.Code
+		}
+
+		if code != tc.expected {
+			t.Errorf("%s: code = %d, expected %d", tc.name, code, tc.expected)
+		}
+	}
+}
+
+func TestRefundFeeLimit(t *testing.T) {
+	for amount, expected := range map[int64]int64{100: 10, 1000: 10, 5000: 50, 1000000: 10000} {
+		if limit := refundFeeLimit(amount); limit != expected {
+			t.Errorf("refundFeeLimit(%d) = %d, expected %d", amount, limit, expected)
+		}
+	}
+}
+
+func TestRefundLimit(t *testing.T) {
+	defer useTestStore(t)()
+
+	add := func(id string, amount int64) error {
+		return db.AddRefund(common.Refund{ID: id, PaymentID: "pay_1", Amount: amount, Status: common.RefundPending}, 1000)
+	}
+
+	if err := add("ref_1", 600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := add("ref_2", 500); !errors.Is(err, store.ErrRefundExceeded) {
+		t.Fatalf("refunds exceeding received amount should be rejected, got: %v", err)
+	}
+
+	// failed refunds don't count
+	if err := db.UpdateRefund(common.Refund{ID: "ref_1", PaymentID: "pay_1", Amount: 600, Status: common.RefundFailed}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := add("ref_3", 1000); err != nil {
+		t.Fatalf("refund of the whole amount should be accepted after a failed one: %v", err)
+	}
+
+	payments := []common.Payment{{NewPayment: common.NewPayment{ID: "pay_1"}}, {NewPayment: common.NewPayment{Hash: "abc"}}}
+	if err := applyRefunds(payments); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(payments[0].Refunds) != 2 || payments[0].Refunded != 1000 || payments[1].Refunds != nil {
+		t.Errorf("refunds applied incorrectly: %+v", payments)
+	}
+}
+
+func TestClaimRefund(t *testing.T) {
+	defer useTestStore(t)()
+
+	k1, hash, err := common.NewRefundK1()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AddRefund(common.Refund{ID: "ref_1", PaymentID: "pay_1", Method: common.RefundLnurl, Amount: 500, Status: common.RefundPending, K1Hash: hash}, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, problem := pendingWithdrawal(k1); problem != "" {
+		t.Fatalf("refund should be pending, got: %s", problem)
+	}
+
+	if _, err := db.ClaimRefund(hash, "lnbc1", 400); err == nil {
+		t.Error("invoice for a different amount should be rejected")
+	}
+
+	r, err := db.ClaimRefund(hash, "lnbc1", 500)
+	if err != nil || r.Bolt11 != "lnbc1" {
+		t.Fatalf("refund should be claimed: %+v, %v", r, err)
+	}
+
+	if _, err := db.ClaimRefund(hash, "lnbc2", 500); err == nil {
+		t.Error("refund should only be claimed once")
+	}
+
+	if _, problem := pendingWithdrawal(k1); problem == "" {
+		t.Error("claimed refund shouldn't be withdrawable")
+	}
+
+	if _, problem := pendingWithdrawal("unknown"); problem != "unknown refund" {
+		t.Errorf("unexpected problem with unknown k1: %s", problem)
+	}
+}
+
+func TestPayRefundOutcome(t *testing.T) {
+	defer useTestStore(t)()
+	defer func(prev LightningClient) { lnClient = prev }(lnClient)
+
+	failed := fmt.Errorf("%w: no route", common.ErrPaymentFailed)
+
+	for _, tc := range []struct {
+		name     string
+		method   string
+		err      error
+		expected string
+		counts   bool
+	}{
+		{"ln paid", common.RefundLn, nil, common.RefundSucceeded, true},
+		{"ln failed", common.RefundLn, failed, common.RefundFailed, false},
+		{"ln timed out", common.RefundLn, context.DeadlineExceeded, common.RefundUnknown, true},
+		{"onchain rejected", common.RefundOnChain, failed, common.RefundFailed, false},
+		{"onchain connection lost", common.RefundOnChain, errors.New("transport is closing"), common.RefundUnknown, true},
+		{"lnurl failed", common.RefundLnurl, failed, common.RefundPending, true},
+		{"lnurl timed out", common.RefundLnurl, context.DeadlineExceeded, common.RefundUnknown, true},
+	} {
+		lnClient = fakeLn{payErr: tc.err}
+
+		r := common.Refund{ID: tc.name, PaymentID: tc.name, Method: tc.method, Status: common.RefundPending, Amount: 500, Bolt11: "lnbc1"}
+		if err := db.AddRefund(r, 500); err != nil {
+			t.Fatal(err)
+		}
+
+		r = payRefund(r, true)
+		if r.Status != tc.expected || (tc.err != nil) != (r.Error != "") {
+			t.Errorf("%s: got %s (%q), expected %s", tc.name, r.Status, r.Error, tc.expected)
+		}
+
+		if tc.expected == common.RefundPending && r.Bolt11 != "" {
+			t.Errorf("%s: failed withdrawal should be claimable again", tc.name)
+		}
+
+		// refunds that might've been paid keep the whole amount from being refunded again
+		err := db.AddRefund(common.Refund{ID: tc.name + " again", PaymentID: tc.name, Amount: 500}, 500)
+		if counts := errors.Is(err, store.ErrRefundExceeded); counts != tc.counts {
+			t.Errorf("%s: counts towards refunded amount: %t, expected %t (%v)", tc.name, counts, tc.counts, err)
+		}
+	}
+}
+
+func TestCreateRefund(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer useTestStore(t)()
+	defer func(prev LightningClient) { lnClient = prev }(lnClient)
+
+	hash := useOrderPayment(t)
+
+	ln := lnClient.(fakeLn)
+	ln.decoded = map[string]common.Invoice{"lnbc1": {Amount: 100}}
+	lnClient = ln
+
+	for _, tc := range []struct {
+		name   string
+		body   string
+		code   int
+		status string
+	}{
+		{"invalid", `{"amount": 100}`, 400, ""},
+		{"bolt11", `{"bolt11": "lnbc1"}`, 200, common.RefundSucceeded},
+		{"bolt11 for another amount", `{"bolt11": "lnbc1", "amount": 200}`, 400, ""},
+		{"address", `{"address": "bc1q", "amount": 300}`, 200, common.RefundSucceeded},
+		{"lnurl", `{"lnurl": true, "amount": 500}`, 200, common.RefundPending},
+		{"more than received", `{"address": "bc1q", "amount": 101}`, 422, ""},
+	} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/api/payments/pay_1/refunds", strings.NewReader(tc.body))
+		c.Params = gin.Params{{Key: "id", Value: "pay_1"}}
+
+		createRefund(c)
+
+		var refund common.Refund
+		_ = json.Unmarshal(w.Body.Bytes(), &refund)
+
+		if w.Code != tc.code || refund.Status != tc.status {
+			t.Errorf("%s: got %d %s, expected %d %s", tc.name, w.Code, w.Body, tc.code, tc.status)
+		}
+
+		if tc.status == common.RefundPending && (refund.LNURL == "" || refund.K1Hash == "") {
+			t.Errorf("%s: LNURL-withdraw link expected: %+v", tc.name, refund)
+		}
+	}
+
+	// refunds are shown with the payment
+	payment, _, err := fetchPayment(context.Background(), common.PaymentRecord{NewPayment: common.NewPayment{ID: "pay_1", Hash: hash}})
+	if err != nil || payment.Refunded != 900 || len(payment.Refunds) != 3 || payment.Fees != 101 {
+		t.Errorf("refunds not applied: %+v, %v", payment, err)
+	}
+}
+
+func TestResolveRefund(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer useTestStore(t)()
+	defer func(prev LightningClient) { lnClient = prev }(lnClient)
+
+	useOrderPayment(t)
+
+	failed := fmt.Errorf("%w: no route", common.ErrPaymentFailed)
+
+	// the other refund's transaction is not this one's
+	err := db.AddRefund(common.Refund{ID: "ref_sent", PaymentID: "pay_1", Method: common.RefundOnChain, Status: common.RefundSucceeded, Amount: 100, Address: "bc1q", TxID: "tx1"}, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		method   string
+		status   string
+		sent     map[string]int64
+		err      error
+		code     int
+		expected string
+	}{
+		{"ln paid", common.RefundLn, common.RefundUnknown, nil, nil, 200, common.RefundSucceeded},
+		{"ln failed", common.RefundLn, common.RefundUnknown, nil, failed, 200, common.RefundFailed},
+		{"ln in flight", common.RefundLn, common.RefundUnknown, nil, common.ErrPaymentInFlight, 200, common.RefundUnknown},
+		{"lnd unavailable", common.RefundLn, common.RefundUnknown, nil, common.ErrBackendUnavailable, 503, common.RefundUnknown},
+		{"lnurl failed", common.RefundLnurl, common.RefundUnknown, nil, failed, 200, common.RefundPending},
+		{"onchain sent", common.RefundOnChain, common.RefundUnknown, map[string]int64{"tx1": 100, "tx2": 150}, nil, 200, common.RefundSucceeded},
+		{"onchain sent by another refund", common.RefundOnChain, common.RefundUnknown, map[string]int64{"tx1": 100}, nil, 200, common.RefundFailed},
+		{"onchain not sent", common.RefundOnChain, common.RefundUnknown, nil, nil, 200, common.RefundFailed},
+		{"already known", common.RefundLn, common.RefundSucceeded, nil, nil, 409, common.RefundSucceeded},
+	} {
+		lnClient = fakeLn{sent: tc.sent, outcomeErr: tc.err}
+
+		r := common.Refund{ID: tc.name, PaymentID: "pay_1", Method: tc.method, Status: tc.status, Amount: 100, Bolt11: "lnbc1", Address: "bc1q"}
+		if err := db.AddRefund(r, 1000); err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/", nil)
+		c.Params = gin.Params{{Key: "id", Value: "pay_1"}, {Key: "refund_id", Value: tc.name}}
+
+		resolveRefund(c)
+
+		refunds, err := db.Refunds()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, stored := range refunds["pay_1"] {
+			if stored.ID == tc.name {
+				r = stored
+			}
+		}
+
+		if w.Code != tc.code || r.Status != tc.expected {
+			t.Errorf("%s: got %d %s (%s), expected %d %s", tc.name, w.Code, r.Status, w.Body, tc.code, tc.expected)
+		}
+
+		if tc.name == "onchain sent" && (r.TxID != "tx2" || r.Fee != 150) {
+			t.Errorf("%s: transaction of another refund matched: %+v", tc.name, r)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/", nil)
+	c.Params = gin.Params{{Key: "id", Value: "pay_1"}, {Key: "refund_id", Value: "ref_missing"}}
+
+	if resolveRefund(c); w.Code != 404 {
+		t.Errorf("missing refund: got %d, expected 404", w.Code)
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(prev common.Config) { conf = prev }(conf)
+
+	for _, tc := range []struct {
+		proxies  []string
+		header   string
+		expected string
+	}{
+		{nil, "", "http://example.com"},
+		{nil, "https", "http://example.com"},
+		{[]string{"192.0.2.1"}, "https", "https://example.com"},
+		{[]string{"192.0.2.0/24"}, "https", "https://example.com"},
+		{[]string{"198.51.100.0/24"}, "https", "http://example.com"},
+	} {
+		conf.TrustedProxies = tc.proxies
+
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/", nil)
+		c.Request.Header.Set("X-Forwarded-Proto", tc.header)
+
+		if url := baseURL(c); url != tc.expected {
+			t.Errorf("%v, %q: got %s, expected %s", tc.proxies, tc.header, url, tc.expected)
+		}
+	}
+}
+
+func TestLnurlWithdraw(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer useTestStore(t)()
+	defer func(prev LightningClient) { lnClient = prev }(lnClient)
+
+	k1, hash, err := common.NewRefundK1()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AddRefund(common.Refund{ID: "ref_1", PaymentID: "pay_1", Method: common.RefundLnurl, Amount: 500, Status: common.RefundPending, K1Hash: hash, Reason: "overpaid"}, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(handler gin.HandlerFunc, url string, reply interface{}) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", url, nil)
+
+		handler(c)
+
+		if err := json.Unmarshal(w.Body.Bytes(), reply); err != nil || w.Code != 200 {
+			t.Fatalf("%s: got %d %s", url, w.Code, w.Body)
+		}
+	}
+
+	var req lnurl.WithdrawRequest
+	get(lnurlWithdraw, "/api/refunds/lnurl?k1="+k1, &req)
+
+	if req.Tag != lnurl.TagWithdraw || req.K1 != k1 || req.Callback != "http://example.com/api/refunds/lnurl/callback" ||
+		req.MinWithdrawable != 500000 || req.MaxWithdrawable != 500000 || req.DefaultDescription != "Refund: overpaid" {
+		t.Errorf("unexpected withdraw request: %+v", req)
+	}
+
+	decoded := map[string]common.Invoice{"lnbc400": {Amount: 400}, "lnbc500": {Amount: 500}}
+	callback := "/api/refunds/lnurl/callback?k1=" + k1 + "&pr="
+
+	for _, tc := range []struct {
+		name   string
+		bolt11 string
+		payErr error
+		status string
+	}{
+		{"wrong amount", "lnbc400", nil, "ERROR"},
+		{"no route", "lnbc500", fmt.Errorf("%w: no route", common.ErrPaymentFailed), "ERROR"},
+		{"retried", "lnbc500", nil, "OK"},
+		{"withdrawn again", "lnbc500", nil, "ERROR"},
+	} {
+		lnClient = fakeLn{decoded: decoded, payErr: tc.payErr}
+
+		var reply lnurl.Reply
+		get(lnurlWithdrawCallback, callback+tc.bolt11, &reply)
+
+		if reply.Status != tc.status {
+			t.Errorf("%s: got %+v, expected %s", tc.name, reply, tc.status)
+		}
+	}
+
+	refunds, err := db.Refunds()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := refunds["pay_1"][0]; r.Status != common.RefundSucceeded || r.Bolt11 != "lnbc500" || r.Preimage == "" || r.Error != "" {
+		t.Errorf("refund should be withdrawn: %+v", r)
+	}
+
+	var reply lnurl.Reply
+	get(lnurlWithdraw, "/api/refunds/lnurl?k1="+k1, &reply)
+
+	if reply.Status != "ERROR" {
+		t.Errorf("withdrawn refund shouldn't be offered again: %+v", reply)
+	}
+}
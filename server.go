@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Closed once shutdown starts, so that open long-polls can tell their clients to retry
+	shuttingDown = make(chan struct{})
+
+	// Functions run after the HTTP server has stopped, in order of registration
+	shutdownHooks []func(ctx context.Context)
+)
+
+// onShutdown registers fn to be run during shutdown.  fn should return once ctx is done.
+func onShutdown(fn func(ctx context.Context)) {
+	shutdownHooks = append(shutdownHooks, fn)
+}
+
+// serve runs server until SIGTERM, or SIGINT is received, and then shuts everything down gracefully.  SIGHUP
+// reloads the config file.
+func serve(server *http.Server) {
+	errs := make(chan error, 1)
+
+	go func() {
+		if server.TLSConfig != nil {
+			// cert, and key are provided by `TLSConfig.GetCertificate`
+			errs <- server.ListenAndServeTLS("", "")
+			return
+		}
+
+		errs <- server.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	for {
+		select {
+		case err := <-errs:
+			panic(err)
+
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				_, err := reloadConfig()
+				if err != nil {
+					log.WithError(err).Errorln("config not reloaded")
+				}
+
+				continue
+			}
+
+			log.WithField("signal", sig.String()).Println("shutting down")
+			shutdown(server)
+
+			return
+		}
+	}
+}
+
+// shutdown stops accepting new requests, asks open long-polls to retry, waits for all requests to finish, runs
+// shutdown hooks, and finally flushes logs.  All of it has to happen within `shutdown-timeout`.
+func shutdown(server *http.Server) {
+	timeout := time.Duration(currentConf().ShutdownTimeout) * time.Second
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	close(shuttingDown)
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.WithError(err).Warningln("not all requests finished before shutdown timeout")
+	}
+
+	for _, hook := range shutdownHooks {
+		hook(ctx)
+	}
+
+	err = lnClient.Close()
+	if err != nil {
+		log.WithError(err).Warningln("unable to close lnd connection")
+	}
+
+	log.Println("invoicer stopped")
+
+	if logFile != nil {
+		_ = logFile.Close()
+	}
+}
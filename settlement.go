@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/lncm/invoicer/common"
+	"github.com/lncm/invoicer/fiat"
+	"github.com/lncm/invoicer/metrics"
+)
+
+var (
+	// Source of exchange rates recorded with settled payments.  nil if not configured.
+	fiatSource *fiat.Source
+
+	// Settlements, and expirations being recorded in the background
+	settling sync.WaitGroup
+
+	// Set by CLI commands.  These don't serve metrics, so outcomes of payments they see are left for the server to
+	// record, and count.
+	skipOutcomes bool
+)
+
+// recordSettlement stores the time payment with `id` (LN hash, or Bitcoin address) was seen settled on `rail`,
+// together with the current exchange rate, if available.  It doesn't block.
+func recordSettlement(id, rail string, createdAt int64) {
+	settlement := common.Settlement{PaidAt: time.Now().Unix()}
+
+	settling.Add(1)
+	go func() {
+		defer settling.Done()
+
+		if saved, _ := saveSettlement(id, settlement); saved != nil && !saved.OverStock {
+			countSettlement(rail, createdAt, saved.PaidAt)
+		}
+	}()
+}
+
+// countSettlement updates metrics of settled payments.  It has to be called only once per payment, ie. when its
+// settlement is first stored, no matter how many times it's seen settled afterwards.
+func countSettlement(rail string, createdAt, paidAt int64) {
+	metrics.PaymentsPaid.Inc(rail)
+
+	if createdAt > 0 {
+		metrics.SettlementLatency.Observe(float64(paidAt-createdAt), rail)
+	}
+}
+
+// recordExpiration stores the time payment `p` was first seen expired without being paid, and counts it then.  It
+// doesn't block.
+func recordExpiration(p common.Payment) {
+	settling.Add(1)
+	go func() {
+		defer settling.Done()
+
+		added, err := db.AddExpiration(p.ID, time.Now().Unix())
+		if err != nil {
+			log.WithError(err).WithField("id", p.ID).Errorln("unable to record expiration")
+			return
+		}
+
+		if !added {
+			return
+		}
+
+		if p.Hash != "" {
+			metrics.PaymentsExpired.Inc(metrics.RailLn)
+		}
+
+		if !conf.OffChainOnly && p.Address != "" {
+			metrics.PaymentsExpired.Inc(metrics.RailBtc)
+		}
+	}()
+}
+
+// recordOutcomes records settlements, and expirations of `payments` created by invoicer, unless these were already
+// recorded, so that each payment is counted once, wherever its final state is first seen.  Payments that could no
+// longer be paid when invoicer started have reached it before, and aren't recorded, so that they don't get the
+// current exchange rate.  It doesn't block.
+func recordOutcomes(payments []common.Payment) error {
+	if skipOutcomes {
+		return nil
+	}
+
+	settlements, err := db.Settlements()
+	if err != nil {
+		return err
+	}
+
+	expirations, err := db.Expirations()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range payments {
+		if p.ID == "" || payableUntil(p.NewPayment) < startedAt.Unix() || isSettled(settlements, p.Hash, p.Address) {
+			continue
+		}
+
+		// expired payments can still be paid late
+		if _, ok := expirations[p.ID]; ok && !p.Paid {
+			continue
+		}
+
+		switch {
+		case p.Paid:
+			rail, id := metrics.RailLn, p.Hash
+			if !p.LnPaid {
+				rail, id = metrics.RailBtc, p.Address
+			}
+
+			recordSettlement(id, rail, p.CreatedAt)
+
+		case p.Expired:
+			recordExpiration(p)
+		}
+	}
+
+	return nil
+}
+
+// payableUntil returns unix timestamp after which payment `p` can no longer be paid: its expiry, or for ones with
+// an address watched for late payments, `late-payment-grace` after that
+func payableUntil(p common.NewPayment) int64 {
+	until := p.CreatedAt + p.Expiry
+	if grace := currentConf().LatePaymentGrace; p.Address != "" && grace > 0 {
+		until += grace
+	}
+
+	return until
+}
+
+// isSettled returns true if settlement of payment with LN `hash`, or Bitcoin `address` was recorded
+func isSettled(settlements map[string]common.Settlement, hash, address string) bool {
+	for _, id := range []string{hash, address} {
+		if _, ok := settlements[id]; ok && id != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// waitSettlements waits for settlements being recorded to be stored, or for ctx to be done
+func waitSettlements(ctx context.Context) {
+	done := make(chan struct{})
+
+	go func() {
+		settling.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warningln("not all settlements were recorded before shutdown timeout")
+	}
+}
+
+// saveSettlement adds the current exchange rate (if available) to `settlement`, and stores it, unless settlement
+// of `id` was already recorded.  Returned settlement is only set if it was stored.  Payments settled after their
+// link's stock ran out are stored as over stock, and reported to `[webhook]`, so that they can be refunded.
+func saveSettlement(id string, settlement common.Settlement) (*common.Settlement, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	if fiatSource != nil {
+		rate, err := fiatSource.Rate(ctx)
+		if err != nil {
+			log.WithError(err).WithField("id", id).Warningln("unable to record exchange rate of a payment")
+		} else {
+			settlement.Rate, settlement.Currency = rate, fiatSource.Currency()
+		}
+	}
+
+	r, err := db.FindPayment(id, id)
+	if err == nil && r.Link != "" {
+		if l, err := findLink(r.Link); err == nil && l.Stock > 0 && l.Owns(r) {
+			unlock := lockLink(l.Slug)
+			defer unlock()
+
+			settlement.OverStock, err = overStock(r, l.Stock)
+			if err != nil {
+				log.WithError(err).WithField("id", id).Errorln("unable to check stock of a payment link")
+				return nil, err
+			}
+		}
+	}
+
+	added, err := db.AddSettlement(id, settlement)
+	if err != nil {
+		log.WithError(err).WithField("id", id).Errorln("unable to record settlement")
+		return nil, err
+	}
+
+	if !added {
+		return nil, nil
+	}
+
+	if settlement.OverStock {
+		payment := recordPayment(r)
+		payment.PaidAt, payment.OverStock = settlement.PaidAt, true
+
+		log.WithFields(log.Fields{"id": r.ID, "link": r.Link}).Warningln("payment settled after its link's stock ran out")
+
+		emitEvent(EventOverStock, payment)
+	}
+
+	return &settlement, nil
+}
+
+// applySettlements adds exchange rates recorded at settlement to payments
+func applySettlements(payments []common.Payment) error {
+	settlements, err := db.Settlements()
+	if err != nil {
+		return err
+	}
+
+	for i, p := range payments {
+		settlement, ok := settlements[p.Hash]
+		if !ok && p.Address != "" {
+			settlement, ok = settlements[p.Address]
+		}
+
+		if !ok {
+			continue
+		}
+
+		if settlement.Rate > 0 {
+			payments[i].FiatRate = settlement.Rate
+			payments[i].FiatCurrency = settlement.Currency
+		}
+
+		// on-chain payments have no settle time of their own
+		if p.PaidAt == 0 {
+			payments[i].PaidAt = settlement.PaidAt
+		}
+
+		payments[i].PaidLate = settlement.Late
+
+		// not fulfilled, but refunded
+		if settlement.OverStock {
+			payments[i].Paid, payments[i].OverStock = false, true
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lncm/invoicer/common"
+	"github.com/lncm/invoicer/metrics"
+)
+
+// fakeLn serves invoices from memory.  Methods tests don't need panic.
+type fakeLn struct {
+	LightningClient
+
+	invoices map[string]common.Invoice
+
+	// keyed by bolt11
+	decoded map[string]common.Invoice
+
+	// returned by PayInvoice, and SendCoins
+	payErr error
+
+	// returned by PaymentOutcome, and SentCoins
+	outcomeErr error
+
+	// on-chain transactions found by SentCoins, with their fees
+	sent map[string]int64
+}
+
+func (f fakeLn) Ready() bool { return true }
+
+func (f fakeLn) Invoice(_ context.Context, hash string) (common.Invoice, error) {
+	invoice, ok := f.invoices[hash]
+	if !ok {
+		return invoice, common.ErrInvoiceNotFound
+	}
+
+	return invoice, nil
+}
+
+func (f fakeLn) Status(ctx context.Context, hash string) (common.Status, error) {
+	invoice, err := f.Invoice(ctx, hash)
+
+	return common.Status{
+		Ts:        invoice.CreatedAt,
+		Settled:   invoice.Paid,
+		Expiry:    invoice.Expiry,
+		Value:     invoice.Amount,
+		ValueMsat: invoice.AmountMsat,
+	}, err
+}
+
+func (f fakeLn) History(context.Context) (invoices common.Invoices, err error) {
+	for _, invoice := range f.invoices {
+		invoices = append(invoices, invoice)
+	}
+
+	return invoices, nil
+}
+
+func (f fakeLn) NewInvoice(_ context.Context, amountMsat int64, desc string) (string, string, error) {
+	hash := fmt.Sprintf("%064x", len(f.invoices)+1)
+
+	f.invoices[hash] = common.Invoice{
+		NewPayment:  common.NewPayment{Hash: hash, Bolt11: "lnbc" + hash, CreatedAt: time.Now().Unix(), Expiry: 3600},
+		Description: desc,
+		Amount:      amountMsat / 1000,
+		AmountMsat:  amountMsat,
+	}
+
+	return "lnbc" + hash, hash, nil
+}
+
+func (f fakeLn) DecodeInvoice(_ context.Context, bolt11 string) (common.Invoice, error) {
+	invoice, ok := f.decoded[bolt11]
+	if !ok {
+		return invoice, errors.New("invalid bolt11")
+	}
+
+	return invoice, nil
+}
+
+func (f fakeLn) PayInvoice(context.Context, string, int64, int64) (string, int64, error) {
+	if f.payErr != nil {
+		return "", 0, f.payErr
+	}
+
+	return "preimage", 1, nil
+}
+
+func (f fakeLn) SendCoins(context.Context, string, int64) (string, int64, error) {
+	if f.payErr != nil {
+		return "", 0, f.payErr
+	}
+
+	return "txid", 100, nil
+}
+
+func (f fakeLn) PaymentOutcome(context.Context, string) (string, int64, error) {
+	if f.outcomeErr != nil {
+		return "", 0, f.outcomeErr
+	}
+
+	return "preimage", 1, nil
+}
+
+func (f fakeLn) SentCoins(context.Context, string, int64) (map[string]int64, error) {
+	if f.outcomeErr != nil {
+		return nil, f.outcomeErr
+	}
+
+	if len(f.sent) == 0 {
+		return nil, common.ErrPaymentFailed
+	}
+
+	return f.sent, nil
+}
+
+func TestSettlementCountedOnce(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer useTestStore(t)()
+	defer func(prev LightningClient) { lnClient = prev }(lnClient)
+
+	const hash = "102d05bebcc9a178112ab6eb92dc9cc14651d993d38b5cfe19799494c9fc29e4"
+
+	lnClient = fakeLn{invoices: map[string]common.Invoice{
+		hash: {
+			NewPayment: common.NewPayment{Hash: hash, CreatedAt: time.Now().Unix() - 60, Expiry: 3600},
+			Amount:     1000,
+			AmountMsat: 1000000,
+			Paid:       true,
+		},
+	}}
+
+	before := metrics.PaymentsPaid.Value(metrics.RailLn)
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "/api/payment?hash="+hash, nil)
+
+		status(c)
+		settling.Wait()
+
+		if w.Code != 200 {
+			t.Fatalf("poll %d: got %d %s, expected 200", i, w.Code, w.Body)
+		}
+	}
+
+	if paid := metrics.PaymentsPaid.Value(metrics.RailLn) - before; paid != 1 {
+		t.Errorf("paid payments counted %v times, expected once", paid)
+	}
+}
+
+func TestExpiryCountedOnce(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer useTestStore(t)()
+	defer func(prev LightningClient) { lnClient = prev }(lnClient)
+
+	const hash = "102d05bebcc9a178112ab6eb92dc9cc14651d993d38b5cfe19799494c9fc29e4"
+
+	createdAt := time.Now().Unix() - 7200
+	lnClient = fakeLn{invoices: map[string]common.Invoice{
+		hash: {
+			NewPayment: common.NewPayment{Hash: hash, CreatedAt: createdAt, Expiry: 3600},
+			Amount:     1000,
+			AmountMsat: 1000000,
+			Expired:    true,
+		},
+	}}
+
+	err := db.AddPayment(common.PaymentRecord{
+		NewPayment: common.NewPayment{ID: "pay_1", Hash: hash, CreatedAt: createdAt, Expiry: 3600},
+		Amount:     1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := metrics.PaymentsExpired.Value(metrics.RailLn)
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "/api/payment?hash="+hash, nil)
+
+		status(c)
+		settling.Wait()
+
+		if w.Code != 408 {
+			t.Fatalf("poll %d: got %d %s, expected 408", i, w.Code, w.Body)
+		}
+	}
+
+	if expired := metrics.PaymentsExpired.Value(metrics.RailLn) - before; expired != 1 {
+		t.Errorf("expired payment counted %v times, expected once", expired)
+	}
+}
+
+func TestOutcomesCountedOnce(t *testing.T) {
+	defer useTestStore(t)()
+	defer func(prevLn LightningClient, prevBtc BitcoinClient) { lnClient, btcClient = prevLn, prevBtc }(lnClient, btcClient)
+	defer func(prev time.Time) { startedAt = prev }(startedAt)
+
+	now := time.Now()
+	startedAt = now.Add(-2 * time.Hour)
+
+	invoices := map[string]common.Invoice{
+		"h1": {NewPayment: common.NewPayment{Hash: "h1", CreatedAt: now.Unix() - 60, Expiry: 3600}, Paid: true, Received: 1000},
+		"h2": {NewPayment: common.NewPayment{Hash: "h2", CreatedAt: now.Unix() - 7200, Expiry: 3600}, Expired: true},
+		"h3": {NewPayment: common.NewPayment{Hash: "h3", CreatedAt: now.Unix() - 60, Expiry: 3600}},
+	}
+
+	lnClient, btcClient = fakeLn{invoices: invoices}, fakeBtc{}
+
+	for _, hash := range []string{"h1", "h2", "h3"} {
+		err := db.AddPayment(common.PaymentRecord{NewPayment: common.NewPayment{
+			ID: "pay_" + hash, Hash: hash, CreatedAt: invoices[hash].CreatedAt, Expiry: invoices[hash].Expiry,
+		}, Amount: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paidBefore, expiredBefore := metrics.PaymentsPaid.Value(metrics.RailLn), metrics.PaymentsExpired.Value(metrics.RailLn)
+
+	expect := func(step string, paid, expired float64) {
+		settling.Wait()
+
+		if got := metrics.PaymentsPaid.Value(metrics.RailLn) - paidBefore; got != paid {
+			t.Errorf("%s: %v payments counted paid, expected %v", step, got, paid)
+		}
+
+		if got := metrics.PaymentsExpired.Value(metrics.RailLn) - expiredBefore; got != expired {
+			t.Errorf("%s: %v payments counted expired, expected %v", step, got, expired)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := fetchHistory(context.Background(), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect("history", 1, 1)
+
+	// paid after it expired, with nobody looking at it
+	invoices["h4"] = common.Invoice{
+		NewPayment: common.NewPayment{Hash: "h4", CreatedAt: now.Unix() - 5400, Expiry: 3600},
+		Paid:       true,
+		Received:   1000,
+	}
+
+	err := db.AddPayment(common.PaymentRecord{
+		NewPayment: common.NewPayment{ID: "pay_h4", Hash: "h4", CreatedAt: now.Unix() - 5400, Expiry: 3600},
+		Amount:     1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := checkExpired(now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect("expired", 2, 1)
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lncm/invoicer/common"
+)
+
+var ErrNotFound = errors.New("not found")
+
+func (s *Store) AddAPIKey(k common.APIKey) error {
+	return s.update(func(d *data) error {
+		d.APIKeys = append(d.APIKeys, k)
+		return nil
+	})
+}
+
+func (s *Store) APIKeys() (keys []common.APIKey, err error) {
+	err = s.read(func(d *data) {
+		keys = append(keys, d.APIKeys...)
+	})
+
+	return
+}
+
+// Authenticate returns the key matching `key`, but only if it is still active
+func (s *Store) Authenticate(key string) (k common.APIKey, err error) {
+	id, secret, err := common.ParseAPIKey(key)
+	if err != nil {
+		return
+	}
+
+	err = s.read(func(d *data) {
+		for _, stored := range d.APIKeys {
+			if stored.ID == id {
+				k = stored
+				return
+			}
+		}
+	})
+	if err != nil {
+		return
+	}
+
+	if k.ID == "" || !k.Matches(secret) || !k.Active() {
+		return common.APIKey{}, common.ErrInvalidAPIKey
+	}
+
+	return k, nil
+}
+
+// RevokeAPIKey marks key with `id` as revoked.  Revoked keys are kept, so that they can still be listed.
+func (s *Store) RevokeAPIKey(id string) error {
+	return s.update(func(d *data) error {
+		for i, k := range d.APIKeys {
+			if k.ID != id {
+				continue
+			}
+
+			if k.RevokedAt > 0 {
+				return fmt.Errorf("API key %s has already been revoked", id)
+			}
+
+			d.APIKeys[i].RevokedAt = time.Now().Unix()
+			return nil
+		}
+
+		return fmt.Errorf("API key %s: %w", id, ErrNotFound)
+	})
+}
@@ -0,0 +1,34 @@
+package store
+
+// AddExpiration records that payment with `id` was first seen expired without being paid at `at` (unix timestamp),
+// unless it was already recorded.  Returns true if it was added.
+func (s *Store) AddExpiration(id string, at int64) (added bool, err error) {
+	err = s.update(func(d *data) error {
+		if _, ok := d.Expirations[id]; ok {
+			return errUnchanged
+		}
+
+		if d.Expirations == nil {
+			d.Expirations = make(map[string]int64)
+		}
+
+		d.Expirations[id] = at
+		added = true
+
+		return nil
+	})
+
+	return
+}
+
+// Expirations returns times payments were first seen expired at, keyed by payment ID
+func (s *Store) Expirations() (expirations map[string]int64, err error) {
+	err = s.read(func(d *data) {
+		expirations = make(map[string]int64, len(d.Expirations))
+		for id, at := range d.Expirations {
+			expirations[id] = at
+		}
+	})
+
+	return
+}
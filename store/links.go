@@ -0,0 +1,131 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lncm/invoicer/common"
+)
+
+// ErrLinkExists is returned when adding a payment link with a slug that's already taken
+var ErrLinkExists = errors.New("payment link already exists")
+
+// AddLink stores payment link `l`, unless one with the same slug already exists
+func (s *Store) AddLink(l common.PaymentLink) error {
+	return s.update(func(d *data) error {
+		for _, stored := range d.Links {
+			if stored.Slug == l.Slug {
+				return fmt.Errorf("%s: %w", l.Slug, ErrLinkExists)
+			}
+		}
+
+		// Sales of a deleted link with the same slug don't carry over
+		d.Links = append(d.Links, l)
+		d.setLinkCounts(l.Slug, common.LinkCounts{})
+		return nil
+	})
+}
+
+// Links returns all stored payment links, oldest first
+func (s *Store) Links() (links []common.PaymentLink, err error) {
+	err = s.read(func(d *data) {
+		links = append(links, d.Links...)
+	})
+
+	return
+}
+
+// DeleteLink removes payment link with `slug`, and its counts.  Payments it has created are kept, but don't count
+// towards sales of a link later created with the same slug.
+func (s *Store) DeleteLink(slug string) error {
+	return s.update(func(d *data) error {
+		for i, stored := range d.Links {
+			if stored.Slug == slug {
+				d.Links = append(d.Links[:i], d.Links[i+1:]...)
+				delete(d.LinkCounts, slug)
+				return nil
+			}
+		}
+
+		return fmt.Errorf("payment link %s: %w", slug, ErrNotFound)
+	})
+}
+
+// LinkCounts returns the number of payments created, and paid through payment link with `slug`
+func (s *Store) LinkCounts(slug string) (counts common.LinkCounts, err error) {
+	err = s.read(func(d *data) {
+		counts = d.linkCounts(slug)
+	})
+
+	return
+}
+
+// LinkPending returns payments created through payment link with `slug` that can still be paid at `now` (unix
+// timestamp), ie. ones neither settled, nor expired.  On-chain ones are watched for `grace` seconds after expiry, so
+// they're pending until then.
+func (s *Store) LinkPending(slug string, now, grace int64) (pending []common.PaymentRecord, err error) {
+	err = s.read(func(d *data) {
+		for _, r := range d.Payments {
+			if r.Link != slug || !d.countsTowardsLink(r) || d.settled(r) {
+				continue
+			}
+
+			expiresAt := r.CreatedAt + r.Expiry
+			if r.Address != "" && grace > 0 {
+				expiresAt += grace
+			}
+
+			if now <= expiresAt {
+				pending = append(pending, r)
+			}
+		}
+	})
+
+	return
+}
+
+// linkCounts returns counts of payment link with `slug`.  Files written before counts were kept have them computed
+// from stored payments.
+func (d *data) linkCounts(slug string) common.LinkCounts {
+	if counts, ok := d.LinkCounts[slug]; ok {
+		return counts
+	}
+
+	var counts common.LinkCounts
+	for _, r := range d.Payments {
+		if r.Link != slug || !d.countsTowardsLink(r) {
+			continue
+		}
+
+		counts.Created++
+		if d.settled(r) {
+			counts.Paid++
+		}
+	}
+
+	return counts
+}
+
+func (d *data) setLinkCounts(slug string, counts common.LinkCounts) {
+	if d.LinkCounts == nil {
+		d.LinkCounts = make(map[string]common.LinkCounts)
+	}
+
+	d.LinkCounts[slug] = counts
+}
+
+// countsTowardsLink returns true if `r` was created through the current payment link with its slug.  Links from the
+// config file aren't stored, and count all payments with their slug.
+func (d *data) countsTowardsLink(r common.PaymentRecord) bool {
+	if r.Link == "" {
+		return false
+	}
+
+	for _, l := range d.Links {
+		if l.Slug == r.Link {
+			return l.Owns(r)
+		}
+	}
+
+	return true
+}
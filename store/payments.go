@@ -0,0 +1,145 @@
+package store
+
+import (
+	"fmt"
+
+	"github.com/lncm/invoicer/common"
+)
+
+func (s *Store) AddPayment(r common.PaymentRecord) error {
+	return s.update(func(d *data) error {
+		if d.countsTowardsLink(r) {
+			counts := d.linkCounts(r.Link)
+			counts.Created++
+			d.setLinkCounts(r.Link, counts)
+		}
+
+		d.Payments = append(d.Payments, r)
+		return nil
+	})
+}
+
+// Payment returns record of payment with `id`
+func (s *Store) Payment(id string) (r common.PaymentRecord, err error) {
+	err = s.read(func(d *data) {
+		for _, stored := range d.Payments {
+			if stored.ID == id {
+				r = stored
+				return
+			}
+		}
+	})
+	if err != nil {
+		return
+	}
+
+	if r.ID == "" {
+		return r, fmt.Errorf("payment %s: %w", id, ErrNotFound)
+	}
+
+	return r, nil
+}
+
+// Payments returns records of all payments created by invoicer, oldest first
+func (s *Store) Payments() (records []common.PaymentRecord, err error) {
+	err = s.read(func(d *data) {
+		records = append(records, d.Payments...)
+	})
+
+	return
+}
+
+// IdempotentPayment returns the newest record of a payment created with `key` since `since` (unix timestamp)
+func (s *Store) IdempotentPayment(key string, since int64) (r common.PaymentRecord, err error) {
+	err = s.read(func(d *data) {
+		for i := len(d.Payments) - 1; i >= 0; i-- {
+			if d.Payments[i].CreatedAt < since {
+				return
+			}
+
+			if d.Payments[i].IdempotencyKey == key {
+				r = d.Payments[i]
+				return
+			}
+		}
+	})
+	if err != nil {
+		return
+	}
+
+	if r.ID == "" {
+		return r, fmt.Errorf("payment with idempotency key %s: %w", key, ErrNotFound)
+	}
+
+	return r, nil
+}
+
+// PruneIdempotencyKeys forgets idempotency keys of payments created before `before` (unix timestamp), as retries
+// are no longer matched with them.  Payment records themselves are kept.
+func (s *Store) PruneIdempotencyKeys(before int64) (pruned int, err error) {
+	err = s.update(func(d *data) error {
+		for i := range d.Payments {
+			r := &d.Payments[i]
+
+			if r.IdempotencyKey != "" && r.CreatedAt < before {
+				r.IdempotencyKey, r.RequestHash = "", ""
+				pruned++
+			}
+		}
+
+		if pruned == 0 {
+			return errUnchanged
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// FindPayment returns record of a payment with LN `hash`, or Bitcoin `address`, whichever is set
+func (s *Store) FindPayment(hash, address string) (r common.PaymentRecord, err error) {
+	err = s.read(func(d *data) {
+		for _, stored := range d.Payments {
+			if (hash != "" && stored.Hash == hash) || (address != "" && stored.Address == address) {
+				r = stored
+				return
+			}
+		}
+	})
+	if err != nil {
+		return
+	}
+
+	if r.ID == "" {
+		id := hash
+		if id == "" {
+			id = address
+		}
+
+		return r, fmt.Errorf("payment %s: %w", id, ErrNotFound)
+	}
+
+	return r, nil
+}
+
+// PaymentByOrderID returns record of the newest payment created for order `orderID`
+func (s *Store) PaymentByOrderID(orderID string) (r common.PaymentRecord, err error) {
+	err = s.read(func(d *data) {
+		for i := len(d.Payments) - 1; i >= 0; i-- {
+			if d.Payments[i].OrderID == orderID {
+				r = d.Payments[i]
+				return
+			}
+		}
+	})
+	if err != nil {
+		return
+	}
+
+	if r.ID == "" {
+		return r, fmt.Errorf("payment for order %s: %w", orderID, ErrNotFound)
+	}
+
+	return r, nil
+}
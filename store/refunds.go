@@ -0,0 +1,107 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lncm/invoicer/common"
+)
+
+// ErrRefundExceeded is returned when refunds of a payment would add up to more than it has received
+var ErrRefundExceeded = errors.New("refunds exceed received amount")
+
+// AddRefund records `r`, unless it, together with refunds of the same payment that didn't fail, exceeds `received`
+func (s *Store) AddRefund(r common.Refund, received int64) error {
+	return s.update(func(d *data) error {
+		refunded := r.Amount
+		for _, stored := range d.Refunds {
+			if stored.PaymentID == r.PaymentID && stored.Counts() {
+				refunded += stored.Amount
+			}
+		}
+
+		if refunded > received {
+			return fmt.Errorf("%d of %d sat: %w", refunded, received, ErrRefundExceeded)
+		}
+
+		d.Refunds = append(d.Refunds, r)
+		return nil
+	})
+}
+
+// UpdateRefund replaces stored refund with the same ID as `r`
+func (s *Store) UpdateRefund(r common.Refund) error {
+	return s.update(func(d *data) error {
+		for i, stored := range d.Refunds {
+			if stored.ID == r.ID {
+				d.Refunds[i] = r
+				return nil
+			}
+		}
+
+		return fmt.Errorf("refund %s: %w", r.ID, ErrNotFound)
+	})
+}
+
+// Refunds returns all refunds keyed by ID of the payment they belong to, oldest first
+func (s *Store) Refunds() (refunds map[string][]common.Refund, err error) {
+	refunds = make(map[string][]common.Refund)
+
+	err = s.read(func(d *data) {
+		for _, r := range d.Refunds {
+			refunds[r.PaymentID] = append(refunds[r.PaymentID], r)
+		}
+	})
+
+	return
+}
+
+// RefundByK1Hash returns LNURL-withdraw refund identified by hash of its `k1`
+func (s *Store) RefundByK1Hash(hash string) (r common.Refund, err error) {
+	err = s.read(func(d *data) {
+		for _, stored := range d.Refunds {
+			if stored.K1Hash != "" && stored.K1Hash == hash {
+				r = stored
+				return
+			}
+		}
+	})
+	if err != nil {
+		return
+	}
+
+	if r.ID == "" {
+		return r, fmt.Errorf("refund: %w", ErrNotFound)
+	}
+
+	return r, nil
+}
+
+// ClaimRefund assigns `bolt11` for `amount` to a pending LNURL-withdraw refund identified by hash of its `k1`, so
+// that it can only be withdrawn once
+func (s *Store) ClaimRefund(k1Hash, bolt11 string, amount int64) (r common.Refund, err error) {
+	err = s.update(func(d *data) error {
+		for i, stored := range d.Refunds {
+			if stored.K1Hash == "" || stored.K1Hash != k1Hash {
+				continue
+			}
+
+			switch {
+			case stored.Status != common.RefundPending || stored.Bolt11 != "":
+				return errors.New("refund was already withdrawn")
+
+			case amount != stored.Amount:
+				return fmt.Errorf("invoice has to be for exactly %d sat", stored.Amount)
+			}
+
+			d.Refunds[i].Bolt11 = bolt11
+			r = d.Refunds[i]
+
+			return nil
+		}
+
+		return fmt.Errorf("refund: %w", ErrNotFound)
+	})
+
+	return
+}
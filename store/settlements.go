@@ -0,0 +1,71 @@
+package store
+
+import (
+	"github.com/lncm/invoicer/common"
+)
+
+// AddSettlement records settlement of payment with `id` (LN hash, or Bitcoin address).  Only the first one
+// is kept, as that's the closest to when the payment has actually settled.
+func (s *Store) AddSettlement(id string, settlement common.Settlement) (added bool, err error) {
+	err = s.update(func(d *data) error {
+		if _, ok := d.Settlements[id]; ok {
+			return errUnchanged
+		}
+
+		// Payments settled on both rails are only counted as sold once, and ones settled beyond stock not at all
+		if r, ok := d.paymentOf(id); ok && d.countsTowardsLink(r) && !d.settled(r) && !settlement.OverStock {
+			counts := d.linkCounts(r.Link)
+			counts.Paid++
+			d.setLinkCounts(r.Link, counts)
+		}
+
+		if d.Settlements == nil {
+			d.Settlements = make(map[string]common.Settlement)
+		}
+
+		d.Settlements[id] = settlement
+		added = true
+
+		return nil
+	})
+
+	return
+}
+
+// paymentOf returns the newest record of payment with `id` (LN hash, or Bitcoin address)
+func (d *data) paymentOf(id string) (common.PaymentRecord, bool) {
+	if id == "" {
+		return common.PaymentRecord{}, false
+	}
+
+	for i := len(d.Payments) - 1; i >= 0; i-- {
+		if r := d.Payments[i]; r.Hash == id || r.Address == id {
+			return r, true
+		}
+	}
+
+	return common.PaymentRecord{}, false
+}
+
+// settled returns true if settlement of `r` was recorded on either rail
+func (d *data) settled(r common.PaymentRecord) bool {
+	for _, id := range []string{r.Hash, r.Address} {
+		if _, ok := d.Settlements[id]; ok && id != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Settlements returns all recorded settlements keyed by LN hash, or Bitcoin address
+func (s *Store) Settlements() (settlements map[string]common.Settlement, err error) {
+	err = s.read(func(d *data) {
+		settlements = make(map[string]common.Settlement, len(d.Settlements))
+		for id, settlement := range d.Settlements {
+			settlements[id] = settlement
+		}
+	})
+
+	return
+}
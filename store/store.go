@@ -0,0 +1,233 @@
+// Package store persists invoicer's own state (API keys, payments, settlements, refunds, payment links, etc.) in a single JSON file.
+//
+// The file is re-read whenever it changes on disk, so that changes made by CLI subcommands are picked up by
+// a running invoicer without a restart.  Updates hold an exclusive lock on `<file>.lock`, so that processes sharing
+// the file (ex. CLI subcommands run while invoicer is serving) never overwrite each other's changes.
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lncm/invoicer/common"
+)
+
+type (
+	// data is the content of the store file.  New fields have to be optional, so that older files remain valid.
+	data struct {
+		APIKeys []common.APIKey `json:"api_keys,omitempty"`
+
+		// Oldest first
+		Payments []common.PaymentRecord `json:"payments,omitempty"`
+
+		// Keyed by LN payment hash, or Bitcoin address
+		Settlements map[string]common.Settlement `json:"settlements,omitempty"`
+
+		// Unix timestamps payments were first seen expired without being paid at, keyed by payment ID
+		Expirations map[string]int64 `json:"expirations,omitempty"`
+
+		// Oldest first
+		Refunds []common.Refund `json:"refunds,omitempty"`
+
+		// Payment links created via the API, oldest first.  Ones from the config file are never stored.
+		Links []common.PaymentLink `json:"links,omitempty"`
+
+		// Keyed by slug of the payment link, including ones from the config file
+		LinkCounts map[string]common.LinkCounts `json:"link_counts,omitempty"`
+	}
+
+	Store struct {
+		path string
+
+		mu      sync.RWMutex
+		data    data
+		modTime time.Time
+		size    int64
+	}
+)
+
+// errUnchanged can be returned by functions passed to `update` to skip saving, when there was nothing to change
+var errUnchanged = errors.New("unchanged")
+
+// Open loads store from `path`.  File (and its directory) is created once anything is saved.
+func Open(path string) (*Store, error) {
+	s := &Store{path: common.CleanAndExpandPath(path)}
+
+	err := s.refresh()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// refresh reloads store content if the file changed since it was last read.  Must be called with lock held.
+func (s *Store) refresh() error {
+	fi, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to access %s: %w", s.path, err)
+	}
+
+	if fi.ModTime().Equal(s.modTime) && fi.Size() == s.size {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %w", s.path, err)
+	}
+
+	var d data
+	err = json.Unmarshal(content, &d)
+	if err != nil {
+		return fmt.Errorf("unable to parse %s: %w", s.path, err)
+	}
+
+	s.data = d
+	s.modTime = fi.ModTime()
+	s.size = fi.Size()
+
+	return nil
+}
+
+// lock takes an exclusive lock shared with other processes using the same store file, and returns a function
+// releasing it
+func (s *Store) lock() (unlock func(), err error) {
+	dir := filepath.Dir(s.path)
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create %s: %w", dir, err)
+	}
+
+	f, err := os.OpenFile(s.path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open lock file: %w", err)
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("unable to lock %s: %w", s.path, err)
+	}
+
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		_ = f.Close()
+	}, nil
+}
+
+// save atomically replaces store file with current content.  Must be called with write lock held.
+func (s *Store) save() error {
+	content, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(s.path)
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %w", dir, err)
+	}
+
+	tmp, err := ioutil.TempFile(dir, filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	_, err = tmp.Write(content)
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), s.path)
+	if err != nil {
+		return fmt.Errorf("unable to save %s: %w", s.path, err)
+	}
+
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.modTime = fi.ModTime()
+	s.size = fi.Size()
+
+	return nil
+}
+
+// read runs fn with up-to-date store content
+func (s *Store) read(fn func(d *data)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.refresh()
+	if err != nil {
+		return err
+	}
+
+	fn(&s.data)
+
+	return nil
+}
+
+// update runs fn with up-to-date store content, and saves the changes unless fn fails.  Other processes can't
+// change the file in the meantime.
+func (s *Store) update(fn func(d *data) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	// Another process might have replaced the file without changing its size, or modification time (ex. on file
+	// systems with coarse timestamps), so it's always re-read before changing it
+	s.modTime = time.Time{}
+
+	err = s.refresh()
+	if err != nil {
+		return err
+	}
+
+	err = fn(&s.data)
+	if errors.Is(err, errUnchanged) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = s.save()
+	if err != nil {
+		// make sure content on disk gets re-read next time
+		s.modTime = time.Time{}
+		return err
+	}
+
+	return nil
+}
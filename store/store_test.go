@@ -0,0 +1,190 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/lncm/invoicer/common"
+)
+
+// Processes sharing the data file (ex. invoicer, and a CLI subcommand) must not lose each other's updates
+func TestConcurrentStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "invoicer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	path := filepath.Join(dir, "invoicer.json")
+
+	const perStore = 20
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		s, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wg.Add(1)
+		go func(i int, s *Store) {
+			defer wg.Done()
+
+			for j := 0; j < perStore; j++ {
+				err := s.AddPayment(common.PaymentRecord{NewPayment: common.NewPayment{ID: fmt.Sprintf("pay_%d_%d", i, j)}})
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}(i, s)
+	}
+
+	wg.Wait()
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := s.Payments()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 3*perStore {
+		t.Errorf("expected %d payments, got %d", 3*perStore, len(records))
+	}
+}
+
+func TestLinkCounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "invoicer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	// written before counts were kept
+	path := filepath.Join(dir, "invoicer.json")
+	legacy := `{"payments": [{"id": "pay_1", "hash": "h1", "link": "coffee"}, {"id": "pay_2", "hash": "h2", "link": "coffee"}],
+		"settlements": {"h1": {"paid_at": 1}}}`
+
+	err = ioutil.WriteFile(path, []byte(legacy), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(step string, created, paid int64) {
+		counts, err := s.LinkCounts("coffee")
+		if err != nil || counts.Created != created || counts.Paid != paid {
+			t.Errorf("%s: got %+v (%v), expected %d created, and %d paid", step, counts, err, created, paid)
+		}
+	}
+
+	expect("legacy", 2, 1)
+
+	err = s.AddPayment(common.PaymentRecord{NewPayment: common.NewPayment{ID: "pay_3", Hash: "h3", Address: "a3"}, Link: "coffee"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect("created", 3, 1)
+
+	for _, id := range []string{"h3", "a3", "h3", "h4"} {
+		if _, err := s.AddSettlement(id, common.Settlement{PaidAt: 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// paid on both rails, but sold once
+	expect("settled", 3, 2)
+
+	if counts, err := s.LinkCounts("tea"); err != nil || counts != (common.LinkCounts{}) {
+		t.Errorf("unexpected counts of a link without payments: %+v (%v)", counts, err)
+	}
+}
+
+func TestDeleteLinkCounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "invoicer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	s, err := Open(filepath.Join(dir, "invoicer.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.AddLink(common.PaymentLink{Slug: "coffee", CreatedAt: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	old := common.PaymentRecord{NewPayment: common.NewPayment{ID: "pay_1", Hash: "h1", CreatedAt: 10}, Link: "coffee"}
+	if err := s.AddPayment(old); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.DeleteLink("coffee"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.AddLink(common.PaymentLink{Slug: "coffee", CreatedAt: 20}); err != nil {
+		t.Fatal(err)
+	}
+
+	// old payment settled after the link was re-created
+	if _, err := s.AddSettlement("h1", common.Settlement{PaidAt: 21}); err != nil {
+		t.Fatal(err)
+	}
+
+	if counts, err := s.LinkCounts("coffee"); err != nil || counts != (common.LinkCounts{}) {
+		t.Errorf("re-created link inherited counts of the deleted one: %+v (%v)", counts, err)
+	}
+
+	err = s.AddPayment(common.PaymentRecord{NewPayment: common.NewPayment{ID: "pay_2", Hash: "h2", CreatedAt: 20}, Link: "coffee"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if counts, err := s.LinkCounts("coffee"); err != nil || counts != (common.LinkCounts{Created: 1}) {
+		t.Errorf("unexpected counts of re-created link: %+v (%v)", counts, err)
+	}
+}
+
+func TestAddExpiration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "invoicer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	s, err := Open(filepath.Join(dir, "invoicer.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range []bool{true, false} {
+		added, err := s.AddExpiration("pay_1", int64(i+1))
+		if err != nil || added != expected {
+			t.Errorf("attempt %d: got %t (%v), expected %t", i, added, err, expected)
+		}
+	}
+
+	// only the first one is kept
+	if expirations, err := s.Expirations(); err != nil || len(expirations) != 1 || expirations["pay_1"] != 1 {
+		t.Errorf("unexpected expirations: %v (%v)", expirations, err)
+	}
+}
@@ -0,0 +1,48 @@
+// Package swaggerui bundles Swagger UI (https://github.com/swagger-api/swagger-ui, Apache License 2.0), so that API
+// docs can be served without loading anything from third-party origins.  Bundled files are generated by `gen.go`.
+package swaggerui
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io/ioutil"
+	"sync"
+)
+
+var (
+	decodeOnce sync.Once
+	decoded    map[string][]byte
+)
+
+// Asset returns content of bundled file `name`, ex. `swagger-ui.css`
+func Asset(name string) ([]byte, bool) {
+	decodeOnce.Do(decode)
+
+	content, ok := decoded[name]
+	return content, ok
+}
+
+// decode decompresses all bundled files.  They're only needed if Swagger UI is actually opened.
+func decode() {
+	decoded = make(map[string][]byte, len(assets))
+
+	for name, encoded := range assets {
+		gz, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			panic("swaggerui: " + name + " is corrupted: " + err.Error())
+		}
+
+		zr, err := gzip.NewReader(bytes.NewReader(gz))
+		if err != nil {
+			panic("swaggerui: " + name + " is corrupted: " + err.Error())
+		}
+
+		content, err := ioutil.ReadAll(zr)
+		if err != nil {
+			panic("swaggerui: " + name + " is corrupted: " + err.Error())
+		}
+
+		decoded[name] = content
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/lncm/invoicer/common"
+)
+
+const (
+	DefaultTLSCert = common.DefaultConfigDir + "invoicer-tls.cert"
+	DefaultTLSKey  = common.DefaultConfigDir + "invoicer-tls.key"
+
+	// How often cert, and key files are checked for changes
+	certReloadInterval = 30 * time.Second
+
+	selfSignedValidity = 365 * 24 * time.Hour
+)
+
+// certReloader serves a certificate loaded from files, and reloads it whenever the files change
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+
+	_, err := r.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	go r.watch()
+
+	return r, nil
+}
+
+// lastModified returns the most recent modification time of cert, and key files
+func (r *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+
+	for _, file := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+// reload loads cert, and key if any of them changed.  On failure, previously loaded certificate is kept.
+func (r *certReloader) reload() (bool, error) {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	unchanged := modTime.Equal(r.modTime)
+	r.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("unable to load TLS certificate: %w", err)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+
+	return true, nil
+}
+
+func (r *certReloader) watch() {
+	for range time.Tick(certReloadInterval) {
+		reloaded, err := r.reload()
+		if err != nil {
+			log.WithError(err).Warningln("TLS certificate not reloaded, still using the previous one")
+			continue
+		}
+
+		if reloaded {
+			log.WithField("cert", r.certFile).Println("TLS certificate reloaded")
+		}
+	}
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// generateSelfSigned creates a self-signed certificate valid for `hosts` (and localhost), and writes it, and its
+// key to files provided
+func generateSelfSigned(certFile, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"invoicer self-signed"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	for _, host := range append([]string{"localhost", "127.0.0.1", "::1"}, hosts...) {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+			continue
+		}
+
+		template.DNSNames = append(template.DNSNames, host)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(certFile), 0700)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// tlsConfig returns TLS config for serving the API, or nil if TLS is disabled.  If neither cert, nor key exist,
+// a self-signed certificate is generated.
+func tlsConfig(c common.TLS) (*tls.Config, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+
+	if c.Cert == "" {
+		c.Cert = DefaultTLSCert
+	}
+	c.Cert = common.CleanAndExpandPath(c.Cert)
+
+	if c.Key == "" {
+		c.Key = DefaultTLSKey
+	}
+	c.Key = common.CleanAndExpandPath(c.Key)
+
+	certExists, keyExists := fileExists(c.Cert), fileExists(c.Key)
+	if certExists != keyExists {
+		return nil, fmt.Errorf("only one of TLS cert (%s), and key (%s) exists", c.Cert, c.Key)
+	}
+
+	if !certExists {
+		err := generateSelfSigned(c.Cert, c.Key, c.Hosts)
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate self-signed certificate: %w", err)
+		}
+
+		log.WithField("cert", c.Cert).Warningln("No TLS certificate provided, self-signed one generated")
+	}
+
+	reloader, err := newCertReloader(c.Cert, c.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if c.ClientCA != "" {
+		caBytes, err := ioutil.ReadFile(common.CleanAndExpandPath(c.ClientCA))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read client CA: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return nil, errors.New("no valid certificates found in client CA file")
+		}
+
+		// Client certificates are optional, as they're only used to authenticate access to admin routes
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config, nil
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+
+	"github.com/lncm/invoicer/common"
+	"github.com/lncm/invoicer/store"
+)
+
+// Machine-readable error codes returned by `/api/v2`.  Unlike messages, these never change.
+const (
+	errInvalidRequest       = "invalid_request"
+	errUnauthorized         = "unauthorized"
+	errForbidden            = "forbidden"
+	errNotFound             = "not_found"
+	errConflict             = "conflict"
+	errIdempotencyKeyReused = "idempotency_key_reused"
+	errRateLimited          = "rate_limited"
+	errBackendUnavailable   = "backend_unavailable"
+	errInternal             = "internal_error"
+)
+
+// States of a payment in `/api/v2`
+const (
+	PaymentPending   = "pending"
+	PaymentUnderpaid = "underpaid"
+	PaymentPaid      = "paid"
+	PaymentExpired   = "expired"
+)
+
+// Key under which requests to `/api/v2` are marked in context, so that shared middleware replies with v2 errors
+const v2CtxKey = "api-v2"
+
+// How often on-chain payments are re-checked while waiting
+const v2PollInterval = 2 * time.Second
+
+type (
+	apiError struct {
+		Code    string `json:"code" doc:"Machine-readable error code, ex. not_found"`
+		Message string `json:"message" doc:"Human-readable description of the error"`
+	}
+
+	errorReply struct {
+		Error apiError `json:"error"`
+	}
+
+	v2Payment struct {
+		ID           string `json:"id" doc:"Payment ID.  Invoices created before IDs were introduced use their LN hash."`
+		Status       string `json:"status" doc:"One of: pending, underpaid, paid, or expired"`
+		OpenAmount   bool   `json:"open_amount,omitempty" doc:"Set for payments created without amount.  Once paid, amount is what was received, up to max_amount."`
+		Amount       int64  `json:"amount" doc:"Requested amount in satoshis, rounded up"`
+		AmountMsat   int64  `json:"amount_msat" doc:"Requested amount in millisatoshis"`
+		Received     int64  `json:"received" doc:"Amount received over both rails, in satoshis"`
+		ReceivedMsat int64  `json:"received_msat" doc:"Amount received over both rails, in millisatoshis"`
+		Description  string `json:"description"`
+
+		// Unix timestamps
+		CreatedAt int64 `json:"created_at"`
+		ExpiresAt int64 `json:"expires_at"`
+		PaidAt    int64 `json:"paid_at,omitempty"`
+
+		PaidLate  bool `json:"paid_late,omitempty" doc:"Set if on-chain deposits completed the payment only after it had expired"`
+		OverStock bool `json:"over_stock,omitempty" doc:"Set if the payment was settled after its payment link's stock ran out.  It's not paid, and has to be refunded."`
+
+		Link string `json:"link,omitempty" doc:"Slug of the payment link the payment was created through"`
+
+		Ln      *v2LnPayment      `json:"ln,omitempty" doc:"Not set for on-chain only payments"`
+		OnChain *v2OnChainPayment `json:"onchain,omitempty" doc:"Not set for LN only payments"`
+		Fiat    *v2Fiat           `json:"fiat,omitempty" doc:"Exchange rate at settlement, if configured"`
+
+		common.OrderInfo
+		common.AmountBounds
+	}
+
+	v2LnPayment struct {
+		Bolt11       string `json:"bolt11"`
+		Hash         string `json:"hash"`
+		Paid         bool   `json:"paid"`
+		Received     int64  `json:"received"`
+		ReceivedMsat int64  `json:"received_msat"`
+		Preimage     string `json:"preimage,omitempty"`
+	}
+
+	v2OnChainPayment struct {
+		Address       string   `json:"address"`
+		Paid          bool     `json:"paid" doc:"Only true if at least the requested amount (less configured tolerance) was received"`
+		Received      int64    `json:"received" doc:"Sum of all deposits made to the address"`
+		Overpaid      int64    `json:"overpaid,omitempty" doc:"Received above the requested amount, to be refunded"`
+		Confirmations int64    `json:"confirmations"`
+		TxIds         []string `json:"txids"`
+	}
+
+	v2Fiat struct {
+		Rate     float64 `json:"rate" doc:"Price of 1 BTC"`
+		Currency string  `json:"currency"`
+	}
+
+	v2PaymentList struct {
+		Payments []v2Payment `json:"payments"`
+	}
+
+	v2PaymentQuery struct {
+		Wait int64 `form:"wait" validate:"min=0,max=3600" doc:"Wait up to this many seconds for a pending payment to get paid, or expire.  Returns immediately, if not set"`
+	}
+
+	v2PaymentsQuery struct {
+		Limit  int64  `form:"limit" validate:"min=0" doc:"Maximum number of payments returned.  All, if not set"`
+		Offset int64  `form:"offset" validate:"min=0" doc:"Number of newest payments to skip"`
+		Status string `form:"status" validate:"omitempty,oneof=pending underpaid paid expired"`
+		Link   string `form:"link" doc:"Only payments created through payment link with this slug"`
+
+		orderQuery
+	}
+)
+
+func newV2Payment(p common.Payment) v2Payment {
+	payment := v2Payment{
+		ID:           p.ID,
+		Status:       paymentStatus(p),
+		OpenAmount:   p.OpenAmount,
+		Amount:       p.Amount,
+		AmountMsat:   p.AmountMsat,
+		Received:     p.Received(),
+		ReceivedMsat: p.ReceivedMsat(),
+		Description:  p.Description,
+		CreatedAt:    p.CreatedAt,
+		ExpiresAt:    p.CreatedAt + p.Expiry,
+		PaidAt:       p.PaidAt,
+		PaidLate:     p.PaidLate,
+		OverStock:    p.OverStock,
+		Link:         p.Link,
+		OrderInfo:    p.OrderInfo,
+		AmountBounds: p.AmountBounds,
+	}
+
+	if payment.ID == "" {
+		payment.ID = p.Hash
+	}
+
+	if p.Hash != "" {
+		payment.Ln = &v2LnPayment{
+			Bolt11:       p.Bolt11,
+			Hash:         p.Hash,
+			Paid:         p.LnPaid,
+			Received:     p.LnAmount,
+			ReceivedMsat: p.LnAmountMsat,
+			Preimage:     p.Preimage,
+		}
+	}
+
+	if p.Address != "" {
+		payment.OnChain = &v2OnChainPayment{
+			Address:       p.Address,
+			Paid:          p.BtcPaid,
+			Received:      p.BtcAmount,
+			Overpaid:      p.Overpaid,
+			Confirmations: p.Confirmations,
+			TxIds:         p.TxIds,
+		}
+	}
+
+	if p.FiatRate > 0 {
+		payment.Fiat = &v2Fiat{Rate: p.FiatRate, Currency: p.FiatCurrency}
+	}
+
+	return payment
+}
+
+func paymentStatus(p common.Payment) string {
+	switch {
+	case p.Paid:
+		return PaymentPaid
+
+	case p.Expired:
+		return PaymentExpired
+
+	case p.Received() > 0:
+		return PaymentUnderpaid
+	}
+
+	return PaymentPending
+}
+
+// apiV2 marks requests as v2, so that errors are replied with `errorReply`
+func apiV2(c *gin.Context) {
+	c.Set(v2CtxKey, true)
+}
+
+// replyError replies with v2 error, and aborts the request
+func replyError(c *gin.Context, status int, code, msg string) {
+	c.AbortWithStatusJSON(status, errorReply{Error: apiError{Code: code, Message: msg}})
+}
+
+// errorCode translates HTTP status of v1 replies into v2 error codes
+func errorCode(status int) string {
+	switch status {
+	case 400:
+		return errInvalidRequest
+
+	case 401:
+		return errUnauthorized
+
+	case 403:
+		return errForbidden
+
+	case 404:
+		return errNotFound
+
+	case 409:
+		return errConflict
+
+	case 422:
+		return errIdempotencyKeyReused
+
+	case 429:
+		return errRateLimited
+
+	case 503:
+		return errBackendUnavailable
+	}
+
+	return errInternal
+}
+
+// replyBackendError replies with a v2 error appropriate for an error returned by backend clients
+func replyBackendError(c *gin.Context, err error) {
+	if errors.Is(err, common.ErrBackendUnavailable) {
+		c.Header("Retry-After", fmt.Sprint(backendRetryAfter))
+	}
+
+	code := errCode(err)
+	replyError(c, code, errorCode(code), err.Error())
+}
+
+func setWarning(c *gin.Context, warning string) {
+	if warning != "" {
+		c.Header("Warning", fmt.Sprintf(`199 invoicer %q`, warning))
+	}
+}
+
+func createPaymentV2(c *gin.Context) {
+	var data paymentRequest
+
+	err := c.ShouldBindJSON(&data)
+	if err != nil {
+		replyError(c, 400, errInvalidRequest, err.Error())
+		return
+	}
+
+	if fail := data.validate(); fail != nil {
+		replyStatus(c, *fail)
+		return
+	}
+
+	key, fail := idempotencyKey(c, data)
+	if fail != nil {
+		replyStatus(c, *fail)
+		return
+	}
+
+	if !requireBackends(c, data.Only != "ln") {
+		return
+	}
+
+	payment, replayed, fail := createPaymentOnce(c, data, key)
+	if fail != nil {
+		replyStatus(c, *fail)
+		return
+	}
+
+	setReplayed(c, replayed)
+
+	c.Header("Location", "/api/v2/payments/"+payment.ID)
+	c.JSON(201, newV2Payment(common.Payment{
+		NewPayment:   payment,
+		OrderInfo:    data.OrderInfo,
+		Description:  data.Description,
+		Amount:       data.Amount,
+		AmountMsat:   data.AmountMsat,
+		AmountBounds: data.AmountBounds,
+		OpenAmount:   data.AmountMsat == 0,
+	}))
+}
+
+func getPaymentV2(c *gin.Context) {
+	var queryParams v2PaymentQuery
+
+	err := c.ShouldBindQuery(&queryParams)
+	if err == nil {
+		err = validator.New().Struct(queryParams)
+	}
+
+	if err != nil {
+		replyError(c, 400, errInvalidRequest, err.Error())
+		return
+	}
+
+	r, err := lookupRecord(c.Param("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		replyError(c, 404, errNotFound, err.Error())
+		return
+	}
+
+	if err != nil {
+		replyError(c, 500, errInternal, err.Error())
+		return
+	}
+
+	if !requireBackends(c, false) {
+		return
+	}
+
+	payment, warning, err := fetchPayment(c, r)
+	if errors.Is(err, common.ErrInvoiceNotFound) {
+		replyError(c, 404, errNotFound, err.Error())
+		return
+	}
+
+	if err != nil {
+		replyBackendError(c, err)
+		return
+	}
+
+	if queryParams.Wait > 0 && paymentStatus(payment) == PaymentPending {
+		if !acquireStatusWaiter() {
+			tooManyRequests(c, backendRetryAfter*time.Second, "too many open status requests")
+			return
+		}
+
+		r.NewPayment = payment.NewPayment
+		payment, warning, err = waitPayment(c, r, time.Duration(queryParams.Wait)*time.Second)
+		releaseStatusWaiter()
+
+		if err != nil {
+			replyBackendError(c, err)
+			return
+		}
+	}
+
+	redactPayment(c, &payment)
+
+	setWarning(c, warning)
+	c.JSON(200, newV2Payment(payment))
+}
+
+// waitPayment returns once payment is no longer pending, it expires, `wait` passes, or invoicer shuts down
+func waitPayment(c *gin.Context, r common.PaymentRecord, wait time.Duration) (payment common.Payment, warning string, err error) {
+	deadline := time.Now().Add(wait)
+	if expiry := time.Unix(r.CreatedAt+r.Expiry, 0); expiry.Before(deadline) {
+		deadline = expiry
+	}
+
+	ctx, cancel := context.WithDeadline(c, deadline)
+	defer cancel()
+
+	settled := make(chan struct{})
+	if r.Hash != "" {
+		go func() {
+			_, err := lnClient.StatusWait(ctx, r.Hash)
+			if err == nil {
+				close(settled)
+			}
+		}()
+	}
+
+	// Only on-chain payments have to be polled
+	var poll <-chan time.Time
+	if r.Address != "" && !conf.OffChainOnly {
+		ticker := time.NewTicker(v2PollInterval)
+		defer ticker.Stop()
+
+		poll = ticker.C
+	}
+
+	for {
+		var stop bool
+
+		select {
+		case <-settled:
+			settled = nil
+
+		case <-poll:
+
+		case <-ctx.Done():
+			stop = true
+
+		case <-shuttingDown:
+			stop = true
+		}
+
+		// ctx might be done already, but the final state is still needed
+		payment, warning, err = fetchPayment(c, r)
+		if stop || err != nil || paymentStatus(payment) != PaymentPending {
+			return payment, warning, err
+		}
+	}
+}
+
+func listPaymentsV2(c *gin.Context) {
+	var queryParams v2PaymentsQuery
+
+	err := c.ShouldBindQuery(&queryParams)
+	if err == nil {
+		err = validator.New().Struct(queryParams)
+	}
+
+	if err != nil {
+		replyError(c, 400, errInvalidRequest, err.Error())
+		return
+	}
+
+	if fail := queryParams.orderQuery.validate(); fail != nil {
+		replyStatus(c, *fail)
+		return
+	}
+
+	if !requireBackends(c, false) {
+		return
+	}
+
+	history, warning, err := fetchHistory(c, "")
+	if err != nil {
+		replyBackendError(c, err)
+		return
+	}
+
+	list := v2PaymentList{Payments: []v2Payment{}}
+	for _, p := range filterLink(queryParams.orderQuery.filter(history), queryParams.Link) {
+		payment := newV2Payment(p)
+		if queryParams.Status == "" || queryParams.Status == payment.Status {
+			list.Payments = append(list.Payments, payment)
+		}
+	}
+
+	if queryParams.Offset > 0 {
+		if queryParams.Offset > int64(len(list.Payments)) {
+			queryParams.Offset = int64(len(list.Payments))
+		}
+
+		list.Payments = list.Payments[queryParams.Offset:]
+	}
+
+	if queryParams.Limit > 0 && queryParams.Limit < int64(len(list.Payments)) {
+		list.Payments = list.Payments[:queryParams.Limit]
+	}
+
+	setWarning(c, warning)
+	c.JSON(200, list)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lncm/invoicer/common"
+)
+
+func TestPaymentStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		payment  common.Payment
+		expected string
+	}{
+		{"new", common.Payment{Amount: 1000}, PaymentPending},
+		{"paid", common.Payment{Amount: 1000, Paid: true, LnPaid: true}, PaymentPaid},
+		{"paid after expiry", common.Payment{Amount: 1000, Paid: true, Expired: true}, PaymentPaid},
+		{"partially paid on-chain", common.Payment{Amount: 1000, BtcAmount: 500}, PaymentUnderpaid},
+		{"expired underpaid", common.Payment{Amount: 1000, BtcAmount: 500, Expired: true}, PaymentExpired},
+		{"expired", common.Payment{Amount: 1000, Expired: true}, PaymentExpired},
+	} {
+		if status := paymentStatus(tc.payment); status != tc.expected {
+			t.Errorf("%s: status = %s, expected %s", tc.name, status, tc.expected)
+		}
+	}
+}
+
+func TestNewV2Payment(t *testing.T) {
+	payments := testPayments()
+
+	ln := newV2Payment(payments[0])
+	if ln.ID != "abc" || ln.Ln == nil || ln.OnChain != nil || ln.Fiat == nil || ln.Received != 1000 {
+		t.Errorf("LN payment converted incorrectly: %+v", ln)
+	}
+
+	payments[1].ID = "pay_1"
+
+	btc := newV2Payment(payments[1])
+	if btc.ID != "pay_1" || btc.Ln != nil || btc.OnChain == nil || btc.Status != PaymentExpired || btc.Received != 20000 {
+		t.Errorf("on-chain payment converted incorrectly: %+v", btc)
+	}
+}
+
+func TestReplyStatusV2(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	for _, tc := range []struct {
+		v2       bool
+		expected string
+	}{
+		{false, `{"error":"slow down"}`},
+		{true, `{"error":{"code":"rate_limited","message":"slow down"}}`},
+	} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+
+		if tc.v2 {
+			apiV2(c)
+		}
+
+		replyStatus(c, common.StatusReply{Code: 429, Error: "slow down"})
+
+		var expected, actual interface{}
+		_ = json.Unmarshal([]byte(tc.expected), &expected)
+
+		err := json.Unmarshal(w.Body.Bytes(), &actual)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if w.Code != 429 || !jsonEqual(expected, actual) {
+			t.Errorf("v2=%v: got %d %s, expected 429 %s", tc.v2, w.Code, w.Body, tc.expected)
+		}
+	}
+}
+
+func TestReplyBackendUnavailable(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	err := fmt.Errorf("can't create new LN invoice: %w", fmt.Errorf("lnd: %w", common.ErrBackendUnavailable))
+
+	for _, v2 := range []bool{false, true} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+
+		if v2 {
+			apiV2(c)
+		}
+
+		replyStatus(c, common.StatusReply{Code: errCode(err), Error: err.Error()})
+
+		if w.Code != 503 || w.Header().Get("Retry-After") == "" {
+			t.Errorf("v2=%v: got %d, Retry-After: %q", v2, w.Code, w.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func jsonEqual(a, b interface{}) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+
+	return string(x) == string(y)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/lncm/invoicer/common"
+)
+
+const (
+	webhookSignatureHeader = "X-Invoicer-Signature"
+	webhookEventHeader     = "X-Invoicer-Event"
+
+	// Events waiting for delivery.  Newer ones are dropped once it's full.
+	webhookQueueSize = 100
+
+	// Delivery of each event is attempted this many times, waiting twice as long after each failure
+	webhookAttempts     = 5
+	webhookInitialDelay = time.Second
+	webhookTimeout      = 10 * time.Second
+
+	// EventPaidLate is sent when on-chain deposits complete a payment after it has expired
+	EventPaidLate = "payment.paid_late"
+
+	// EventOverStock is sent when a payment is settled after its payment link's stock ran out
+	EventOverStock = "payment.over_stock"
+)
+
+type webhookEvent struct {
+	ID        string         `json:"id"`
+	Type      string         `json:"type"`
+	CreatedAt int64          `json:"created_at"`
+	Payment   common.Payment `json:"payment"`
+}
+
+var webhooks struct {
+	sync.Mutex
+
+	// nil, unless `[webhook]` is configured, and after the queue was closed on shutdown
+	queue chan webhookEvent
+}
+
+// startWebhooks starts delivering events to `[webhook] url`, if set.  Events still queued on shutdown are
+// delivered before invoicer exits, unless `shutdown-timeout` runs out.
+func startWebhooks(c common.Webhook) {
+	if c.URL == "" {
+		return
+	}
+
+	queue := make(chan webhookEvent, webhookQueueSize)
+	done := make(chan struct{})
+
+	webhooks.Lock()
+	webhooks.queue = queue
+	webhooks.Unlock()
+
+	go func() {
+		defer close(done)
+
+		client := &http.Client{Timeout: webhookTimeout}
+		for event := range queue {
+			deliverWebhook(client, c, event)
+		}
+	}()
+
+	onShutdown(func(ctx context.Context) {
+		webhooks.Lock()
+		webhooks.queue = nil
+		close(queue)
+		webhooks.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			log.WithField("count", len(queue)).Warningln("undelivered webhook events dropped")
+		}
+	})
+}
+
+// emitEvent queues event of type `eventType` about `payment` for delivery.  It doesn't block.
+func emitEvent(eventType string, payment common.Payment) {
+	id, err := common.NewEventID()
+	if err != nil {
+		log.WithError(err).Errorln("can't generate event ID")
+		return
+	}
+
+	event := webhookEvent{ID: id, Type: eventType, CreatedAt: time.Now().Unix(), Payment: payment}
+
+	webhooks.Lock()
+	defer webhooks.Unlock()
+
+	if webhooks.queue == nil {
+		return
+	}
+
+	select {
+	case webhooks.queue <- event:
+	default:
+		log.WithFields(log.Fields{"id": id, "type": eventType}).Warningln("webhook queue full, event dropped")
+	}
+}
+
+// signWebhook returns HMAC-SHA256 of `body` in the form sent in `X-Invoicer-Signature` header
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook POSTs `event` to `c.URL`, retrying with increasing delays until it's accepted with a 2xx reply
+func deliverWebhook(client *http.Client, c common.Webhook, event webhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.WithError(err).WithField("id", event.ID).Errorln("can't encode webhook event")
+		return
+	}
+
+	logger := log.WithFields(log.Fields{"id": event.ID, "type": event.Type})
+
+	delay := webhookInitialDelay
+	for attempt := 1; ; attempt++ {
+		err = postWebhook(client, c, event.Type, body)
+		if err == nil {
+			logger.Println("webhook event delivered")
+			return
+		}
+
+		if attempt == webhookAttempts {
+			logger.WithError(err).Errorln("webhook event not delivered, giving up")
+			return
+		}
+
+		logger.WithError(err).WithField("attempt", attempt).Warningln("webhook event not delivered, retrying")
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func postWebhook(client *http.Client, c common.Webhook, eventType string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, eventType)
+
+	if c.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, signWebhook(c.Secret, body))
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	_ = res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %s", res.Status)
+	}
+
+	return nil
+}
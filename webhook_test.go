@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lncm/invoicer/common"
+)
+
+func TestDeliverWebhook(t *testing.T) {
+	var (
+		attempts int
+		received webhookEvent
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+
+		// first delivery fails, so that it's retried
+		if attempts == 1 {
+			w.WriteHeader(500)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(webhookSignatureHeader) != signWebhook("secret", body) {
+			t.Error("invalid signature")
+		}
+
+		if r.Header.Get(webhookEventHeader) != EventPaidLate {
+			t.Errorf("unexpected event header: %s", r.Header.Get(webhookEventHeader))
+		}
+
+		_ = json.Unmarshal(body, &received)
+	}))
+	defer server.Close()
+
+	event := webhookEvent{ID: "evt_1", Type: EventPaidLate, Payment: common.Payment{Amount: 1000}}
+	deliverWebhook(server.Client(), common.Webhook{URL: server.URL, Secret: "secret"}, event)
+
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts)
+	}
+
+	if received.ID != "evt_1" || received.Payment.Amount != 1000 {
+		t.Errorf("unexpected event received: %+v", received)
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	// echo -n '{}' | openssl dgst -sha256 -hmac secret
+	expected := "sha256=77325902caca812dc259733aacd046b73817372c777b8d95b402647474516e13"
+	if sig := signWebhook("secret", []byte("{}")); sig != expected {
+		t.Errorf("signWebhook() = %s, expected %s", sig, expected)
+	}
+}